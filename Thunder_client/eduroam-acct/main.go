@@ -0,0 +1,1444 @@
+/*
+Program: eduroam-acct (Accounting Traffic Report)
+Version: 1.0.0
+Description: This program aggregates Accounting-Request (Acct-Status-Type Stop) records for users
+             from a specified domain, summing input/output octets, session time and session
+             counts per user and per service provider, and reports the top consumers by traffic.
+
+Usage: ./eduroam-acct [flags] <domain|all> [days|Ny|yxxxx|DD-MM-YYYY]
+      <domain>: The home domain (realm) to search for (e.g., 'ku.ac.th'), or 'all' for every realm
+      [days]: Optional. The number of days (1-3650) to look back from the current date.
+      [Ny]: Optional. The number of years (1y-10y) to look back from the current date.
+      [yxxxx]: Optional. Specific year (e.g., y2024)
+      [DD-MM-YYYY]: Optional. A specific date to process data for.
+
+Flags:
+  -top int
+        Number of users kept in top_users, sorted by total traffic (default 20)
+  -from string
+        First day of an explicit range as DD-MM-YYYY (local time), given with -to instead of the
+        [days|Ny|yxxxx|DD-MM-YYYY] argument, e.g., -from 05-03-2024 -to 20-03-2024
+  -to string
+        Last day of the -from range as DD-MM-YYYY, included in the range; must not be before -from
+  -strict
+        Exit with a non-zero status instead of writing a report when the query matches nothing
+  -summary
+        Print a table to stderr at the end of the run: top 10 providers by sessions, the totals and
+        the timings; the JSON report is unchanged
+  -timeout duration
+        HTTP timeout for each Quickwit request (default 30s)
+  -max-idle-conns int
+        Maximum idle keep-alive connections kept to Quickwit (default 10)
+  -max-inflight int
+        Maximum search requests in flight to Quickwit at once across all workers (default 0 = no limit)
+  -out-url string
+        Upload the report to s3://bucket/prefix instead of writing it under output/
+        (S3_ENDPOINT, S3_REGION, S3_ACCESS_KEY and S3_SECRET_KEY are read from qw-auth.properties)
+  -stdout
+        Write the report JSON to stdout instead of a file under output/ (no manifest is written);
+        progress and informational messages go to stderr, so the output can be piped into jq
+  -dump-raw string
+        Write each day-job's raw Quickwit response to <dir>/<start>-<end>.json before it is processed
+        (for debugging aggregation mismatches)
+  -prefer-file
+        When both qw-auth.properties and the QW_USER, QW_PASS or QW_URL environment variables set a value,
+        use the file (by default the environment wins; it is also used when the file is absent)
+  -check
+        Verify Quickwit is reachable and the nro-logs index exists, then exit (0 = OK)
+
+qw-auth.properties may also set QW_CLIENT_CERT and QW_CLIENT_KEY (PEM file paths, both or neither)
+to present a client certificate to a Quickwit deployment that requires mutual TLS.
+Requests follow HTTP_PROXY/HTTPS_PROXY/NO_PROXY from the environment; QW_PROXY (proxy URL) and
+QW_NO_PROXY (comma list of hosts or domains reached directly, "*" for all) override them.
+
+Requirements:
+- log2quickwit v1.5.8 or later, which parses the Acct-* attributes into the acct_* fields
+- acct_input_octets, acct_output_octets and acct_session_time mapped as fast i64 fields
+  (see qw_maintanance/nro-log-new-config.json)
+
+Features:
+- sum aggregations on the accounting fields, split into one query per day
+- Per-user and per-provider totals of sessions, octets and session time
+- Summary totals from top-level sum aggregations, so users and providers beyond the terms sizes
+  (by_user 10000, by_provider 1000 per day) still count; the truncation is reported as a warning
+- Worker pool and shared keep-alive HTTP client, as in eduroam-accept
+- A <report>.manifest.json with the query, window, hit count and SHA-256 of the report
+
+Build: go build (go.mod pins aws-sdk-go-v2 v1.47.1, credentials v1.20.6, service/s3 v1.113.4,
+used by -out-url; Go 1.24 or later)
+
+Author: [P.Itarun]
+*/
+
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/tls"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "net/url"
+    "os"
+    "path"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "text/tabwriter"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/credentials"
+    "github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Options holds the command-line options
+type Options struct {
+    TopN         int
+    Strict       bool
+    Summary      bool
+    From         string
+    To           string
+    Timeout      time.Duration
+    MaxIdleConns int
+    MaxInflight  int
+    Check        bool
+    PreferFile   bool
+    DumpRaw      string
+    OutURL       string
+    Stdout       bool
+}
+
+var opts Options
+
+// allDomains is the domain argument that selects every realm
+const allDomains = "all"
+
+// httpClient is shared by all workers so keep-alive connections are reused
+var httpClient *http.Client
+
+// inflight limits concurrent search requests to -max-inflight (nil = no limit)
+var inflight chan struct{}
+
+// malformedBuckets counts aggregation buckets dropped because they failed a type assertion;
+// reported at the end of the run
+var malformedBuckets atomic.Int64
+
+// terms sizes of the per-day by_user and by_provider aggregations
+const (
+    userBucketSize     = 10000
+    providerBucketSize = 1000
+)
+
+// sessions in the by_user/by_provider buckets beyond the terms size (sum_other_doc_count);
+// the summary totals still include them, reported at the end of the run
+var (
+    truncatedUsers     atomic.Int64
+    truncatedProviders atomic.Int64
+)
+
+// proxyFunc returns the transport Proxy for QW_PROXY/QW_NO_PROXY: requests go through proxyURL
+// ("" = HTTP_PROXY/HTTPS_PROXY/NO_PROXY from the environment) unless the host matches an entry of
+// the comma list noProxy ("*", a host, or a domain with or without a leading dot)
+func proxyFunc(proxyURL, noProxy string) (func(*http.Request) (*url.URL, error), error) {
+    var proxy *url.URL
+    if proxyURL != "" {
+        u, err := url.Parse(proxyURL)
+        if err != nil || u.Host == "" {
+            return nil, fmt.Errorf("invalid proxy URL %q", proxyURL)
+        }
+        proxy = u
+    }
+    var bypass []string
+    for _, host := range strings.Split(noProxy, ",") {
+        if host = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(host), ".")); host != "" {
+            bypass = append(bypass, host)
+        }
+    }
+
+    return func(req *http.Request) (*url.URL, error) {
+        host := strings.ToLower(req.URL.Hostname())
+        for _, domain := range bypass {
+            if domain == "*" || host == domain || strings.HasSuffix(host, "."+domain) {
+                return nil, nil
+            }
+        }
+        if proxy != nil {
+            return proxy, nil
+        }
+        return http.ProxyFromEnvironment(req)
+    }, nil
+}
+
+// newHTTPClient creates the shared Quickwit client with a tuned transport
+// and, when props has QW_CLIENT_CERT/QW_CLIENT_KEY, a client certificate for mutual TLS;
+// the environment proxy settings apply unless QW_PROXY/QW_NO_PROXY override them
+func newHTTPClient(timeout time.Duration, maxIdleConns int, props Properties) (*http.Client, error) {
+    transport := http.DefaultTransport.(*http.Transport).Clone()
+    transport.MaxIdleConns = maxIdleConns
+    transport.MaxIdleConnsPerHost = maxIdleConns
+    transport.IdleConnTimeout = 90 * time.Second
+    if props.ClientCert != "" {
+        cert, err := tls.LoadX509KeyPair(props.ClientCert, props.ClientKey)
+        if err != nil {
+            return nil, fmt.Errorf("error loading client certificate: %v", err)
+        }
+        transport.TLSClientConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+    }
+    if props.Proxy != "" || props.NoProxy != "" {
+        proxy, err := proxyFunc(props.Proxy, props.NoProxy)
+        if err != nil {
+            return nil, err
+        }
+        transport.Proxy = proxy
+    }
+
+    return &http.Client{
+        Timeout:   timeout,
+        Transport: &tracingTransport{base: transport},
+    }, nil
+}
+
+// userAgent identifies this tool in Quickwit access logs
+const userAgent = "log2quickwit/eduroam-acct/1.0.0"
+
+// tracingTransport sets the User-Agent and a per-request X-Request-ID on every call
+// made through the shared client, so Quickwit-side load can be traced back to a run
+type tracingTransport struct {
+    base http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    req = req.Clone(req.Context())
+    req.Header.Set("User-Agent", userAgent)
+    if req.Header.Get("X-Request-ID") == "" {
+        req.Header.Set("X-Request-ID", newRequestID())
+    }
+    return t.base.RoundTrip(req)
+}
+
+// newRequestID returns a random UUIDv4 used as X-Request-ID
+func newRequestID() string {
+    var b [16]byte
+    rand.Read(b[:])
+    b[6] = (b[6] & 0x0f) | 0x40
+    b[8] = (b[8] & 0x3f) | 0x80
+    return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// Properties represents the authentication properties for Quickwit API
+type Properties struct {
+    QWUser     string
+    QWPass     string
+    QWURL      string
+    ClientCert string // QW_CLIENT_CERT: PEM client certificate สำหรับ mutual TLS
+    ClientKey  string // QW_CLIENT_KEY
+    Proxy      string // QW_PROXY: proxy URL แทน HTTP_PROXY/HTTPS_PROXY
+    NoProxy    string // QW_NO_PROXY: host/domain ที่ต่อตรงไม่ผ่าน proxy
+    S3         S3Config
+}
+
+// S3Config holds the S3-compatible object storage settings used by -out-url
+type S3Config struct {
+    Endpoint  string // e.g., https://minio.example.org (default https://s3.<region>.amazonaws.com)
+    Region    string
+    AccessKey string
+    SecretKey string
+}
+
+// outputS3 is set from qw-auth.properties in main
+var outputS3 S3Config
+
+// reportOut receives the report with -stdout; os.Stdout itself is pointed at stderr
+// so progress and informational prints stay out of the pipe
+var reportOut io.Writer
+
+// LogEntry is one user or provider bucket of a day's accounting aggregation
+// (exactly one of Username / ServiceProvider is set), or the day's totals
+type LogEntry struct {
+    Username        string
+    ServiceProvider string
+    DayTotal        bool // ยอดรวมของวันจาก sum ระดับบนสุด
+    Sessions        int64
+    InputOctets     int64
+    OutputOctets    int64
+    SessionTime     int64
+}
+
+// Usage holds accumulated accounting totals
+type Usage struct {
+    Sessions     int64
+    InputOctets  int64
+    OutputOctets int64
+    SessionTime  int64
+}
+
+// Result holds the aggregated results
+type Result struct {
+    Users     map[string]*Usage
+    Providers map[string]*Usage
+    Totals    Usage // จาก sum aggregation ระดับบนสุด จึงรวม bucket ที่ terms ตัดทิ้งด้วย
+}
+
+// UsageStat for output
+type UsageStat struct {
+    Username           string `json:"username,omitempty"`
+    Provider           string `json:"provider,omitempty"`
+    Sessions           int64  `json:"sessions"`
+    InputOctets        int64  `json:"input_octets"`
+    OutputOctets       int64  `json:"output_octets"`
+    TotalOctets        int64  `json:"total_octets"`
+    TotalTraffic       string `json:"total_traffic"`
+    SessionTimeSeconds int64  `json:"session_time_seconds"`
+}
+
+// SimplifiedOutputData represents the output JSON structure
+type SimplifiedOutputData struct {
+    NoData    bool `json:"no_data,omitempty"`
+    QueryInfo struct {
+        Domain    string `json:"domain"`
+        Days      int    `json:"days"`
+        StartDate string `json:"start_date"`
+        EndDate   string `json:"end_date"`
+        Top       int    `json:"top"`
+    } `json:"query_info"`
+    Description string `json:"description"`
+    Summary     struct {
+        TotalUsers         int    `json:"total_users"`
+        TotalProviders     int    `json:"total_providers"`
+        TotalSessions      int64  `json:"total_sessions"`
+        TotalInputOctets   int64  `json:"total_input_octets"`
+        TotalOutputOctets  int64  `json:"total_output_octets"`
+        TotalTraffic       string `json:"total_traffic"`
+        TotalSessionTime   int64  `json:"total_session_time_seconds"`
+    } `json:"summary"`
+    TopUsers      []UsageStat `json:"top_users"`
+    ProviderStats []UsageStat `json:"provider_stats"`
+}
+
+// Manifest records how a report was produced so it can be traced and verified (<output>.manifest.json)
+type Manifest struct {
+    Tool        string `json:"tool"`
+    Query       string `json:"query"`
+    StartTime   string `json:"start_time"`
+    EndTime     string `json:"end_time"`
+    Workers     int    `json:"workers"`
+    TotalHits   int64  `json:"total_hits"`
+    Output      string `json:"output"`
+    SHA256      string `json:"sha256"`
+    GeneratedAt string `json:"generated_at"`
+}
+
+// Job represents a single day's query job
+type Job struct {
+    StartTimestamp int64
+    EndTimestamp   int64
+}
+
+// sendQuickwitRequest sends a search request, retrying up to maxResponseRetries times when the
+// response body is cut short or lacks the keys of a search response (a dropped connection)
+func sendQuickwitRequest(query map[string]interface{}, props Properties) (map[string]interface{}, error) {
+    for attempt := 1; ; attempt++ {
+        result, err := sendQuickwitAttempt(query, props)
+        retryable := errors.Is(err, ErrIncompleteResponse) || errors.Is(err, ErrServerUnavailable)
+        if err == nil || !retryable || attempt > maxResponseRetries {
+            return result, err
+        }
+        log.Printf("Quickwit search failed (attempt %d of %d), retrying: %v", attempt, maxResponseRetries+1, err)
+        time.Sleep(time.Duration(attempt) * time.Second)
+    }
+}
+
+// maxResponseRetries is how many times a search that fails with ErrIncompleteResponse or
+// ErrServerUnavailable is re-requested
+const maxResponseRetries = 3
+
+// Errors returned by the Quickwit requests; sendQuickwitRequest branches on them with errors.Is
+var (
+    ErrQuickwitAuth       = errors.New("quickwit authentication failed")
+    ErrQuickwitQuery      = errors.New("quickwit rejected the query")
+    ErrPayloadTooLarge    = errors.New("quickwit payload too large")
+    ErrServerUnavailable  = errors.New("quickwit unavailable")
+    ErrIncompleteResponse = errors.New("incomplete response")
+)
+
+// statusError wraps a non-200 Quickwit answer in the matching sentinel error:
+// 401/403 auth, 413 payload too large, 429/5xx unavailable, other 4xx query
+func statusError(status int, body []byte) error {
+    var kind error
+    switch {
+    case status == http.StatusUnauthorized || status == http.StatusForbidden:
+        kind = ErrQuickwitAuth
+    case status == http.StatusRequestEntityTooLarge:
+        kind = ErrPayloadTooLarge
+    case status == http.StatusTooManyRequests || status >= 500:
+        kind = ErrServerUnavailable
+    case status >= 400:
+        kind = ErrQuickwitQuery
+    default:
+        return fmt.Errorf("quickwit error (status %d): %s", status, string(body))
+    }
+    return fmt.Errorf("%w (status %d): %s", kind, status, string(body))
+}
+
+// sendQuickwitAttempt sends a search request once; retryable reports an incomplete response
+func sendQuickwitAttempt(query map[string]interface{}, props Properties) (map[string]interface{}, error) {
+    if inflight != nil {
+        inflight <- struct{}{}
+        defer func() { <-inflight }()
+    }
+
+    jsonQuery, err := json.Marshal(query)
+    if err != nil {
+        return nil, fmt.Errorf("error marshaling query: %v", err)
+    }
+
+    req, err := http.NewRequest("POST", props.QWURL+"/api/v1/nro-logs/search", strings.NewReader(string(jsonQuery)))
+    if err != nil {
+        return nil, fmt.Errorf("error creating request: %v", err)
+    }
+
+    req.SetBasicAuth(props.QWUser, props.QWPass)
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("Accept", "application/json")
+
+    resp, err := httpClient.Do(req)
+    if err != nil {
+        return nil, fmt.Errorf("%w: error sending request: %v", ErrServerUnavailable, err)
+    }
+    defer resp.Body.Close()
+
+    body, err := io.ReadAll(resp.Body)
+    if err != nil {
+        return nil, fmt.Errorf("%w: error reading response: %v", ErrIncompleteResponse, err)
+    }
+
+    if resp.StatusCode != http.StatusOK {
+        return nil, statusError(resp.StatusCode, body)
+    }
+
+    var result map[string]interface{}
+    if err := json.Unmarshal(body, &result); err != nil {
+        return nil, fmt.Errorf("%w: error decoding response (truncated or invalid body): %v", ErrIncompleteResponse, err)
+    }
+
+    if err := checkSearchResponse(query, result); err != nil {
+        return nil, err
+    }
+
+    return result, nil
+}
+
+// checkSearchResponse verifies a decoded search response is complete: num_hits and hits are always
+// present, and aggregations whenever the query asked for aggs
+func checkSearchResponse(query, result map[string]interface{}) error {
+    if _, ok := result["num_hits"].(float64); !ok {
+        return fmt.Errorf("%w: no num_hits", ErrIncompleteResponse)
+    }
+    if _, ok := result["hits"].([]interface{}); !ok {
+        return fmt.Errorf("%w: no hits", ErrIncompleteResponse)
+    }
+    if _, asked := query["aggs"]; asked {
+        if _, ok := result["aggregations"].(map[string]interface{}); !ok {
+            return fmt.Errorf("%w: no aggregations", ErrIncompleteResponse)
+        }
+    }
+    return nil
+}
+
+// checkQuickwit verifies that Quickwit is alive and the nro-logs index exists
+func checkQuickwit(props Properties) error {
+    // livez อยู่หลัง proxy เดียวกับ API ซึ่งอาจบังคับ basic auth ด้วย
+    req, err := http.NewRequest("GET", props.QWURL+"/health/livez", nil)
+    if err != nil {
+        return fmt.Errorf("error creating request: %v", err)
+    }
+    req.SetBasicAuth(props.QWUser, props.QWPass)
+
+    resp, err := httpClient.Do(req)
+    if err != nil {
+        return fmt.Errorf("%w: error connecting to %s: %v", ErrServerUnavailable, props.QWURL, err)
+    }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("%w: health check failed (status %d)", ErrServerUnavailable, resp.StatusCode)
+    }
+
+    req, err = http.NewRequest("GET", props.QWURL+"/api/v1/indexes/nro-logs", nil)
+    if err != nil {
+        return fmt.Errorf("error creating request: %v", err)
+    }
+    req.SetBasicAuth(props.QWUser, props.QWPass)
+
+    resp, err = httpClient.Do(req)
+    if err != nil {
+        return fmt.Errorf("error sending request: %v", err)
+    }
+    defer resp.Body.Close()
+
+    switch resp.StatusCode {
+    case http.StatusOK:
+        return nil
+    case http.StatusUnauthorized, http.StatusForbidden:
+        return fmt.Errorf("%w (status %d): check QW_USER/QW_PASS", ErrQuickwitAuth, resp.StatusCode)
+    case http.StatusNotFound:
+        return fmt.Errorf("%w: index nro-logs not found", ErrQuickwitQuery)
+    default:
+        body, _ := io.ReadAll(resp.Body)
+        return fmt.Errorf("quickwit error (status %d): %s", resp.StatusCode, string(body))
+    }
+}
+
+// runCheck runs checkQuickwit with qw-auth.properties and exits with its result
+func runCheck() {
+    props, err := readProperties("qw-auth.properties")
+    if err != nil {
+        log.Fatalf("Error reading properties: %v", err)
+    }
+    httpClient, err = newHTTPClient(opts.Timeout, opts.MaxIdleConns, props)
+    if err != nil {
+        log.Fatalf("Error creating HTTP client: %v", err)
+    }
+
+    if err := checkQuickwit(props); err != nil {
+        fmt.Printf("Check failed: %v\n", err)
+        os.Exit(1)
+    }
+    fmt.Printf("Check OK: %s is reachable and index nro-logs exists\n", props.QWURL)
+    os.Exit(0)
+}
+
+// readProperties reads the authentication properties from a file, with QW_USER/QW_PASS/QW_URL environment overrides
+func readProperties(filePath string) (Properties, error) {
+    file, err := os.Open(filePath)
+    if os.IsNotExist(err) {
+        // ไม่มีไฟล์: ใช้ QW_USER/QW_PASS/QW_URL จาก environment (เช่นใน container)
+        props := Properties{}
+        applyEnvProperties(&props)
+        if props.QWURL == "" {
+            return Properties{}, err
+        }
+        return props, validateProperties(props)
+    }
+    if err != nil {
+        return Properties{}, err
+    }
+    defer file.Close()
+
+    props := Properties{}
+    scanner := bufio.NewScanner(file)
+    for scanner.Scan() {
+        line := scanner.Text()
+        if line != "" && !strings.HasPrefix(line, "#") {
+            parts := strings.SplitN(line, "=", 2)
+            if len(parts) == 2 {
+                key := strings.TrimSpace(parts[0])
+                value := strings.TrimSpace(parts[1])
+                value = strings.Trim(value, "\"")
+
+                switch key {
+                case "QW_USER":
+                    props.QWUser = value
+                case "QW_PASS":
+                    props.QWPass = value
+                case "QW_URL":
+                    props.QWURL = strings.TrimPrefix(value, "=")
+                case "QW_CLIENT_CERT":
+                    props.ClientCert = value
+                case "QW_CLIENT_KEY":
+                    props.ClientKey = value
+                case "QW_PROXY":
+                    props.Proxy = value
+                case "QW_NO_PROXY":
+                    props.NoProxy = value
+                case "S3_ENDPOINT":
+                    props.S3.Endpoint = strings.TrimSuffix(value, "/")
+                case "S3_REGION":
+                    props.S3.Region = value
+                case "S3_ACCESS_KEY":
+                    props.S3.AccessKey = value
+                case "S3_SECRET_KEY":
+                    props.S3.SecretKey = value
+                }
+            }
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        return props, err
+    }
+    if (props.ClientCert == "") != (props.ClientKey == "") {
+        return props, fmt.Errorf("QW_CLIENT_CERT and QW_CLIENT_KEY must be set together")
+    }
+    applyEnvProperties(&props)
+    return props, validateProperties(props)
+}
+
+// validateProperties reports the Quickwit settings left empty by both qw-auth.properties and the
+// environment, so a missing key fails here instead of as a 401 from Quickwit
+func validateProperties(props Properties) error {
+    var missing []string
+    for _, field := range []struct {
+        name  string
+        value string
+    }{
+        {"QW_USER", props.QWUser},
+        {"QW_PASS", props.QWPass},
+        {"QW_URL", props.QWURL},
+    } {
+        if field.value == "" {
+            missing = append(missing, field.name)
+        }
+    }
+    if len(missing) > 0 {
+        return fmt.Errorf("missing required settings in qw-auth.properties (or the environment): %s", strings.Join(missing, ", "))
+    }
+    return nil
+}
+
+// applyEnvProperties fills QWUser/QWPass/QWURL from the QW_USER/QW_PASS/QW_URL environment
+// variables; a set variable overrides the file unless -prefer-file is given
+func applyEnvProperties(props *Properties) {
+    for _, field := range []struct {
+        name  string
+        value *string
+    }{
+        {"QW_USER", &props.QWUser},
+        {"QW_PASS", &props.QWPass},
+        {"QW_URL", &props.QWURL},
+    } {
+        if value := os.Getenv(field.name); value != "" && (*field.value == "" || !opts.PreferFile) {
+            *field.value = value
+        }
+    }
+}
+
+// getDomain returns the full domain name based on the input
+func getDomain(input string) string {
+    if input == "etlr1" {
+        return "etlr1.eduroam.org"
+    }
+    if input == "etlr2" {
+        return "etlr2.eduroam.org"
+    }
+    return fmt.Sprintf("eduroam.%s", input)
+}
+
+// queryValueEscaper escapes the characters that end or escape a quoted query phrase
+var queryValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// escapeQueryValue makes value safe to interpolate inside a quoted Quickwit query term
+// (field:"value"); inside the quotes only '\' and '"' are special, so ':', '@' and spaces are kept
+func escapeQueryValue(value string) string {
+    return queryValueEscaper.Replace(value)
+}
+
+// usageAggs builds the sum aggregations on the accounting fields
+func usageAggs() map[string]interface{} {
+    return map[string]interface{}{
+        "input_octets": map[string]interface{}{
+            "sum": map[string]interface{}{"field": "acct_input_octets"},
+        },
+        "output_octets": map[string]interface{}{
+            "sum": map[string]interface{}{"field": "acct_output_octets"},
+        },
+        "session_time": map[string]interface{}{
+            "sum": map[string]interface{}{"field": "acct_session_time"},
+        },
+    }
+}
+
+// dumpRawResponse writes a job's raw Quickwit response to -dump-raw/<start>-<end>.json
+func dumpRawResponse(job Job, result map[string]interface{}) error {
+    data, err := json.MarshalIndent(result, "", "  ")
+    if err != nil {
+        return fmt.Errorf("error marshaling raw response: %v", err)
+    }
+    name := filepath.Join(opts.DumpRaw, fmt.Sprintf("%d-%d.json", job.StartTimestamp, job.EndTimestamp))
+    if err := os.WriteFile(name, data, 0644); err != nil {
+        return fmt.Errorf("error writing raw response: %v", err)
+    }
+    return nil
+}
+
+// worker processes a single day's query
+func worker(job Job, resultChan chan<- LogEntry, query map[string]interface{}, props Properties) (int64, error) {
+    // sum ระดับบนสุดให้ยอดรวมของวัน ไม่ขึ้นกับขนาดของ terms
+    aggs := usageAggs()
+    aggs["by_user"] = map[string]interface{}{
+        "terms": map[string]interface{}{
+            "field": "username",
+            "size":  userBucketSize,
+        },
+        "aggs": usageAggs(),
+    }
+    aggs["by_provider"] = map[string]interface{}{
+        "terms": map[string]interface{}{
+            "field": "service_provider",
+            "size":  providerBucketSize,
+        },
+        "aggs": usageAggs(),
+    }
+    currentQuery := map[string]interface{}{
+        "query":           query["query"],
+        "start_timestamp": job.StartTimestamp,
+        "end_timestamp":   job.EndTimestamp,
+        "max_hits":        0,
+        "aggs":            aggs,
+    }
+
+    result, err := sendQuickwitRequest(currentQuery, props)
+    if err != nil {
+        return 0, err
+    }
+    if opts.DumpRaw != "" {
+        if err := dumpRawResponse(job, result); err != nil {
+            return 0, err
+        }
+    }
+
+    return processAggregations(result, resultChan)
+}
+
+// processAggregations sends the user and provider buckets and the day's totals to resultChan and
+// returns the day's session count
+func processAggregations(result map[string]interface{}, resultChan chan<- LogEntry) (int64, error) {
+    aggs, ok := result["aggregations"].(map[string]interface{})
+    if !ok {
+        return 0, fmt.Errorf("no aggregations in response")
+    }
+
+    if byUser, ok := aggs["by_user"].(map[string]interface{}); ok {
+        countTruncated(byUser, &truncatedUsers)
+        if buckets, ok := byUser["buckets"].([]interface{}); ok {
+            for _, bucketInterface := range buckets {
+                bucket, ok := bucketInterface.(map[string]interface{})
+                if !ok {
+                    malformedBuckets.Add(1)
+                    continue
+                }
+                entry := usageEntry(bucket)
+                if entry.Username, ok = bucket["key"].(string); !ok {
+                    malformedBuckets.Add(1)
+                    continue
+                }
+                resultChan <- entry
+            }
+        }
+    } else {
+        return 0, fmt.Errorf("no by_user aggregation")
+    }
+
+    if byProvider, ok := aggs["by_provider"].(map[string]interface{}); ok {
+        countTruncated(byProvider, &truncatedProviders)
+        if buckets, ok := byProvider["buckets"].([]interface{}); ok {
+            for _, bucketInterface := range buckets {
+                bucket, ok := bucketInterface.(map[string]interface{})
+                if !ok {
+                    malformedBuckets.Add(1)
+                    continue
+                }
+                entry := usageEntry(bucket)
+                if entry.ServiceProvider, ok = bucket["key"].(string); !ok {
+                    malformedBuckets.Add(1)
+                    continue
+                }
+                resultChan <- entry
+            }
+        }
+    }
+
+    // ทุก Stop record คือหนึ่ง session: num_hits คือจำนวน session ของวัน
+    totals := usageEntry(aggs)
+    numHits, _ := result["num_hits"].(float64)
+    totals.Sessions = int64(numHits)
+    totals.DayTotal = true
+    resultChan <- totals
+
+    return totals.Sessions, nil
+}
+
+// countTruncated adds the sum_other_doc_count of a terms aggregation to counter
+func countTruncated(agg map[string]interface{}, counter *atomic.Int64) {
+    if other, ok := agg["sum_other_doc_count"].(float64); ok && other > 0 {
+        counter.Add(int64(other))
+    }
+}
+
+// usageEntry reads the session count and the sums from a terms bucket (or the top-level aggregations)
+func usageEntry(bucket map[string]interface{}) LogEntry {
+    docCount, _ := bucket["doc_count"].(float64)
+    return LogEntry{
+        Sessions:     int64(docCount),
+        InputOctets:  sumValue(bucket, "input_octets"),
+        OutputOctets: sumValue(bucket, "output_octets"),
+        SessionTime:  sumValue(bucket, "session_time"),
+    }
+}
+
+// sumValue returns the value of a sum sub-aggregation (0 if missing or null)
+func sumValue(bucket map[string]interface{}, name string) int64 {
+    agg, ok := bucket[name].(map[string]interface{})
+    if !ok {
+        return 0
+    }
+    value, _ := agg["value"].(float64)
+    return int64(value)
+}
+
+// processResults adds the per-day entries into the user, provider and overall totals
+func processResults(resultChan <-chan LogEntry, result *Result, mu *sync.Mutex) {
+    for entry := range resultChan {
+        mu.Lock()
+        var usage *Usage
+        switch {
+        case entry.DayTotal:
+            usage = &result.Totals
+        case entry.ServiceProvider != "":
+            usage = result.Providers[entry.ServiceProvider]
+            if usage == nil {
+                usage = &Usage{}
+                result.Providers[entry.ServiceProvider] = usage
+            }
+        default:
+            usage = result.Users[entry.Username]
+            if usage == nil {
+                usage = &Usage{}
+                result.Users[entry.Username] = usage
+            }
+        }
+        usage.Sessions += entry.Sessions
+        usage.InputOctets += entry.InputOctets
+        usage.OutputOctets += entry.OutputOctets
+        usage.SessionTime += entry.SessionTime
+        mu.Unlock()
+    }
+}
+
+// formatBytes formats an octet count as a human-readable size (e.g., "1.5 GB")
+func formatBytes(octets int64) string {
+    const unit = 1024
+    if octets < unit {
+        return fmt.Sprintf("%d B", octets)
+    }
+    div, exp := int64(unit), 0
+    for n := octets / unit; n >= unit; n /= unit {
+        div *= unit
+        exp++
+    }
+    return fmt.Sprintf("%.1f %cB", float64(octets)/float64(div), "KMGTPE"[exp])
+}
+
+// usageStat converts accumulated totals into an output row
+func usageStat(usage *Usage) UsageStat {
+    total := usage.InputOctets + usage.OutputOctets
+    return UsageStat{
+        Sessions:           usage.Sessions,
+        InputOctets:        usage.InputOctets,
+        OutputOctets:       usage.OutputOctets,
+        TotalOctets:        total,
+        TotalTraffic:       formatBytes(total),
+        SessionTimeSeconds: usage.SessionTime,
+    }
+}
+
+// sortByTraffic sorts rows by total_octets (descending)
+func sortByTraffic(stats []UsageStat) {
+    sort.Slice(stats, func(i, j int) bool {
+        if stats[i].TotalOctets != stats[j].TotalOctets {
+            return stats[i].TotalOctets > stats[j].TotalOctets
+        }
+        return stats[i].Username+stats[i].Provider < stats[j].Username+stats[j].Provider
+    })
+}
+
+// createOutputData creates the output JSON structure
+func createOutputData(result *Result, domain string, startDate, endDate time.Time, days int) SimplifiedOutputData {
+    output := SimplifiedOutputData{}
+    output.QueryInfo.Domain = domain
+    output.QueryInfo.Days = days
+    output.QueryInfo.StartDate = startDate.Format("2006-01-02 15:04:05")
+    output.QueryInfo.EndDate = endDate.Format("2006-01-02 15:04:05")
+    output.QueryInfo.Top = opts.TopN
+    output.Description = "Accounting traffic (Acct-Status-Type Stop) per user and provider for the specified domain and time range."
+
+    output.Summary.TotalUsers = len(result.Users)
+    output.Summary.TotalProviders = len(result.Providers)
+
+    output.TopUsers = make([]UsageStat, 0, len(result.Users))
+    for username, usage := range result.Users {
+        stat := usageStat(usage)
+        stat.Username = username
+        output.TopUsers = append(output.TopUsers, stat)
+    }
+    output.Summary.TotalSessions = result.Totals.Sessions
+    output.Summary.TotalInputOctets = result.Totals.InputOctets
+    output.Summary.TotalOutputOctets = result.Totals.OutputOctets
+    output.Summary.TotalSessionTime = result.Totals.SessionTime
+    output.Summary.TotalTraffic = formatBytes(output.Summary.TotalInputOctets + output.Summary.TotalOutputOctets)
+
+    sortByTraffic(output.TopUsers)
+    if len(output.TopUsers) > opts.TopN {
+        output.TopUsers = output.TopUsers[:opts.TopN]
+    }
+
+    output.ProviderStats = make([]UsageStat, 0, len(result.Providers))
+    for provider, usage := range result.Providers {
+        stat := usageStat(usage)
+        stat.Provider = provider
+        output.ProviderStats = append(output.ProviderStats, stat)
+    }
+    sortByTraffic(output.ProviderStats)
+
+    return output
+}
+
+// warnTruncated prints a warning for each terms aggregation that dropped sessions beyond its size
+func warnTruncated() {
+    for _, agg := range []struct {
+        name    string
+        size    int
+        dropped int64
+    }{
+        {"by_user", userBucketSize, truncatedUsers.Load()},
+        {"by_provider", providerBucketSize, truncatedProviders.Load()},
+    } {
+        if agg.dropped > 0 {
+            fmt.Printf("WARNING: the %s aggregation (size %d) truncated %d sessions; the summary totals include them, the per-%s rows do not\n",
+                agg.name, agg.size, agg.dropped, strings.TrimPrefix(agg.name, "by_"))
+        }
+    }
+}
+
+// warnNoData prints the likely causes of an empty result
+func warnNoData(domain string, startDate, endDate time.Time) {
+    fmt.Println("WARNING: the query matched no Accounting-Request Stop records.")
+    if domain != allDomains {
+        fmt.Printf("  realm: %s\n", getDomain(domain))
+    }
+    fmt.Printf("  range: %s to %s\n", startDate.Format("2006-01-02"), endDate.Format("2006-01-02"))
+    fmt.Println("  Common causes:")
+    fmt.Println("    - wrong domain (pass it without the 'eduroam.' prefix, e.g. 'ku.ac.th')")
+    fmt.Println("    - logs ingested before log2quickwit parsed the Acct-* attributes")
+    fmt.Println("    - the nro-logs index name or QW_URL in qw-auth.properties")
+}
+
+// writeManifest writes <output>.manifest.json next to the report with the query parameters
+// and the SHA-256 of the report bytes
+func writeManifest(filename string, data []byte, queryString string, startDate, endDate time.Time, workers int, totalHits int64) error {
+    // -stdout: ไม่มีไฟล์ report ให้วาง manifest ไว้ข้างๆ
+    if opts.Stdout {
+        return nil
+    }
+    manifest := Manifest{
+        Tool:        userAgent,
+        Query:       queryString,
+        StartTime:   startDate.Format(time.RFC3339),
+        EndTime:     endDate.Format(time.RFC3339),
+        Workers:     workers,
+        TotalHits:   totalHits,
+        Output:      outputLocation(filename),
+        SHA256:      sha256Hex(data),
+        GeneratedAt: time.Now().Format(time.RFC3339),
+    }
+
+    manifestData, err := json.MarshalIndent(manifest, "", "  ")
+    if err != nil {
+        return fmt.Errorf("error marshaling manifest: %v", err)
+    }
+    return writeOutput(strings.TrimSuffix(filename, ".json")+".manifest.json", manifestData)
+}
+
+// writeFileAtomic writes data to name through a temporary file and a rename, so a reader
+// (or a run killed mid-write) never sees a truncated file
+func writeFileAtomic(name string, data []byte) error {
+    tmp := name + ".tmp"
+    if err := os.WriteFile(tmp, data, 0644); err != nil {
+        return err
+    }
+    return os.Rename(tmp, name)
+}
+
+// writeOutput writes a report to its local path under output/ (atomically), to stdout with -stdout,
+// or uploads it when -out-url is s3://
+func writeOutput(name string, data []byte) error {
+    if opts.Stdout {
+        _, err := reportOut.Write(append(data, '\n'))
+        return err
+    }
+    if opts.OutURL == "" {
+        if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+            return fmt.Errorf("error creating output directory: %v", err)
+        }
+        return writeFileAtomic(name, data)
+    }
+
+    u, _ := url.Parse(opts.OutURL)
+    return putS3Object(outputS3, u.Host, s3Key(name), data)
+}
+
+// outputLocation returns where writeOutput stores name
+func outputLocation(name string) string {
+    if opts.Stdout {
+        return "stdout"
+    }
+    if opts.OutURL == "" {
+        return name
+    }
+    u, _ := url.Parse(opts.OutURL)
+    return fmt.Sprintf("s3://%s/%s", u.Host, s3Key(name))
+}
+
+// s3Key maps a local output path (output/<dir>/<file>) to a key under the -out-url prefix
+func s3Key(name string) string {
+    u, _ := url.Parse(opts.OutURL)
+    return strings.TrimPrefix(path.Join(u.Path, strings.TrimPrefix(filepath.ToSlash(name), "output/")), "/")
+}
+
+// putS3Object uploads data with the AWS SDK; path-style addressing and S3_ENDPOINT make it work with
+// S3-compatible stores such as MinIO as well as AWS S3
+// (the SDK's own HTTP client is used: the proxy, client certificate and timeout of httpClient are Quickwit's)
+func putS3Object(cfg S3Config, bucket, key string, data []byte) error {
+    if cfg.Region == "" {
+        cfg.Region = "us-east-1"
+    }
+    if cfg.AccessKey == "" || cfg.SecretKey == "" {
+        return fmt.Errorf("S3_ACCESS_KEY and S3_SECRET_KEY must be set in qw-auth.properties")
+    }
+
+    client := s3.New(s3.Options{
+        Region:       cfg.Region,
+        Credentials:  credentials.NewStaticCredentialsProvider(cfg.AccessKey, cfg.SecretKey, ""),
+        UsePathStyle: true,
+    }, func(o *s3.Options) {
+        if cfg.Endpoint != "" {
+            o.BaseEndpoint = aws.String(cfg.Endpoint)
+        }
+    })
+
+    contentType := "application/json"
+    if strings.HasSuffix(key, ".csv") {
+        contentType = "text/csv"
+    }
+    _, err := client.PutObject(context.Background(), &s3.PutObjectInput{
+        Bucket:      aws.String(bucket),
+        Key:         aws.String(key),
+        Body:        bytes.NewReader(data),
+        ContentType: aws.String(contentType),
+    })
+    if err != nil {
+        return fmt.Errorf("error uploading to S3: %v", err)
+    }
+    return nil
+}
+
+func sha256Hex(data []byte) string {
+    sum := sha256.Sum256(data)
+    return hex.EncodeToString(sum[:])
+}
+
+// runDayJobs splits [startDate, endDate) into day-jobs and runs fn on each with numWorkers workers.
+// fn runs concurrently, so it guards its own shared state. After the first error the remaining
+// day-jobs are skipped and that error is returned.
+func runDayJobs(startDate, endDate time.Time, numWorkers int, fn func(job Job) error) error {
+    var wg sync.WaitGroup
+    var failed atomic.Bool
+    errChan := make(chan error, 1)
+    jobs := make(chan Job, numWorkers)
+
+    for w := 1; w <= numWorkers; w++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for job := range jobs {
+                if failed.Load() {
+                    continue
+                }
+                if err := fn(job); err != nil {
+                    failed.Store(true)
+                    select {
+                    case errChan <- err:
+                    default:
+                    }
+                }
+            }
+        }()
+    }
+
+    currentDate := startDate
+    for currentDate.Before(endDate) {
+        nextDate := currentDate.Add(24 * time.Hour)
+        if nextDate.After(endDate) {
+            nextDate = endDate
+        }
+        jobs <- Job{
+            StartTimestamp: currentDate.Unix(),
+            EndTimestamp:   nextDate.Unix(),
+        }
+        currentDate = nextDate
+    }
+    close(jobs)
+    wg.Wait()
+
+    select {
+    case err := <-errChan:
+        return err
+    default:
+    }
+    return nil
+}
+
+// parseDateRange parses -from/-to (DD-MM-YYYY, both days included) into the local start
+// and end of the range and its number of days
+func parseDateRange(from, to string) (time.Time, time.Time, int, error) {
+    first, err := time.Parse("02-01-2006", from)
+    if err != nil {
+        return time.Time{}, time.Time{}, 0, fmt.Errorf("invalid -from %q: use DD-MM-YYYY", from)
+    }
+    last, err := time.Parse("02-01-2006", to)
+    if err != nil {
+        return time.Time{}, time.Time{}, 0, fmt.Errorf("invalid -to %q: use DD-MM-YYYY", to)
+    }
+    if last.Before(first) {
+        return time.Time{}, time.Time{}, 0, fmt.Errorf("-from %s is after -to %s", from, to)
+    }
+    days := int(last.Sub(first).Hours()/24) + 1
+    startDate := time.Date(first.Year(), first.Month(), first.Day(), 0, 0, 0, 0, time.Local)
+    endDate := time.Date(last.Year(), last.Month(), last.Day(), 23, 59, 59, 999999999, time.Local)
+    return startDate, endDate, days, nil
+}
+
+// usage prints the command-line help
+func usage() {
+    fmt.Println("Usage: ./eduroam-acct [flags] <domain|all> [days|Ny|yxxxx|DD-MM-YYYY]")
+    fmt.Println("  domain: domain name (e.g., 'ku.ac.th', 'etlr1'), or 'all' for every realm")
+    fmt.Println("  days: number of days (1-3650)")
+    fmt.Println("  Ny: number of years (1y-10y)")
+    fmt.Println("  yxxxx: specific year (e.g., y2024)")
+    fmt.Println("  DD-MM-YYYY: specific date")
+    fmt.Println("  or -from DD-MM-YYYY -to DD-MM-YYYY instead of the argument: explicit range, both days included")
+    fmt.Println("Flags:")
+    flag.PrintDefaults()
+}
+
+// parseFlags registers and parses the command-line flags into opts
+func parseFlags() []string {
+    flag.IntVar(&opts.TopN, "top", 20, "number of users kept in top_users, sorted by total traffic")
+    flag.BoolVar(&opts.Strict, "strict", false, "exit non-zero instead of writing a report when nothing matched")
+    flag.BoolVar(&opts.Summary, "summary", false, "print a top-10/totals/timing table to stderr at the end of the run")
+    flag.StringVar(&opts.From, "from", "", "first day (DD-MM-YYYY) of an explicit range, with -to")
+    flag.StringVar(&opts.To, "to", "", "last day (DD-MM-YYYY, included) of the -from range")
+    flag.DurationVar(&opts.Timeout, "timeout", 30*time.Second, "HTTP timeout for each Quickwit request")
+    flag.IntVar(&opts.MaxIdleConns, "max-idle-conns", 10, "maximum idle keep-alive connections kept to Quickwit")
+    flag.IntVar(&opts.MaxInflight, "max-inflight", 0, "maximum search requests in flight to Quickwit at once (0 = no limit)")
+    flag.StringVar(&opts.OutURL, "out-url", "", "upload the report to s3://bucket/prefix instead of output/")
+    flag.BoolVar(&opts.Stdout, "stdout", false, "write the report to stdout (messages go to stderr) instead of output/")
+    flag.StringVar(&opts.DumpRaw, "dump-raw", "", "write each day-job's raw Quickwit response to this directory")
+    flag.BoolVar(&opts.PreferFile, "prefer-file", false, "let qw-auth.properties win over QW_USER/QW_PASS/QW_URL environment variables")
+    flag.BoolVar(&opts.Check, "check", false, "verify Quickwit connectivity and the nro-logs index, then exit")
+    flag.Usage = usage
+    flag.Parse()
+
+    if opts.OutURL != "" {
+        u, err := url.Parse(opts.OutURL)
+        if err != nil || u.Scheme != "s3" || u.Host == "" {
+            log.Fatalf("Invalid out-url %q. Use s3://bucket/prefix", opts.OutURL)
+        }
+    }
+
+    if opts.TopN < 1 {
+        log.Fatalf("Invalid top. Must be 1 or greater")
+    }
+    if (opts.From == "") != (opts.To == "") {
+        log.Fatalf("-from and -to must be given together")
+    }
+    if opts.Timeout <= 0 {
+        log.Fatalf("Invalid timeout. Must be greater than 0")
+    }
+    if opts.MaxIdleConns < 1 {
+        log.Fatalf("Invalid max idle connections. Must be 1 or greater")
+    }
+    if opts.MaxInflight < 0 {
+        log.Fatalf("Invalid max inflight. Must be 0 or greater")
+    }
+    if opts.MaxInflight > 0 {
+        inflight = make(chan struct{}, opts.MaxInflight)
+    }
+
+    if opts.Stdout {
+        if opts.OutURL != "" {
+            log.Fatalf("-stdout cannot be combined with -out-url")
+        }
+        reportOut = os.Stdout
+        os.Stdout = os.Stderr
+    }
+
+    if opts.DumpRaw != "" {
+        if err := os.MkdirAll(opts.DumpRaw, 0755); err != nil {
+            log.Fatalf("Error creating dump-raw directory: %v", err)
+        }
+    }
+
+    return flag.Args()
+}
+
+func main() {
+    args := parseFlags()
+    if opts.Check {
+        runCheck()
+    }
+    if len(args) < 1 || len(args) > 2 {
+        usage()
+        os.Exit(1)
+    }
+
+    domain := args[0]
+    var startDate, endDate time.Time
+    var days int
+    var specificDate bool
+
+    if opts.From != "" {
+        if len(args) == 2 {
+            log.Fatalf("-from/-to replace the [days|Ny|yxxxx|DD-MM-YYYY] argument; do not pass both")
+        }
+        var err error
+        startDate, endDate, days, err = parseDateRange(opts.From, opts.To)
+        if err != nil {
+            log.Fatalf("Invalid date range: %v", err)
+        }
+        if days > 3650 {
+            log.Fatalf("Invalid date range. Must be at most 3650 days")
+        }
+    } else if len(args) == 2 {
+        param := args[1]
+
+        if strings.HasPrefix(param, "y") && len(param) == 5 {
+            yearStr := param[1:]
+            if year, err := strconv.Atoi(yearStr); err == nil {
+                if year >= 2000 && year <= 2100 {
+                    startDate = time.Date(year, 1, 1, 0, 0, 0, 0, time.Local)
+                    endDate = time.Date(year, 12, 31, 23, 59, 59, 999999999, time.Local)
+                    days = 365
+                    if isLeapYear(year) {
+                        days = 366
+                    }
+                } else {
+                    log.Fatalf("Invalid year range. Must be between 2000 and 2100")
+                }
+            } else {
+                log.Fatalf("Invalid year format. Use y followed by 4 digits (e.g., y2024)")
+            }
+        } else if strings.HasSuffix(param, "y") {
+            yearStr := strings.TrimSuffix(param, "y")
+            if years, err := strconv.Atoi(yearStr); err == nil {
+                if years >= 1 && years <= 10 {
+                    days = years * 365
+                    endDate = time.Now()
+                    startDate = endDate.AddDate(0, 0, -days+1)
+                } else {
+                    log.Fatalf("Invalid year range. Must be between 1y and 10y")
+                }
+            } else {
+                log.Fatalf("Invalid year format. Use 1y-10y")
+            }
+        } else if d, err := strconv.Atoi(param); err == nil {
+            if d >= 1 && d <= 3650 {
+                days = d
+                endDate = time.Now()
+                startDate = endDate.AddDate(0, 0, -days+1)
+            } else {
+                log.Fatalf("Invalid number of days. Must be between 1 and 3650")
+            }
+        } else {
+            specificDate = true
+            var err error
+            startDate, err = time.Parse("02-01-2006", param)
+            if err != nil {
+                log.Fatalf("Invalid date format. Use DD-MM-YYYY: %v", err)
+            }
+            endDate = startDate.AddDate(0, 0, 1)
+            days = 1
+        }
+    } else {
+        // Default: 1 day
+        days = 1
+        endDate = time.Now()
+        startDate = endDate.AddDate(0, 0, -1)
+    }
+
+    startDate = time.Date(startDate.Year(), startDate.Month(), startDate.Day(), 0, 0, 0, 0, startDate.Location())
+    endDate = time.Date(endDate.Year(), endDate.Month(), endDate.Day(), 23, 59, 59, 999999999, endDate.Location())
+
+    props, err := readProperties("qw-auth.properties")
+    if err != nil {
+        log.Fatalf("Error reading properties: %v", err)
+    }
+    httpClient, err = newHTTPClient(opts.Timeout, opts.MaxIdleConns, props)
+    if err != nil {
+        log.Fatalf("Error creating HTTP client: %v", err)
+    }
+    defer httpClient.CloseIdleConnections()
+    outputS3 = props.S3
+
+    if specificDate {
+        fmt.Printf("Searching for date: %s\n", startDate.Format("2006-01-02"))
+    } else {
+        fmt.Printf("Searching from %s to %s\n", startDate.Format("2006-01-02"), endDate.Format("2006-01-02"))
+    }
+
+    // เฉพาะ Stop records ซึ่งมี octets/session time สุดท้ายของ session
+    queryString := `message_type:"Accounting-Request" AND acct_status_type:"Stop"`
+    if domain != allDomains {
+        queryString += fmt.Sprintf(` AND realm:"%s"`, escapeQueryValue(getDomain(domain)))
+    }
+
+    query := map[string]interface{}{
+        "query":           queryString,
+        "start_timestamp": startDate.Unix(),
+        "end_timestamp":   endDate.Unix(),
+        "max_hits":        10000,
+    }
+
+    resultChan := make(chan LogEntry, 10000)
+    var totalHits atomic.Int64
+    var mu sync.Mutex
+
+    numWorkers := 10
+
+    var processedDays int32
+    queryStart := time.Now()
+
+    result := &Result{
+        Users:     make(map[string]*Usage),
+        Providers: make(map[string]*Usage),
+    }
+
+    processDone := make(chan struct{})
+    go func() {
+        processResults(resultChan, result, &mu)
+        close(processDone)
+    }()
+
+    err = runDayJobs(startDate, endDate, numWorkers, func(job Job) error {
+        hits, err := worker(job, resultChan, query, props)
+        if err != nil {
+            return err
+        }
+        totalHits.Add(hits)
+        current := atomic.AddInt32(&processedDays, 1)
+        fmt.Printf("\rProgress: %d/%d days processed, Progress hits: %d",
+            current, days, totalHits.Load())
+        return nil
+    })
+    close(resultChan)
+    <-processDone
+    if err != nil {
+        log.Fatalf("Error occurred: %v", err)
+    }
+
+    queryDuration := time.Since(queryStart)
+
+    fmt.Printf("\n")
+    noData := totalHits.Load() == 0
+    if noData {
+        warnNoData(domain, startDate, endDate)
+        if opts.Strict {
+            os.Exit(2)
+        }
+    }
+    fmt.Printf("Number of users: %d\n", len(result.Users))
+    fmt.Printf("Number of providers: %d\n", len(result.Providers))
+    if skipped := malformedBuckets.Load(); skipped > 0 {
+        fmt.Printf("Skipped %d malformed buckets\n", skipped)
+    }
+    warnTruncated()
+
+    processStart := time.Now()
+    outputData := createOutputData(result, domain, startDate, endDate, days)
+    outputData.NoData = noData
+    processDuration := time.Since(processStart)
+    fmt.Printf("Total traffic: %s in %d sessions\n", outputData.Summary.TotalTraffic, outputData.Summary.TotalSessions)
+
+    outputDir := fmt.Sprintf("output/%s", strings.Replace(domain, ".", "-", -1))
+
+    currentTime := time.Now().Format("20060102-150405")
+    var filename string
+    if specificDate {
+        filename = fmt.Sprintf("%s/%s-%s-acct.json", outputDir, currentTime, startDate.Format("20060102"))
+    } else if len(args) > 1 && strings.HasPrefix(args[1], "y") && len(args[1]) == 5 {
+        filename = fmt.Sprintf("%s/%s-%s-acct.json", outputDir, currentTime, args[1][1:])
+    } else if opts.From != "" {
+        filename = fmt.Sprintf("%s/%s-%s-%s-acct.json", outputDir, currentTime, startDate.Format("20060102"), endDate.Format("20060102"))
+    } else {
+        filename = fmt.Sprintf("%s/%s-%dd-acct.json", outputDir, currentTime, days)
+    }
+
+    jsonData, err := json.MarshalIndent(outputData, "", "  ")
+    if err != nil {
+        log.Fatalf("Error marshaling JSON: %v", err)
+    }
+
+    if err := writeOutput(filename, jsonData); err != nil {
+        log.Fatalf("Error writing output: %v", err)
+    }
+    if err := writeManifest(filename, jsonData, queryString, startDate, endDate, numWorkers, totalHits.Load()); err != nil {
+        log.Fatalf("Error writing manifest: %v", err)
+    }
+
+    fmt.Printf("Results have been saved to %s\n", outputLocation(filename))
+    fmt.Printf("Time taken:\n")
+    fmt.Printf("  Quickwit query: %v\n", queryDuration)
+    fmt.Printf("  Local processing: %v\n", processDuration)
+    fmt.Printf("  Overall: %v\n", time.Since(queryStart))
+    if opts.Summary {
+        printSummary(outputData, queryDuration, processDuration, time.Since(queryStart))
+    }
+}
+
+// summaryTopN คือจำนวน provider ที่แสดงในตาราง -summary
+const summaryTopN = 10
+
+// printSummary writes the -summary table to stderr: top providers by sessions, the totals and the
+// timings. It only reads the report, so the JSON stays as written.
+func printSummary(output SimplifiedOutputData, queryDuration, processDuration, overall time.Duration) {
+    // provider_stats เรียงตาม traffic อยู่แล้ว จึงเรียงสำเนาตามจำนวน session
+    providers := append([]UsageStat(nil), output.ProviderStats...)
+    sort.SliceStable(providers, func(i, j int) bool { return providers[i].Sessions > providers[j].Sessions })
+
+    w := tabwriter.NewWriter(os.Stderr, 0, 0, 2, ' ', 0)
+    fmt.Fprintf(w, "\nSummary: %s, %s to %s\n", output.QueryInfo.Domain,
+        output.QueryInfo.StartDate, output.QueryInfo.EndDate)
+    fmt.Fprintln(w, "PROVIDER\tSESSIONS\tTRAFFIC")
+    for i, p := range providers {
+        if i == summaryTopN {
+            break
+        }
+        fmt.Fprintf(w, "%s\t%d\t%s\n", p.Provider, p.Sessions, p.TotalTraffic)
+    }
+
+    fmt.Fprintln(w)
+    fmt.Fprintf(w, "Total sessions\t%d\n", output.Summary.TotalSessions)
+    fmt.Fprintf(w, "Total traffic\t%s\n", output.Summary.TotalTraffic)
+    fmt.Fprintf(w, "Total users\t%d\n", output.Summary.TotalUsers)
+    fmt.Fprintf(w, "Total providers\t%d\n", output.Summary.TotalProviders)
+    fmt.Fprintf(w, "Quickwit query\t%v\n", queryDuration.Round(time.Millisecond))
+    fmt.Fprintf(w, "Local processing\t%v\n", processDuration.Round(time.Millisecond))
+    fmt.Fprintf(w, "Overall\t%v\n", overall.Round(time.Millisecond))
+    w.Flush()
+}
+
+// isLeapYear ตรวจสอบปีอธิกสุรทิน
+func isLeapYear(year int) bool {
+    return year%4 == 0 && (year%100 != 0 || year%400 == 0)
+}
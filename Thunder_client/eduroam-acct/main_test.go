@@ -0,0 +1,155 @@
+package main
+
+import (
+    "encoding/json"
+    "reflect"
+    "sync"
+    "testing"
+)
+
+// decode แปลง JSON ของ Quickwit เป็น map แบบเดียวกับ sendQuickwitRequest
+func decode(t *testing.T, body string) map[string]interface{} {
+    t.Helper()
+    var result map[string]interface{}
+    if err := json.Unmarshal([]byte(body), &result); err != nil {
+        t.Fatalf("decode %s: %v", body, err)
+    }
+    return result
+}
+
+func TestSumValue(t *testing.T) {
+    bucket := decode(t, `{"input_octets":{"value":1500.0},"output_octets":{"value":null},"session_time":{}}`)
+    tests := []struct {
+        name string
+        want int64
+    }{
+        {"input_octets", 1500},
+        {"output_octets", 0}, // null เมื่อไม่มีเอกสารที่มี field นี้
+        {"session_time", 0},
+        {"missing", 0},
+    }
+    for _, tt := range tests {
+        if got := sumValue(bucket, tt.name); got != tt.want {
+            t.Errorf("sumValue(%s) = %d, want %d", tt.name, got, tt.want)
+        }
+    }
+}
+
+func TestUsageEntry(t *testing.T) {
+    bucket := decode(t, `{"key":"john@ku.ac.th","doc_count":3,
+        "input_octets":{"value":100},"output_octets":{"value":200},"session_time":{"value":60}}`)
+    want := LogEntry{Sessions: 3, InputOctets: 100, OutputOctets: 200, SessionTime: 60}
+    if got := usageEntry(bucket); got != want {
+        t.Errorf("usageEntry = %+v, want %+v", got, want)
+    }
+}
+
+func TestProcessAggregations(t *testing.T) {
+    truncatedUsers.Store(0)
+    truncatedProviders.Store(0)
+    malformedBuckets.Store(0)
+    defer func() {
+        truncatedUsers.Store(0)
+        truncatedProviders.Store(0)
+        malformedBuckets.Store(0)
+    }()
+
+    result := decode(t, `{"num_hits":5,"hits":[],"aggregations":{
+        "input_octets":{"value":1000},"output_octets":{"value":2000},"session_time":{"value":500},
+        "by_user":{"sum_other_doc_count":2,"buckets":[
+            {"key":"john@ku.ac.th","doc_count":2,"input_octets":{"value":300},"output_octets":{"value":400},"session_time":{"value":100}},
+            {"key":"jane@ku.ac.th","doc_count":1,"input_octets":{"value":100},"output_octets":{"value":100},"session_time":{"value":50}},
+            "not a bucket"]},
+        "by_provider":{"sum_other_doc_count":0,"buckets":[
+            {"key":"eduroam.cmu.ac.th","doc_count":5,"input_octets":{"value":1000},"output_octets":{"value":2000},"session_time":{"value":500}}]}}}`)
+
+    resultChan := make(chan LogEntry, 10)
+    hits, err := processAggregations(result, resultChan)
+    if err != nil {
+        t.Fatalf("processAggregations: %v", err)
+    }
+    close(resultChan)
+    var got []LogEntry
+    for entry := range resultChan {
+        got = append(got, entry)
+    }
+
+    want := []LogEntry{
+        {Username: "john@ku.ac.th", Sessions: 2, InputOctets: 300, OutputOctets: 400, SessionTime: 100},
+        {Username: "jane@ku.ac.th", Sessions: 1, InputOctets: 100, OutputOctets: 100, SessionTime: 50},
+        {ServiceProvider: "eduroam.cmu.ac.th", Sessions: 5, InputOctets: 1000, OutputOctets: 2000, SessionTime: 500},
+        {DayTotal: true, Sessions: 5, InputOctets: 1000, OutputOctets: 2000, SessionTime: 500},
+    }
+    if hits != 5 {
+        t.Errorf("hits = %d, want num_hits 5 (including the truncated users)", hits)
+    }
+    if !reflect.DeepEqual(got, want) {
+        t.Errorf("entries = %+v\nwant %+v", got, want)
+    }
+    if truncatedUsers.Load() != 2 || truncatedProviders.Load() != 0 {
+        t.Errorf("truncated users/providers = %d/%d, want 2/0", truncatedUsers.Load(), truncatedProviders.Load())
+    }
+    if malformedBuckets.Load() != 1 {
+        t.Errorf("malformed buckets = %d, want 1", malformedBuckets.Load())
+    }
+
+    if _, err := processAggregations(decode(t, `{"num_hits":0,"hits":[],"aggregations":{}}`), make(chan LogEntry, 1)); err == nil {
+        t.Error("processAggregations without by_user succeeded, want an error")
+    }
+}
+
+func TestProcessResultsTotalsFromDayTotal(t *testing.T) {
+    result := &Result{Users: make(map[string]*Usage), Providers: make(map[string]*Usage)}
+    resultChan := make(chan LogEntry, 3)
+    resultChan <- LogEntry{Username: "john@ku.ac.th", Sessions: 2, InputOctets: 300}
+    resultChan <- LogEntry{ServiceProvider: "eduroam.cmu.ac.th", Sessions: 5, InputOctets: 1000}
+    resultChan <- LogEntry{DayTotal: true, Sessions: 5, InputOctets: 1000}
+    close(resultChan)
+    var mu sync.Mutex
+    processResults(resultChan, result, &mu)
+
+    if result.Totals.Sessions != 5 || result.Totals.InputOctets != 1000 {
+        t.Errorf("totals = %+v, want the day total, not the sum of the user rows", result.Totals)
+    }
+    if len(result.Users) != 1 || len(result.Providers) != 1 {
+        t.Errorf("%d users, %d providers; want 1 each", len(result.Users), len(result.Providers))
+    }
+}
+
+func TestFormatBytes(t *testing.T) {
+    tests := []struct {
+        octets int64
+        want   string
+    }{
+        {0, "0 B"},
+        {1023, "1023 B"},
+        {1024, "1.0 KB"},
+        {1536, "1.5 KB"},
+        {1024 * 1024, "1.0 MB"},
+        {5 * 1024 * 1024 * 1024, "5.0 GB"},
+        {1 << 40, "1.0 TB"},
+    }
+    for _, tt := range tests {
+        if got := formatBytes(tt.octets); got != tt.want {
+            t.Errorf("formatBytes(%d) = %q, want %q", tt.octets, got, tt.want)
+        }
+    }
+}
+
+func TestEscapeQueryValue(t *testing.T) {
+    tests := []struct {
+        value string
+        want  string
+    }{
+        {"eduroam.ku.ac.th", "eduroam.ku.ac.th"},
+        {`eduroam.ku"ac.th`, `eduroam.ku\"ac.th`},
+        {`eduroam.ku\ac.th`, `eduroam.ku\\ac.th`},
+        {`eduroam.x\" OR realm:*`, `eduroam.x\\\" OR realm:*`},
+        {"", ""},
+    }
+    for _, tt := range tests {
+        if got := escapeQueryValue(tt.value); got != tt.want {
+            t.Errorf("escapeQueryValue(%q) = %q, want %q", tt.value, got, tt.want)
+        }
+    }
+}
@@ -5,11 +5,18 @@ Description: This program aggregates Access-Accept events for users from a speci
              using the Quickwit search engine. It collects data over a specified time range,
              processes the results, and outputs the aggregated data to a JSON file.
 
-Usage: ./eduroam-accept <domain> [days|DD-MM-YYYY]
+Usage: ./eduroam-accept [flags] <domain> [days|DD-MM-YYYY]
   <domain>: The domain to search for (e.g., 'example.ac.th' or 'etlr1' or 'etlr2')
   [days]: Optional. The number of days to look back from the current date. Default is 1. Max is 366.
   [DD-MM-YYYY]: Optional. A specific date to process data for.
 
+Flags:
+  -min-daily-auths int
+        Minimum Access-Accept events on a day for it to count towards days_active (default 1)
+  -out-url string
+        Upload the report to s3://bucket/prefix instead of writing it under output/
+        (S3_ENDPOINT, S3_REGION, S3_ACCESS_KEY and S3_SECRET_KEY are read from qw-auth.properties)
+
 Features:
 - Concurrent querying and processing using goroutines for improved performance
 - Flexible time range specification: number of days or specific date
@@ -45,6 +52,9 @@ Changes in version 2.0.0:
 - Restructured output to show data by username and service provider 
 - Improved error handling and logging
 
+Build: go build (go.mod pins aws-sdk-go-v2 v1.47.1, credentials v1.20.6, service/s3 v1.113.4,
+used by -out-url; Go 1.24 or later)
+
 Author: [P.Itarun]
 Date: [21 Oct 2024]
 License: [License Information if applicable]
@@ -54,27 +64,58 @@ package main
 
 import (
     "bufio"
+    "bytes"
+    "context"
+    "crypto/rand"
     "encoding/json"
+    "flag"
     "fmt"
     "io"
     "log"
     "net/http"
+    "net/url"
     "os"
+    "path"
+    "path/filepath"
     "sort"
     "strconv"
     "strings"
     "sync"
     "time"
     "sync/atomic"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/credentials"
+    "github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
+// Options holds the command-line options
+type Options struct {
+    MinDailyAuths int
+    OutURL        string
+}
+
+var opts Options
+
 // Properties represents the authentication properties for Quickwit API
 type Properties struct {
     QWUser string
     QWPass string
     QWURL  string
+    S3     S3Config
 }
 
+// S3Config holds the S3-compatible object storage settings used by -out-url
+type S3Config struct {
+    Endpoint  string // e.g., https://minio.example.org (default https://s3.<region>.amazonaws.com)
+    Region    string
+    AccessKey string
+    SecretKey string
+}
+
+// outputS3 is set from qw-auth.properties in main
+var outputS3 S3Config
+
 // LogEntry represents a single log entry from Quickwit search results
 type LogEntry struct {
     Username        string    `json:"username"`
@@ -85,6 +126,7 @@ type LogEntry struct {
 // UserStats contains statistics for a user
 type UserStats struct {
     DaysActive int
+    ActiveDays map[string]int // map[YYYY-MM-DD]จำนวน auth รวมทั้ง run
     Providers  map[string]bool
 }
 
@@ -118,8 +160,9 @@ type SimplifiedOutputData struct {
         Users     []string `json:"users"`
     } `json:"provider_stats"`
     UserStats []struct {
-        Username  string   `json:"username"`
-        Providers []string `json:"providers"`
+        Username   string   `json:"username"`
+        DaysActive int      `json:"days_active"`
+        Providers  []string `json:"providers"`
     } `json:"user_stats"`
 }
 
@@ -136,7 +179,7 @@ type UserData struct {
 }
 
 type UserActivity struct {
-    ActiveDays map[string]bool    // map[YYYY-MM-DD]bool
+    ActiveDays map[string]int     // map[YYYY-MM-DD]จำนวน auth ในวันนั้น
     Providers  map[string]bool    // map[provider]bool
 }
 
@@ -164,6 +207,14 @@ func readProperties(filePath string) (Properties, error) {
                     props.QWPass = value
                 case "QW_URL":
                     props.QWURL = strings.TrimPrefix(value, "=")
+                case "S3_ENDPOINT":
+                    props.S3.Endpoint = strings.TrimSuffix(value, "/")
+                case "S3_REGION":
+                    props.S3.Region = value
+                case "S3_ACCESS_KEY":
+                    props.S3.AccessKey = value
+                case "S3_SECRET_KEY":
+                    props.S3.SecretKey = value
                 }
             }
         }
@@ -171,6 +222,18 @@ func readProperties(filePath string) (Properties, error) {
     return props, scanner.Err()
 }
 
+// userAgent identifies this tool in Quickwit access logs
+const userAgent = "log2quickwit/eduroam-accept/2.1.2"
+
+// newRequestID returns a random UUIDv4 sent as X-Request-ID with each slice query
+func newRequestID() string {
+    var b [16]byte
+    rand.Read(b[:])
+    b[6] = (b[6] & 0x0f) | 0x40
+    b[8] = (b[8] & 0x3f) | 0x80
+    return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
 // getQuickwitResults retrieves search results from Quickwit API
 func getQuickwitResults(query map[string]interface{}, auth Properties, resultChan chan<- LogEntry) (int64, error) {
     client := &http.Client{}
@@ -189,6 +252,8 @@ func getQuickwitResults(query map[string]interface{}, auth Properties, resultCha
     req.SetBasicAuth(auth.QWUser, auth.QWPass)
     req.Header.Set("Content-Type", "application/json")
     req.Header.Set("Accept", "application/json")
+    req.Header.Set("User-Agent", userAgent)
+    req.Header.Set("X-Request-ID", newRequestID())
 
     resp, err := client.Do(req)
     if err != nil {
@@ -300,6 +365,7 @@ func createSimplifiedOutputData(result *Result, domain string, startDate, endDat
         for user := range stats.Users {
             users = append(users, user)
         }
+        sort.Strings(users)
         mu.Unlock()
         output.ProviderStats = append(output.ProviderStats, struct {
             Provider  string   `json:"provider"`
@@ -314,13 +380,17 @@ func createSimplifiedOutputData(result *Result, domain string, startDate, endDat
 
     // Sort provider stats by number of users
     sort.Slice(output.ProviderStats, func(i, j int) bool {
-        return output.ProviderStats[i].UserCount > output.ProviderStats[j].UserCount
+        if output.ProviderStats[i].UserCount != output.ProviderStats[j].UserCount {
+            return output.ProviderStats[i].UserCount > output.ProviderStats[j].UserCount
+        }
+        return output.ProviderStats[i].Provider < output.ProviderStats[j].Provider
     })
 
     // Process user stats
     output.UserStats = make([]struct {
-        Username  string   `json:"username"`
-        Providers []string `json:"providers"`
+        Username   string   `json:"username"`
+        DaysActive int      `json:"days_active"`
+        Providers  []string `json:"providers"`
     }, 0, len(result.Users))
 
     for username, stats := range result.Users {
@@ -329,13 +399,16 @@ func createSimplifiedOutputData(result *Result, domain string, startDate, endDat
         for provider := range stats.Providers {
             providers = append(providers, provider)
         }
+        sort.Strings(providers)
         mu.Unlock()
         output.UserStats = append(output.UserStats, struct {
-            Username  string   `json:"username"`
-            Providers []string `json:"providers"`
+            Username   string   `json:"username"`
+            DaysActive int      `json:"days_active"`
+            Providers  []string `json:"providers"`
         }{
-            Username:  username,
-            Providers: providers,
+            Username:   username,
+            DaysActive: stats.DaysActive,
+            Providers:  providers,
         })
     }
 
@@ -347,6 +420,10 @@ func createSimplifiedOutputData(result *Result, domain string, startDate, endDat
     return output
 }
 
+// intervalEstimate is the last time-slice width (seconds) that worked, shared by all workers
+// so each new day starts near the right size instead of the full 24 hours (0 = not set yet)
+var intervalEstimate atomic.Int64
+
 // worker function to process jobs
 func worker(job Job, resultChan chan<- LogEntry, query map[string]interface{}, props Properties) (int64, error) {
     currentQuery := make(map[string]interface{})
@@ -358,7 +435,10 @@ func worker(job Job, resultChan chan<- LogEntry, query map[string]interface{}, p
     var totalHits int64
     currentTime := job.StartTimestamp
     baseInterval := int64(86400) // 24 ชั่วโมง
-    interval := baseInterval
+    interval := intervalEstimate.Load()
+    if interval <= 0 || interval > baseInterval {
+        interval = baseInterval
+    }
 
     for currentTime < job.EndTimestamp {
         endTime := currentTime + interval
@@ -399,6 +479,7 @@ func worker(job Job, resultChan chan<- LogEntry, query map[string]interface{}, p
                 interval = baseInterval
             }
         }
+        intervalEstimate.Store(interval)
     }
     
     return totalHits, nil
@@ -421,14 +502,14 @@ func processResults(resultChan <-chan LogEntry, result *Result, mu *sync.Mutex,
         // สร้างข้อมูลผู้ใช้ถ้ายังไม่มี
         if _, exists := userActivities[entry.Username]; !exists {
             userActivities[entry.Username] = &UserActivity{
-                ActiveDays: make(map[string]bool),
+                ActiveDays: make(map[string]int),
                 Providers:  make(map[string]bool),
             }
         }
 
-        // บันทึกวันที่มีการใช้งาน
+        // นับจำนวน auth ของแต่ละวัน
         day := entry.Timestamp.Format("2006-01-02")
-        userActivities[entry.Username].ActiveDays[day] = true
+        userActivities[entry.Username].ActiveDays[day]++
         userActivities[entry.Username].Providers[entry.ServiceProvider] = true
     }
 
@@ -440,12 +521,22 @@ func processResults(resultChan <-chan LogEntry, result *Result, mu *sync.Mutex,
     for username, activity := range userActivities {
         if _, exists := result.Users[username]; !exists {
             result.Users[username] = &UserStats{
-                DaysActive: len(activity.ActiveDays),
+                ActiveDays: make(map[string]int),
                 Providers:  make(map[string]bool),
             }
-        } else {
-            // นับจำนวนวันที่ active
-            result.Users[username].DaysActive = len(activity.ActiveDays)
+        }
+
+        // รวม (union) วันที่ active กับที่มีอยู่แล้ว แทนการเขียนทับ แล้วนับใหม่
+        // นับเฉพาะวันที่มี auth อย่างน้อย -min-daily-auths ครั้ง
+        stats := result.Users[username]
+        for day, count := range activity.ActiveDays {
+            stats.ActiveDays[day] += count
+        }
+        stats.DaysActive = 0
+        for _, count := range stats.ActiveDays {
+            if count >= opts.MinDailyAuths {
+                stats.DaysActive++
+            }
         }
 
         // copy providers
@@ -463,6 +554,76 @@ func processResults(resultChan <-chan LogEntry, result *Result, mu *sync.Mutex,
     }
 }
 
+// writeOutput writes a report to its local path under output/ (atomically), or uploads it when -out-url is s3://
+func writeOutput(name string, data []byte) error {
+    if opts.OutURL == "" {
+        if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+            return fmt.Errorf("error creating output directory: %v", err)
+        }
+        return writeFileAtomic(name, data)
+    }
+
+    u, _ := url.Parse(opts.OutURL)
+    return putS3Object(outputS3, u.Host, s3Key(name), data)
+}
+
+// writeFileAtomic writes data to name through a temporary file and a rename, so an
+// interrupted write never leaves a truncated file behind
+func writeFileAtomic(name string, data []byte) error {
+    tmp := name + ".tmp"
+    if err := os.WriteFile(tmp, data, 0644); err != nil {
+        return err
+    }
+    return os.Rename(tmp, name)
+}
+
+// outputLocation returns where writeOutput stores name
+func outputLocation(name string) string {
+    if opts.OutURL == "" {
+        return name
+    }
+    u, _ := url.Parse(opts.OutURL)
+    return fmt.Sprintf("s3://%s/%s", u.Host, s3Key(name))
+}
+
+// s3Key maps a local output path (output/<dir>/<file>) to a key under the -out-url prefix
+func s3Key(name string) string {
+    u, _ := url.Parse(opts.OutURL)
+    return strings.TrimPrefix(path.Join(u.Path, strings.TrimPrefix(filepath.ToSlash(name), "output/")), "/")
+}
+
+// putS3Object uploads data with the AWS SDK; path-style addressing and S3_ENDPOINT make it work with
+// S3-compatible stores such as MinIO as well as AWS S3
+func putS3Object(cfg S3Config, bucket, key string, data []byte) error {
+    if cfg.Region == "" {
+        cfg.Region = "us-east-1"
+    }
+    if cfg.AccessKey == "" || cfg.SecretKey == "" {
+        return fmt.Errorf("S3_ACCESS_KEY and S3_SECRET_KEY must be set in qw-auth.properties")
+    }
+
+    client := s3.New(s3.Options{
+        Region:       cfg.Region,
+        Credentials:  credentials.NewStaticCredentialsProvider(cfg.AccessKey, cfg.SecretKey, ""),
+        UsePathStyle: true,
+    }, func(o *s3.Options) {
+        if cfg.Endpoint != "" {
+            o.BaseEndpoint = aws.String(cfg.Endpoint)
+        }
+    })
+
+    _, err := client.PutObject(context.Background(), &s3.PutObjectInput{
+        Bucket:      aws.String(bucket),
+        Key:         aws.String(key),
+        Body:        bytes.NewReader(data),
+        ContentType: aws.String("application/json"),
+    })
+    if err != nil {
+        return fmt.Errorf("error uploading to S3: %v", err)
+    }
+    return nil
+}
+
 func main() {
     // Set logging flags
     log.SetFlags(log.LstdFlags | log.Lshortfile)
@@ -470,18 +631,33 @@ func main() {
     // Record overall start time 
     overallStart := time.Now()
 
-    if len(os.Args) < 2 || len(os.Args) > 3 {
-        fmt.Println("Usage: ./eduroam-accept <domain> [days|DD-MM-YYYY]")
+    flag.IntVar(&opts.MinDailyAuths, "min-daily-auths", 1, "minimum auths on a day for it to count towards days_active")
+    flag.StringVar(&opts.OutURL, "out-url", "", "upload the report to s3://bucket/prefix instead of output/")
+    flag.Parse()
+    if opts.MinDailyAuths < 1 {
+        log.Fatalf("Invalid min daily auths. Must be 1 or greater")
+    }
+    if opts.OutURL != "" {
+        u, err := url.Parse(opts.OutURL)
+        if err != nil || u.Scheme != "s3" || u.Host == "" {
+            log.Fatalf("Invalid out-url %q. Use s3://bucket/prefix", opts.OutURL)
+        }
+    }
+
+    args := flag.Args()
+    if len(args) < 1 || len(args) > 2 {
+        fmt.Println("Usage: ./eduroam-accept [flags] <domain> [days|DD-MM-YYYY]")
+        flag.PrintDefaults()
         os.Exit(1)
     }
 
-    domain := os.Args[1]
+    domain := args[0]
     var startDate, endDate time.Time
     var days int
     var specificDate bool
 
-    if len(os.Args) == 3 {
-        if d, err := strconv.Atoi(os.Args[2]); err == nil && d <= 366 {
+    if len(args) == 2 {
+        if d, err := strconv.Atoi(args[1]); err == nil && d <= 366 {
             // จำนวนวันถูกระบุ (ไม่เกิน 366 วัน)
             days = d
             endDate = time.Now()
@@ -490,7 +666,7 @@ func main() {
             // วันที่เฉพาะถูกระบุในรูปแบบ DD-MM-YYYY
             specificDate = true
             var err error
-            startDate, err = time.Parse("02-01-2006", os.Args[2])
+            startDate, err = time.Parse("02-01-2006", args[1])
             if err != nil {
                 log.Fatalf("Invalid date format. Use DD-MM-YYYY: %v", err)
             }
@@ -515,6 +691,7 @@ func main() {
     if err != nil {
         log.Fatalf("Error reading properties: %v", err)
     }
+    outputS3 = props.S3
 
     if specificDate {
         log.Printf("Searching for date: %s", startDate.Format("2006-01-02"))
@@ -630,9 +807,6 @@ func main() {
     processDuration := time.Since(processStart)
 
     outputDir := fmt.Sprintf("output/%s", domain)
-    if err := os.MkdirAll(outputDir, 0755); err != nil {
-        log.Fatalf("Error creating output directory: %v", err)
-    }
 
     // สร้างชื่อไฟล์ output
     currentTime := time.Now().Format("20060102-150405")
@@ -649,13 +823,13 @@ func main() {
         log.Fatalf("Error marshaling JSON: %v", err)
     }
 
-    if err := os.WriteFile(filename, jsonData, 0644); err != nil {
+    if err := writeOutput(filename, jsonData); err != nil {
         log.Fatalf("Error writing file: %v", err)
     }
 
     overallDuration := time.Since(overallStart)
 
-    fmt.Printf("Results have been saved to %s\n", filename)
+    fmt.Printf("Results have been saved to %s\n", outputLocation(filename))
     fmt.Printf("Time taken:\n")
     fmt.Printf("  Quickwit query: %v\n", queryDuration)
     fmt.Printf("  Local processing: %v\n", processDuration)
@@ -0,0 +1,59 @@
+package main
+
+import (
+    "sync"
+    "testing"
+    "time"
+)
+
+// runDayJob feeds entries to processResults the way one day-job's results channel does
+func runDayJob(result *Result, mu *sync.Mutex, startDate, endDate time.Time, entries ...LogEntry) {
+    resultChan := make(chan LogEntry, len(entries))
+    for _, entry := range entries {
+        resultChan <- entry
+    }
+    close(resultChan)
+    processResults(resultChan, result, mu, startDate, endDate)
+}
+
+func TestProcessResultsDaysActiveAcrossDayJobs(t *testing.T) {
+    startDate := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+    endDate := startDate.AddDate(0, 0, 2)
+    day1 := startDate.Add(9 * time.Hour)
+    day2 := startDate.AddDate(0, 0, 1).Add(9 * time.Hour)
+
+    tests := []struct {
+        minDailyAuths int
+        daysActive    int
+    }{
+        {1, 2},
+        {2, 1}, // วันที่สองมี auth ครั้งเดียว
+    }
+    for _, tt := range tests {
+        opts.MinDailyAuths = tt.minDailyAuths
+        result := &Result{
+            Users:     make(map[string]*UserStats),
+            Providers: make(map[string]*ProviderStats),
+        }
+        var mu sync.Mutex
+
+        runDayJob(result, &mu, startDate, endDate,
+            LogEntry{Username: "john@ku.ac.th", ServiceProvider: "eduroam.ku.ac.th", Timestamp: day1},
+            LogEntry{Username: "john@ku.ac.th", ServiceProvider: "eduroam.ku.ac.th", Timestamp: day1.Add(time.Hour)})
+        runDayJob(result, &mu, startDate, endDate,
+            LogEntry{Username: "john@ku.ac.th", ServiceProvider: "eduroam.cmu.ac.th", Timestamp: day2})
+
+        stats := result.Users["john@ku.ac.th"]
+        if stats == nil {
+            t.Fatalf("min-daily-auths %d: user missing from result", tt.minDailyAuths)
+        }
+        if stats.DaysActive != tt.daysActive {
+            t.Errorf("min-daily-auths %d: DaysActive = %d, want %d (active days %v)",
+                tt.minDailyAuths, stats.DaysActive, tt.daysActive, stats.ActiveDays)
+        }
+        if len(stats.Providers) != 2 {
+            t.Errorf("min-daily-auths %d: providers = %v, want both day-jobs' providers", tt.minDailyAuths, stats.Providers)
+        }
+    }
+    opts.MinDailyAuths = 1
+}
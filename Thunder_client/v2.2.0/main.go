@@ -6,12 +6,88 @@ Description: This program aggregates Access-Accept events for users from a speci
              over a specified time range, processes the results, and outputs the aggregated 
              data to a JSON file.
 
-Usage: ./eduroam-accept <domain> [days|Ny|DD-MM-YYYY]
+Usage: ./eduroam-accept [flags] <domain> [days|Ny|DD-MM-YYYY]
       <domain>: The domain to search for (e.g., 'example.ac.th' or 'etlr1' or 'etlr2')
       [days]: Optional. The number of days (1-3650) to look back from the current date.
       [Ny]: Optional. The number of years (1y-10y) to look back from the current date.
       [DD-MM-YYYY]: Optional. A specific date to process data for.
 
+Flags:
+  -from string
+        First day of an explicit range as DD-MM-YYYY (local time), given with -to instead of the
+        [days|Ny|yxxxx|DD-MM-YYYY] argument, e.g., -from 05-03-2024 -to 20-03-2024
+  -to string
+        Last day of the -from range as DD-MM-YYYY, included in the range; must not be before -from
+  -strict
+        Exit with a non-zero status instead of writing a report when the query matches nothing
+  -summary
+        Print a table to stderr at the end of the run: top 10 providers by users, the totals and
+        the timings (with -baseline-compare, of the requested window plus the new/returning/churned
+        counts); the JSON report is unchanged
+  -timeout duration
+        HTTP timeout for each Quickwit request (default 30s)
+  -max-idle-conns int
+        Maximum idle keep-alive connections kept to Quickwit (default 10)
+  -max-inflight int
+        Maximum search requests in flight to Quickwit at once across all workers (default 0 = no limit)
+  -slice string
+        Job granularity of the worker pool: day, hour, or auto (hour for windows up to 2 days,
+        day otherwise) (default "day")
+  -sample int
+        Query only every Nth day of the range (all slices of a sampled day with -slice hour) and report
+        estimated_accepts, the hit count extrapolated by days/sampled days; query_info is marked sampled
+        with the rate. User and provider counts cover the sampled days only (default 1 = every day)
+  -sequences
+        Record each user's (day, provider) visits and report provider-to-provider transition counts
+  -busiest-hour
+        Bucket each provider's accepts by hour of day and add busiest_hour (0-23) and busiest_hour_auths
+        to provider_stats (ties go to the earliest hour). Hours are in the local time zone of the machine
+        (set TZ, e.g., TZ=Asia/Bangkok, to change it); query_info.timezone records the zone used
+  -baseline-compare
+        Also query the window of the same length just before the requested one (e.g., the previous 7 days
+        for 7) and write per-user and per-provider active-day deltas with new/returning/churned status
+        instead of the regular report; its manifest covers both windows
+  -group-by-local
+        Key users by the local part of "local@realm", so the same person logged with and without a realm
+        is counted once; each user's realms are listed in user_stats either way (the indexed realm field,
+        which the ingester sets from "from <realm>" even for usernames without @realm, falling back to the
+        @realm of the username for documents indexed without it)
+  -case-insensitive-users
+        Lowercase usernames (and realms) before aggregating, so "alice@ku.ac.th" and "Alice@KU.AC.TH"
+        are one user. Accounts seen with more than one casing are always listed in case_variants
+        (a sign of client misconfiguration), with or without this flag
+  -provider-aliases string
+        File of "variant,canonical" lines (# comments allowed); providers are renamed to their canonical
+        name before aggregation, e.g. "ku.ac.th,eduroam.ku.ac.th". Unlisted providers are kept as is
+  -sort string
+        Order of provider_stats and user_stats as field[:asc|desc], field one of name, users (user_count of
+        provider_stats), providers (provider count of user_stats), e.g., users:desc; direction defaults to asc
+        and ties are ordered by name. An array without the field is ordered by name. Default: providers by
+        user_count descending, users by username
+  -users-only
+        Write only user_stats (with query_info and summary), leaving out provider_stats
+  -providers-only
+        Write only provider_stats (with query_info and summary), leaving out user_stats
+  -out-url string
+        Upload the report to s3://bucket/prefix instead of writing it under output/
+        (S3_ENDPOINT, S3_REGION, S3_ACCESS_KEY and S3_SECRET_KEY are read from qw-auth.properties)
+  -stdout
+        Write the report JSON to stdout instead of a file under output/ (no manifest is written);
+        progress and informational messages go to stderr, so the output can be piped into jq
+  -dump-raw string
+        Write each day-job's raw Quickwit response to <dir>/<start>-<end>.json before it is processed
+        (for debugging aggregation mismatches)
+  -prefer-file
+        When both qw-auth.properties and the QW_USER, QW_PASS or QW_URL environment variables set a value,
+        use the file (by default the environment wins; it is also used when the file is absent)
+  -check
+        Verify Quickwit is reachable and the nro-logs index exists, then exit (0 = OK)
+
+qw-auth.properties may also set QW_CLIENT_CERT and QW_CLIENT_KEY (PEM file paths, both or neither)
+to present a client certificate to a Quickwit deployment that requires mutual TLS.
+Requests follow HTTP_PROXY/HTTPS_PROXY/NO_PROXY from the environment; QW_PROXY (proxy URL) and
+QW_NO_PROXY (comma list of hosts or domains reached directly, "*" for all) override them.
+
 Features:
 - Efficient data aggregation using Quickwit's aggregation queries
 - Optimized concurrent processing with worker pools
@@ -19,6 +95,7 @@ Features:
 - Real-time progress reporting with accurate hit counts
 - Streamlined output format focusing on essential information
 - Enhanced performance through code optimization
+- A <report>.manifest.json with the query, window, hit count and SHA-256 of the report
 
 Changes in version 2.2.0:
 - Added support for year-based time range specification (1y-10y)
@@ -58,6 +135,9 @@ Changes in version 2.0.0:
 - Restructured output to show data by username and service provider 
 - Improved error handling and logging
 
+Build: go build (go.mod pins aws-sdk-go-v2 v1.47.1, credentials v1.20.6, service/s3 v1.113.4,
+used by -out-url; Go 1.24 or later)
+
 Author: [P.Itarun]
 Date: [23 Oct 2024]
 License: [License Information if applicable]
@@ -67,72 +147,403 @@ package main
 
 import (
     "bufio"
+    "bytes"
+    "context"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/tls"
+    "encoding/hex"
     "encoding/json"
+    "errors"
+    "flag"
     "fmt"
     "io"
     "log"
+    "math"
     "net/http"
+    "net/url"
     "os"
+    "path"
+    "path/filepath"
     "sort"
     "strconv"
     "strings"
     "sync"
+    "text/tabwriter"
     "time"
     "sync/atomic"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/credentials"
+    "github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
+// Options holds the command-line options
+type Options struct {
+    Strict          bool
+    Summary         bool
+    From            string
+    To              string
+    Timeout         time.Duration
+    Slice           string
+    MaxIdleConns    int
+    MaxInflight     int
+    Check           bool
+    Sort            string
+    CaseInsensitive bool
+    Sample          int
+    PreferFile      bool
+    DumpRaw         string
+    OutURL          string
+    Stdout          bool
+    Sequences       bool
+    BusiestHour     bool
+    UsersOnly       bool
+    ProvidersOnly   bool
+    GroupByLocal    bool
+    ProviderAliases string
+    BaselineCompare bool
+}
+
+// httpClient is shared by all workers so keep-alive connections are reused
+var httpClient *http.Client
+
+// sortFields lists the keys accepted by -sort
+var sortFields = []string{"name", "users", "providers"}
+
+// SortOrder is a parsed -sort field and direction (zero Field = the default orders)
+type SortOrder struct {
+    Field string
+    Desc  bool
+}
+
+// sortOrder is set from -sort in parseFlags
+var sortOrder SortOrder
+
+// sortItem holds the -sort keys of one provider_stats or user_stats entry
+type sortItem struct {
+    Name      string
+    Users     int
+    Providers int
+}
+
+// less orders a before b by the -sort field and direction; equal counts fall back to name
+func (o SortOrder) less(a, b sortItem) bool {
+    countA, countB := a.Users, b.Users
+    if o.Field == "providers" {
+        countA, countB = a.Providers, b.Providers
+    }
+    if o.Field != "name" && countA != countB {
+        if o.Desc {
+            return countA > countB
+        }
+        return countA < countB
+    }
+    if o.Desc {
+        return a.Name > b.Name
+    }
+    return a.Name < b.Name
+}
+
+// validSortField reports whether field is one of sortFields
+func validSortField(field string) bool {
+    for _, f := range sortFields {
+        if f == field {
+            return true
+        }
+    }
+    return false
+}
+
+// providerAliases maps a lower-cased provider variant to its canonical name (nil = no aliases)
+var providerAliases map[string]string
+
+// inflight limits concurrent search requests to -max-inflight (nil = no limit)
+var inflight chan struct{}
+
+// malformedBuckets counts aggregation buckets dropped because they failed a type assertion;
+// reported at the end of the run
+var malformedBuckets atomic.Int64
+
+// proxyFunc returns the transport Proxy for QW_PROXY/QW_NO_PROXY: requests go through proxyURL
+// ("" = HTTP_PROXY/HTTPS_PROXY/NO_PROXY from the environment) unless the host matches an entry of
+// the comma list noProxy ("*", a host, or a domain with or without a leading dot)
+func proxyFunc(proxyURL, noProxy string) (func(*http.Request) (*url.URL, error), error) {
+    var proxy *url.URL
+    if proxyURL != "" {
+        u, err := url.Parse(proxyURL)
+        if err != nil || u.Host == "" {
+            return nil, fmt.Errorf("invalid proxy URL %q", proxyURL)
+        }
+        proxy = u
+    }
+    var bypass []string
+    for _, host := range strings.Split(noProxy, ",") {
+        if host = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(host), ".")); host != "" {
+            bypass = append(bypass, host)
+        }
+    }
+
+    return func(req *http.Request) (*url.URL, error) {
+        host := strings.ToLower(req.URL.Hostname())
+        for _, domain := range bypass {
+            if domain == "*" || host == domain || strings.HasSuffix(host, "."+domain) {
+                return nil, nil
+            }
+        }
+        if proxy != nil {
+            return proxy, nil
+        }
+        return http.ProxyFromEnvironment(req)
+    }, nil
+}
+
+// newHTTPClient creates the shared Quickwit client with a tuned transport
+// and, when props has QW_CLIENT_CERT/QW_CLIENT_KEY, a client certificate for mutual TLS;
+// the environment proxy settings apply unless QW_PROXY/QW_NO_PROXY override them
+func newHTTPClient(timeout time.Duration, maxIdleConns int, props Properties) (*http.Client, error) {
+    transport := http.DefaultTransport.(*http.Transport).Clone()
+    transport.MaxIdleConns = maxIdleConns
+    transport.MaxIdleConnsPerHost = maxIdleConns
+    transport.IdleConnTimeout = 90 * time.Second
+    if props.ClientCert != "" {
+        cert, err := tls.LoadX509KeyPair(props.ClientCert, props.ClientKey)
+        if err != nil {
+            return nil, fmt.Errorf("error loading client certificate: %v", err)
+        }
+        transport.TLSClientConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+    }
+    if props.Proxy != "" || props.NoProxy != "" {
+        proxy, err := proxyFunc(props.Proxy, props.NoProxy)
+        if err != nil {
+            return nil, err
+        }
+        transport.Proxy = proxy
+    }
+
+    return &http.Client{
+        Timeout:   timeout,
+        Transport: &tracingTransport{base: transport},
+    }, nil
+}
+
+// numWorkers is the number of days queried concurrently
+const numWorkers = 10
+
+// userAgent identifies this tool in Quickwit access logs
+const userAgent = "log2quickwit/eduroam-accept/2.2.0"
+
+// tracingTransport sets the User-Agent and a per-request X-Request-ID on every call
+// made through the shared client, so Quickwit-side load can be traced back to a run
+type tracingTransport struct {
+    base http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    req = req.Clone(req.Context())
+    req.Header.Set("User-Agent", userAgent)
+    if req.Header.Get("X-Request-ID") == "" {
+        req.Header.Set("X-Request-ID", newRequestID())
+    }
+    return t.base.RoundTrip(req)
+}
+
+// newRequestID returns a random UUIDv4 used as X-Request-ID
+func newRequestID() string {
+    var b [16]byte
+    rand.Read(b[:])
+    b[6] = (b[6] & 0x0f) | 0x40
+    b[8] = (b[8] & 0x3f) | 0x80
+    return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+var opts Options
+
 // Properties represents the authentication properties for Quickwit API
 type Properties struct {
-    QWUser string
-    QWPass string
-    QWURL  string
+    QWUser     string
+    QWPass     string
+    QWURL      string
+    ClientCert string // QW_CLIENT_CERT: PEM client certificate สำหรับ mutual TLS
+    ClientKey  string // QW_CLIENT_KEY
+    Proxy      string // QW_PROXY: proxy URL แทน HTTP_PROXY/HTTPS_PROXY
+    NoProxy    string // QW_NO_PROXY: host/domain ที่ต่อตรงไม่ผ่าน proxy
+    S3         S3Config
+}
+
+// S3Config holds the S3-compatible object storage settings used by -out-url
+type S3Config struct {
+    Endpoint  string // e.g., https://minio.example.org (default https://s3.<region>.amazonaws.com)
+    Region    string
+    AccessKey string
+    SecretKey string
 }
 
+// outputS3 is set from qw-auth.properties in main
+var outputS3 S3Config
+
+// reportOut receives the report with -stdout; os.Stdout itself is pointed at stderr
+// so progress and informational prints stay out of the pipe
+var reportOut io.Writer
+
 // LogEntry represents a single log entry from Quickwit search results
 type LogEntry struct {
     Username        string    `json:"username"`
+    Realm           string    `json:"realm,omitempty"`
     ServiceProvider string    `json:"service_provider"`
     Timestamp       time.Time `json:"timestamp"`
+    Hourly          bool      `json:"-"` // bucket รายชั่วโมงของ -busiest-hour: Auths ครั้งในชั่วโมงที่เริ่มที่ Timestamp
+    Auths           int64     `json:"-"`
 }
 
 // UserStats contains statistics for a user
 type UserStats struct {
     Providers map[string]bool
+    Days      map[string]bool // วันที่ active (YYYY-MM-DD)
+    Realms    map[string]bool // realm ที่ index ไว้ หรือจาก "local@realm" เมื่อไม่มี
+    Visits    []Visit         // (day, provider) ที่พบ เฉพาะ -sequences
+}
+
+// Visit is a day on which a user authenticated at a provider
+type Visit struct {
+    Day      time.Time
+    Provider string
+}
+
+// Transition counts users moving from one provider to the next in their visit sequence
+type Transition struct {
+    From  string `json:"from"`
+    To    string `json:"to"`
+    Count int    `json:"count"`
 }
 
 // ProviderStats contains statistics for a service provider
 type ProviderStats struct {
     Users map[string]bool
+    Days  map[string]bool // วันที่มี user ของ domain นี้ active (แม่นยำเมื่อ query daily ราย provider)
+    Hours [24]int64       // accept ต่อชั่วโมงของวัน (local time) เฉพาะ -busiest-hour
 }
 
 // Result holds the aggregated results
 type Result struct {
-    Users     map[string]*UserStats
-    Providers map[string]*ProviderStats
+    Users        map[string]*UserStats
+    Providers    map[string]*ProviderStats
+    CaseVariants map[string]map[string]bool // key: username ตัวพิมพ์เล็ก -> ตัวสะกดที่พบจริง
+}
+
+// CaseVariant is an account logged with more than one username casing
+type CaseVariant struct {
+    Account  string   `json:"account"`
+    Variants []string `json:"variants"`
 }
 
 // SimplifiedOutputData represents the output JSON structure
 type SimplifiedOutputData struct {
+    NoData    bool `json:"no_data,omitempty"`
     QueryInfo struct {
-        Domain    string `json:"domain"`
-        Days      int    `json:"days"`
-        StartDate string `json:"start_date"`
-        EndDate   string `json:"end_date"`
+        Domain       string `json:"domain"`
+        Days         int    `json:"days"`
+        StartDate    string `json:"start_date"`
+        EndDate      string `json:"end_date"`
+        Sequences    bool   `json:"sequences,omitempty"`
+        BusiestHour  bool   `json:"busiest_hour,omitempty"`
+        Timezone     string `json:"timezone,omitempty"`
+        GroupByLocal bool   `json:"group_by_local,omitempty"`
+        CaseInsensitive bool `json:"case_insensitive_users,omitempty"`
+        Sampled      bool   `json:"sampled,omitempty"`
+        SampleRate   int    `json:"sample_rate,omitempty"`
+        SampledDays  int    `json:"sampled_days,omitempty"`
     } `json:"query_info"`
     Description   string `json:"description"`
     Summary       struct {
-        TotalUsers     int `json:"total_users"`
-        TotalProviders int `json:"total_providers"`
+        TotalUsers       int   `json:"total_users"`
+        TotalProviders   int   `json:"total_providers"`
+        EstimatedAccepts int64 `json:"estimated_accepts,omitempty"`
     } `json:"summary"`
     ProviderStats []struct {
         Provider  string   `json:"provider"`
         UserCount int      `json:"user_count"`
         Users     []string `json:"users"`
+        BusiestHour      *int  `json:"busiest_hour,omitempty"`
+        BusiestHourAuths int64 `json:"busiest_hour_auths,omitempty"`
     } `json:"provider_stats"`
     UserStats []struct {
         Username  string   `json:"username"`
+        Realms    []string `json:"realms,omitempty"`
         Providers []string `json:"providers"`
     } `json:"user_stats"`
+    Transitions  []Transition  `json:"transitions,omitempty"`
+    CaseVariants []CaseVariant `json:"case_variants,omitempty"`
+}
+
+// usersOnlyOutput hides provider_stats at marshal time (-users-only)
+type usersOnlyOutput struct {
+    SimplifiedOutputData
+    ProviderStats *struct{} `json:"provider_stats,omitempty"`
+}
+
+// providersOnlyOutput hides user_stats at marshal time (-providers-only)
+type providersOnlyOutput struct {
+    SimplifiedOutputData
+    UserStats *struct{} `json:"user_stats,omitempty"`
+}
+
+// projectOutput returns the value to marshal: the full output or the -users-only/-providers-only projection
+func projectOutput(output SimplifiedOutputData) interface{} {
+    if opts.UsersOnly {
+        return usersOnlyOutput{SimplifiedOutputData: output}
+    }
+    if opts.ProvidersOnly {
+        return providersOnlyOutput{SimplifiedOutputData: output}
+    }
+    return output
+}
+
+// Delta compares a user or provider between the baseline and the current window (-baseline-compare)
+type Delta struct {
+    Key          string `json:"key"`
+    Status       string `json:"status"` // new, returning หรือ churned
+    CurrentDays  int    `json:"current_days"`
+    BaselineDays int    `json:"baseline_days"`
+    DaysDelta    int    `json:"days_delta"`
+}
+
+// ComparisonOutput represents the -baseline-compare output JSON structure
+type ComparisonOutput struct {
+    NoData    bool `json:"no_data,omitempty"`
+    QueryInfo struct {
+        Domain            string `json:"domain"`
+        Days              int    `json:"days"`
+        StartDate         string `json:"start_date"`
+        EndDate           string `json:"end_date"`
+        BaselineStartDate string `json:"baseline_start_date"`
+        BaselineEndDate   string `json:"baseline_end_date"`
+        Sampled           bool   `json:"sampled,omitempty"`
+        SampleRate        int    `json:"sample_rate,omitempty"`
+    } `json:"query_info"`
+    Summary struct {
+        NewUsers           int `json:"new_users"`
+        ReturningUsers     int `json:"returning_users"`
+        ChurnedUsers       int `json:"churned_users"`
+        NewProviders       int `json:"new_providers"`
+        ReturningProviders int `json:"returning_providers"`
+        ChurnedProviders   int `json:"churned_providers"`
+    } `json:"summary"`
+    Users     []Delta `json:"users"`
+    Providers []Delta `json:"providers"`
+}
+
+// Manifest records how a report was produced so it can be traced and verified (<output>.manifest.json)
+type Manifest struct {
+    Tool        string `json:"tool"`
+    Query       string `json:"query"`
+    StartTime   string `json:"start_time"`
+    EndTime     string `json:"end_time"`
+    Workers     int    `json:"workers"`
+    TotalHits   int64  `json:"total_hits"`
+    Output      string `json:"output"`
+    SHA256      string `json:"sha256"`
+    GeneratedAt string `json:"generated_at"`
 }
 
 // Job represents a single day's query job
@@ -141,9 +552,59 @@ type Job struct {
     EndTimestamp   int64
 }
 
-// sendQuickwitRequest handles HTTP communication with Quickwit
+// sendQuickwitRequest sends a search request, retrying up to maxResponseRetries times when the
+// response body is cut short or lacks the keys of a search response (a dropped connection)
 func sendQuickwitRequest(query map[string]interface{}, props Properties) (map[string]interface{}, error) {
-    client := &http.Client{}
+    for attempt := 1; ; attempt++ {
+        result, err := sendQuickwitAttempt(query, props)
+        retryable := errors.Is(err, ErrIncompleteResponse) || errors.Is(err, ErrServerUnavailable)
+        if err == nil || !retryable || attempt > maxResponseRetries {
+            return result, err
+        }
+        log.Printf("Quickwit search failed (attempt %d of %d), retrying: %v", attempt, maxResponseRetries+1, err)
+        time.Sleep(time.Duration(attempt) * time.Second)
+    }
+}
+
+// maxResponseRetries is how many times a search that fails with ErrIncompleteResponse or
+// ErrServerUnavailable is re-requested
+const maxResponseRetries = 3
+
+// Errors returned by the Quickwit requests; sendQuickwitRequest branches on them with errors.Is
+var (
+    ErrQuickwitAuth       = errors.New("quickwit authentication failed")
+    ErrQuickwitQuery      = errors.New("quickwit rejected the query")
+    ErrPayloadTooLarge    = errors.New("quickwit payload too large")
+    ErrServerUnavailable  = errors.New("quickwit unavailable")
+    ErrIncompleteResponse = errors.New("incomplete response")
+)
+
+// statusError wraps a non-200 Quickwit answer in the matching sentinel error:
+// 401/403 auth, 413 payload too large, 429/5xx unavailable, other 4xx query
+func statusError(status int, body []byte) error {
+    var kind error
+    switch {
+    case status == http.StatusUnauthorized || status == http.StatusForbidden:
+        kind = ErrQuickwitAuth
+    case status == http.StatusRequestEntityTooLarge:
+        kind = ErrPayloadTooLarge
+    case status == http.StatusTooManyRequests || status >= 500:
+        kind = ErrServerUnavailable
+    case status >= 400:
+        kind = ErrQuickwitQuery
+    default:
+        return fmt.Errorf("quickwit error (status %d): %s", status, string(body))
+    }
+    return fmt.Errorf("%w (status %d): %s", kind, status, string(body))
+}
+
+// sendQuickwitAttempt sends a search request once; retryable reports an incomplete response
+func sendQuickwitAttempt(query map[string]interface{}, props Properties) (map[string]interface{}, error) {
+    if inflight != nil {
+        inflight <- struct{}{}
+        defer func() { <-inflight }()
+    }
+
     jsonQuery, _ := json.Marshal(query)
     
     // Debug output if needed
@@ -160,36 +621,128 @@ func sendQuickwitRequest(query map[string]interface{}, props Properties) (map[st
     req.Header.Set("Content-Type", "application/json")
     req.Header.Set("Accept", "application/json")
 
-    resp, err := client.Do(req)
+    resp, err := httpClient.Do(req)
     if err != nil {
-        return nil, fmt.Errorf("error sending request: %v", err)
+        return nil, fmt.Errorf("%w: error sending request: %v", ErrServerUnavailable, err)
     }
     defer resp.Body.Close()
 
     bodyBytes, err := io.ReadAll(resp.Body)
     if err != nil {
-        return nil, fmt.Errorf("error reading response: %v", err)
+        return nil, fmt.Errorf("%w: error reading response: %v", ErrIncompleteResponse, err)
     }
 
     if resp.StatusCode != http.StatusOK {
-        return nil, fmt.Errorf("quickwit error (status %d): %s", resp.StatusCode, string(bodyBytes))
+        return nil, statusError(resp.StatusCode, bodyBytes)
     }
 
     var result map[string]interface{}
     if err := json.Unmarshal(bodyBytes, &result); err != nil {
-        return nil, fmt.Errorf("error decoding response: %v", err)
+        return nil, fmt.Errorf("%w: error decoding response (truncated or invalid body): %v", ErrIncompleteResponse, err)
     }
 
     if errorMsg, hasError := result["error"].(string); hasError {
-        return nil, fmt.Errorf("quickwit error: %s", errorMsg)
+        return nil, fmt.Errorf("%w: %s", ErrQuickwitQuery, errorMsg)
+    }
+
+    if err := checkSearchResponse(query, result); err != nil {
+        return nil, err
     }
 
     return result, nil
 }
 
-// readProperties reads the authentication properties from a file
+// checkSearchResponse verifies a decoded search response is complete: num_hits and hits are always
+// present, and aggregations whenever the query asked for aggs
+func checkSearchResponse(query, result map[string]interface{}) error {
+    if _, ok := result["num_hits"].(float64); !ok {
+        return fmt.Errorf("%w: no num_hits", ErrIncompleteResponse)
+    }
+    if _, ok := result["hits"].([]interface{}); !ok {
+        return fmt.Errorf("%w: no hits", ErrIncompleteResponse)
+    }
+    if _, asked := query["aggs"]; asked {
+        if _, ok := result["aggregations"].(map[string]interface{}); !ok {
+            return fmt.Errorf("%w: no aggregations", ErrIncompleteResponse)
+        }
+    }
+    return nil
+}
+
+// checkQuickwit verifies that Quickwit is alive and the nro-logs index exists
+func checkQuickwit(props Properties) error {
+    // livez อยู่หลัง proxy เดียวกับ API ซึ่งอาจบังคับ basic auth ด้วย
+    req, err := http.NewRequest("GET", props.QWURL+"/health/livez", nil)
+    if err != nil {
+        return fmt.Errorf("error creating request: %v", err)
+    }
+    req.SetBasicAuth(props.QWUser, props.QWPass)
+
+    resp, err := httpClient.Do(req)
+    if err != nil {
+        return fmt.Errorf("%w: error connecting to %s: %v", ErrServerUnavailable, props.QWURL, err)
+    }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("%w: health check failed (status %d)", ErrServerUnavailable, resp.StatusCode)
+    }
+
+    req, err = http.NewRequest("GET", props.QWURL+"/api/v1/indexes/nro-logs", nil)
+    if err != nil {
+        return fmt.Errorf("error creating request: %v", err)
+    }
+    req.SetBasicAuth(props.QWUser, props.QWPass)
+
+    resp, err = httpClient.Do(req)
+    if err != nil {
+        return fmt.Errorf("error sending request: %v", err)
+    }
+    defer resp.Body.Close()
+
+    switch resp.StatusCode {
+    case http.StatusOK:
+        return nil
+    case http.StatusUnauthorized, http.StatusForbidden:
+        return fmt.Errorf("%w (status %d): check QW_USER/QW_PASS", ErrQuickwitAuth, resp.StatusCode)
+    case http.StatusNotFound:
+        return fmt.Errorf("%w: index nro-logs not found", ErrQuickwitQuery)
+    default:
+        body, _ := io.ReadAll(resp.Body)
+        return fmt.Errorf("quickwit error (status %d): %s", resp.StatusCode, string(body))
+    }
+}
+
+// runCheck runs checkQuickwit with qw-auth.properties and exits with its result
+func runCheck() {
+    props, err := readProperties("qw-auth.properties")
+    if err != nil {
+        log.Fatalf("Error reading properties: %v", err)
+    }
+    httpClient, err = newHTTPClient(opts.Timeout, opts.MaxIdleConns, props)
+    if err != nil {
+        log.Fatalf("Error creating HTTP client: %v", err)
+    }
+
+    if err := checkQuickwit(props); err != nil {
+        fmt.Printf("Check failed: %v\n", err)
+        os.Exit(1)
+    }
+    fmt.Printf("Check OK: %s is reachable and index nro-logs exists\n", props.QWURL)
+    os.Exit(0)
+}
+
+// readProperties reads the authentication properties from a file, with QW_USER/QW_PASS/QW_URL environment overrides
 func readProperties(filePath string) (Properties, error) {
     file, err := os.Open(filePath)
+    if os.IsNotExist(err) {
+        // ไม่มีไฟล์: ใช้ QW_USER/QW_PASS/QW_URL จาก environment (เช่นใน container)
+        props := Properties{}
+        applyEnvProperties(&props)
+        if props.QWURL == "" {
+            return Properties{}, err
+        }
+        return props, validateProperties(props)
+    }
     if err != nil {
         return Properties{}, err
     }
@@ -211,11 +764,120 @@ func readProperties(filePath string) (Properties, error) {
                     props.QWPass = value
                 case "QW_URL":
                     props.QWURL = strings.TrimPrefix(value, "=")
+                case "QW_CLIENT_CERT":
+                    props.ClientCert = value
+                case "QW_CLIENT_KEY":
+                    props.ClientKey = value
+                case "QW_PROXY":
+                    props.Proxy = value
+                case "QW_NO_PROXY":
+                    props.NoProxy = value
+                case "S3_ENDPOINT":
+                    props.S3.Endpoint = strings.TrimSuffix(value, "/")
+                case "S3_REGION":
+                    props.S3.Region = value
+                case "S3_ACCESS_KEY":
+                    props.S3.AccessKey = value
+                case "S3_SECRET_KEY":
+                    props.S3.SecretKey = value
                 }
             }
         }
     }
-    return props, scanner.Err()
+    if err := scanner.Err(); err != nil {
+        return props, err
+    }
+    if (props.ClientCert == "") != (props.ClientKey == "") {
+        return props, fmt.Errorf("QW_CLIENT_CERT and QW_CLIENT_KEY must be set together")
+    }
+    applyEnvProperties(&props)
+    return props, validateProperties(props)
+}
+
+// validateProperties reports the Quickwit settings left empty by both qw-auth.properties and the
+// environment, so a missing key fails here instead of as a 401 from Quickwit
+func validateProperties(props Properties) error {
+    var missing []string
+    for _, field := range []struct {
+        name  string
+        value string
+    }{
+        {"QW_USER", props.QWUser},
+        {"QW_PASS", props.QWPass},
+        {"QW_URL", props.QWURL},
+    } {
+        if field.value == "" {
+            missing = append(missing, field.name)
+        }
+    }
+    if len(missing) > 0 {
+        return fmt.Errorf("missing required settings in qw-auth.properties (or the environment): %s", strings.Join(missing, ", "))
+    }
+    return nil
+}
+
+// applyEnvProperties fills QWUser/QWPass/QWURL from the QW_USER/QW_PASS/QW_URL environment
+// variables; a set variable overrides the file unless -prefer-file is given
+func applyEnvProperties(props *Properties) {
+    for _, field := range []struct {
+        name  string
+        value *string
+    }{
+        {"QW_USER", &props.QWUser},
+        {"QW_PASS", &props.QWPass},
+        {"QW_URL", &props.QWURL},
+    } {
+        if value := os.Getenv(field.name); value != "" && (*field.value == "" || !opts.PreferFile) {
+            *field.value = value
+        }
+    }
+}
+
+// loadProviderAliases reads "variant,canonical" lines; blank lines and '#' comments are skipped
+func loadProviderAliases(filePath string) (map[string]string, error) {
+    file, err := os.Open(filePath)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    aliases := make(map[string]string)
+    scanner := bufio.NewScanner(file)
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+
+        parts := strings.SplitN(line, ",", 2)
+        if len(parts) != 2 {
+            return nil, fmt.Errorf("invalid alias line %q: use variant,canonical", line)
+        }
+        variant, canonical := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+        if variant == "" || canonical == "" {
+            return nil, fmt.Errorf("invalid alias line %q: use variant,canonical", line)
+        }
+        aliases[strings.ToLower(variant)] = canonical
+    }
+
+    return aliases, scanner.Err()
+}
+
+// canonicalProvider returns the -provider-aliases name of provider, or provider itself if unlisted
+func canonicalProvider(provider string) string {
+    if canonical, ok := providerAliases[strings.ToLower(provider)]; ok {
+        return canonical
+    }
+    return provider
+}
+
+// splitUsername splits "local@realm" at the last '@'; a username without '@' has no realm
+func splitUsername(username string) (string, string) {
+    index := strings.LastIndex(username, "@")
+    if index == -1 {
+        return username, ""
+    }
+    return username[:index], username[index+1:]
 }
 
 // getDomain returns the full domain name based on the input
@@ -229,6 +891,133 @@ func getDomain(input string) string {
     return fmt.Sprintf("eduroam.%s", input)
 }
 
+// autoHourlyDays is the longest window (in days) that -slice auto splits per hour
+const autoHourlyDays = 2
+
+// sliceDuration returns the length of one job for -slice; the daily histograms are
+// fixed at 86400s so hour slices still produce per-day buckets
+func sliceDuration(days int) (time.Duration, string) {
+    if opts.Slice == "hour" || (opts.Slice == "auto" && days <= autoHourlyDays) {
+        return time.Hour, "hours"
+    }
+    return 24 * time.Hour, "days"
+}
+
+// sampledDay reports whether the day containing slice start t is queried under -sample N
+// (every Nth day counted from startDate)
+func sampledDay(startDate, t time.Time) bool {
+    return int(t.Sub(startDate)/(24*time.Hour))%opts.Sample == 0
+}
+
+// sampleCoverage returns how many days of [startDate, endDate) -sample queries and the
+// factor that extrapolates their totals to the whole range (1 when not sampling)
+func sampleCoverage(startDate, endDate time.Time) (int, float64) {
+    total := int((endDate.Sub(startDate) + 24*time.Hour - 1) / (24 * time.Hour))
+    sampled := (total + opts.Sample - 1) / opts.Sample
+    if sampled == 0 {
+        return 0, 1
+    }
+    return sampled, float64(total) / float64(sampled)
+}
+
+// collectResult runs the worker pool for query over [startDate, endDate], one job per
+// -slice (day or hour), and returns the aggregated result with the total number of hits
+func collectResult(query map[string]interface{}, props Properties, startDate, endDate time.Time, days int) (*Result, int64) {
+    resultChan := make(chan LogEntry, 10000)
+    errChan := make(chan error, 1)
+    var totalHits atomic.Int64
+    var mu sync.Mutex
+    var wg sync.WaitGroup
+
+    step, unit := sliceDuration(days)
+    var jobList []Job
+    currentDate := startDate
+    for currentDate.Before(endDate) {
+        nextDate := currentDate.Add(step)
+        if nextDate.After(endDate) {
+            nextDate = endDate
+        }
+        if sampledDay(startDate, currentDate) {
+            jobList = append(jobList, Job{
+                StartTimestamp: currentDate.Unix(),
+                EndTimestamp:   nextDate.Unix(),
+            })
+        }
+        currentDate = nextDate
+    }
+    totalJobs := len(jobList)
+    jobs := make(chan Job, totalJobs)
+
+    var processedJobs int32
+
+    result := &Result{
+        Users:        make(map[string]*UserStats),
+        Providers:    make(map[string]*ProviderStats),
+        CaseVariants: make(map[string]map[string]bool),
+    }
+
+    // Start worker pool
+    for w := 1; w <= numWorkers; w++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for job := range jobs {
+                hits, err := worker(job, resultChan, query, props)
+                if err != nil {
+                    select {
+                    case errChan <- err:
+                    default:
+                    }
+                    return
+                }
+                totalHits.Add(hits)
+                current := atomic.AddInt32(&processedJobs, 1)
+                fmt.Printf("\rProgress: %d/%d %s processed, Progress hits: %d", 
+                    current, totalJobs, unit, totalHits.Load())
+            }
+        }()
+    }
+
+    processDone := make(chan struct{})
+    go func() {
+        processResults(resultChan, result, &mu)
+        close(processDone)
+    }()
+
+    for _, job := range jobList {
+        jobs <- job
+    }
+    close(jobs)
+
+    wg.Wait()
+    close(resultChan)
+
+    <-processDone
+
+    select {
+    case err := <-errChan:
+        if err != nil {
+            log.Fatalf("Error occurred: %v", err)
+        }
+    default:
+    }
+
+    return result, totalHits.Load()
+}
+
+// dumpRawResponse writes a job's raw Quickwit response to -dump-raw/<start>-<end>.json
+func dumpRawResponse(job Job, result map[string]interface{}) error {
+    data, err := json.MarshalIndent(result, "", "  ")
+    if err != nil {
+        return fmt.Errorf("error marshaling raw response: %v", err)
+    }
+    name := filepath.Join(opts.DumpRaw, fmt.Sprintf("%d-%d.json", job.StartTimestamp, job.EndTimestamp))
+    if err := os.WriteFile(name, data, 0644); err != nil {
+        return fmt.Errorf("error writing raw response: %v", err)
+    }
+    return nil
+}
+
 // worker processes a single job
 func worker(job Job, resultChan chan<- LogEntry, query map[string]interface{}, props Properties) (int64, error) {
     currentQuery := map[string]interface{}{
@@ -243,10 +1032,11 @@ func worker(job Job, resultChan chan<- LogEntry, query map[string]interface{}, p
                     "size": 10000,
                 },
                 "aggs": map[string]interface{}{
-                    "providers": map[string]interface{}{
+                    "providers": providersAgg(),
+                    "realms": map[string]interface{}{
                         "terms": map[string]interface{}{
-                            "field": "service_provider",
-                            "size": 1000,
+                            "field": "realm",
+                            "size": 10,
                         },
                     },
                     "daily": map[string]interface{}{
@@ -264,22 +1054,66 @@ func worker(job Job, resultChan chan<- LogEntry, query map[string]interface{}, p
     if err != nil {
         return 0, err
     }
+    if opts.DumpRaw != "" {
+        if err := dumpRawResponse(job, result); err != nil {
+            return 0, err
+        }
+    }
 
     return processAggregations(result, resultChan)
 }
 
-// processAggregations processes the aggregation results
-func processAggregations(result map[string]interface{}, resultChan chan<- LogEntry) (int64, error) {
-    aggs, ok := result["aggregations"].(map[string]interface{})
-    if !ok {
-        return 0, fmt.Errorf("no aggregations in response")
-    }
+// perProviderDaily reports whether daily histograms are queried per provider
+// (-sequences and -baseline-compare need provider-accurate days)
+func perProviderDaily() bool {
+    return opts.Sequences || opts.BaselineCompare
+}
 
-    uniqueUsers, ok := aggs["unique_users"].(map[string]interface{})
-    if !ok {
-        return 0, fmt.Errorf("no unique_users aggregation")
+// providersAgg builds the per-user provider terms aggregation; with -sequences each
+// provider gets its own daily histogram so visits are attributed to the right provider
+func providersAgg() map[string]interface{} {
+    agg := map[string]interface{}{
+        "terms": map[string]interface{}{
+            "field": "service_provider",
+            "size": 1000,
+        },
     }
-
+    subAggs := map[string]interface{}{}
+    if perProviderDaily() {
+        subAggs["daily"] = map[string]interface{}{
+            "date_histogram": map[string]interface{}{
+                "field": "timestamp",
+                "fixed_interval": "86400s",
+            },
+        }
+    }
+    // -busiest-hour: bucket รายชั่วโมงต่อ provider แปลงเป็นชั่วโมงของวันตอน processResults
+    if opts.BusiestHour {
+        subAggs["hourly"] = map[string]interface{}{
+            "date_histogram": map[string]interface{}{
+                "field": "timestamp",
+                "fixed_interval": "3600s",
+            },
+        }
+    }
+    if len(subAggs) > 0 {
+        agg["aggs"] = subAggs
+    }
+    return agg
+}
+
+// processAggregations processes the aggregation results
+func processAggregations(result map[string]interface{}, resultChan chan<- LogEntry) (int64, error) {
+    aggs, ok := result["aggregations"].(map[string]interface{})
+    if !ok {
+        return 0, fmt.Errorf("no aggregations in response")
+    }
+
+    uniqueUsers, ok := aggs["unique_users"].(map[string]interface{})
+    if !ok {
+        return 0, fmt.Errorf("no unique_users aggregation")
+    }
+
     buckets, ok := uniqueUsers["buckets"].([]interface{})
     if !ok {
         return 0, fmt.Errorf("no buckets in unique_users aggregation")
@@ -289,12 +1123,21 @@ func processAggregations(result map[string]interface{}, resultChan chan<- LogEnt
     for _, bucketInterface := range buckets {
         bucket, ok := bucketInterface.(map[string]interface{})
         if !ok {
+            malformedBuckets.Add(1)
             continue
         }
 
-        username := bucket["key"].(string)
-        docCount := int64(bucket["doc_count"].(float64))
-        totalHits += docCount
+        username, ok := bucket["key"].(string)
+        if !ok {
+            malformedBuckets.Add(1)
+            continue
+        }
+        docCount, ok := bucket["doc_count"].(float64)
+        if !ok {
+            malformedBuckets.Add(1)
+            continue
+        }
+        totalHits += int64(docCount)
 
         processUserBucket(bucket, username, resultChan)
     }
@@ -304,33 +1147,80 @@ func processAggregations(result map[string]interface{}, resultChan chan<- LogEnt
 
 // processUserBucket processes a single user bucket from aggregations
 func processUserBucket(bucket map[string]interface{}, username string, resultChan chan<- LogEntry) {
+    realm := indexedRealm(bucket)
     if providersAgg, ok := bucket["providers"].(map[string]interface{}); ok {
         if providerBuckets, ok := providersAgg["buckets"].([]interface{}); ok {
             for _, providerBucketInterface := range providerBuckets {
                 providerBucket, ok := providerBucketInterface.(map[string]interface{})
                 if !ok {
+                    malformedBuckets.Add(1)
                     continue
                 }
-                provider := providerBucket["key"].(string)
-                processUserProviderDaily(bucket, username, provider, resultChan)
+                provider, ok := providerBucket["key"].(string)
+                if !ok {
+                    malformedBuckets.Add(1)
+                    continue
+                }
+                if perProviderDaily() {
+                    processUserProviderDaily(providerBucket, username, realm, provider, resultChan)
+                } else {
+                    processUserProviderDaily(bucket, username, realm, provider, resultChan)
+                }
+                if opts.BusiestHour {
+                    processUserProviderHourly(providerBucket, username, provider, resultChan)
+                }
             }
         }
     }
 }
 
+// indexedRealm returns the first realm bucket of a user bucket: the realm field the ingester
+// sets from "from <realm>", which is present even when the username has no @realm ("" if absent)
+func indexedRealm(bucket map[string]interface{}) string {
+    realms, ok := bucket["realms"].(map[string]interface{})
+    if !ok {
+        return ""
+    }
+    realmBuckets, ok := realms["buckets"].([]interface{})
+    if !ok || len(realmBuckets) == 0 {
+        return ""
+    }
+    realmBucket, ok := realmBuckets[0].(map[string]interface{})
+    if !ok {
+        return ""
+    }
+    realm, _ := realmBucket["key"].(string)
+    return realm
+}
+
 // processUserProviderDaily processes daily activities for a user and provider
-func processUserProviderDaily(bucket map[string]interface{}, username, provider string, resultChan chan<- LogEntry) {
+func processUserProviderDaily(bucket map[string]interface{}, username, realm, provider string, resultChan chan<- LogEntry) {
     if dailyAgg, ok := bucket["daily"].(map[string]interface{}); ok {
         if dailyBuckets, ok := dailyAgg["buckets"].([]interface{}); ok {
             for _, dailyBucketInterface := range dailyBuckets {
                 dailyBucket, ok := dailyBucketInterface.(map[string]interface{})
-                if !ok || dailyBucket["doc_count"].(float64) == 0 {
+                if !ok {
+                    malformedBuckets.Add(1)
+                    continue
+                }
+                docCount, ok := dailyBucket["doc_count"].(float64)
+                if !ok {
+                    malformedBuckets.Add(1)
+                    continue
+                }
+                if docCount == 0 {
+                    continue
+                }
+                key, ok := dailyBucket["key"].(float64)
+                if !ok {
+                    malformedBuckets.Add(1)
                     continue
                 }
 
-                timestamp := time.Unix(int64(dailyBucket["key"].(float64)/1000), 0)
+                timestamp := time.Unix(int64(key/1000), 0)
                 resultChan <- LogEntry{
                     Username:        username,
+                    Realm:           realm,
                     ServiceProvider: provider,
                     Timestamp:      timestamp,
                 }
@@ -339,25 +1229,143 @@ func processUserProviderDaily(bucket map[string]interface{}, username, provider
     }
 }
 
+// processUserProviderHourly sends the hourly accept counts of a user at a provider (-busiest-hour)
+func processUserProviderHourly(bucket map[string]interface{}, username, provider string, resultChan chan<- LogEntry) {
+    hourlyAgg, ok := bucket["hourly"].(map[string]interface{})
+    if !ok {
+        return
+    }
+    hourlyBuckets, ok := hourlyAgg["buckets"].([]interface{})
+    if !ok {
+        return
+    }
+    for _, hourlyBucketInterface := range hourlyBuckets {
+        hourlyBucket, ok := hourlyBucketInterface.(map[string]interface{})
+        if !ok {
+            malformedBuckets.Add(1)
+            continue
+        }
+        docCount, ok := hourlyBucket["doc_count"].(float64)
+        if !ok {
+            malformedBuckets.Add(1)
+            continue
+        }
+        if docCount == 0 {
+            continue
+        }
+        key, ok := hourlyBucket["key"].(float64)
+        if !ok {
+            malformedBuckets.Add(1)
+            continue
+        }
+
+        resultChan <- LogEntry{
+            Username:        username,
+            ServiceProvider: provider,
+            Timestamp:       time.Unix(int64(key/1000), 0),
+            Hourly:          true,
+            Auths:           int64(docCount),
+        }
+    }
+}
+
 // processResults processes the search results and updates the result struct
 func processResults(resultChan <-chan LogEntry, result *Result, mu *sync.Mutex) {
     userMap := make(map[string]map[string]bool)
+    visitMap := make(map[string][]Visit)
+    dayMap := make(map[string]map[string]bool)
+    providerDays := make(map[string]map[string]bool)
+    realmMap := make(map[string]map[string]bool)
+    casings := make(map[string]map[string]bool)
+    providerHours := make(map[string]*[24]int64)
     for entry := range resultChan {
-        if _, exists := userMap[entry.Username]; !exists {
-            userMap[entry.Username] = make(map[string]bool)
+        // bucket รายชั่วโมงนับแยก ไม่ใช่วันที่ active ของ user
+        if entry.Hourly {
+            provider := canonicalProvider(entry.ServiceProvider)
+            if providerHours[provider] == nil {
+                providerHours[provider] = &[24]int64{}
+            }
+            providerHours[provider][entry.Timestamp.Local().Hour()] += entry.Auths
+            continue
+        }
+
+        account := strings.ToLower(entry.Username)
+        if _, exists := casings[account]; !exists {
+            casings[account] = make(map[string]bool)
+        }
+        casings[account][entry.Username] = true
+
+        // -case-insensitive-users: รวม "Alice@KU.AC.TH" กับ "alice@ku.ac.th"
+        username := entry.Username
+        if opts.CaseInsensitive {
+            username = account
+        }
+        // -group-by-local: ใช้ local-part เป็น key เพื่อรวม "user" กับ "user@realm"
+        local, realm := splitUsername(username)
+        // realm ที่ index ไว้ (จาก "from <realm>") มาก่อน ส่วนที่ตัดจาก username เป็นเพียง fallback
+        if entry.Realm != "" {
+            realm = entry.Realm
+            if opts.CaseInsensitive {
+                realm = strings.ToLower(realm)
+            }
+        }
+        if opts.GroupByLocal {
+            username = local
+        }
+        provider := canonicalProvider(entry.ServiceProvider)
+        if _, exists := userMap[username]; !exists {
+            userMap[username] = make(map[string]bool)
+            dayMap[username] = make(map[string]bool)
+            realmMap[username] = make(map[string]bool)
+        }
+        if realm != "" {
+            realmMap[username][realm] = true
+        }
+        userMap[username][provider] = true
+
+        day := entry.Timestamp.Format("2006-01-02")
+        dayMap[username][day] = true
+        if _, exists := providerDays[provider]; !exists {
+            providerDays[provider] = make(map[string]bool)
+        }
+        providerDays[provider][day] = true
+
+        if opts.Sequences {
+            visitMap[username] = append(visitMap[username], Visit{
+                Day:      entry.Timestamp,
+                Provider: provider,
+            })
         }
-        userMap[entry.Username][entry.ServiceProvider] = true
     }
 
     mu.Lock()
     defer mu.Unlock()
 
+    for account, variants := range casings {
+        if _, exists := result.CaseVariants[account]; !exists {
+            result.CaseVariants[account] = make(map[string]bool)
+        }
+        for variant := range variants {
+            result.CaseVariants[account][variant] = true
+        }
+    }
+
     for username, providers := range userMap {
         if _, exists := result.Users[username]; !exists {
             result.Users[username] = &UserStats{
                 Providers: make(map[string]bool),
+                Days:      make(map[string]bool),
+                Realms:    make(map[string]bool),
             }
         }
+        for realm := range realmMap[username] {
+            result.Users[username].Realms[realm] = true
+        }
+
+        result.Users[username].Visits = append(result.Users[username].Visits, visitMap[username]...)
+        for day := range dayMap[username] {
+            result.Users[username].Days[day] = true
+        }
 
         for provider := range providers {
             result.Users[username].Providers[provider] = true
@@ -365,11 +1373,48 @@ func processResults(resultChan <-chan LogEntry, result *Result, mu *sync.Mutex)
             if _, exists := result.Providers[provider]; !exists {
                 result.Providers[provider] = &ProviderStats{
                     Users: make(map[string]bool),
+                    Days:  make(map[string]bool),
                 }
             }
             result.Providers[provider].Users[username] = true
         }
     }
+
+    for provider, days := range providerDays {
+        for day := range days {
+            result.Providers[provider].Days[day] = true
+        }
+    }
+
+    for provider, hours := range providerHours {
+        stats, exists := result.Providers[provider]
+        if !exists {
+            continue
+        }
+        for hour, count := range hours {
+            stats.Hours[hour] += count
+        }
+    }
+}
+
+// caseVariants lists the accounts seen with more than one username casing, sorted by account
+func caseVariants(result *Result) []CaseVariant {
+    var variants []CaseVariant
+    for account, spellings := range result.CaseVariants {
+        if len(spellings) < 2 {
+            continue
+        }
+        list := make([]string, 0, len(spellings))
+        for spelling := range spellings {
+            list = append(list, spelling)
+        }
+        sort.Strings(list)
+        variants = append(variants, CaseVariant{Account: account, Variants: list})
+    }
+    sort.Slice(variants, func(i, j int) bool {
+        return variants[i].Account < variants[j].Account
+    })
+    return variants
 }
 
 // createOutputData creates the output JSON structure
@@ -379,6 +1424,13 @@ func createOutputData(result *Result, domain string, startDate, endDate time.Tim
     output.QueryInfo.Days = days
     output.QueryInfo.StartDate = startDate.Format("2006-01-02 15:04:05")
     output.QueryInfo.EndDate = endDate.Format("2006-01-02 15:04:05")
+    output.QueryInfo.Sequences = opts.Sequences
+    output.QueryInfo.BusiestHour = opts.BusiestHour
+    if opts.BusiestHour {
+        output.QueryInfo.Timezone, _ = time.Now().Zone()
+    }
+    output.QueryInfo.GroupByLocal = opts.GroupByLocal
+    output.QueryInfo.CaseInsensitive = opts.CaseInsensitive
     output.Description = "Aggregated Access-Accept events for the specified domain and time range."
 
     output.Summary.TotalUsers = len(result.Users)
@@ -389,6 +1441,8 @@ func createOutputData(result *Result, domain string, startDate, endDate time.Tim
         Provider  string   `json:"provider"`
         UserCount int      `json:"user_count"`
         Users     []string `json:"users"`
+        BusiestHour      *int  `json:"busiest_hour,omitempty"`
+        BusiestHourAuths int64 `json:"busiest_hour_auths,omitempty"`
     }, 0, len(result.Providers))
 
     for provider, stats := range result.Providers {
@@ -396,25 +1450,41 @@ func createOutputData(result *Result, domain string, startDate, endDate time.Tim
         for user := range stats.Users {
             users = append(users, user)
         }
+        sort.Strings(users)
         output.ProviderStats = append(output.ProviderStats, struct {
             Provider  string   `json:"provider"`
             UserCount int      `json:"user_count"`
             Users     []string `json:"users"`
+            BusiestHour      *int  `json:"busiest_hour,omitempty"`
+            BusiestHourAuths int64 `json:"busiest_hour_auths,omitempty"`
         }{
             Provider:  provider,
             UserCount: len(users),
             Users:     users,
         })
+        if opts.BusiestHour {
+            last := &output.ProviderStats[len(output.ProviderStats)-1]
+            last.BusiestHour, last.BusiestHourAuths = busiestHour(stats)
+        }
     }
 
-    // Sort provider stats by number of users
+    // Sort provider stats by number of users (หรือตาม -sort)
     sort.Slice(output.ProviderStats, func(i, j int) bool {
-        return output.ProviderStats[i].UserCount > output.ProviderStats[j].UserCount
+        if sortOrder.Field != "" {
+            return sortOrder.less(
+                sortItem{Name: output.ProviderStats[i].Provider, Users: output.ProviderStats[i].UserCount},
+                sortItem{Name: output.ProviderStats[j].Provider, Users: output.ProviderStats[j].UserCount})
+        }
+        if output.ProviderStats[i].UserCount != output.ProviderStats[j].UserCount {
+            return output.ProviderStats[i].UserCount > output.ProviderStats[j].UserCount
+        }
+        return output.ProviderStats[i].Provider < output.ProviderStats[j].Provider
     })
 
     // Process user stats
     output.UserStats = make([]struct {
         Username  string   `json:"username"`
+        Realms    []string `json:"realms,omitempty"`
         Providers []string `json:"providers"`
     }, 0, len(result.Users))
 
@@ -423,41 +1493,380 @@ func createOutputData(result *Result, domain string, startDate, endDate time.Tim
         for provider := range stats.Providers {
             providers = append(providers, provider)
         }
+        sort.Strings(providers)
+        realms := make([]string, 0, len(stats.Realms))
+        for realm := range stats.Realms {
+            realms = append(realms, realm)
+        }
+        sort.Strings(realms)
         output.UserStats = append(output.UserStats, struct {
             Username  string   `json:"username"`
+            Realms    []string `json:"realms,omitempty"`
             Providers []string `json:"providers"`
         }{
             Username:  username,
+            Realms:    realms,
             Providers: providers,
         })
     }
 
-    // Sort user stats by username
+    // Sort user stats by username (หรือตาม -sort)
     sort.Slice(output.UserStats, func(i, j int) bool {
+        if sortOrder.Field != "" {
+            return sortOrder.less(
+                sortItem{Name: output.UserStats[i].Username, Providers: len(output.UserStats[i].Providers)},
+                sortItem{Name: output.UserStats[j].Username, Providers: len(output.UserStats[j].Providers)})
+        }
         return output.UserStats[i].Username < output.UserStats[j].Username
     })
 
+    if opts.Sequences {
+        output.Transitions = buildTransitions(result)
+    }
+    output.CaseVariants = caseVariants(result)
+
     return output
 }
 
+// busiestHour returns the hour of day (local time) with the most accepts at a provider and
+// its count, the earliest hour on a tie, or nil when the provider has no hourly accepts
+func busiestHour(stats *ProviderStats) (*int, int64) {
+    best := -1
+    for hour, count := range stats.Hours {
+        if count > 0 && (best < 0 || count > stats.Hours[best]) {
+            best = hour
+        }
+    }
+    if best < 0 {
+        return nil, 0
+    }
+    return &best, stats.Hours[best]
+}
+
+// buildTransitions orders each user's visits by day and counts the distinct provider-to-provider moves
+// providers on the same day are ordered by name since the daily histogram cannot tell them apart
+func buildTransitions(result *Result) []Transition {
+    counts := make(map[[2]string]int)
+    for _, stats := range result.Users {
+        sort.Slice(stats.Visits, func(i, j int) bool {
+            if !stats.Visits[i].Day.Equal(stats.Visits[j].Day) {
+                return stats.Visits[i].Day.Before(stats.Visits[j].Day)
+            }
+            return stats.Visits[i].Provider < stats.Visits[j].Provider
+        })
+
+        for i := 1; i < len(stats.Visits); i++ {
+            from, to := stats.Visits[i-1].Provider, stats.Visits[i].Provider
+            if from != to {
+                counts[[2]string{from, to}]++
+            }
+        }
+    }
+
+    transitions := make([]Transition, 0, len(counts))
+    for pair, count := range counts {
+        transitions = append(transitions, Transition{From: pair[0], To: pair[1], Count: count})
+    }
+
+    // Sort transitions by count (descending), then by pair
+    sort.Slice(transitions, func(i, j int) bool {
+        if transitions[i].Count != transitions[j].Count {
+            return transitions[i].Count > transitions[j].Count
+        }
+        if transitions[i].From != transitions[j].From {
+            return transitions[i].From < transitions[j].From
+        }
+        return transitions[i].To < transitions[j].To
+    })
+
+    return transitions
+}
+
+// warnNoData prints a prominent warning when the query matched no documents
+func warnNoData(domain string, startDate, endDate time.Time) {
+    fmt.Println("WARNING: the query matched no Access-Accept events.")
+    fmt.Printf("  realm: %s\n", getDomain(domain))
+    fmt.Printf("  range: %s to %s\n", startDate.Format("2006-01-02"), endDate.Format("2006-01-02"))
+    fmt.Println("  Common causes:")
+    fmt.Println("    - wrong domain (pass it without the 'eduroam.' prefix, e.g. 'ku.ac.th')")
+    fmt.Println("    - a date range in the future or before data was indexed")
+    fmt.Println("    - the nro-logs index name or QW_URL in qw-auth.properties")
+}
+
+// writeManifest writes <output>.manifest.json next to the report with the query parameters
+// and the SHA-256 of the report bytes
+func writeManifest(filename string, data []byte, queryString string, startDate, endDate time.Time, workers int, totalHits int64) error {
+    // -stdout: ไม่มีไฟล์ report ให้วาง manifest ไว้ข้างๆ
+    if opts.Stdout {
+        return nil
+    }
+    manifest := Manifest{
+        Tool:        userAgent,
+        Query:       queryString,
+        StartTime:   startDate.Format(time.RFC3339),
+        EndTime:     endDate.Format(time.RFC3339),
+        Workers:     workers,
+        TotalHits:   totalHits,
+        Output:      outputLocation(filename),
+        SHA256:      sha256Hex(data),
+        GeneratedAt: time.Now().Format(time.RFC3339),
+    }
+
+    manifestData, err := json.MarshalIndent(manifest, "", "  ")
+    if err != nil {
+        return fmt.Errorf("error marshaling manifest: %v", err)
+    }
+    return writeOutput(strings.TrimSuffix(filename, ".json")+".manifest.json", manifestData)
+}
+
+// writeFileAtomic writes data to name through a temporary file and a rename, so a reader
+// (or a run killed mid-write) never sees a truncated file
+func writeFileAtomic(name string, data []byte) error {
+    tmp := name + ".tmp"
+    if err := os.WriteFile(tmp, data, 0644); err != nil {
+        return err
+    }
+    return os.Rename(tmp, name)
+}
+
+// writeOutput writes a report to its local path under output/ (atomically), to stdout with -stdout,
+// or uploads it when -out-url is s3://
+func writeOutput(name string, data []byte) error {
+    if opts.Stdout {
+        _, err := reportOut.Write(append(data, '\n'))
+        return err
+    }
+    if opts.OutURL == "" {
+        if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+            return fmt.Errorf("error creating output directory: %v", err)
+        }
+        return writeFileAtomic(name, data)
+    }
+
+    u, _ := url.Parse(opts.OutURL)
+    return putS3Object(outputS3, u.Host, s3Key(name), data)
+}
+
+// outputLocation returns where writeOutput stores name
+func outputLocation(name string) string {
+    if opts.Stdout {
+        return "stdout"
+    }
+    if opts.OutURL == "" {
+        return name
+    }
+    u, _ := url.Parse(opts.OutURL)
+    return fmt.Sprintf("s3://%s/%s", u.Host, s3Key(name))
+}
+
+// s3Key maps a local output path (output/<dir>/<file>) to a key under the -out-url prefix
+func s3Key(name string) string {
+    u, _ := url.Parse(opts.OutURL)
+    return strings.TrimPrefix(path.Join(u.Path, strings.TrimPrefix(filepath.ToSlash(name), "output/")), "/")
+}
+
+// putS3Object uploads data with the AWS SDK; path-style addressing and S3_ENDPOINT make it work with
+// S3-compatible stores such as MinIO as well as AWS S3
+// (the SDK's own HTTP client is used: the proxy, client certificate and timeout of httpClient are Quickwit's)
+func putS3Object(cfg S3Config, bucket, key string, data []byte) error {
+    if cfg.Region == "" {
+        cfg.Region = "us-east-1"
+    }
+    if cfg.AccessKey == "" || cfg.SecretKey == "" {
+        return fmt.Errorf("S3_ACCESS_KEY and S3_SECRET_KEY must be set in qw-auth.properties")
+    }
+
+    client := s3.New(s3.Options{
+        Region:       cfg.Region,
+        Credentials:  credentials.NewStaticCredentialsProvider(cfg.AccessKey, cfg.SecretKey, ""),
+        UsePathStyle: true,
+    }, func(o *s3.Options) {
+        if cfg.Endpoint != "" {
+            o.BaseEndpoint = aws.String(cfg.Endpoint)
+        }
+    })
+
+    contentType := "application/json"
+    if strings.HasSuffix(key, ".csv") {
+        contentType = "text/csv"
+    }
+    _, err := client.PutObject(context.Background(), &s3.PutObjectInput{
+        Bucket:      aws.String(bucket),
+        Key:         aws.String(key),
+        Body:        bytes.NewReader(data),
+        ContentType: aws.String(contentType),
+    })
+    if err != nil {
+        return fmt.Errorf("error uploading to S3: %v", err)
+    }
+    return nil
+}
+
+func sha256Hex(data []byte) string {
+    sum := sha256.Sum256(data)
+    return hex.EncodeToString(sum[:])
+}
+
+// parseDateRange parses -from/-to (DD-MM-YYYY, both days included) into the local start
+// and end of the range and its number of days
+func parseDateRange(from, to string) (time.Time, time.Time, int, error) {
+    first, err := time.Parse("02-01-2006", from)
+    if err != nil {
+        return time.Time{}, time.Time{}, 0, fmt.Errorf("invalid -from %q: use DD-MM-YYYY", from)
+    }
+    last, err := time.Parse("02-01-2006", to)
+    if err != nil {
+        return time.Time{}, time.Time{}, 0, fmt.Errorf("invalid -to %q: use DD-MM-YYYY", to)
+    }
+    if last.Before(first) {
+        return time.Time{}, time.Time{}, 0, fmt.Errorf("-from %s is after -to %s", from, to)
+    }
+    days := int(last.Sub(first).Hours()/24) + 1
+    startDate := time.Date(first.Year(), first.Month(), first.Day(), 0, 0, 0, 0, time.Local)
+    endDate := time.Date(last.Year(), last.Month(), last.Day(), 23, 59, 59, 999999999, time.Local)
+    return startDate, endDate, days, nil
+}
+
+// usage prints the command-line help
+func usage() {
+    fmt.Println("Usage: ./eduroam-accept [flags] <domain> [days|Ny|yxxxx|DD-MM-YYYY]")
+    fmt.Println("  domain: domain name (e.g., 'ku.ac.th', 'etlr1')")
+    fmt.Println("  days: number of days (1-3650)")
+    fmt.Println("  Ny: number of years (1y-10y)")
+    fmt.Println("  yxxxx: specific year (e.g., y2024)")
+    fmt.Println("  DD-MM-YYYY: specific date")
+    fmt.Println("  or -from DD-MM-YYYY -to DD-MM-YYYY instead of the argument: explicit range, both days included")
+    fmt.Println("Flags:")
+    flag.PrintDefaults()
+}
+
+// parseFlags registers and parses the command-line flags into opts
+func parseFlags() []string {
+    flag.BoolVar(&opts.Strict, "strict", false, "exit non-zero instead of writing a report when nothing matched")
+    flag.BoolVar(&opts.Summary, "summary", false, "print a top-10/totals/timing table to stderr at the end of the run")
+    flag.StringVar(&opts.From, "from", "", "first day (DD-MM-YYYY) of an explicit range, with -to")
+    flag.StringVar(&opts.To, "to", "", "last day (DD-MM-YYYY, included) of the -from range")
+    flag.DurationVar(&opts.Timeout, "timeout", 30*time.Second, "HTTP timeout for each Quickwit request")
+    flag.IntVar(&opts.MaxIdleConns, "max-idle-conns", 10, "maximum idle keep-alive connections kept to Quickwit")
+    flag.IntVar(&opts.MaxInflight, "max-inflight", 0, "maximum search requests in flight to Quickwit at once (0 = no limit)")
+    flag.StringVar(&opts.Slice, "slice", "day", "job granularity: day, hour or auto")
+    flag.IntVar(&opts.Sample, "sample", 1, "query every Nth day and extrapolate totals (1 = every day)")
+    flag.BoolVar(&opts.Sequences, "sequences", false, "report provider-to-provider transitions per user over time")
+    flag.BoolVar(&opts.BusiestHour, "busiest-hour", false, "report each provider's busiest hour of day (local time) and its accept count")
+    flag.BoolVar(&opts.BaselineCompare, "baseline-compare", false, "compare with the window of the same length just before and report new/returning/churned")
+    flag.BoolVar(&opts.GroupByLocal, "group-by-local", false, "count users by the local part, merging \"user\" and \"user@realm\"")
+    flag.BoolVar(&opts.CaseInsensitive, "case-insensitive-users", false, "lowercase usernames and realms before aggregating")
+    flag.StringVar(&opts.ProviderAliases, "provider-aliases", "", "file of \"variant,canonical\" lines merging provider name variants")
+    flag.StringVar(&opts.Sort, "sort", "", "order output arrays by field[:asc|desc]: name, users or providers")
+    flag.BoolVar(&opts.UsersOnly, "users-only", false, "write only user_stats (plus query_info and summary)")
+    flag.BoolVar(&opts.ProvidersOnly, "providers-only", false, "write only provider_stats (plus query_info and summary)")
+    flag.StringVar(&opts.OutURL, "out-url", "", "upload the report to s3://bucket/prefix instead of output/")
+    flag.BoolVar(&opts.Stdout, "stdout", false, "write the report to stdout (messages go to stderr) instead of output/")
+    flag.StringVar(&opts.DumpRaw, "dump-raw", "", "write each day-job's raw Quickwit response to this directory")
+    flag.BoolVar(&opts.PreferFile, "prefer-file", false, "let qw-auth.properties win over QW_USER/QW_PASS/QW_URL environment variables")
+    flag.BoolVar(&opts.Check, "check", false, "verify Quickwit connectivity and the nro-logs index, then exit")
+    flag.Usage = usage
+    flag.Parse()
+
+    if opts.OutURL != "" {
+        u, err := url.Parse(opts.OutURL)
+        if err != nil || u.Scheme != "s3" || u.Host == "" {
+            log.Fatalf("Invalid out-url %q. Use s3://bucket/prefix", opts.OutURL)
+        }
+    }
+
+    if opts.UsersOnly && opts.ProvidersOnly {
+        log.Fatalf("-users-only and -providers-only cannot be combined")
+    }
+    if opts.BaselineCompare && (opts.UsersOnly || opts.ProvidersOnly) {
+        log.Fatalf("-baseline-compare cannot be combined with -users-only or -providers-only")
+    }
+    if (opts.From == "") != (opts.To == "") {
+        log.Fatalf("-from and -to must be given together")
+    }
+    if opts.Timeout <= 0 {
+        log.Fatalf("Invalid timeout. Must be greater than 0")
+    }
+    if opts.MaxIdleConns < 1 {
+        log.Fatalf("Invalid max idle connections. Must be 1 or greater")
+    }
+    if opts.MaxInflight < 0 {
+        log.Fatalf("Invalid max inflight. Must be 0 or greater")
+    }
+    if opts.MaxInflight > 0 {
+        inflight = make(chan struct{}, opts.MaxInflight)
+    }
+    if opts.Slice != "day" && opts.Slice != "hour" && opts.Slice != "auto" {
+        log.Fatalf("Invalid slice %q. Use day, hour or auto", opts.Slice)
+    }
+    if opts.Sample < 1 {
+        log.Fatalf("Invalid sample. Must be 1 or greater")
+    }
+    if opts.Sort != "" {
+        field, direction, _ := strings.Cut(opts.Sort, ":")
+        if !validSortField(field) {
+            log.Fatalf("Invalid sort field %q. Use %s", field, strings.Join(sortFields, ", "))
+        }
+        if direction != "" && direction != "asc" && direction != "desc" {
+            log.Fatalf("Invalid sort direction %q. Use asc or desc", direction)
+        }
+        sortOrder = SortOrder{Field: field, Desc: direction == "desc"}
+    }
+
+    if opts.Stdout {
+        if opts.OutURL != "" {
+            log.Fatalf("-stdout cannot be combined with -out-url")
+        }
+        reportOut = os.Stdout
+        os.Stdout = os.Stderr
+    }
+
+    if opts.DumpRaw != "" {
+        if err := os.MkdirAll(opts.DumpRaw, 0755); err != nil {
+            log.Fatalf("Error creating dump-raw directory: %v", err)
+        }
+    }
+
+    if opts.ProviderAliases != "" {
+        aliases, err := loadProviderAliases(opts.ProviderAliases)
+        if err != nil {
+            log.Fatalf("Error reading provider aliases: %v", err)
+        }
+        providerAliases = aliases
+    }
+
+    return flag.Args()
+}
+
 func main() {
-    if len(os.Args) < 2 || len(os.Args) > 3 {
-        fmt.Println("Usage: ./eduroam-idp <domain> [days|Ny|yxxxx|DD-MM-YYYY]")
-        fmt.Println("  domain: domain name (e.g., 'ku.ac.th', 'etlr1')")
-        fmt.Println("  days: number of days (1-3650)")
-        fmt.Println("  Ny: number of years (1y-10y)")
-        fmt.Println("  yxxxx: specific year (e.g., y2024)")
-        fmt.Println("  DD-MM-YYYY: specific date")
+    args := parseFlags()
+    if opts.Check {
+        runCheck()
+    }
+    if len(args) < 1 || len(args) > 2 {
+        usage()
         os.Exit(1)
     }
 
-    domain := os.Args[1]
+    domain := args[0]
     var startDate, endDate time.Time
     var days int
     var specificDate bool
 
-    if len(os.Args) == 3 {
-        param := os.Args[2]
+    if opts.From != "" {
+        if len(args) == 2 {
+            log.Fatalf("-from/-to replace the [days|Ny|yxxxx|DD-MM-YYYY] argument; do not pass both")
+        }
+        var err error
+        startDate, endDate, days, err = parseDateRange(opts.From, opts.To)
+        if err != nil {
+            log.Fatalf("Invalid date range: %v", err)
+        }
+        if days > 3650 {
+            log.Fatalf("Invalid date range. Must be at most 3650 days")
+        }
+    } else if len(args) == 2 {
+        param := args[1]
         
         // เพิ่มการตรวจสอบรูปแบบ yxxxx สำหรับปี
         if strings.HasPrefix(param, "y") && len(param) == 5 {
@@ -523,6 +1932,12 @@ func main() {
     if err != nil {
         log.Fatalf("Error reading properties: %v", err)
     }
+    httpClient, err = newHTTPClient(opts.Timeout, opts.MaxIdleConns, props)
+    if err != nil {
+        log.Fatalf("Error creating HTTP client: %v", err)
+    }
+    defer httpClient.CloseIdleConnections()
+    outputS3 = props.S3
 
     if specificDate {
         fmt.Printf("Searching for date: %s\n", startDate.Format("2006-01-02"))
@@ -537,119 +1952,284 @@ func main() {
         "max_hits":        10000,
     }
 
-    resultChan := make(chan LogEntry, 10000)
-    errChan := make(chan error, 1)
-    var totalHits atomic.Int64
-    var mu sync.Mutex
-    var wg sync.WaitGroup
+    queryStart := time.Now()
+    result, totalHits := collectResult(query, props, startDate, endDate, days)
 
-    jobs := make(chan Job, days)
-    numWorkers := 10
+    if opts.BaselineCompare {
+        runBaselineCompare(query, props, result, totalHits, domain, startDate, endDate, days, specificDate, args, queryStart)
+        return
+    }
 
-    var processedDays int32
-    queryStart := time.Now()
+    queryDuration := time.Since(queryStart)
 
-    result := &Result{
-        Users:     make(map[string]*UserStats),
-        Providers: make(map[string]*ProviderStats),
+    fmt.Printf("\n")
+    noData := totalHits == 0
+    if noData {
+        warnNoData(domain, startDate, endDate)
+        if opts.Strict {
+            os.Exit(2)
+        }
+    }
+    fmt.Printf("Number of users: %d\n", len(result.Users))
+    fmt.Printf("Number of providers: %d\n", len(result.Providers))
+    if variants := caseVariants(result); len(variants) > 0 {
+        fmt.Printf("Accounts seen with multiple casings: %d\n", len(variants))
+    }
+    if skipped := malformedBuckets.Load(); skipped > 0 {
+        fmt.Printf("Skipped %d malformed buckets\n", skipped)
     }
 
-    // Start worker pool
-    for w := 1; w <= numWorkers; w++ {
-        wg.Add(1)
-        go func() {
-            defer wg.Done()
-            for job := range jobs {
-                hits, err := worker(job, resultChan, query, props)
-                if err != nil {
-                    select {
-                    case errChan <- err:
-                    default:
-                    }
-                    return
-                }
-                totalHits.Add(hits)
-                current := atomic.AddInt32(&processedDays, 1)
-                fmt.Printf("\rProgress: %d/%d days processed, Progress hits: %d", 
-                    current, days, totalHits.Load())
-            }
-        }()
+    processStart := time.Now()
+    outputData := createOutputData(result, domain, startDate, endDate, days)
+    outputData.NoData = noData
+    if opts.Sample > 1 {
+        sampledDays, scale := sampleCoverage(startDate, endDate)
+        outputData.QueryInfo.Sampled = true
+        outputData.QueryInfo.SampleRate = opts.Sample
+        outputData.QueryInfo.SampledDays = sampledDays
+        outputData.Summary.EstimatedAccepts = int64(math.Round(float64(totalHits) * scale))
+        fmt.Printf("Estimated accepts (%d of %d days queried): %d\n", sampledDays, days, outputData.Summary.EstimatedAccepts)
     }
+    processDuration := time.Since(processStart)
 
-    processDone := make(chan struct{})
-    go func() {
-        processResults(resultChan, result, &mu)
-        close(processDone)
-    }()
+    outputDir := fmt.Sprintf("output/%s", strings.Replace(domain, ".", "-", -1))
 
-    currentDate := startDate
-    for currentDate.Before(endDate) {
-        nextDate := currentDate.Add(24 * time.Hour)
-        if nextDate.After(endDate) {
-            nextDate = endDate
-        }
-        jobs <- Job{
-            StartTimestamp: currentDate.Unix(),
-            EndTimestamp:   nextDate.Unix(),
-        }
-        currentDate = nextDate
+    currentTime := time.Now().Format("20060102-150405")
+    var filename string
+    if specificDate {
+        filename = fmt.Sprintf("%s/%s-%s.json", outputDir, currentTime, startDate.Format("20060102"))
+    } else if len(args) > 1 && strings.HasPrefix(args[1], "y") && len(args[1]) == 5 {
+        // กรณี yxxxx
+        year := args[1][1:] // ตัด y ออกเหลือแค่ปี
+        filename = fmt.Sprintf("%s/%s-%s.json", outputDir, currentTime, year)
+    } else if opts.From != "" {
+        filename = fmt.Sprintf("%s/%s-%s-%s.json", outputDir, currentTime, startDate.Format("20060102"), endDate.Format("20060102"))
+    } else {
+        filename = fmt.Sprintf("%s/%s-%dd.json", outputDir, currentTime, days)
     }
-    close(jobs)
 
-    wg.Wait()
-    close(resultChan)
+    jsonData, err := json.MarshalIndent(projectOutput(outputData), "", "  ")
+    if err != nil {
+        log.Fatalf("Error marshaling JSON: %v", err)
+    }
 
-    <-processDone
+    if err := writeOutput(filename, jsonData); err != nil {
+        log.Fatalf("Error writing output: %v", err)
+    }
+    if err := writeManifest(filename, jsonData, query["query"].(string), startDate, endDate, numWorkers, totalHits); err != nil {
+        log.Fatalf("Error writing manifest: %v", err)
+    }
 
-    select {
-    case err := <-errChan:
-        if err != nil {
-            log.Fatalf("Error occurred: %v", err)
+    fmt.Printf("Results have been saved to %s\n", outputLocation(filename))
+    fmt.Printf("Time taken:\n")
+    fmt.Printf("  Quickwit query: %v\n", queryDuration)
+    fmt.Printf("  Local processing: %v\n", processDuration)
+    fmt.Printf("  Overall: %v\n", time.Since(queryStart))
+    if opts.Summary {
+        printSummary(outputData, totalHits, queryDuration, processDuration, time.Since(queryStart))
+    }
+}
+
+// summaryTopN คือจำนวน provider ที่แสดงในตาราง -summary
+const summaryTopN = 10
+
+// printSummary writes the -summary table to stderr: top providers by users, the totals and the
+// timings. It only reads the report, so the JSON stays as written.
+func printSummary(output SimplifiedOutputData, totalHits int64, queryDuration, processDuration, overall time.Duration) {
+    type row struct {
+        provider string
+        users    int
+    }
+    rows := make([]row, 0, len(output.ProviderStats))
+    for _, p := range output.ProviderStats {
+        rows = append(rows, row{p.Provider, p.UserCount})
+    }
+    sort.SliceStable(rows, func(i, j int) bool { return rows[i].users > rows[j].users })
+
+    w := tabwriter.NewWriter(os.Stderr, 0, 0, 2, ' ', 0)
+    fmt.Fprintf(w, "\nSummary: %s, %s to %s\n", output.QueryInfo.Domain,
+        output.QueryInfo.StartDate, output.QueryInfo.EndDate)
+    fmt.Fprintln(w, "PROVIDER\tUSERS")
+    for i, r := range rows {
+        if i == summaryTopN {
+            break
         }
-    default:
+        fmt.Fprintf(w, "%s\t%d\n", r.provider, r.users)
     }
 
+    fmt.Fprintln(w)
+    fmt.Fprintf(w, "Total accepts\t%d\n", totalHits)
+    if output.Summary.EstimatedAccepts > 0 {
+        fmt.Fprintf(w, "Estimated accepts\t%d\n", output.Summary.EstimatedAccepts)
+    }
+    fmt.Fprintf(w, "Total users\t%d\n", output.Summary.TotalUsers)
+    fmt.Fprintf(w, "Total providers\t%d\n", output.Summary.TotalProviders)
+    fmt.Fprintf(w, "Quickwit query\t%v\n", queryDuration.Round(time.Millisecond))
+    fmt.Fprintf(w, "Local processing\t%v\n", processDuration.Round(time.Millisecond))
+    fmt.Fprintf(w, "Overall\t%v\n", overall.Round(time.Millisecond))
+    w.Flush()
+}
+
+// runBaselineCompare queries the window of the same length just before startDate and
+// writes the new/returning/churned comparison instead of the regular report
+func runBaselineCompare(query map[string]interface{}, props Properties, current *Result, currentHits int64, domain string, startDate, endDate time.Time, days int, specificDate bool, args []string, queryStart time.Time) {
+    baselineStart := startDate.AddDate(0, 0, -days)
+    baselineEnd := startDate.Add(-time.Nanosecond)
+    fmt.Printf("\nQuerying baseline from %s to %s\n", baselineStart.Format("2006-01-02"), baselineEnd.Format("2006-01-02"))
+    baseline, baselineHits := collectResult(query, props, baselineStart, baselineEnd, days)
     queryDuration := time.Since(queryStart)
 
     fmt.Printf("\n")
-    fmt.Printf("Number of users: %d\n", len(result.Users))
-    fmt.Printf("Number of providers: %d\n", len(result.Providers))
+    noData := currentHits == 0 && baselineHits == 0
+    if noData {
+        warnNoData(domain, baselineStart, endDate)
+        if opts.Strict {
+            os.Exit(2)
+        }
+    }
 
     processStart := time.Now()
-    outputData := createOutputData(result, domain, startDate, endDate, days)
+    output := createComparisonOutput(current, baseline, domain, startDate, endDate, baselineStart, baselineEnd, days)
+    output.NoData = noData
     processDuration := time.Since(processStart)
-
-    outputDir := fmt.Sprintf("output/%s", strings.Replace(domain, ".", "-", -1))
-    if err := os.MkdirAll(outputDir, 0755); err != nil {
-        log.Fatalf("Error creating output directory: %v", err)
+    fmt.Printf("Users: %d new, %d returning, %d churned\n",
+        output.Summary.NewUsers, output.Summary.ReturningUsers, output.Summary.ChurnedUsers)
+    fmt.Printf("Providers: %d new, %d returning, %d churned\n",
+        output.Summary.NewProviders, output.Summary.ReturningProviders, output.Summary.ChurnedProviders)
+    if skipped := malformedBuckets.Load(); skipped > 0 {
+        fmt.Printf("Skipped %d malformed buckets\n", skipped)
     }
 
+    outputDir := fmt.Sprintf("output/%s", strings.Replace(domain, ".", "-", -1))
     currentTime := time.Now().Format("20060102-150405")
     var filename string
     if specificDate {
-        filename = fmt.Sprintf("%s/%s-%s.json", outputDir, currentTime, startDate.Format("20060102"))
-    } else if len(os.Args) > 2 && strings.HasPrefix(os.Args[2], "y") && len(os.Args[2]) == 5 {
-        // กรณี yxxxx
-        year := os.Args[2][1:] // ตัด y ออกเหลือแค่ปี
-        filename = fmt.Sprintf("%s/%s-%s.json", outputDir, currentTime, year)
+        filename = fmt.Sprintf("%s/%s-%s-compare.json", outputDir, currentTime, startDate.Format("20060102"))
+    } else if len(args) > 1 && strings.HasPrefix(args[1], "y") && len(args[1]) == 5 {
+        filename = fmt.Sprintf("%s/%s-%s-compare.json", outputDir, currentTime, args[1][1:])
+    } else if opts.From != "" {
+        filename = fmt.Sprintf("%s/%s-%s-%s-compare.json", outputDir, currentTime, startDate.Format("20060102"), endDate.Format("20060102"))
     } else {
-        filename = fmt.Sprintf("%s/%s-%dd.json", outputDir, currentTime, days)
+        filename = fmt.Sprintf("%s/%s-%dd-compare.json", outputDir, currentTime, days)
     }
 
-    jsonData, err := json.MarshalIndent(outputData, "", "  ")
+    jsonData, err := json.MarshalIndent(output, "", "  ")
     if err != nil {
         log.Fatalf("Error marshaling JSON: %v", err)
     }
-
-    if err := os.WriteFile(filename, jsonData, 0644); err != nil {
-        log.Fatalf("Error writing file: %v", err)
+    if err := writeOutput(filename, jsonData); err != nil {
+        log.Fatalf("Error writing output: %v", err)
+    }
+    // manifest ครอบทั้งช่วง baseline และช่วงปัจจุบันที่ถูก query
+    if err := writeManifest(filename, jsonData, query["query"].(string), baselineStart, endDate, numWorkers, currentHits+baselineHits); err != nil {
+        log.Fatalf("Error writing manifest: %v", err)
     }
 
-    fmt.Printf("Results have been saved to %s\n", filename)
+    fmt.Printf("Results have been saved to %s\n", outputLocation(filename))
     fmt.Printf("Time taken:\n")
     fmt.Printf("  Quickwit query: %v\n", queryDuration)
     fmt.Printf("  Local processing: %v\n", processDuration)
     fmt.Printf("  Overall: %v\n", time.Since(queryStart))
+    if opts.Summary {
+        printSummary(createOutputData(current, domain, startDate, endDate, days), currentHits,
+            queryDuration, processDuration, time.Since(queryStart))
+        printCompareSummary(output)
+    }
+}
+
+// printCompareSummary adds the new/returning/churned counts of -baseline-compare to the -summary table
+func printCompareSummary(output ComparisonOutput) {
+    w := tabwriter.NewWriter(os.Stderr, 0, 0, 2, ' ', 0)
+    fmt.Fprintf(w, "\nBaseline: %s to %s\n", output.QueryInfo.BaselineStartDate, output.QueryInfo.BaselineEndDate)
+    fmt.Fprintln(w, "\tNEW\tRETURNING\tCHURNED")
+    fmt.Fprintf(w, "Users\t%d\t%d\t%d\n", output.Summary.NewUsers, output.Summary.ReturningUsers, output.Summary.ChurnedUsers)
+    fmt.Fprintf(w, "Providers\t%d\t%d\t%d\n", output.Summary.NewProviders, output.Summary.ReturningProviders, output.Summary.ChurnedProviders)
+    w.Flush()
+}
+
+// compareDays builds the per-key deltas between two day-sets; a key only in current is
+// new, in both is returning, only in baseline is churned. Returns the deltas and the status counts.
+func compareDays(current, baseline map[string]map[string]bool) ([]Delta, map[string]int) {
+    counts := make(map[string]int)
+    deltas := make([]Delta, 0, len(current)+len(baseline))
+    for key, days := range current {
+        status := "new"
+        if _, exists := baseline[key]; exists {
+            status = "returning"
+        }
+        deltas = append(deltas, Delta{
+            Key:          key,
+            Status:       status,
+            CurrentDays:  len(days),
+            BaselineDays: len(baseline[key]),
+            DaysDelta:    len(days) - len(baseline[key]),
+        })
+        counts[status]++
+    }
+    for key, days := range baseline {
+        if _, exists := current[key]; exists {
+            continue
+        }
+        deltas = append(deltas, Delta{
+            Key:          key,
+            Status:       "churned",
+            BaselineDays: len(days),
+            DaysDelta:    -len(days),
+        })
+        counts["churned"]++
+    }
+
+    // Sort by days_delta (ascending, largest drops first), then by key
+    sort.Slice(deltas, func(i, j int) bool {
+        if deltas[i].DaysDelta != deltas[j].DaysDelta {
+            return deltas[i].DaysDelta < deltas[j].DaysDelta
+        }
+        return deltas[i].Key < deltas[j].Key
+    })
+    return deltas, counts
+}
+
+// createComparisonOutput compares the current window with the baseline window
+func createComparisonOutput(current, baseline *Result, domain string, startDate, endDate, baselineStart, baselineEnd time.Time, days int) ComparisonOutput {
+    output := ComparisonOutput{}
+    output.QueryInfo.Domain = domain
+    output.QueryInfo.Days = days
+    output.QueryInfo.StartDate = startDate.Format("2006-01-02 15:04:05")
+    output.QueryInfo.EndDate = endDate.Format("2006-01-02 15:04:05")
+    output.QueryInfo.BaselineStartDate = baselineStart.Format("2006-01-02 15:04:05")
+    output.QueryInfo.BaselineEndDate = baselineEnd.Format("2006-01-02 15:04:05")
+    if opts.Sample > 1 {
+        output.QueryInfo.Sampled = true
+        output.QueryInfo.SampleRate = opts.Sample
+    }
+
+    userDays := func(result *Result) map[string]map[string]bool {
+        days := make(map[string]map[string]bool, len(result.Users))
+        for username, stats := range result.Users {
+            days[username] = stats.Days
+        }
+        return days
+    }
+    providerDays := func(result *Result) map[string]map[string]bool {
+        days := make(map[string]map[string]bool, len(result.Providers))
+        for provider, stats := range result.Providers {
+            days[provider] = stats.Days
+        }
+        return days
+    }
+
+    var counts map[string]int
+    output.Users, counts = compareDays(userDays(current), userDays(baseline))
+    output.Summary.NewUsers = counts["new"]
+    output.Summary.ReturningUsers = counts["returning"]
+    output.Summary.ChurnedUsers = counts["churned"]
+
+    output.Providers, counts = compareDays(providerDays(current), providerDays(baseline))
+    output.Summary.NewProviders = counts["new"]
+    output.Summary.ReturningProviders = counts["returning"]
+    output.Summary.ChurnedProviders = counts["churned"]
+
+    return output
 }
 
 // เพิ่มฟังก์ชันสำหรับตรวจสอบปีอธิกสุรทิน
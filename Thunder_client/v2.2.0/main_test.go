@@ -0,0 +1,75 @@
+package main
+
+import (
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestIndexedRealm(t *testing.T) {
+    tests := []struct {
+        name   string
+        bucket map[string]interface{}
+        realm  string
+    }{
+        {"first realm bucket", map[string]interface{}{"realms": map[string]interface{}{"buckets": []interface{}{
+            map[string]interface{}{"key": "ku.ac.th", "doc_count": float64(3)},
+            map[string]interface{}{"key": "cmu.ac.th", "doc_count": float64(1)},
+        }}}, "ku.ac.th"},
+        {"no realms agg", map[string]interface{}{}, ""},
+        {"no realm buckets", map[string]interface{}{"realms": map[string]interface{}{"buckets": []interface{}{}}}, ""},
+        {"malformed bucket", map[string]interface{}{"realms": map[string]interface{}{"buckets": []interface{}{"ku.ac.th"}}}, ""},
+    }
+    for _, tt := range tests {
+        if got := indexedRealm(tt.bucket); got != tt.realm {
+            t.Errorf("%s: indexedRealm = %q, want %q", tt.name, got, tt.realm)
+        }
+    }
+}
+
+func TestProcessResultsRealmFallback(t *testing.T) {
+    day := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+    tests := []struct {
+        name            string
+        username        string
+        realm           string // realm ที่ index ไว้ใน entry
+        caseInsensitive bool
+        user            string
+        realms          []string
+    }{
+        {"indexed realm without @", "john", "ku.ac.th", false, "john", []string{"ku.ac.th"}},
+        {"fallback to @realm", "john@cmu.ac.th", "", false, "john@cmu.ac.th", []string{"cmu.ac.th"}},
+        {"indexed realm wins", "john@cmu.ac.th", "ku.ac.th", false, "john@cmu.ac.th", []string{"ku.ac.th"}},
+        {"no realm anywhere", "john", "", false, "john", nil},
+        {"indexed realm lowercased", "Alice@KU.AC.TH", "KU.AC.TH", true, "alice@ku.ac.th", []string{"ku.ac.th"}},
+    }
+    for _, tt := range tests {
+        opts.CaseInsensitive = tt.caseInsensitive
+        result := &Result{
+            Users:        make(map[string]*UserStats),
+            Providers:    make(map[string]*ProviderStats),
+            CaseVariants: make(map[string]map[string]bool),
+        }
+        resultChan := make(chan LogEntry, 1)
+        resultChan <- LogEntry{Username: tt.username, Realm: tt.realm, ServiceProvider: "eduroam.ku.ac.th", Timestamp: day}
+        close(resultChan)
+        var mu sync.Mutex
+        processResults(resultChan, result, &mu)
+
+        stats := result.Users[tt.user]
+        if stats == nil {
+            t.Errorf("%s: user %q missing from result", tt.name, tt.user)
+            continue
+        }
+        if len(stats.Realms) != len(tt.realms) {
+            t.Errorf("%s: realms = %v, want %v", tt.name, stats.Realms, tt.realms)
+            continue
+        }
+        for _, realm := range tt.realms {
+            if !stats.Realms[realm] {
+                t.Errorf("%s: realms = %v, want %v", tt.name, stats.Realms, tt.realms)
+            }
+        }
+    }
+    opts.CaseInsensitive = false
+}
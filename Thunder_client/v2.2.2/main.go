@@ -12,13 +12,210 @@ Major changes in v2.2.2:
 5. Improved aggregation queries to handle device-centric analysis
 6. Added summary statistics for unique devices and their usage 
 
-Usage: ./eduroam-sp <service_provider> [days|Ny|yxxxx|DD-MM-YYYY]
-      <service_provider>: The service provider to search for (e.g., 'eduroam.ku.ac.th')
+Each station report is written with a <report>.manifest.json holding the query, window, worker
+count, total hits and the SHA-256 of the report, so a report can be traced and verified.
+
+Each day-job also asks Quickwit for the cardinality of username. The station report lists it per day in
+user_cardinality next to the distinct usernames its terms buckets returned (capped by -station-size and
+-user-size); days where the estimate is more than 10% higher are counted in summary.undercounted_days
+and reported with a warning.
+
+Usage: ./eduroam-sp [flags] <service_provider> [days|Ny|yxxxx|DD-MM-YYYY]
+      <service_provider>: The service provider to search for (e.g., 'eduroam.ku.ac.th'),
+                          or 'all' (or omitted) for a per-provider rollup of the whole NRO; a lone range
+                          argument (e.g., './eduroam-sp 7') is the range of the rollup, not a provider
       [days]: Optional. The number of days (1-3650) to look back from the current date.
       [Ny]: Optional. The number of years (1y-10y) to look back from the current date.
       [yxxxx]: Optional. Specific year (e.g., y2024)
       [DD-MM-YYYY]: Optional. A specific date to process data for.
 
+       ./eduroam-sp [flags] merge <report.json> <report.json>...
+      Combines station reports written per provider (or all-providers reports) into one all-providers
+      report under output/all/, without querying Quickwit: each input becomes an entry of providers and
+      the summary counts stations, users and realms once across providers. Users can only be deduplicated
+      from user_details, so reports written with -no-details or without details in -fields make the
+      unique counts lower bounds (a warning is printed).
+
+Flags:
+  -buffer int
+        Size of the result channel buffer between workers and processResults (default 10000)
+  -baseline-days int
+        Number of days before the start date used to find already-known station_ids (0 = disabled)
+  -acct-sessions
+        Build session_analysis from Accounting-Request records joined by acct_session_id (start from
+        Accounting-Start or Stop minus Acct-Session-Time, end at the last record) instead of the 15-minute
+        auth-gap heuristic; stations without accounting data keep the heuristic
+  -follow duration
+        Re-run the station query every interval over the trailing -follow-window and stream each report
+        to stdout as one NDJSON line until interrupted (e.g., -follow 1m)
+  -follow-window duration
+        Trailing window queried by -follow, up to 24h (default: the -follow interval)
+  -interval string
+        date_histogram fixed_interval for auth timestamps: 1m, 5m, 15m or 1h (default "1m")
+  -from string
+        First day of an explicit range as DD-MM-YYYY (local time), given with -to instead of the
+        [days|Ny|yxxxx|DD-MM-YYYY] argument, e.g., -from 05-03-2024 -to 20-03-2024
+  -to string
+        Last day of the -from range as DD-MM-YYYY, included in the range; must not be before -from
+  -strict
+        Exit with a non-zero status instead of writing a report when the query matches nothing
+  -oui-file string
+        OUI vendor list (IEEE oui.txt or "AABBCC,Vendor" lines) used to set a vendor per station
+  -exclude-randomized
+        Drop stations whose MAC has the locally-administered bit set (randomized MACs of modern phones)
+        from the station, realm and unique counts; how many were dropped is reported in the summary as
+        excluded_randomized_stations
+  -quiet-hours string
+        Quiet hours as HH-HH (e.g., 00-05); auths inside are reported as overnight activity
+  -quiet-threshold int
+        Overnight auths a station may have before an overnight_activity issue is raised (default 0)
+  -business-hours string
+        Business hours as HH-HH (e.g., 08-18, end hour exclusive); each station gets business_hours_ratio,
+        the fraction of its auths inside them (0-1, also for a station with a single auth). Hours are in
+        the local time zone of the machine, like -quiet-hours (set TZ, e.g., TZ=Asia/Bangkok, to change it)
+  -max-identities int
+        Raise a many_identities issue for stations seen with more than this many distinct usernames
+        in the window, a shared-device or MAC-spoofing signal (default 10, 0 = disabled)
+  -max-realms int
+        Raise a many_realms issue for stations whose users came from more than this many distinct home
+        realms over the whole window (each station reports distinct_realms); a MAC reused across
+        institutions on different days is a spoofing signal the per-window username count can miss
+        (default 3, 0 = disabled)
+  -station-size int
+        Maximum station_id buckets per day-job (per provider with all) (default 1000)
+  -user-size int
+        Maximum username buckets per station and day-job (default 100)
+  -realm-size int
+        Maximum realm buckets per user; the first realm is reported (default 10)
+        Quickwit drops the buckets beyond these sizes; the documents they held (sum_other_doc_count)
+        are counted and a warning is printed at the end of the run so the size can be raised
+  -no-details
+        Skip per-user details and pattern/session/issue analysis; emit counts and the top stations only
+  -top int
+        Number of stations kept in station_stats with -no-details (default 10)
+  -timeout duration
+        HTTP timeout for each Quickwit request (default 30s)
+  -max-idle-conns int
+        Maximum idle keep-alive connections kept to Quickwit (default 10)
+  -max-inflight int
+        Maximum search requests in flight to Quickwit at once across all workers (default 0 = no limit)
+  -max-days int
+        Refuse date ranges longer than this many days unless -force is given (default 400)
+  -force
+        Run ranges longer than -max-days
+  -out-url string
+        Upload the report to s3://bucket/prefix instead of writing it under output/
+        (S3_ENDPOINT, S3_REGION, S3_ACCESS_KEY and S3_SECRET_KEY are read from qw-auth.properties)
+  -stdout
+        Write the report JSON to stdout instead of a file under output/ (no manifest is written);
+        progress and informational messages go to stderr, so the output can be piped into jq
+  -summary
+        Print a table to stderr at the end of the station report: top 10 stations by auths (providers
+        with "all"), the totals and the timings; the JSON report is unchanged
+  -user string
+        Build the auth timeline of a single username (e.g., user@ku.ac.th) instead of the station report;
+        the service_provider argument may then be omitted (e.g., ./eduroam-sp -user user@ku.ac.th 30)
+  -dest-ip
+        Report auths per destination_ip (the ETLR/proxy each request went to) instead of the station report
+  -cidr string
+        With -dest-ip, group destinations by subnet: IPv4 prefix, optionally followed by an IPv6 prefix
+        (e.g., 24 or 24,64; default per address)
+  -append string
+        Merge this run into a rolling JSON file keyed by date instead of writing a timestamped report;
+        station/realm auth counts are summed and user sets unioned, session/pattern analysis is dropped,
+        and a run whose dates are already in the file is refused
+  -trend
+        Add a per-realm daily series (date, active_users, auths) to realm_stats
+  -fill-gaps
+        With -trend, add zero points for the days in the range without activity so each series is continuous
+  -flatten
+        Write a flat JSON array with one {station_id, username, realm, timestamp, provider} object per
+        auth event (sorted by timestamp) instead of the nested station report, for pandas/jq
+  -heatmap
+        Write a CSV matrix of auth counts instead of the station report: one row per date of the range
+        (local time, days without auths included as zeros), columns date and hours 0-23, summed across all
+        stations (and providers with all), for spreadsheet heatmaps of capacity
+  -device-trend
+        Write a daily series of {date, unique_stations, unique_users} instead of the station report, from
+        the same auth events (local time, days without auths included as zeros), for trend dashboards
+  -sample int
+        Query only every Nth day of the range and extrapolate total_authentications/total_challenges by
+        days/sampled days; query_info is marked sampled with the rate. Station, realm and unique counts
+        cover the sampled days only, as do the counts of -dest-ip, -ssid, -tls, -nas-ip, -message-types,
+        -group-by and -query-file. Not available with -user, -count-only, -append or -follow (default 1 = every day)
+  -count-only
+        Print total auths and unique users/stations from a single max_hits:0 request and exit;
+        no day-jobs, no per-station analysis and no output file
+  -ssid
+        Report auths per SSID (the suffix of Called-Station-Id, e.g., eduroam vs guest SSIDs on the same APs);
+        auths logged without an SSID are counted under "(none)"
+  -nas-ip
+        Report auths per nas_ip (NAS-IP-Address, the access point or controller that relayed the request,
+        parsed by the ingester) to spot overloaded or misbehaving APs; auths logged without it are counted
+        under "(none)"
+  -tls
+        Report TLS handshake/certificate failures (tls_error, parsed by the ingester from EAP-TLS errors)
+        per realm for the service provider, or per service provider with all; failures logged without
+        the field are counted under "(none)"
+  -query-file string
+        Run the Quickwit search request in this JSON file (query, aggs, ...) per day-job instead of the
+        station report; {start} and {end} are replaced by each day's unix timestamps (start_timestamp and
+        end_timestamp are set to them when the file leaves them out). The aggregations of all days are
+        merged (buckets by key, doc_count and metric values summed, so only additive metrics such as sum
+        and value_count stay exact) and written to output/<service_provider>/<time>-query.json; the file's
+        query is sent as is, so the service_provider argument only names the output directory
+  -group-by string
+        Report auth counts nested by an ordered comma list of dimensions (station_id, username, realm,
+        service_provider) instead of the station report, e.g., realm,station_id for the stations of each
+        realm or service_provider,username with all. Each level is a terms aggregation sized by -station-size,
+        -user-size or -realm-size (1000 for service_provider); auths in the dropped buckets are reported as
+        other_auths. -sort name or auths orders each level
+  -message-types
+        Report the events of the service provider (or all) per message_type (Access-Accept, Access-Reject,
+        Access-Challenge, accounting, ...) over the window with a daily series, from one terms aggregation
+        per day-job, as a quick health check instead of the station report
+  -ts-format string
+        How auth/session/timeline timestamps are written: rfc3339, epoch_ms or epoch_s (default "rfc3339")
+  -fields string
+        Comma list of the per-station analyses to include: patterns, sessions, issues, details
+        (default "patterns,sessions,issues,details")
+  -sort string
+        Order of station_stats, realm_stats and (with all) providers as field[:asc|desc], field one of
+        name, auths, users (e.g., users:desc; direction defaults to asc, ties ordered by name).
+        Default: total auths descending. With -no-details the top stations are taken in this order
+  -dump-raw string
+        Write each day-job's raw Quickwit response to <dir>/<start>-<end>.json before it is processed
+        (for debugging aggregation mismatches)
+  -checkpoint string
+        Save each finished day-job of the station report (its hits and parsed entries) to <dir>/<start>-<end>.json
+        and list it in <dir>/progress.json together with the query, so an interrupted run can be resumed
+  -resume
+        With -checkpoint, skip the day-jobs already listed in progress.json and reload their cached results
+        (entries, hits, user_cardinality and truncation counts); refused if the checkpoint was written for a
+        different query or day-job request (-interval, -station-size, -user-size, -realm-size,
+        -include-challenges). With -dump-raw the listed days are queried again to dump their responses. A day
+        cached while still in progress (today) is not re-queried, so delete the directory for a fresh run
+  -cache-dir string
+        Keep each Quickwit search response whose time range ended before today in <dir>/<sha256>.json, keyed by
+        a hash of the Quickwit URL and the whole request (query, range, aggregations), and answer the same
+        request from there on later runs. Requests covering today are always sent, since today is still
+        changing; delete the directory after re-ingesting past days
+  -prefer-file
+        When both qw-auth.properties and the QW_USER, QW_PASS or QW_URL environment variables set a value,
+        use the file (by default the environment wins; it is also used when the file is absent)
+  -check
+        Verify Quickwit is reachable and the nro-logs index exists, then exit (0 = OK)
+  -include-challenges
+        Also query Access-Challenge events and report them separately from completed auths
+
+qw-auth.properties may also set QW_CLIENT_CERT and QW_CLIENT_KEY (PEM file paths, both or neither)
+to present a client certificate to a Quickwit deployment that requires mutual TLS.
+Requests follow HTTP_PROXY/HTTPS_PROXY/NO_PROXY from the environment; QW_PROXY (proxy URL) and
+QW_NO_PROXY (comma list of hosts or domains reached directly, "*" for all) override them.
+
+Build: go build (go.mod pins aws-sdk-go-v2 v1.47.1, credentials v1.20.6, service/s3 v1.113.4,
+used by -out-url; Go 1.24 or later)
+
 Author: [P.Itarun]
 Date: October 25, 2024
 */
@@ -27,33 +224,402 @@ package main
 
 import (
     "bufio"
+    "bytes"
+    "context"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/tls"
+    "encoding/csv"
+    "encoding/hex"
     "encoding/json"
+    "errors"
+    "flag"
     "fmt"
     "io"
     "log"
+    "math"
     "net/http"
+    "net/netip"
+    "net/url"
     "os"
+    "os/signal"
+    "path"
+    "path/filepath"
     "sort"
     "strconv"
     "strings"
     "sync"
+    "syscall"
+    "text/tabwriter"
     "time"
     "sync/atomic"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/credentials"
+    "github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Options holds the command-line options
+type Options struct {
+    BufferSize        int
+    BaselineDays      int
+    Interval          string
+    Strict            bool
+    From              string
+    To                string
+    OUIFile           string
+    ExcludeRandomized bool
+    AllProviders      bool
+    Timeout           time.Duration
+    MaxIdleConns      int
+    MaxInflight       int
+    Check             bool
+    Checkpoint        string
+    CacheDir          string
+    Resume            bool
+    Sort              string
+    Flatten           bool
+    Heatmap           bool
+    DeviceTrend       bool
+    Sample            int
+    PreferFile        bool
+    DumpRaw           string
+    Follow            time.Duration
+    FollowWindow      time.Duration
+    AcctSessions      bool
+    MaxIdentities     int
+    MaxRealms         int
+    TSFormat          string
+    SSID              bool
+    TLS               bool
+    QueryFile         string
+    GroupBy           string
+    MessageTypes      bool
+    NASIP             bool
+    CountOnly         bool
+    Trend             bool
+    FillGaps          bool
+    Append            string
+    DestIP            bool
+    CIDR              string
+    CIDR4             int
+    CIDR6             int
+    Fields            string
+    User              string
+    OutURL            string
+    Stdout            bool
+    Summary           bool
+    MaxDays           int
+    Force             bool
+    QuietHours        string
+    QuietStart        int
+    QuietEnd          int
+    QuietThreshold    int
+    BusinessHours     string
+    BusinessStart     int
+    BusinessEnd       int
+    NoDetails         bool
+    StationSize       int
+    UserSize          int
+    RealmSize         int
+    TopN              int
+    IncludeChallenges bool
+}
+
+// httpClient is shared by all workers so keep-alive connections are reused
+var httpClient *http.Client
+
+// inflight limits concurrent search requests to -max-inflight (nil = no limit)
+var inflight chan struct{}
+
+// proxyFunc returns the transport Proxy for QW_PROXY/QW_NO_PROXY: requests go through proxyURL
+// ("" = HTTP_PROXY/HTTPS_PROXY/NO_PROXY from the environment) unless the host matches an entry of
+// the comma list noProxy ("*", a host, or a domain with or without a leading dot)
+func proxyFunc(proxyURL, noProxy string) (func(*http.Request) (*url.URL, error), error) {
+    var proxy *url.URL
+    if proxyURL != "" {
+        u, err := url.Parse(proxyURL)
+        if err != nil || u.Host == "" {
+            return nil, fmt.Errorf("invalid proxy URL %q", proxyURL)
+        }
+        proxy = u
+    }
+    var bypass []string
+    for _, host := range strings.Split(noProxy, ",") {
+        if host = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(host), ".")); host != "" {
+            bypass = append(bypass, host)
+        }
+    }
+
+    return func(req *http.Request) (*url.URL, error) {
+        host := strings.ToLower(req.URL.Hostname())
+        for _, domain := range bypass {
+            if domain == "*" || host == domain || strings.HasSuffix(host, "."+domain) {
+                return nil, nil
+            }
+        }
+        if proxy != nil {
+            return proxy, nil
+        }
+        return http.ProxyFromEnvironment(req)
+    }, nil
+}
+
+// newHTTPClient creates the shared Quickwit client with a tuned transport
+// and, when props has QW_CLIENT_CERT/QW_CLIENT_KEY, a client certificate for mutual TLS;
+// the environment proxy settings apply unless QW_PROXY/QW_NO_PROXY override them
+func newHTTPClient(timeout time.Duration, maxIdleConns int, props Properties) (*http.Client, error) {
+    transport := http.DefaultTransport.(*http.Transport).Clone()
+    transport.MaxIdleConns = maxIdleConns
+    transport.MaxIdleConnsPerHost = maxIdleConns
+    transport.IdleConnTimeout = 90 * time.Second
+    if props.ClientCert != "" {
+        cert, err := tls.LoadX509KeyPair(props.ClientCert, props.ClientKey)
+        if err != nil {
+            return nil, fmt.Errorf("error loading client certificate: %v", err)
+        }
+        transport.TLSClientConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+    }
+    if props.Proxy != "" || props.NoProxy != "" {
+        proxy, err := proxyFunc(props.Proxy, props.NoProxy)
+        if err != nil {
+            return nil, err
+        }
+        transport.Proxy = proxy
+    }
+
+    return &http.Client{
+        Timeout:   timeout,
+        Transport: &tracingTransport{base: transport},
+    }, nil
+}
+
+// userAgent identifies this tool in Quickwit access logs
+const userAgent = "log2quickwit/eduroam-sp/2.2.2"
+
+// tracingTransport sets the User-Agent and a per-request X-Request-ID on every call
+// made through the shared client, so Quickwit-side load can be traced back to a run
+type tracingTransport struct {
+    base http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    req = req.Clone(req.Context())
+    req.Header.Set("User-Agent", userAgent)
+    if req.Header.Get("X-Request-ID") == "" {
+        req.Header.Set("X-Request-ID", newRequestID())
+    }
+    return t.base.RoundTrip(req)
+}
+
+// newRequestID returns a random UUIDv4 used as X-Request-ID
+func newRequestID() string {
+    var b [16]byte
+    rand.Read(b[:])
+    b[6] = (b[6] & 0x0f) | 0x40
+    b[8] = (b[8] & 0x3f) | 0x80
+    return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// RADIUS message types handled by the analysis
+const (
+    messageAccept    = "Access-Accept"
+    messageChallenge = "Access-Challenge"
+)
+
+// allProviders is the service_provider argument that selects the all-providers (NRO) mode
+const allProviders = "all"
+
+// ouiVendors maps a 6 hex digit OUI prefix to a vendor name (nil = lookup disabled)
+var ouiVendors map[string]string
+
+// queryTemplate is the -query-file request body with {start}/{end} placeholders ("" = not given)
+var queryTemplate string
+
+// validIntervals lists the accepted auth_times histogram intervals
+var validIntervals = map[string]bool{
+    "1m":  true,
+    "5m":  true,
+    "15m": true,
+    "1h":  true,
+}
+
+var opts Options
+
+// allAnalysisFields lists the per-station analyses selectable with -fields
+var allAnalysisFields = []string{"patterns", "sessions", "issues", "details"}
+
+// analysisFields is the set of analyses enabled by -fields
+var analysisFields map[string]bool
+
+// sortFields lists the keys accepted by -sort
+var sortFields = []string{"name", "auths", "users"}
+
+// SortOrder is a parsed -sort field and direction (zero Field = the default orders)
+type SortOrder struct {
+    Field string
+    Desc  bool
+}
+
+// sortOrder is set from -sort in parseFlags
+var sortOrder SortOrder
+
+// sortItem holds the -sort keys of one station, realm or provider entry
+type sortItem struct {
+    Name  string
+    Auths int
+    Users int
+}
+
+// less orders a before b by the -sort field and direction; equal counts fall back to name
+func (o SortOrder) less(a, b sortItem) bool {
+    countA, countB := a.Auths, b.Auths
+    if o.Field == "users" {
+        countA, countB = a.Users, b.Users
+    }
+    if o.Field != "name" && countA != countB {
+        if o.Desc {
+            return countA > countB
+        }
+        return countA < countB
+    }
+    if o.Desc {
+        return a.Name > b.Name
+    }
+    return a.Name < b.Name
+}
+
+// validSortField reports whether field is one of sortFields
+func validSortField(field string) bool {
+    for _, f := range sortFields {
+        if f == field {
+            return true
+        }
+    }
+    return false
+}
+
+// validAnalysisField reports whether field is one of allAnalysisFields
+func validAnalysisField(field string) bool {
+    for _, f := range allAnalysisFields {
+        if f == field {
+            return true
+        }
+    }
+    return false
+}
+
+// Backpressure counters for sends into the result channel
+var (
+    totalSends   atomic.Int64
+    blockedSends atomic.Int64
+)
+
+// UserCardinalityDay compares a day-job's cardinality estimate of username with the distinct
+// usernames its terms buckets returned (counted_users is capped by -station-size/-user-size)
+type UserCardinalityDay struct {
+    Date      string `json:"date"`
+    Estimated int    `json:"estimated_users"`
+    Counted   int    `json:"counted_users"`
+}
+
+// cardinalityTolerance is how far the estimate may exceed the counted users before a day is
+// reported as undercounted (Quickwit's cardinality is a HyperLogLog approximation)
+const cardinalityTolerance = 0.1
+
+// Per day-job username cardinality of the station report, reset by collectStationResult
+var (
+    userCardinalityMu   sync.Mutex
+    userCardinalityDays []UserCardinalityDay
 )
 
+// Documents left out of the station/user/realm terms aggregations by -station-size,
+// -user-size and -realm-size (Quickwit's sum_other_doc_count); reported at the end of the run
+var (
+    truncatedStations atomic.Int64
+    truncatedUsers    atomic.Int64
+    truncatedRealms   atomic.Int64
+    truncatedBaseline atomic.Int64 // baseline ของ -baseline-days ที่ยังถูกตัดแม้ query รายชั่วโมง
+)
+
+// countTruncated adds the sum_other_doc_count of a terms aggregation to counter
+func countTruncated(agg map[string]interface{}, counter *atomic.Int64) {
+    counter.Add(otherDocCount(agg))
+}
+
+// otherDocCount returns the sum_other_doc_count of a terms aggregation (0 when absent)
+func otherDocCount(agg map[string]interface{}) int64 {
+    if other, ok := agg["sum_other_doc_count"].(float64); ok && other > 0 {
+        return int64(other)
+    }
+    return 0
+}
+
+// DayTruncation is what -station-size, -user-size and -realm-size left out of one day-job
+type DayTruncation struct {
+    Stations int64 `json:"stations,omitempty"`
+    Users    int64 `json:"users,omitempty"`
+    Realms   int64 `json:"realms,omitempty"`
+}
+
+// DayStats are a day-job's hits and the per-day values the station report keeps besides its
+// entries; -checkpoint saves them so a resumed day is reported like a queried one
+type DayStats struct {
+    Hits            int64               `json:"hits"`
+    UserCardinality *UserCardinalityDay `json:"user_cardinality,omitempty"`
+    Truncated       DayTruncation       `json:"truncated"`
+}
+
+// record adds the day's values to the run's user_cardinality and truncation totals
+func (d DayStats) record() {
+    if d.UserCardinality != nil {
+        userCardinalityMu.Lock()
+        userCardinalityDays = append(userCardinalityDays, *d.UserCardinality)
+        userCardinalityMu.Unlock()
+    }
+    truncatedStations.Add(d.Truncated.Stations)
+    truncatedUsers.Add(d.Truncated.Users)
+    truncatedRealms.Add(d.Truncated.Realms)
+}
+
+// malformedBuckets counts aggregation buckets dropped because they failed a type assertion
+// or lacked an expected sub-aggregation; reported at the end of the run
+var malformedBuckets atomic.Int64
+
 // Properties represents the authentication properties for Quickwit API
 type Properties struct {
-    QWUser string
-    QWPass string
-    QWURL  string
+    QWUser     string
+    QWPass     string
+    QWURL      string
+    ClientCert string // QW_CLIENT_CERT: PEM client certificate สำหรับ mutual TLS
+    ClientKey  string // QW_CLIENT_KEY
+    Proxy      string // QW_PROXY: proxy URL แทน HTTP_PROXY/HTTPS_PROXY
+    NoProxy    string // QW_NO_PROXY: host/domain ที่ต่อตรงไม่ผ่าน proxy
+    S3         S3Config
+}
+
+// S3Config holds the S3-compatible object storage settings used by -out-url
+type S3Config struct {
+    Endpoint  string // e.g., https://minio.example.org (default https://s3.<region>.amazonaws.com)
+    Region    string
+    AccessKey string
+    SecretKey string
 }
 
+// outputS3 is set from qw-auth.properties in main
+var outputS3 S3Config
+
+// reportOut receives the report with -stdout; os.Stdout itself is pointed at stderr
+// so progress and informational prints stay out of the pipe
+var reportOut io.Writer
+
 // LogEntry represents a single log entry from Quickwit search results
 type LogEntry struct {
     Username        string    `json:"username"`
     Realm          string    `json:"realm"`
     ServiceProvider string    `json:"service_provider"`
     StationID      string    `json:"station_id"`
+    MessageType    string    `json:"message_type"`
     Timestamp      time.Time `json:"timestamp"`
 }
 
@@ -62,20 +628,31 @@ type UserActivity struct {
     Username       string
     Realm         string
     AuthTimestamps []time.Time
+    ChallengeTimestamps []time.Time // Access-Challenge (เฉพาะ -include-challenges)
 }
 
 // StationStats contains statistics for a station_id
 type StationStats struct {
     StationID    string
     TotalAuths   int
+    TotalChallenges int
+    Realms       map[string]bool // realm ที่เห็นบน station ตลอดช่วงเวลา (เฉพาะ auth)
     Users        map[string]*UserActivity  // key: username
 }
 
 // StationStatsOutput ใช้สำหรับ JSON output
 type StationStatsOutput struct {
     StationID           string         `json:"station_id"`
+    IsNew               *bool          `json:"is_new,omitempty"`
+    Vendor              string         `json:"vendor,omitempty"`
     TotalAuths          int            `json:"total_auths"`
+    TotalChallenges     int            `json:"total_challenges,omitempty"`
     TotalUsers          int            `json:"total_users"`
+    DistinctRealms      int            `json:"distinct_realms,omitempty"`
+    FirstSeen           TimeString     `json:"first_seen,omitempty"`
+    LastSeen            TimeString     `json:"last_seen,omitempty"`
+    LifespanDays        int            `json:"lifespan_days,omitempty"` // จำนวนวันตามปฏิทินจาก first_seen ถึง last_seen (นับทั้งสองวัน)
+    BusinessHoursRatio  *float64       `json:"business_hours_ratio,omitempty"` // สัดส่วน auth ใน -business-hours
     UsagePatterns       *UsagePattern  `json:"usage_patterns"`
     SessionAnalysis     *SessionAnalysis `json:"session_analysis"`
     PotentialIssues     []PotentialIssue `json:"potential_issues"`
@@ -88,26 +665,66 @@ type RealmStats struct {
     Users         map[string]bool    // key: username
     Stations      map[string]bool    // key: station_id
     TotalAuths    int
+    Daily         map[string]*RealmDay // key: YYYY-MM-DD (เฉพาะ -trend)
+}
+
+// RealmDay contains a realm's activity on one day (-trend)
+type RealmDay struct {
+    Users map[string]bool // key: username
+    Auths int
 }
 
 // RealmStat for output
 type RealmStat struct {
-    Realm         string `json:"realm"`
-    TotalUsers    int    `json:"total_users"`
-    TotalStations int    `json:"total_stations"`
-    TotalAuths    int    `json:"total_auths"`
+    Realm         string            `json:"realm"`
+    TotalUsers    int               `json:"total_users"`
+    TotalStations int               `json:"total_stations"`
+    TotalAuths    int               `json:"total_auths"`
+    Trend         []RealmTrendPoint `json:"trend,omitempty"`
+}
+
+// RealmTrendPoint is one day of a realm's daily series (-trend)
+type RealmTrendPoint struct {
+    Date        string `json:"date"`
+    ActiveUsers int    `json:"active_users"`
+    Auths       int    `json:"auths"`
+}
+
+// RealmAnomaly lists a username seen with more than one realm
+type RealmAnomaly struct {
+    Username string         `json:"username"`
+    Realms   map[string]int `json:"realms"` // key: realm, value: auth count
+}
+
+// TimeString is an RFC3339 timestamp; it is written to JSON as given by -ts-format
+type TimeString string
+
+// MarshalJSON writes the timestamp as an RFC3339 string, epoch milliseconds or epoch seconds
+func (t TimeString) MarshalJSON() ([]byte, error) {
+    ts, err := time.Parse(time.RFC3339, string(t))
+    if opts.TSFormat == "rfc3339" || err != nil {
+        return json.Marshal(string(t))
+    }
+    if opts.TSFormat == "epoch_ms" {
+        return []byte(strconv.FormatInt(ts.UnixMilli(), 10)), nil
+    }
+    return []byte(strconv.FormatInt(ts.Unix(), 10)), nil
 }
 
 // UserDetail for output
 type UserDetail struct {
-    Username       string    `json:"username"`
-    Realm         string    `json:"realm"`
-    AuthTimestamps []string `json:"auth_timestamps"`
+    Username       string       `json:"username"`
+    Realm          string       `json:"realm"`
+    AuthTimestamps []TimeString `json:"auth_timestamps"`
+    ChallengeCount int          `json:"challenge_count,omitempty"`
 }
 
 // UsagePattern contains pattern analysis results
 type UsagePattern struct {
     HourlyDistribution map[string]int    `json:"hourly_distribution"`
+    OvernightAuthCount int               `json:"overnight_auth_count,omitempty"`
+    ChallengeCount     int               `json:"challenge_count,omitempty"`
+    ChallengesPerAuth  float64           `json:"challenges_per_auth,omitempty"`
     AuthIntervals struct {
         AverageMinutes float64 `json:"average_minutes"`
         MinMinutes     int     `json:"min_minutes"`
@@ -122,10 +739,10 @@ type UsagePattern struct {
 
 // Period represents a time period
 type Period struct {
-    Start           string `json:"start"`
-    End             string `json:"end"`
-    DurationMinutes int    `json:"duration_minutes"`
-    AuthCount       int    `json:"auth_count,omitempty"`
+    Start           TimeString `json:"start"`
+    End             TimeString `json:"end"`
+    DurationMinutes int        `json:"duration_minutes"`
+    AuthCount       int        `json:"auth_count,omitempty"`
 }
 
 // FrequentReauth represents a period of frequent re-authentications
@@ -137,18 +754,19 @@ type FrequentReauth struct {
 
 // SessionAnalysis contains session-based analysis
 type SessionAnalysis struct {
-    TotalSessions           int      `json:"total_sessions"`
-    AverageSessionDuration  string   `json:"average_session_duration"`
+    Source                 string    `json:"source,omitempty"` // "accounting" เมื่อมาจาก -acct-sessions
+    TotalSessions          int       `json:"total_sessions"`
+    AverageSessionDuration string    `json:"average_session_duration"`
     SessionDetails         []Session `json:"session_details"`
 }
 
 // Session represents a single usage session
 type Session struct {
-    Start       string  `json:"start"`
-    End         string  `json:"end"`
-    Duration    string  `json:"duration"`
-    AuthsCount  int     `json:"auths_count"`
-    ReauthRate  string  `json:"reauth_rate"`
+    Start      TimeString `json:"start"`
+    End        TimeString `json:"end"`
+    Duration   string     `json:"duration"`
+    AuthsCount int        `json:"auths_count"`
+    ReauthRate string     `json:"reauth_rate"`
 }
 
 // PotentialIssue represents a potential connection issue
@@ -158,6 +776,239 @@ type PotentialIssue struct {
     Description string `json:"description"`
 }
 
+// TimelineEntry is a single auth event of a user (-user mode)
+type TimelineEntry struct {
+    Timestamp       TimeString `json:"timestamp"`
+    MessageType     string     `json:"message_type"`
+    ServiceProvider string     `json:"service_provider"`
+    StationID       string     `json:"station_id"`
+    Realm           string     `json:"realm"`
+}
+
+// UserTimelineOutput represents the -user output JSON structure
+type UserTimelineOutput struct {
+    NoData    bool `json:"no_data,omitempty"`
+    QueryInfo struct {
+        Username          string `json:"username"`
+        ServiceProvider   string `json:"service_provider,omitempty"`
+        Days              int    `json:"days"`
+        StartDate         string `json:"start_date"`
+        EndDate           string `json:"end_date"`
+        IncludeChallenges bool   `json:"include_challenges,omitempty"`
+    } `json:"query_info"`
+    Summary struct {
+        TotalAuths      int      `json:"total_authentications"`
+        TotalChallenges int      `json:"total_challenges,omitempty"`
+        Providers       []string `json:"providers"`
+        Stations        []string `json:"stations"`
+        Truncated       bool     `json:"truncated,omitempty"`
+    } `json:"summary"`
+    SessionAnalysis *SessionAnalysis `json:"session_analysis,omitempty"`
+    Timeline        []TimelineEntry  `json:"timeline"`
+}
+
+// DestinationStat is the auth count of one destination IP or subnet (-dest-ip mode)
+type DestinationStat struct {
+    Destination string  `json:"destination"`
+    IPVersion   string  `json:"ip_version"`
+    Count       int64   `json:"count"`
+    Percentage  float64 `json:"percentage"`
+}
+
+// DestinationOutput represents the -dest-ip output JSON structure
+type DestinationOutput struct {
+    NoData    bool `json:"no_data,omitempty"`
+    QueryInfo struct {
+        ServiceProvider string `json:"service_provider"`
+        Days            int    `json:"days"`
+        StartDate       string `json:"start_date"`
+        EndDate         string `json:"end_date"`
+        CIDR            string `json:"cidr,omitempty"`
+        SampleInfo
+    } `json:"query_info"`
+    Summary struct {
+        TotalAuths   int64 `json:"total_authentications"`
+        IPv4Auths    int64 `json:"ipv4_authentications"`
+        IPv6Auths    int64 `json:"ipv6_authentications"`
+        Destinations int   `json:"destinations"`
+    } `json:"summary"`
+    Destinations []DestinationStat `json:"destinations"`
+}
+
+// RollingDay is the per-date total of a rolling dataset (-append)
+type RollingDay struct {
+    Date       string `json:"date"`
+    TotalAuths int    `json:"total_auths"`
+    Stations   int    `json:"stations"`
+    Users      int    `json:"users"`
+}
+
+// RollingStation is a station_id accumulated over all appended runs
+type RollingStation struct {
+    StationID  string   `json:"station_id"`
+    TotalAuths int      `json:"total_auths"`
+    FirstSeen  string   `json:"first_seen"`
+    LastSeen   string   `json:"last_seen"`
+    Users      []string `json:"users"`
+}
+
+// RollingRealm is a realm accumulated over all appended runs
+type RollingRealm struct {
+    Realm      string   `json:"realm"`
+    TotalAuths int      `json:"total_auths"`
+    Users      []string `json:"users"`
+    Stations   []string `json:"stations"`
+}
+
+// RollingData represents the -append rolling JSON structure
+type RollingData struct {
+    ServiceProvider string `json:"service_provider"`
+    UpdatedAt       string `json:"updated_at"`
+    Summary         struct {
+        UniqueStations int `json:"unique_stations"`
+        UniqueUsers    int `json:"unique_users"`
+        UniqueRealms   int `json:"unique_realms"`
+        TotalAuths     int `json:"total_authentications"`
+    } `json:"summary"`
+    Daily        []RollingDay     `json:"daily"`
+    StationStats []RollingStation `json:"station_stats"`
+    RealmStats   []RollingRealm   `json:"realm_stats"`
+}
+
+// TermStat is the event count of one value of a breakdown field (-ssid, -tls, -nas-ip)
+type TermStat struct {
+    Value      string  `json:"value"`
+    Count      int64   `json:"count"`
+    Percentage float64 `json:"percentage"`
+}
+
+// TermReportOutput represents the output JSON structure of a per-field breakdown
+type TermReportOutput struct {
+    NoData    bool `json:"no_data,omitempty"`
+    QueryInfo struct {
+        ServiceProvider string `json:"service_provider"`
+        Query           string `json:"query"`
+        Field           string `json:"field"`
+        Days            int    `json:"days"`
+        StartDate       string `json:"start_date"`
+        EndDate         string `json:"end_date"`
+        SampleInfo
+    } `json:"query_info"`
+    Summary struct {
+        TotalAuths int64 `json:"total_authentications"`
+        Values     int   `json:"values"`
+        Missing    int64 `json:"missing"`
+    } `json:"summary"`
+    Values []TermStat `json:"values"`
+}
+
+// QueryFileOutput represents the output JSON structure of a -query-file run
+type QueryFileOutput struct {
+    NoData    bool `json:"no_data,omitempty"`
+    QueryInfo struct {
+        ServiceProvider string `json:"service_provider"`
+        QueryFile       string `json:"query_file"`
+        Days            int    `json:"days"`
+        StartDate       string `json:"start_date"`
+        EndDate         string `json:"end_date"`
+        SampleInfo
+    } `json:"query_info"`
+    Summary struct {
+        TotalHits int64 `json:"total_hits"`
+        DayJobs   int   `json:"day_jobs"`
+    } `json:"summary"`
+    Aggregations map[string]interface{} `json:"aggregations"`
+}
+
+// MessageTypeDay is the events per message_type of one day (-message-types)
+type MessageTypeDay struct {
+    Date   string           `json:"date"`
+    Total  int64            `json:"total"`
+    Counts map[string]int64 `json:"counts"`
+}
+
+// MessageTypeOutput represents the output JSON structure of a -message-types report
+type MessageTypeOutput struct {
+    NoData    bool `json:"no_data,omitempty"`
+    QueryInfo struct {
+        ServiceProvider string `json:"service_provider"`
+        Query           string `json:"query"`
+        Days            int    `json:"days"`
+        StartDate       string `json:"start_date"`
+        EndDate         string `json:"end_date"`
+        SampleInfo
+    } `json:"query_info"`
+    Summary struct {
+        TotalEvents int64 `json:"total_events"`
+        Types       int   `json:"types"`
+    } `json:"summary"`
+    MessageTypes []TermStat       `json:"message_types"`
+    Daily        []MessageTypeDay `json:"daily"`
+}
+
+// DeviceTrendPoint is one day of the -device-trend series
+type DeviceTrendPoint struct {
+    Date           string `json:"date"`
+    UniqueStations int    `json:"unique_stations"`
+    UniqueUsers    int    `json:"unique_users"`
+}
+
+// DeviceTrendOutput represents the output JSON structure of a -device-trend report
+type DeviceTrendOutput struct {
+    NoData    bool `json:"no_data,omitempty"`
+    QueryInfo struct {
+        ServiceProvider string `json:"service_provider"`
+        Query           string `json:"query"`
+        Days            int    `json:"days"`
+        StartDate       string `json:"start_date"`
+        EndDate         string `json:"end_date"`
+    } `json:"query_info"`
+    Series []DeviceTrendPoint `json:"series"`
+}
+
+// GroupStat is the auth count of one value of a -group-by dimension and its nested groups
+type GroupStat struct {
+    Key        string      `json:"key"`
+    Auths      int64       `json:"total_authentications"`
+    OtherAuths int64       `json:"other_auths,omitempty"`
+    Field      string      `json:"field,omitempty"` // dimension ของ groups ชั้นถัดไป
+    Groups     []GroupStat `json:"groups,omitempty"`
+}
+
+// GroupByOutput represents the output JSON structure of a -group-by report
+type GroupByOutput struct {
+    NoData    bool `json:"no_data,omitempty"`
+    QueryInfo struct {
+        ServiceProvider string   `json:"service_provider"`
+        Query           string   `json:"query"`
+        GroupBy         []string `json:"group_by"`
+        Days            int      `json:"days"`
+        StartDate       string   `json:"start_date"`
+        EndDate         string   `json:"end_date"`
+        SampleInfo
+    } `json:"query_info"`
+    Summary struct {
+        TotalAuths int64 `json:"total_authentications"`
+        Groups     int   `json:"groups"`
+        OtherAuths int64 `json:"other_auths,omitempty"`
+    } `json:"summary"`
+    Field  string      `json:"field"`
+    Groups []GroupStat `json:"groups"`
+}
+
+// Manifest records how a report was produced so it can be traced and verified (<output>.manifest.json)
+type Manifest struct {
+    Tool        string `json:"tool"`
+    Query       string `json:"query"`
+    StartTime   string `json:"start_time"`
+    EndTime     string `json:"end_time"`
+    Workers     int    `json:"workers"`
+    TotalHits   int64  `json:"total_hits"`
+    Output      string `json:"output"`
+    SHA256      string `json:"sha256"`
+    GeneratedAt string `json:"generated_at"`
+}
+
 // Job represents a single day's query job
 type Job struct {
     StartTimestamp int64
@@ -167,20 +1018,125 @@ type Job struct {
 
 // SimplifiedOutputData represents the output JSON structure
 type SimplifiedOutputData struct {
+    NoData    bool `json:"no_data,omitempty"`
     QueryInfo struct {
         ServiceProvider string `json:"service_provider"`
         Days           int    `json:"days"`
         StartDate      string `json:"start_date"`
         EndDate        string `json:"end_date"`
+        BaselineDays   int    `json:"baseline_days,omitempty"`
+        BaselineTruncated int64 `json:"baseline_truncated_events,omitempty"` // events ที่ baseline นับ station ไม่ครบ
+        AuthInterval   string `json:"auth_interval"`
+        NoDetails      bool   `json:"no_details,omitempty"`
+        IncludeChallenges bool `json:"include_challenges,omitempty"`
+        Trend          bool   `json:"trend,omitempty"`
+        SampleInfo
+        ExcludeRandomized bool `json:"exclude_randomized,omitempty"`
     } `json:"query_info"`
     Summary struct {
         UniqueStations int `json:"unique_stations"`
         UniqueUsers    int `json:"unique_users"`
         UniqueRealms   int `json:"unique_realms"`
         TotalAuths     int `json:"total_authentications"`
+        TotalChallenges int `json:"total_challenges,omitempty"`
+        NewStations    int `json:"new_stations,omitempty"`
+        OvernightStations int `json:"overnight_stations,omitempty"`
+        ManyIdentityStations int `json:"many_identity_stations,omitempty"`
+        ManyRealmStations    int `json:"many_realm_stations,omitempty"`
+        AvgUsersPerStation float64 `json:"avg_users_per_station"`
+        MaxUsersPerStation int     `json:"max_users_per_station"`
+        AvgStationsPerUser float64 `json:"avg_stations_per_user"`
+        MaxStationsPerUser int     `json:"max_stations_per_user"`
+        ExcludedRandomized int     `json:"excluded_randomized_stations,omitempty"`
+        UndercountedDays   int     `json:"undercounted_days,omitempty"` // วันที่ cardinality เกิน counted_users เกิน cardinalityTolerance
     } `json:"summary"`
-    StationStats []StationStatsOutput `json:"station_stats"`
-    RealmStats   []RealmStat         `json:"realm_stats"`
+    StationStats   []StationStatsOutput   `json:"station_stats"`
+    RealmStats     []RealmStat            `json:"realm_stats"`
+    UserCardinality []UserCardinalityDay  `json:"user_cardinality,omitempty"`
+    RealmAnomalies []RealmAnomaly         `json:"realm_anomalies,omitempty"`
+    Providers      []SimplifiedOutputData `json:"providers,omitempty"`
+}
+
+// setDensity copies the users-per-station / stations-per-user metrics into the summary
+func (o *SimplifiedOutputData) setDensity(d Density) {
+    o.Summary.AvgUsersPerStation = d.AvgUsersPerStation
+    o.Summary.MaxUsersPerStation = d.MaxUsersPerStation
+    o.Summary.AvgStationsPerUser = d.AvgStationsPerUser
+    o.Summary.MaxStationsPerUser = d.MaxStationsPerUser
+}
+
+// createNationalOutputData builds the all-providers output: one nested report
+// per service provider plus summary totals deduplicated across providers
+func createNationalOutputData(result *Result, startDate, endDate time.Time, days int) SimplifiedOutputData {
+    output := SimplifiedOutputData{}
+    output.QueryInfo.ServiceProvider = allProviders
+    output.QueryInfo.Days = days
+    output.QueryInfo.StartDate = startDate.Format("2006-01-02 15:04:05")
+    output.QueryInfo.EndDate = endDate.Format("2006-01-02 15:04:05")
+    output.QueryInfo.AuthInterval = opts.Interval
+    output.QueryInfo.IncludeChallenges = opts.IncludeChallenges
+    output.QueryInfo.Trend = opts.Trend
+    output.QueryInfo.ExcludeRandomized = opts.ExcludeRandomized
+    if result.KnownStations != nil {
+        output.QueryInfo.BaselineDays = opts.BaselineDays
+        output.QueryInfo.BaselineTruncated = truncatedBaseline.Load()
+    }
+    output.QueryInfo.SampleInfo = newSampleInfo(startDate, endDate)
+    output.StationStats = []StationStatsOutput{}
+    output.RealmStats = []RealmStat{}
+
+    uniqueUsers := make(map[string]bool)
+    randomized := make(map[string]bool)
+    output.Providers = make([]SimplifiedOutputData, 0, len(result.Providers))
+    for provider, sub := range result.Providers {
+        report := createOutputData(sub, provider, startDate, endDate, days)
+        output.Providers = append(output.Providers, report)
+
+        for stationID := range sub.Randomized {
+            randomized[stationID] = true
+        }
+
+        for _, stats := range sub.Stations {
+            for username := range stats.Users {
+                uniqueUsers[username] = true
+            }
+        }
+        output.Summary.TotalAuths += report.Summary.TotalAuths
+        output.Summary.TotalChallenges += report.Summary.TotalChallenges
+    }
+
+    output.Summary.UniqueStations, output.Summary.UniqueRealms = result.countUnique()
+    if result.KnownStations != nil {
+        seen := make(map[string]bool)
+        for _, sub := range result.Providers {
+            for stationID := range sub.Stations {
+                if !result.KnownStations[stationID] && !seen[stationID] {
+                    output.Summary.NewStations++
+                }
+                seen[stationID] = true
+            }
+        }
+    }
+    output.Summary.UniqueUsers = len(uniqueUsers)
+    output.Summary.ExcludedRandomized = len(randomized)
+    output.setDensity(result.density())
+
+    sortProviders(output.Providers)
+
+    return output
+}
+
+// sortProviders orders provider reports by total_authentications (descending) or by -sort
+func sortProviders(providers []SimplifiedOutputData) {
+    sort.Slice(providers, func(i, j int) bool {
+        a, b := providers[i], providers[j]
+        if sortOrder.Field != "" {
+            return sortOrder.less(
+                sortItem{a.QueryInfo.ServiceProvider, a.Summary.TotalAuths, a.Summary.UniqueUsers},
+                sortItem{b.QueryInfo.ServiceProvider, b.Summary.TotalAuths, b.Summary.UniqueUsers})
+        }
+        return a.Summary.TotalAuths > b.Summary.TotalAuths
+    })
 }
 
 
@@ -193,6 +1149,15 @@ func createOutputData(result *Result, serviceProvider string, startDate, endDate
     output.QueryInfo.Days = days
     output.QueryInfo.StartDate = startDate.Format("2006-01-02 15:04:05")
     output.QueryInfo.EndDate = endDate.Format("2006-01-02 15:04:05")
+    output.QueryInfo.AuthInterval = opts.Interval
+    output.QueryInfo.NoDetails = opts.NoDetails
+    output.QueryInfo.IncludeChallenges = opts.IncludeChallenges
+    output.QueryInfo.Trend = opts.Trend
+    output.QueryInfo.ExcludeRandomized = opts.ExcludeRandomized
+    if result.KnownStations != nil {
+        output.QueryInfo.BaselineDays = opts.BaselineDays
+        output.QueryInfo.BaselineTruncated = truncatedBaseline.Load()
+    }
 
     // Calculate summary
     uniqueUsers := make(map[string]bool)
@@ -202,12 +1167,23 @@ func createOutputData(result *Result, serviceProvider string, startDate, endDate
             uniqueUsers[username] = true
         }
         totalAuths += stats.TotalAuths
+        output.Summary.TotalChallenges += stats.TotalChallenges
     }
 
     output.Summary.UniqueStations = len(result.Stations)
     output.Summary.UniqueUsers = len(uniqueUsers)
     output.Summary.UniqueRealms = len(result.Realms)
     output.Summary.TotalAuths = totalAuths
+    output.Summary.ExcludedRandomized = len(result.Randomized)
+    output.setDensity(result.density())
+
+    // -sample: ขยายยอดรวมจากวันที่ query จริงให้เต็มช่วง (ตัวเลขราย station/realm ยังเป็นค่าที่สุ่มได้)
+    if opts.Sample > 1 {
+        _, scale := sampleCoverage(startDate, endDate)
+        output.QueryInfo.SampleInfo = newSampleInfo(startDate, endDate)
+        output.Summary.TotalAuths = int(math.Round(float64(totalAuths) * scale))
+        output.Summary.TotalChallenges = int(math.Round(float64(output.Summary.TotalChallenges) * scale))
+    }
 
     // Process station stats
     output.StationStats = make([]StationStatsOutput, 0, len(result.Stations))
@@ -216,34 +1192,106 @@ func createOutputData(result *Result, serviceProvider string, startDate, endDate
         stationStat := StationStatsOutput{
             StationID:  stationID,
             TotalAuths: stats.TotalAuths,
+            TotalChallenges: stats.TotalChallenges,
             TotalUsers: len(stats.Users),
-            UserDetails: make([]UserDetail, 0, len(stats.Users)),
         }
 
-        // Process each user's details
-        for username, activity := range stats.Users {
-            // Convert timestamps to RFC3339
-            timestamps := make([]string, len(activity.AuthTimestamps))
-            parsedTimestamps := make([]time.Time, len(activity.AuthTimestamps))
+        // ช่วงเวลาที่เห็น station: แยกอุปกรณ์ guest ชั่วคราวออกจากอุปกรณ์ที่ติดตั้งถาวร
+        if firstSeen, lastSeen, ok := stationSpan(stats); ok {
+            stationStat.FirstSeen = TimeString(firstSeen.Format(time.RFC3339))
+            stationStat.LastSeen = TimeString(lastSeen.Format(time.RFC3339))
+            stationStat.LifespanDays = lifespanDays(firstSeen, lastSeen)
+        }
+
+        if ouiVendors != nil {
+            stationStat.Vendor = lookupVendor(stationID)
+        }
+
+        if opts.BusinessHours != "" {
+            stationStat.BusinessHoursRatio = businessHoursRatio(stats)
+        }
+
+        // ตรวจสอบว่าเป็นอุปกรณ์ใหม่เทียบกับช่วง baseline
+        if result.KnownStations != nil {
+            isNew := !result.KnownStations[stationID]
+            stationStat.IsNew = &isNew
+            if isNew {
+                output.Summary.NewStations++
+            }
+        }
+
+        // Process each user's details (ข้ามเมื่อใช้ -no-details)
+        // -fields เลือกเฉพาะส่วนที่ต้องการ (ค่าเริ่มต้นคือทั้งหมด)
+        var usagePatterns *UsagePattern
+        if !opts.NoDetails {
+            if analysisFields["details"] {
+                stationStat.UserDetails = make([]UserDetail, 0, len(stats.Users))
+            }
+            for username, activity := range stats.Users {
+                // Convert timestamps to RFC3339 (serialized per -ts-format)
+                timestamps := make([]TimeString, len(activity.AuthTimestamps))
+                parsedTimestamps := make([]time.Time, len(activity.AuthTimestamps))
             
-            for i, ts := range activity.AuthTimestamps {
-                timestamps[i] = ts.Format(time.RFC3339)
-                parsedTimestamps[i] = ts
+                for i, ts := range activity.AuthTimestamps {
+                    timestamps[i] = TimeString(ts.Format(time.RFC3339))
+                    parsedTimestamps[i] = ts
+                }
+
+                userDetail := UserDetail{
+                    Username:       username,
+                    Realm:         activity.Realm,
+                    AuthTimestamps: timestamps,
+                    ChallengeCount: len(activity.ChallengeTimestamps),
+                }
+                if analysisFields["details"] {
+                    stationStat.UserDetails = append(stationStat.UserDetails, userDetail)
+                }
+
+                if analysisFields["sessions"] && len(parsedTimestamps) > 0 {
+                    if sessions := result.AcctSessions[stationID]; len(sessions) > 0 {
+                        stationStat.SessionAnalysis = acctSessionAnalysis(sessions, parsedTimestamps)
+                    } else {
+                        stationStat.SessionAnalysis = analyzeSessionPatterns(parsedTimestamps)
+                    }
+                }
+
+                // Analyze patterns for this device (ใช้กับ issues และ quiet hours ด้วย)
+                if !analysisFields["patterns"] && !analysisFields["issues"] && opts.QuietHours == "" {
+                    continue
+                }
+                if patterns := analyzeUsagePatterns(parsedTimestamps, activity.ChallengeTimestamps); patterns != nil {
+                    usagePatterns = patterns
+                    if analysisFields["patterns"] {
+                        stationStat.UsagePatterns = patterns
+                    }
+                    if analysisFields["issues"] {
+                        stationStat.PotentialIssues = analyzePotentialIssues(patterns)
+                    }
+                }
             }
+        }
 
-            userDetail := UserDetail{
-                Username:       username,
-                Realm:         activity.Realm,
-                AuthTimestamps: timestamps,
+        if opts.QuietHours != "" && usagePatterns != nil &&
+            usagePatterns.OvernightAuthCount > opts.QuietThreshold {
+            output.Summary.OvernightStations++
+        }
+
+        // MAC เดียวแต่ใช้หลาย username (shared device / MAC spoofing)
+        if opts.MaxIdentities > 0 && len(stats.Users) > opts.MaxIdentities {
+            output.Summary.ManyIdentityStations++
+            if analysisFields["issues"] && !opts.NoDetails {
+                stationStat.PotentialIssues = append(stationStat.PotentialIssues,
+                    manyIdentitiesIssue(stats, startDate, endDate))
             }
-            stationStat.UserDetails = append(stationStat.UserDetails, userDetail)
+        }
 
-            // Analyze patterns for this device
-            usagePatterns := analyzeUsagePatterns(parsedTimestamps)
-            if usagePatterns != nil {
-                stationStat.UsagePatterns = usagePatterns
-                stationStat.SessionAnalysis = analyzeSessionPatterns(parsedTimestamps)
-                stationStat.PotentialIssues = analyzePotentialIssues(usagePatterns)
+        // MAC เดียวถูกใช้โดย user จากหลาย realm ข้ามวัน (MAC spoofing ข้ามสถาบัน)
+        stationStat.DistinctRealms = len(stats.Realms)
+        if opts.MaxRealms > 0 && len(stats.Realms) > opts.MaxRealms {
+            output.Summary.ManyRealmStations++
+            if analysisFields["issues"] && !opts.NoDetails {
+                stationStat.PotentialIssues = append(stationStat.PotentialIssues,
+                    manyRealmsIssue(stats, startDate, endDate))
             }
         }
 
@@ -255,11 +1303,22 @@ func createOutputData(result *Result, serviceProvider string, startDate, endDate
         output.StationStats = append(output.StationStats, stationStat)
     }
 
-    // Sort StationStats by total_auths (descending)
+    // Sort StationStats by total_auths (descending) หรือตาม -sort
     sort.Slice(output.StationStats, func(i, j int) bool {
-        return output.StationStats[i].TotalAuths > output.StationStats[j].TotalAuths
+        a, b := output.StationStats[i], output.StationStats[j]
+        if sortOrder.Field != "" {
+            return sortOrder.less(
+                sortItem{a.StationID, a.TotalAuths, a.TotalUsers},
+                sortItem{b.StationID, b.TotalAuths, b.TotalUsers})
+        }
+        return a.TotalAuths > b.TotalAuths
     })
 
+    // เก็บเฉพาะ top-N stations ในโหมด -no-details
+    if opts.NoDetails && len(output.StationStats) > opts.TopN {
+        output.StationStats = output.StationStats[:opts.TopN]
+    }
+
     // Process realm stats
     output.RealmStats = make([]RealmStat, 0, len(result.Realms))
     for realm, stats := range result.Realms {
@@ -269,42 +1328,208 @@ func createOutputData(result *Result, serviceProvider string, startDate, endDate
             TotalStations: len(stats.Stations),
             TotalAuths:    stats.TotalAuths,
         }
+        for date, day := range stats.Daily {
+            realmStat.Trend = append(realmStat.Trend, RealmTrendPoint{
+                Date:        date,
+                ActiveUsers: len(day.Users),
+                Auths:       day.Auths,
+            })
+        }
+        if opts.FillGaps && opts.Trend {
+            realmStat.Trend = fillTrendGaps(realmStat.Trend, stats.Daily, startDate, endDate)
+        }
+        sort.Slice(realmStat.Trend, func(i, j int) bool {
+            return realmStat.Trend[i].Date < realmStat.Trend[j].Date
+        })
         output.RealmStats = append(output.RealmStats, realmStat)
     }
 
-    // Sort RealmStats by total_auths (descending)
+    // Sort RealmStats by total_auths (descending) หรือตาม -sort
     sort.Slice(output.RealmStats, func(i, j int) bool {
-        return output.RealmStats[i].TotalAuths > output.RealmStats[j].TotalAuths
+        a, b := output.RealmStats[i], output.RealmStats[j]
+        if sortOrder.Field != "" {
+            return sortOrder.less(
+                sortItem{a.Realm, a.TotalAuths, a.TotalUsers},
+                sortItem{b.Realm, b.TotalAuths, b.TotalUsers})
+        }
+        return a.TotalAuths > b.TotalAuths
+    })
+
+    // Users seen with more than one realm
+    for username, realms := range result.UserRealms {
+        if len(realms) > 1 {
+            output.RealmAnomalies = append(output.RealmAnomalies, RealmAnomaly{
+                Username: username,
+                Realms:   realms,
+            })
+        }
+    }
+
+    // Sort RealmAnomalies by number of realms (descending), then username
+    sort.Slice(output.RealmAnomalies, func(i, j int) bool {
+        if len(output.RealmAnomalies[i].Realms) != len(output.RealmAnomalies[j].Realms) {
+            return len(output.RealmAnomalies[i].Realms) > len(output.RealmAnomalies[j].Realms)
+        }
+        return output.RealmAnomalies[i].Username < output.RealmAnomalies[j].Username
     })
 
     return output
 }
 
+// AcctSession is one accounting session of a station, merged from all Accounting-Request
+// records that share an acct_session_id
+type AcctSession struct {
+    ID          string
+    Start       time.Time
+    End         time.Time
+    SessionTime int64 // Acct-Session-Time สูงสุดที่พบ (วินาที)
+}
+
 // แก้ไข struct กลางที่ใช้ในการประมวลผล
 type Result struct {
-    Stations    map[string]*StationStats  // key: station_id
-    Realms      map[string]*RealmStats    // key: realm
+    Stations      map[string]*StationStats  // key: station_id
+    Realms        map[string]*RealmStats    // key: realm
+    UserRealms    map[string]map[string]int // key: username -> realm -> auth count
+    KnownStations map[string]bool           // station_id ที่พบในช่วง baseline (nil = ไม่ได้ query)
+    AcctSessions  map[string][]AcctSession  // key: station_id (nil = ไม่ได้ใช้ -acct-sessions)
+    Providers     map[string]*Result        // key: service_provider (เฉพาะโหมด all)
+    Randomized    map[string]bool           // station_id ที่ถูกตัดออกด้วย -exclude-randomized
 }
 
-// analyzeUsagePatterns วิเคราะห์ pattern การใช้งานจาก timestamps
-func analyzeUsagePatterns(timestamps []time.Time) *UsagePattern {
-    if len(timestamps) == 0 {
-        return nil
+// newResult creates an empty Result
+func newResult() *Result {
+    return &Result{
+        Stations:   make(map[string]*StationStats),
+        Realms:     make(map[string]*RealmStats),
+        UserRealms: make(map[string]map[string]int),
     }
+}
 
-    // เรียงลำดับเวลา
-    sort.Slice(timestamps, func(i, j int) bool {
-        return timestamps[i].Before(timestamps[j])
-    })
-
-    pattern := &UsagePattern{
-        HourlyDistribution: make(map[string]int),
+// providerResult returns the nested Result for a provider, creating it if needed
+func (r *Result) providerResult(provider string) *Result {
+    sub, exists := r.Providers[provider]
+    if !exists {
+        sub = newResult()
+        sub.KnownStations = r.KnownStations
+        sub.AcctSessions = r.AcctSessions
+        r.Providers[provider] = sub
+    }
+    return sub
+}
+
+// leafResults returns the Results that hold station data: the per-provider
+// Results in all-providers mode, or r itself otherwise
+func (r *Result) leafResults() []*Result {
+    if r.Providers == nil {
+        return []*Result{r}
+    }
+    leaves := make([]*Result, 0, len(r.Providers))
+    for _, sub := range r.Providers {
+        leaves = append(leaves, sub)
+    }
+    return leaves
+}
+
+// countUnique returns the number of distinct stations and realms across all leaf Results
+func (r *Result) countUnique() (int, int) {
+    stations := make(map[string]bool)
+    realms := make(map[string]bool)
+    for _, leaf := range r.leafResults() {
+        for stationID := range leaf.Stations {
+            stations[stationID] = true
+        }
+        for realm := range leaf.Realms {
+            realms[realm] = true
+        }
+    }
+    return len(stations), len(realms)
+}
+
+// Density holds the users-per-station and stations-per-user distribution of a Result
+type Density struct {
+    AvgUsersPerStation float64
+    MaxUsersPerStation int
+    AvgStationsPerUser float64
+    MaxStationsPerUser int
+}
+
+// density computes Density across all leaf Results; a station seen under several
+// providers counts once with the union of its users
+func (r *Result) density() Density {
+    stationUsers := make(map[string]map[string]bool)
+    userStations := make(map[string]map[string]bool)
+    for _, leaf := range r.leafResults() {
+        for stationID, stats := range leaf.Stations {
+            if stationUsers[stationID] == nil {
+                stationUsers[stationID] = make(map[string]bool)
+            }
+            for username := range stats.Users {
+                stationUsers[stationID][username] = true
+                if userStations[username] == nil {
+                    userStations[username] = make(map[string]bool)
+                }
+                userStations[username][stationID] = true
+            }
+        }
+    }
+
+    var d Density
+    pairs := 0
+    for _, users := range stationUsers {
+        pairs += len(users)
+        if len(users) > d.MaxUsersPerStation {
+            d.MaxUsersPerStation = len(users)
+        }
+    }
+    for _, stations := range userStations {
+        if len(stations) > d.MaxStationsPerUser {
+            d.MaxStationsPerUser = len(stations)
+        }
+    }
+    // จำนวนคู่ station-user เท่ากันทั้งสองทิศ ต่างกันแค่ตัวหาร
+    if len(stationUsers) > 0 {
+        d.AvgUsersPerStation = math.Round(float64(pairs)/float64(len(stationUsers))*100) / 100
+    }
+    if len(userStations) > 0 {
+        d.AvgStationsPerUser = math.Round(float64(pairs)/float64(len(userStations))*100) / 100
+    }
+    return d
+}
+
+// analyzeUsagePatterns วิเคราะห์ pattern การใช้งานจาก timestamps
+// วิเคราะห์เฉพาะ Access-Accept ส่วน challenges นับแยกเพื่อไม่ให้ปนกับ reauth
+func analyzeUsagePatterns(timestamps []time.Time, challenges []time.Time) *UsagePattern {
+    if len(timestamps) == 0 {
+        return nil
+    }
+
+    // เรียงลำดับเวลา
+    sort.Slice(timestamps, func(i, j int) bool {
+        return timestamps[i].Before(timestamps[j])
+    })
+
+    pattern := &UsagePattern{
+        HourlyDistribution: make(map[string]int),
     }
 
     // วิเคราะห์การกระจายตัวรายชั่วโมง
     for _, ts := range timestamps {
-        hour := ts.Format("15:00-15:59")
-        pattern.HourlyDistribution[hour]++
+        pattern.HourlyDistribution[hourKey(ts.Hour())]++
+    }
+
+    // นับ Access-Challenge แยกจาก auth ที่สำเร็จ
+    pattern.ChallengeCount = len(challenges)
+    if pattern.ChallengeCount > 0 {
+        pattern.ChallengesPerAuth = float64(pattern.ChallengeCount) / float64(len(timestamps))
+    }
+
+    // นับ auth ในช่วง quiet hours จาก hourly distribution
+    if opts.QuietHours != "" {
+        for hour := 0; hour < 24; hour++ {
+            if inQuietHours(hour) {
+                pattern.OvernightAuthCount += pattern.HourlyDistribution[hourKey(hour)]
+            }
+        }
     }
 
     // วิเคราะห์ช่วงเวลาระหว่าง auth
@@ -344,8 +1569,189 @@ func analyzeUsagePatterns(timestamps []time.Time) *UsagePattern {
     return pattern
 }
 
-// sendQuickwitRequest handles HTTP communication with Quickwit
+// hourKey returns the hourly_distribution key for an hour of the day (e.g., "08:00-08:59")
+func hourKey(hour int) string {
+    return fmt.Sprintf("%02d:00-%02d:59", hour, hour)
+}
+
+// businessHoursRatio returns the fraction of a station's auths inside -business-hours (local time),
+// rounded to 3 decimals, or nil for a station without auths (challenges only)
+func businessHoursRatio(stats *StationStats) *float64 {
+    var total, inside int
+    for _, activity := range stats.Users {
+        for _, ts := range activity.AuthTimestamps {
+            total++
+            if inBusinessHours(ts.Local().Hour()) {
+                inside++
+            }
+        }
+    }
+    if total == 0 {
+        return nil
+    }
+    ratio := math.Round(float64(inside)/float64(total)*1000) / 1000
+    return &ratio
+}
+
+// inBusinessHours reports whether an hour of the day falls inside -business-hours
+func inBusinessHours(hour int) bool {
+    if opts.BusinessStart < opts.BusinessEnd {
+        return hour >= opts.BusinessStart && hour < opts.BusinessEnd
+    }
+    return hour >= opts.BusinessStart || hour < opts.BusinessEnd
+}
+
+// parseQuietHours parses a HH-HH range (-quiet-hours, -business-hours); the end hour is exclusive and the range may wrap midnight
+func parseQuietHours(value string) (int, int, error) {
+    parts := strings.SplitN(value, "-", 2)
+    if len(parts) != 2 {
+        return 0, 0, fmt.Errorf("expected HH-HH, got %q", value)
+    }
+    start, err := strconv.Atoi(parts[0])
+    if err != nil || start < 0 || start > 23 {
+        return 0, 0, fmt.Errorf("invalid start hour %q", parts[0])
+    }
+    end, err := strconv.Atoi(parts[1])
+    if err != nil || end < 0 || end > 24 {
+        return 0, 0, fmt.Errorf("invalid end hour %q", parts[1])
+    }
+    if start == end {
+        return 0, 0, fmt.Errorf("start and end hour must differ")
+    }
+    return start, end, nil
+}
+
+// inQuietHours reports whether an hour of the day falls inside the configured quiet hours
+func inQuietHours(hour int) bool {
+    if opts.QuietStart < opts.QuietEnd {
+        return hour >= opts.QuietStart && hour < opts.QuietEnd
+    }
+    return hour >= opts.QuietStart || hour < opts.QuietEnd
+}
+
+// sendQuickwitRequest sends a search request, retrying up to maxResponseRetries times when the
+// response body is cut short or lacks the keys of a search response (a dropped connection)
 func sendQuickwitRequest(query map[string]interface{}, props Properties) (map[string]interface{}, error) {
+    cacheFile := cachePath(query, props)
+    if cacheFile != "" {
+        if result, err := loadCachedResponse(cacheFile); err == nil {
+            cacheHits.Add(1)
+            return result, nil
+        }
+    }
+
+    for attempt := 1; ; attempt++ {
+        result, err := sendQuickwitAttempt(query, props)
+        if err == nil && cacheFile != "" {
+            if err := saveCachedResponse(cacheFile, result); err != nil {
+                log.Printf("Error caching response: %v", err)
+            }
+        }
+        retryable := errors.Is(err, ErrIncompleteResponse) || errors.Is(err, ErrServerUnavailable)
+        if err == nil || !retryable || attempt > maxResponseRetries {
+            return result, err
+        }
+        log.Printf("Quickwit search failed (attempt %d of %d), retrying: %v", attempt, maxResponseRetries+1, err)
+        time.Sleep(time.Duration(attempt) * time.Second)
+    }
+}
+
+// cacheHits counts the requests answered from -cache-dir
+var cacheHits atomic.Int64
+
+// cachePath returns the -cache-dir file of a search request, or "" when caching is off or the
+// request's range reaches into today (its results may still change)
+func cachePath(query map[string]interface{}, props Properties) string {
+    if opts.CacheDir == "" {
+        return ""
+    }
+    var end int64
+    switch v := query["end_timestamp"].(type) {
+    case int64:
+        end = v
+    case int:
+        end = int64(v)
+    case float64:
+        end = int64(v)
+    default:
+        return ""
+    }
+    // end_timestamp ไม่รวมตัวเอง: day-job ที่จบเที่ยงคืนวันนี้คือเมื่อวานทั้งวัน จึง cache ได้
+    now := time.Now()
+    today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+    if end > today.Unix() {
+        return ""
+    }
+
+    // encoding/json เรียง key ของ map จึงได้ hash เดิมสำหรับ request เดิม
+    data, err := json.Marshal(query)
+    if err != nil {
+        return ""
+    }
+    return filepath.Join(opts.CacheDir, sha256Hex(append([]byte(props.QWURL+"\n"), data...))+".json")
+}
+
+// loadCachedResponse reads a search response saved by saveCachedResponse
+func loadCachedResponse(name string) (map[string]interface{}, error) {
+    data, err := os.ReadFile(name)
+    if err != nil {
+        return nil, err
+    }
+    var result map[string]interface{}
+    if err := json.Unmarshal(data, &result); err != nil {
+        return nil, err
+    }
+    return result, nil
+}
+
+// saveCachedResponse stores a search response in -cache-dir
+func saveCachedResponse(name string, result map[string]interface{}) error {
+    data, err := json.Marshal(result)
+    if err != nil {
+        return err
+    }
+    return writeFileAtomic(name, data)
+}
+
+// maxResponseRetries is how many times a search that fails with ErrIncompleteResponse or
+// ErrServerUnavailable is re-requested
+const maxResponseRetries = 3
+
+// Errors returned by the Quickwit requests; sendQuickwitRequest branches on them with errors.Is
+var (
+    ErrQuickwitAuth       = errors.New("quickwit authentication failed")
+    ErrQuickwitQuery      = errors.New("quickwit rejected the query")
+    ErrPayloadTooLarge    = errors.New("quickwit payload too large")
+    ErrServerUnavailable  = errors.New("quickwit unavailable")
+    ErrIncompleteResponse = errors.New("incomplete response")
+)
+
+// statusError wraps a non-200 Quickwit answer in the matching sentinel error:
+// 401/403 auth, 413 payload too large, 429/5xx unavailable, other 4xx query
+func statusError(status int, body []byte) error {
+    var kind error
+    switch {
+    case status == http.StatusUnauthorized || status == http.StatusForbidden:
+        kind = ErrQuickwitAuth
+    case status == http.StatusRequestEntityTooLarge:
+        kind = ErrPayloadTooLarge
+    case status == http.StatusTooManyRequests || status >= 500:
+        kind = ErrServerUnavailable
+    case status >= 400:
+        kind = ErrQuickwitQuery
+    default:
+        return fmt.Errorf("quickwit error (status %d): %s", status, string(body))
+    }
+    return fmt.Errorf("%w (status %d): %s", kind, status, string(body))
+}
+
+// sendQuickwitAttempt sends a search request once; retryable reports an incomplete response
+func sendQuickwitAttempt(query map[string]interface{}, props Properties) (map[string]interface{}, error) {
+    if inflight != nil {
+        inflight <- struct{}{}
+        defer func() { <-inflight }()
+    }
+
     jsonQuery, err := json.Marshal(query)
     if err != nil {
         return nil, fmt.Errorf("error marshaling query: %v", err)
@@ -360,95 +1766,282 @@ func sendQuickwitRequest(query map[string]interface{}, props Properties) (map[st
     req.Header.Set("Content-Type", "application/json")
     req.Header.Set("Accept", "application/json")
 
-    client := &http.Client{Timeout: 30 * time.Second}
-    resp, err := client.Do(req)
+    resp, err := httpClient.Do(req)
     if err != nil {
-        return nil, fmt.Errorf("error sending request: %v", err)
+        return nil, fmt.Errorf("%w: error sending request: %v", ErrServerUnavailable, err)
     }
     defer resp.Body.Close()
 
     body, err := io.ReadAll(resp.Body)
     if err != nil {
-        return nil, fmt.Errorf("error reading response: %v", err)
+        return nil, fmt.Errorf("%w: error reading response: %v", ErrIncompleteResponse, err)
     }
 
     if resp.StatusCode != http.StatusOK {
-        return nil, fmt.Errorf("quickwit error (status %d): %s", resp.StatusCode, string(body))
+        return nil, statusError(resp.StatusCode, body)
     }
 
     var result map[string]interface{}
     if err := json.Unmarshal(body, &result); err != nil {
-        return nil, fmt.Errorf("error decoding response: %v", err)
+        return nil, fmt.Errorf("%w: error decoding response (truncated or invalid body): %v", ErrIncompleteResponse, err)
+    }
+
+    if err := checkSearchResponse(query, result); err != nil {
+        return nil, err
     }
 
     return result, nil
 }
 
+// checkSearchResponse verifies a decoded search response is complete: num_hits and hits are always
+// present, and aggregations whenever the query asked for aggs
+func checkSearchResponse(query, result map[string]interface{}) error {
+    if _, ok := result["num_hits"].(float64); !ok {
+        return fmt.Errorf("%w: no num_hits", ErrIncompleteResponse)
+    }
+    if _, ok := result["hits"].([]interface{}); !ok {
+        return fmt.Errorf("%w: no hits", ErrIncompleteResponse)
+    }
+    if _, asked := query["aggs"]; asked {
+        if _, ok := result["aggregations"].(map[string]interface{}); !ok {
+            return fmt.Errorf("%w: no aggregations", ErrIncompleteResponse)
+        }
+    }
+    return nil
+}
+
 // processStationBucket processes a single station bucket
-func processStationBucket(bucket map[string]interface{}, stationID string, resultChan chan<- LogEntry) {
+func processStationBucket(bucket map[string]interface{}, stationID, provider string, resultChan chan<- LogEntry, truncated *DayTruncation) {
     byUser, ok := bucket["by_user"].(map[string]interface{})
     if !ok {
+        malformedBuckets.Add(1)
         return
     }
 
     userBuckets, ok := byUser["buckets"].([]interface{})
     if !ok {
+        malformedBuckets.Add(1)
         return
     }
+    truncated.Users += otherDocCount(byUser)
 
     for _, userBucketInterface := range userBuckets {
         userBucket, ok := userBucketInterface.(map[string]interface{})
         if !ok {
+            malformedBuckets.Add(1)
             continue
         }
 
-        username := userBucket["key"].(string)
+        username, ok := userBucket["key"].(string)
+        if !ok {
+            malformedBuckets.Add(1)
+            continue
+        }
 
-        // Process realm information
-        if byRealm, ok := userBucket["by_realm"].(map[string]interface{}); ok {
-            if realmBuckets, ok := byRealm["buckets"].([]interface{}); ok {
-                if len(realmBuckets) > 0 {
-                    if realmBucket, ok := realmBuckets[0].(map[string]interface{}); ok {
-                        realm := realmBucket["key"].(string)
-                        processUserAuthTimes(userBucket, username, realm, stationID, resultChan)
-                    }
-                }
-            }
+        // Process realm information: the indexed realm (the ingester's "from <realm>") wins,
+        // the domain of "user@realm" is only a fallback for documents indexed without it
+        realm, ok := firstRealm(userBucket, truncated)
+        if !ok {
+            realm, ok = usernameRealm(username)
+        }
+        if !ok {
+            malformedBuckets.Add(1)
+            continue
+        }
+        processUserMessageTypes(userBucket, username, realm, stationID, provider, resultChan)
+    }
+}
+
+// firstRealm returns the key of the first by_realm bucket of a user bucket
+func firstRealm(userBucket map[string]interface{}, truncated *DayTruncation) (string, bool) {
+    byRealm, ok := userBucket["by_realm"].(map[string]interface{})
+    if !ok {
+        return "", false
+    }
+    truncated.Realms += otherDocCount(byRealm)
+    realmBuckets, ok := byRealm["buckets"].([]interface{})
+    if !ok || len(realmBuckets) == 0 {
+        return "", false
+    }
+    realmBucket, ok := realmBuckets[0].(map[string]interface{})
+    if !ok {
+        return "", false
+    }
+    realm, ok := realmBucket["key"].(string)
+    return realm, ok
+}
+
+// usernameRealm returns the realm of "user@realm" (split at the last '@'), or false without one
+func usernameRealm(username string) (string, bool) {
+    index := strings.LastIndex(username, "@")
+    if index == -1 || index == len(username)-1 {
+        return "", false
+    }
+    return username[index+1:], true
+}
+
+// processUserMessageTypes splits a user bucket by message_type when -include-challenges is set
+func processUserMessageTypes(bucket map[string]interface{}, username, realm, stationID, provider string, resultChan chan<- LogEntry) {
+    if !opts.IncludeChallenges {
+        processUserAuthTimes(bucket, username, realm, stationID, provider, messageAccept, resultChan)
+        return
+    }
+
+    byType, ok := bucket["by_type"].(map[string]interface{})
+    if !ok {
+        malformedBuckets.Add(1)
+        return
+    }
+
+    typeBuckets, ok := byType["buckets"].([]interface{})
+    if !ok {
+        malformedBuckets.Add(1)
+        return
+    }
+
+    for _, typeBucketInterface := range typeBuckets {
+        typeBucket, ok := typeBucketInterface.(map[string]interface{})
+        if !ok {
+            malformedBuckets.Add(1)
+            continue
         }
+
+        messageType, _ := typeBucket["key"].(string)
+        processUserAuthTimes(typeBucket, username, realm, stationID, provider, messageType, resultChan)
     }
 }
 
 // processUserAuthTimes processes authentication timestamps for a user
-func processUserAuthTimes(bucket map[string]interface{}, username, realm, stationID string, resultChan chan<- LogEntry) {
+func processUserAuthTimes(bucket map[string]interface{}, username, realm, stationID, provider, messageType string, resultChan chan<- LogEntry) {
     authTimes, ok := bucket["auth_times"].(map[string]interface{})
     if !ok {
+        malformedBuckets.Add(1)
         return
     }
 
     timeBuckets, ok := authTimes["buckets"].([]interface{})
     if !ok {
+        malformedBuckets.Add(1)
         return
     }
 
     for _, timeBucketInterface := range timeBuckets {
         timeBucket, ok := timeBucketInterface.(map[string]interface{})
-        if !ok || timeBucket["doc_count"].(float64) == 0 {
+        if !ok {
+            malformedBuckets.Add(1)
+            continue
+        }
+        docCount, ok := timeBucket["doc_count"].(float64)
+        if !ok {
+            malformedBuckets.Add(1)
+            continue
+        }
+        if docCount == 0 {
+            continue
+        }
+        key, ok := timeBucket["key"].(float64)
+        if !ok {
+            malformedBuckets.Add(1)
             continue
         }
 
-        timestamp := time.Unix(int64(timeBucket["key"].(float64)/1000), 0)
-        resultChan <- LogEntry{
+        timestamp := time.Unix(int64(key/1000), 0)
+        sendEntry(resultChan, LogEntry{
             Username:        username,  // แน่ใจว่ามีการส่ง username
             Realm:          realm,
+            ServiceProvider: provider,
             StationID:      stationID,
+            MessageType:    messageType,
             Timestamp:      timestamp,
-        }
+        })
+    }
+}
+
+// sendEntry sends an entry to resultChan, counting sends that had to block
+func sendEntry(resultChan chan<- LogEntry, entry LogEntry) {
+    totalSends.Add(1)
+    select {
+    case resultChan <- entry:
+    default:
+        blockedSends.Add(1)
+        resultChan <- entry
+    }
+}
+
+// checkQuickwit verifies that Quickwit is alive and the nro-logs index exists
+func checkQuickwit(props Properties) error {
+    // livez อยู่หลัง proxy เดียวกับ API ซึ่งอาจบังคับ basic auth ด้วย
+    req, err := http.NewRequest("GET", props.QWURL+"/health/livez", nil)
+    if err != nil {
+        return fmt.Errorf("error creating request: %v", err)
+    }
+    req.SetBasicAuth(props.QWUser, props.QWPass)
+
+    resp, err := httpClient.Do(req)
+    if err != nil {
+        return fmt.Errorf("%w: error connecting to %s: %v", ErrServerUnavailable, props.QWURL, err)
+    }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("%w: health check failed (status %d)", ErrServerUnavailable, resp.StatusCode)
+    }
+
+    req, err = http.NewRequest("GET", props.QWURL+"/api/v1/indexes/nro-logs", nil)
+    if err != nil {
+        return fmt.Errorf("error creating request: %v", err)
+    }
+    req.SetBasicAuth(props.QWUser, props.QWPass)
+
+    resp, err = httpClient.Do(req)
+    if err != nil {
+        return fmt.Errorf("error sending request: %v", err)
+    }
+    defer resp.Body.Close()
+
+    switch resp.StatusCode {
+    case http.StatusOK:
+        return nil
+    case http.StatusUnauthorized, http.StatusForbidden:
+        return fmt.Errorf("%w (status %d): check QW_USER/QW_PASS", ErrQuickwitAuth, resp.StatusCode)
+    case http.StatusNotFound:
+        return fmt.Errorf("%w: index nro-logs not found", ErrQuickwitQuery)
+    default:
+        body, _ := io.ReadAll(resp.Body)
+        return fmt.Errorf("quickwit error (status %d): %s", resp.StatusCode, string(body))
+    }
+}
+
+// runCheck runs checkQuickwit with qw-auth.properties and exits with its result
+func runCheck() {
+    props, err := readProperties("qw-auth.properties")
+    if err != nil {
+        log.Fatalf("Error reading properties: %v", err)
+    }
+    httpClient, err = newHTTPClient(opts.Timeout, opts.MaxIdleConns, props)
+    if err != nil {
+        log.Fatalf("Error creating HTTP client: %v", err)
     }
+
+    if err := checkQuickwit(props); err != nil {
+        fmt.Printf("Check failed: %v\n", err)
+        os.Exit(1)
+    }
+    fmt.Printf("Check OK: %s is reachable and index nro-logs exists\n", props.QWURL)
+    os.Exit(0)
 }
 
-// readProperties reads authentication properties from a file
+// readProperties reads authentication properties from a file, with QW_USER/QW_PASS/QW_URL environment overrides
 func readProperties(filePath string) (Properties, error) {
     file, err := os.Open(filePath)
+    if os.IsNotExist(err) {
+        // ไม่มีไฟล์: ใช้ QW_USER/QW_PASS/QW_URL จาก environment (เช่นใน container)
+        props := Properties{}
+        applyEnvProperties(&props)
+        if props.QWURL == "" {
+            return Properties{}, err
+        }
+        return props, validateProperties(props)
+    }
     if err != nil {
         return Properties{}, err
     }
@@ -472,12 +2065,166 @@ func readProperties(filePath string) (Properties, error) {
                     props.QWPass = value
                 case "QW_URL":
                     props.QWURL = strings.TrimPrefix(value, "=")
+                case "QW_CLIENT_CERT":
+                    props.ClientCert = value
+                case "QW_CLIENT_KEY":
+                    props.ClientKey = value
+                case "QW_PROXY":
+                    props.Proxy = value
+                case "QW_NO_PROXY":
+                    props.NoProxy = value
+                case "S3_ENDPOINT":
+                    props.S3.Endpoint = strings.TrimSuffix(value, "/")
+                case "S3_REGION":
+                    props.S3.Region = value
+                case "S3_ACCESS_KEY":
+                    props.S3.AccessKey = value
+                case "S3_SECRET_KEY":
+                    props.S3.SecretKey = value
                 }
             }
         }
     }
     
-    return props, scanner.Err()
+    if err := scanner.Err(); err != nil {
+        return props, err
+    }
+    if (props.ClientCert == "") != (props.ClientKey == "") {
+        return props, fmt.Errorf("QW_CLIENT_CERT and QW_CLIENT_KEY must be set together")
+    }
+    applyEnvProperties(&props)
+    return props, validateProperties(props)
+}
+
+// validateProperties reports the Quickwit settings left empty by both qw-auth.properties and the
+// environment, so a missing key fails here instead of as a 401 from Quickwit
+func validateProperties(props Properties) error {
+    var missing []string
+    for _, field := range []struct {
+        name  string
+        value string
+    }{
+        {"QW_USER", props.QWUser},
+        {"QW_PASS", props.QWPass},
+        {"QW_URL", props.QWURL},
+    } {
+        if field.value == "" {
+            missing = append(missing, field.name)
+        }
+    }
+    if len(missing) > 0 {
+        return fmt.Errorf("missing required settings in qw-auth.properties (or the environment): %s", strings.Join(missing, ", "))
+    }
+    return nil
+}
+
+// applyEnvProperties fills QWUser/QWPass/QWURL from the QW_USER/QW_PASS/QW_URL environment
+// variables; a set variable overrides the file unless -prefer-file is given
+func applyEnvProperties(props *Properties) {
+    for _, field := range []struct {
+        name  string
+        value *string
+    }{
+        {"QW_USER", &props.QWUser},
+        {"QW_PASS", &props.QWPass},
+        {"QW_URL", &props.QWURL},
+    } {
+        if value := os.Getenv(field.name); value != "" && (*field.value == "" || !opts.PreferFile) {
+            *field.value = value
+        }
+    }
+}
+
+// normalizeMAC extracts the 12 hex digits of a MAC address from a station_id
+// (e.g., "AA-BB-CC-11-22-33", "aa:bb:cc:11:22:33", "aabb.cc11.2233") and returns
+// them upper-cased, or "" if the station_id does not start with a MAC address
+func normalizeMAC(stationID string) string {
+    var digits strings.Builder
+    for _, c := range stationID {
+        if digits.Len() == 12 {
+            break
+        }
+        switch {
+        case c >= '0' && c <= '9', c >= 'a' && c <= 'f', c >= 'A' && c <= 'F':
+            digits.WriteRune(c)
+        case c == '-' || c == ':' || c == '.':
+            continue
+        default:
+            return ""
+        }
+    }
+    if digits.Len() != 12 {
+        return ""
+    }
+    return strings.ToUpper(digits.String())
+}
+
+// isRandomizedMAC reports whether the locally-administered bit of the first octet is set
+func isRandomizedMAC(mac string) bool {
+    firstOctet, err := strconv.ParseUint(mac[:2], 16, 8)
+    if err != nil {
+        return false
+    }
+    return firstOctet&0x02 != 0
+}
+
+// randomizedStation reports whether a station_id starts with a locally-administered MAC
+func randomizedStation(stationID string) bool {
+    mac := normalizeMAC(stationID)
+    return mac != "" && isRandomizedMAC(mac)
+}
+
+// loadOUIFile reads an OUI vendor list in IEEE oui.txt format
+// ("AA-BB-CC   (hex)\t\tVendor") or simple "AABBCC,Vendor" lines
+func loadOUIFile(filePath string) (map[string]string, error) {
+    file, err := os.Open(filePath)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    vendors := make(map[string]string)
+    scanner := bufio.NewScanner(file)
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+
+        var prefix, vendor string
+        if strings.Contains(line, "(hex)") {
+            parts := strings.SplitN(line, "(hex)", 2)
+            prefix, vendor = parts[0], parts[1]
+        } else if parts := strings.SplitN(line, ",", 2); len(parts) == 2 {
+            prefix, vendor = parts[0], parts[1]
+        } else {
+            continue
+        }
+
+        prefix = strings.NewReplacer("-", "", ":", "", " ", "").Replace(strings.ToUpper(prefix))
+        vendor = strings.Trim(strings.TrimSpace(vendor), "\"")
+        if len(prefix) == 6 && vendor != "" {
+            vendors[prefix] = vendor
+        }
+    }
+
+    return vendors, scanner.Err()
+}
+
+// lookupVendor returns the vendor for a station_id, "randomized" for
+// locally-administered MACs, or "unknown"
+func lookupVendor(stationID string) string {
+    mac := normalizeMAC(stationID)
+    if mac == "" {
+        return "unknown"
+    }
+    if isRandomizedMAC(mac) {
+        return "randomized"
+    }
+    if vendor, ok := ouiVendors[mac[:6]]; ok {
+        return vendor
+    }
+    return "unknown"
 }
 
 // getDomain returns the full domain name
@@ -496,6 +2243,26 @@ func getDomain(input string) string {
     return fmt.Sprintf("eduroam.%s", input)
 }
 
+// queryValueEscaper escapes the characters that end or escape a quoted query phrase
+var queryValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// escapeQueryValue makes value safe to interpolate inside a quoted Quickwit query term
+// (field:"value"); inside the quotes only '\' and '"' are special, so ':', '@' and spaces are kept
+func escapeQueryValue(value string) string {
+    return queryValueEscaper.Replace(value)
+}
+
+// fillTrendGaps appends a zero point for every day in [startDate, endDate] missing from daily
+func fillTrendGaps(trend []RealmTrendPoint, daily map[string]*RealmDay, startDate, endDate time.Time) []RealmTrendPoint {
+    for day := startDate; !day.After(endDate); day = day.AddDate(0, 0, 1) {
+        date := day.Format("2006-01-02")
+        if _, exists := daily[date]; !exists {
+            trend = append(trend, RealmTrendPoint{Date: date})
+        }
+    }
+    return trend
+}
+
 // isLeapYear checks if a year is a leap year
 func isLeapYear(year int) bool {
     return year%4 == 0 && (year%100 != 0 || year%400 == 0)
@@ -512,7 +2279,7 @@ func analyzeSessionPatterns(timestamps []time.Time) *SessionAnalysis {
     var currentSession Session
     var sessions []Session
 
-    currentSession.Start = timestamps[0].Format(time.RFC3339)
+    currentSession.Start = TimeString(timestamps[0].Format(time.RFC3339))
     authCount := 1
 
     for i := 1; i < len(timestamps); i++ {
@@ -520,9 +2287,9 @@ func analyzeSessionPatterns(timestamps []time.Time) *SessionAnalysis {
 
         if gap > sessionTimeout {
             // จบ session เก่า
-            currentSession.End = timestamps[i-1].Format(time.RFC3339)
-            startTime, _ := time.Parse(time.RFC3339, currentSession.Start)
-            endTime, _ := time.Parse(time.RFC3339, currentSession.End)
+            currentSession.End = TimeString(timestamps[i-1].Format(time.RFC3339))
+            startTime, _ := time.Parse(time.RFC3339, string(currentSession.Start))
+            endTime, _ := time.Parse(time.RFC3339, string(currentSession.End))
             duration := endTime.Sub(startTime).Minutes()
             currentSession.Duration = fmt.Sprintf("%.0f minutes", duration)
             currentSession.AuthsCount = authCount
@@ -531,7 +2298,7 @@ func analyzeSessionPatterns(timestamps []time.Time) *SessionAnalysis {
 
             // เริ่ม session ใหม่
             currentSession = Session{
-                Start: timestamps[i].Format(time.RFC3339),
+                Start: TimeString(timestamps[i].Format(time.RFC3339)),
             }
             authCount = 1
         } else {
@@ -540,9 +2307,9 @@ func analyzeSessionPatterns(timestamps []time.Time) *SessionAnalysis {
     }
 
     // จบ session สุดท้าย
-    currentSession.End = timestamps[len(timestamps)-1].Format(time.RFC3339)
-    startTime, _ := time.Parse(time.RFC3339, currentSession.Start)
-    endTime, _ := time.Parse(time.RFC3339, currentSession.End)
+    currentSession.End = TimeString(timestamps[len(timestamps)-1].Format(time.RFC3339))
+    startTime, _ := time.Parse(time.RFC3339, string(currentSession.Start))
+    endTime, _ := time.Parse(time.RFC3339, string(currentSession.End))
     duration := endTime.Sub(startTime).Minutes()
     currentSession.Duration = fmt.Sprintf("%.0f minutes", duration)
     currentSession.AuthsCount = authCount
@@ -552,8 +2319,8 @@ func analyzeSessionPatterns(timestamps []time.Time) *SessionAnalysis {
     // คำนวณค่าเฉลี่ย
     var totalDuration float64
     for _, session := range sessions {
-        startTime, _ := time.Parse(time.RFC3339, session.Start)
-        endTime, _ := time.Parse(time.RFC3339, session.End)
+        startTime, _ := time.Parse(time.RFC3339, string(session.Start))
+        endTime, _ := time.Parse(time.RFC3339, string(session.End))
         totalDuration += endTime.Sub(startTime).Minutes()
     }
 
@@ -564,6 +2331,42 @@ func analyzeSessionPatterns(timestamps []time.Time) *SessionAnalysis {
     return &analysis
 }
 
+// acctSessionAnalysis builds a SessionAnalysis from accounting sessions; auths_count is the
+// number of Access-Accepts from the station between a session's start (minus one
+// -interval bucket, as the Accept precedes Accounting-Start) and its end
+func acctSessionAnalysis(acctSessions []AcctSession, timestamps []time.Time) *SessionAnalysis {
+    lead, _ := time.ParseDuration(opts.Interval)
+    var analysis SessionAnalysis
+    var totalDuration float64
+
+    for _, acctSession := range acctSessions {
+        authCount := 0
+        for _, ts := range timestamps {
+            if !ts.Before(acctSession.Start.Add(-lead)) && !ts.After(acctSession.End) {
+                authCount++
+            }
+        }
+
+        duration := acctSession.End.Sub(acctSession.Start).Minutes()
+        totalDuration += duration
+        session := Session{
+            Start:      TimeString(acctSession.Start.Format(time.RFC3339)),
+            End:        TimeString(acctSession.End.Format(time.RFC3339)),
+            Duration:   fmt.Sprintf("%.0f minutes", duration),
+            AuthsCount: authCount,
+        }
+        if authCount > 0 {
+            session.ReauthRate = fmt.Sprintf("1 auth/%.1f minutes", duration/float64(authCount))
+        }
+        analysis.SessionDetails = append(analysis.SessionDetails, session)
+    }
+
+    analysis.Source = "accounting"
+    analysis.TotalSessions = len(acctSessions)
+    analysis.AverageSessionDuration = fmt.Sprintf("%.0f minutes", totalDuration/float64(len(acctSessions)))
+    return &analysis
+}
+
 // findActivePeriods หาช่วงเวลาที่มีการใช้งานต่อเนื่อง
 func findActivePeriods(timestamps []time.Time) []Period {
     if len(timestamps) < 2 {
@@ -573,7 +2376,7 @@ func findActivePeriods(timestamps []time.Time) []Period {
     const maxGapMinutes = 15 // ช่วงห่างมากกว่า 15 นาทีถือเป็นคนละ period
     var periods []Period
     var currentPeriod Period
-    currentPeriod.Start = timestamps[0].Format(time.RFC3339)
+    currentPeriod.Start = TimeString(timestamps[0].Format(time.RFC3339))
     authCount := 1
 
     for i := 1; i < len(timestamps); i++ {
@@ -581,16 +2384,16 @@ func findActivePeriods(timestamps []time.Time) []Period {
         
         if gap > maxGapMinutes {
             // จบ period เก่า
-            currentPeriod.End = timestamps[i-1].Format(time.RFC3339)
+            currentPeriod.End = TimeString(timestamps[i-1].Format(time.RFC3339))
             currentPeriod.AuthCount = authCount
-            startTime, _ := time.Parse(time.RFC3339, currentPeriod.Start)
-            endTime, _ := time.Parse(time.RFC3339, currentPeriod.End)
+            startTime, _ := time.Parse(time.RFC3339, string(currentPeriod.Start))
+            endTime, _ := time.Parse(time.RFC3339, string(currentPeriod.End))
             currentPeriod.DurationMinutes = int(endTime.Sub(startTime).Minutes())
             periods = append(periods, currentPeriod)
 
             // เริ่ม period ใหม่
             currentPeriod = Period{
-                Start: timestamps[i].Format(time.RFC3339),
+                Start: TimeString(timestamps[i].Format(time.RFC3339)),
             }
             authCount = 1
         } else {
@@ -599,10 +2402,10 @@ func findActivePeriods(timestamps []time.Time) []Period {
     }
 
     // จบ period สุดท้าย
-    currentPeriod.End = timestamps[len(timestamps)-1].Format(time.RFC3339)
+    currentPeriod.End = TimeString(timestamps[len(timestamps)-1].Format(time.RFC3339))
     currentPeriod.AuthCount = authCount
-    startTime, _ := time.Parse(time.RFC3339, currentPeriod.Start)
-    endTime, _ := time.Parse(time.RFC3339, currentPeriod.End)
+    startTime, _ := time.Parse(time.RFC3339, string(currentPeriod.Start))
+    endTime, _ := time.Parse(time.RFC3339, string(currentPeriod.End))
     currentPeriod.DurationMinutes = int(endTime.Sub(startTime).Minutes())
     periods = append(periods, currentPeriod)
 
@@ -664,8 +2467,8 @@ func findLongestGap(timestamps []time.Time) Period {
         if gap > maxGap {
             maxGap = gap
             longestGap = Period{
-                Start:           timestamps[i-1].Format(time.RFC3339),
-                End:             timestamps[i].Format(time.RFC3339),
+                Start:           TimeString(timestamps[i-1].Format(time.RFC3339)),
+                End:             TimeString(timestamps[i].Format(time.RFC3339)),
                 DurationMinutes: int(gap),
             }
         }
@@ -674,200 +2477,3054 @@ func findLongestGap(timestamps []time.Time) Period {
     return longestGap
 }
 
+// addEntry adds a single auth entry to the station and realm stats of result
+func addEntry(result *Result, entry LogEntry) {
+    // -exclude-randomized: ไม่นับ station ที่เป็น MAC แบบสุ่ม แต่จำ station_id ไว้นับใน summary
+    if opts.ExcludeRandomized && randomizedStation(entry.StationID) {
+        if result.Randomized == nil {
+            result.Randomized = make(map[string]bool)
+        }
+        result.Randomized[entry.StationID] = true
+        return
+    }
+
+    // Process station stats
+    if _, exists := result.Stations[entry.StationID]; !exists {
+        result.Stations[entry.StationID] = &StationStats{
+            StationID: entry.StationID,
+            Users:    make(map[string]*UserActivity),
+        }
+    }
+    
+    station := result.Stations[entry.StationID]
+    if _, exists := station.Users[entry.Username]; !exists {
+        station.Users[entry.Username] = &UserActivity{
+            Username:       entry.Username,
+            Realm:         entry.Realm,
+            AuthTimestamps: []time.Time{},
+        }
+    }
+
+    // Access-Challenge เก็บแยก ไม่นับเป็น auth และไม่นับใน realm stats
+    if entry.MessageType == messageChallenge {
+        station.Users[entry.Username].ChallengeTimestamps = append(
+            station.Users[entry.Username].ChallengeTimestamps,
+            entry.Timestamp,
+        )
+        station.TotalChallenges++
+        return
+    }
+
+    station.Users[entry.Username].AuthTimestamps = append(
+        station.Users[entry.Username].AuthTimestamps,
+        entry.Timestamp,
+    )
+    station.TotalAuths++
+    if entry.Realm != "" {
+        if station.Realms == nil {
+            station.Realms = make(map[string]bool)
+        }
+        station.Realms[entry.Realm] = true
+    }
+
+    // Process realm stats
+    if _, exists := result.Realms[entry.Realm]; !exists {
+        result.Realms[entry.Realm] = &RealmStats{
+            Realm:    entry.Realm,
+            Users:    make(map[string]bool),
+            Stations: make(map[string]bool),
+        }
+    }
+    
+    realm := result.Realms[entry.Realm]
+    realm.Users[entry.Username] = true
+    realm.Stations[entry.StationID] = true
+    realm.TotalAuths++
+
+    // bucket รายวันสำหรับ -trend
+    if opts.Trend {
+        if realm.Daily == nil {
+            realm.Daily = make(map[string]*RealmDay)
+        }
+        date := entry.Timestamp.Local().Format("2006-01-02")
+        day, exists := realm.Daily[date]
+        if !exists {
+            day = &RealmDay{Users: make(map[string]bool)}
+            realm.Daily[date] = day
+        }
+        day.Users[entry.Username] = true
+        day.Auths++
+    }
+
+    // Track realms seen per username
+    if _, exists := result.UserRealms[entry.Username]; !exists {
+        result.UserRealms[entry.Username] = make(map[string]int)
+    }
+    result.UserRealms[entry.Username][entry.Realm]++
+}
+
 // processResults ปรับให้สอดคล้องกับ struct ที่แก้ไขแล้ว
 func processResults(resultChan <-chan LogEntry, result *Result, mu *sync.Mutex) {
     for entry := range resultChan {
         mu.Lock()
-        
-        // Process station stats
-        if _, exists := result.Stations[entry.StationID]; !exists {
-            result.Stations[entry.StationID] = &StationStats{
-                StationID: entry.StationID,
-                Users:    make(map[string]*UserActivity),
-            }
+        if result.Providers != nil {
+            addEntry(result.providerResult(entry.ServiceProvider), entry)
+        } else {
+            addEntry(result, entry)
         }
-        
-        station := result.Stations[entry.StationID]
-        if _, exists := station.Users[entry.Username]; !exists {
-            station.Users[entry.Username] = &UserActivity{
-                Username:       entry.Username,
-                Realm:         entry.Realm,
-                AuthTimestamps: []time.Time{},
+        mu.Unlock()
+    }
+
+    // เรียงลำดับ timestamps สำหรับทุก user activity
+    // resultChan ถูกปิดแล้ว ไม่มี writer อื่น จึงเรียงลำดับนอก mutex ได้
+    for _, r := range result.leafResults() {
+        for _, station := range r.Stations {
+            for _, activity := range station.Users {
+                sort.Slice(activity.AuthTimestamps, func(i, j int) bool {
+                    return activity.AuthTimestamps[i].Before(activity.AuthTimestamps[j])
+                })
             }
         }
-        station.Users[entry.Username].AuthTimestamps = append(
-            station.Users[entry.Username].AuthTimestamps,
-            entry.Timestamp,
-        )
-        station.TotalAuths++
+    }
+}
 
-        // Process realm stats
-        if _, exists := result.Realms[entry.Realm]; !exists {
-            result.Realms[entry.Realm] = &RealmStats{
-                Realm:    entry.Realm,
-                Users:    make(map[string]bool),
-                Stations: make(map[string]bool),
-            }
+// dumpRawResponse writes a job's raw Quickwit response to -dump-raw/<start>-<end>.json
+func dumpRawResponse(job Job, result map[string]interface{}) error {
+    data, err := json.MarshalIndent(result, "", "  ")
+    if err != nil {
+        return fmt.Errorf("error marshaling raw response: %v", err)
+    }
+    name := filepath.Join(opts.DumpRaw, fmt.Sprintf("%d-%d.json", job.StartTimestamp, job.EndTimestamp))
+    if err := os.WriteFile(name, data, 0644); err != nil {
+        return fmt.Errorf("error writing raw response: %v", err)
+    }
+    return nil
+}
+
+// DayCheckpoint is the cached result of one finished day-job (-checkpoint)
+type DayCheckpoint struct {
+    DayStats
+    Entries []LogEntry `json:"entries"`
+}
+
+// CheckpointProgress is <dir>/progress.json: the query and day-job request a checkpoint belongs to
+// and its finished day-jobs
+type CheckpointProgress struct {
+    Query     string   `json:"query"`
+    Request   string   `json:"request_sha256"` // SHA-256 ของ stationRequest (ไม่รวม timestamp)
+    Completed []string `json:"completed"`      // "<start>-<end>" ของ day-job ที่เสร็จแล้ว
+}
+
+// Checkpoint persists finished day-jobs of the station report so an interrupted run can -resume
+type Checkpoint struct {
+    mu       sync.Mutex
+    dir      string
+    progress CheckpointProgress
+    done     map[string]bool
+}
+
+// checkpoint is nil when -checkpoint is not given
+var checkpoint *Checkpoint
+
+// jobKey names a day-job by its start and end timestamps
+func jobKey(job Job) string {
+    return fmt.Sprintf("%d-%d", job.StartTimestamp, job.EndTimestamp)
+}
+
+// openCheckpoint prepares dir for queryString and the day-job request hashed in request; with
+// resume it loads progress.json (if any), otherwise it starts an empty progress list
+func openCheckpoint(dir, queryString, request string, resume bool) (*Checkpoint, error) {
+    c := &Checkpoint{
+        dir:      dir,
+        progress: CheckpointProgress{Query: queryString, Request: request},
+        done:     make(map[string]bool),
+    }
+    if !resume {
+        return c, c.writeProgress()
+    }
+
+    data, err := os.ReadFile(filepath.Join(dir, "progress.json"))
+    if os.IsNotExist(err) {
+        return c, nil
+    }
+    if err != nil {
+        return nil, fmt.Errorf("error reading checkpoint progress: %v", err)
+    }
+    var progress CheckpointProgress
+    if err := json.Unmarshal(data, &progress); err != nil {
+        return nil, fmt.Errorf("error parsing checkpoint progress: %v", err)
+    }
+    if progress.Query != queryString {
+        return nil, fmt.Errorf("checkpoint in %s was written for query %q, not %q", dir, progress.Query, queryString)
+    }
+    if progress.Request != request {
+        return nil, fmt.Errorf("checkpoint in %s was written for a different day-job request "+
+            "(-interval, -station-size, -user-size, -realm-size, -include-challenges or all changed)", dir)
+    }
+    c.progress = progress
+    for _, key := range progress.Completed {
+        c.done[key] = true
+    }
+    return c, nil
+}
+
+// Run returns the hits of job, records its DayStats and sends its entries to resultChan, from the
+// cache when the day-job is already done, otherwise by querying it and saving the result first.
+// With -dump-raw a done day-job is queried again, since its raw response is not saved.
+func (c *Checkpoint) Run(job Job, resultChan chan<- LogEntry, query map[string]interface{}, props Properties) (int64, error) {
+    if c == nil {
+        day, err := worker(job, resultChan, query, props)
+        if err != nil {
+            return 0, err
         }
-        
-        realm := result.Realms[entry.Realm]
-        realm.Users[entry.Username] = true
-        realm.Stations[entry.StationID] = true
-        realm.TotalAuths++
+        day.record()
+        return day.Hits, nil
+    }
 
-        mu.Unlock()
+    key := jobKey(job)
+    c.mu.Lock()
+    done := c.done[key]
+    c.mu.Unlock()
+    if done && opts.DumpRaw == "" {
+        day, err := c.load(key)
+        if err == nil {
+            day.record()
+            for _, entry := range day.Entries {
+                resultChan <- entry
+            }
+            return day.Hits, nil
+        }
+        log.Printf("Re-querying %s: %v", key, err)
     }
 
-    // เรียงลำดับ timestamps สำหรับทุก user activity
-    mu.Lock()
-    for _, station := range result.Stations {
-        for _, activity := range station.Users {
-            sort.Slice(activity.AuthTimestamps, func(i, j int) bool {
-                return activity.AuthTimestamps[i].Before(activity.AuthTimestamps[j])
-            })
+    // เก็บ entries ของวันนี้ไว้ก่อน แล้วจึงส่งต่อเมื่อบันทึก checkpoint แล้ว
+    entries := make(chan LogEntry, opts.BufferSize)
+    collected := make(chan struct{})
+    var day DayCheckpoint
+    go func() {
+        for entry := range entries {
+            day.Entries = append(day.Entries, entry)
         }
+        close(collected)
+    }()
+    stats, err := worker(job, entries, query, props)
+    close(entries)
+    <-collected
+    if err != nil {
+        return 0, err
     }
-    mu.Unlock()
+
+    day.DayStats = stats
+    if err := c.save(key, day); err != nil {
+        return 0, err
+    }
+    day.record()
+    for _, entry := range day.Entries {
+        resultChan <- entry
+    }
+    return day.Hits, nil
+}
+
+// load reads the cached result of a finished day-job
+func (c *Checkpoint) load(key string) (DayCheckpoint, error) {
+    var day DayCheckpoint
+    data, err := os.ReadFile(filepath.Join(c.dir, key+".json"))
+    if err != nil {
+        return day, fmt.Errorf("error reading checkpoint: %v", err)
+    }
+    if err := json.Unmarshal(data, &day); err != nil {
+        return day, fmt.Errorf("error parsing checkpoint: %v", err)
+    }
+    return day, nil
+}
+
+// save writes a day-job's result and then records it in progress.json
+func (c *Checkpoint) save(key string, day DayCheckpoint) error {
+    data, err := json.Marshal(day)
+    if err != nil {
+        return fmt.Errorf("error marshaling checkpoint: %v", err)
+    }
+    if err := writeFileAtomic(filepath.Join(c.dir, key+".json"), data); err != nil {
+        return fmt.Errorf("error writing checkpoint: %v", err)
+    }
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if !c.done[key] {
+        c.done[key] = true
+        c.progress.Completed = append(c.progress.Completed, key)
+    }
+    return c.writeProgress()
+}
+
+// writeProgress rewrites progress.json; callers other than openCheckpoint hold c.mu
+func (c *Checkpoint) writeProgress() error {
+    data, err := json.MarshalIndent(c.progress, "", "  ")
+    if err != nil {
+        return fmt.Errorf("error marshaling checkpoint progress: %v", err)
+    }
+    if err := writeFileAtomic(filepath.Join(c.dir, "progress.json"), data); err != nil {
+        return fmt.Errorf("error writing checkpoint progress: %v", err)
+    }
+    return nil
+}
+
+// writeFileAtomic writes data to name through a temporary file and a rename, so an
+// interrupted write never leaves a truncated file behind
+func writeFileAtomic(name string, data []byte) error {
+    tmp := name + ".tmp"
+    if err := os.WriteFile(tmp, data, 0644); err != nil {
+        return err
+    }
+    return os.Rename(tmp, name)
 }
 
 // แก้ไขฟังก์ชัน worker เพื่อจำกัดจำนวน buckets
-func worker(job Job, resultChan chan<- LogEntry, query map[string]interface{}, props Properties) (int64, error) {
+func worker(job Job, resultChan chan<- LogEntry, query map[string]interface{}, props Properties) (DayStats, error) {
+    result, err := sendQuickwitRequest(stationRequest(query, job), props)
+    if err != nil {
+        return DayStats{}, err
+    }
+    day := DayStats{UserCardinality: userCardinality(job, result)}
+    if opts.DumpRaw != "" {
+        if err := dumpRawResponse(job, result); err != nil {
+            return DayStats{}, err
+        }
+    }
+
+    day.Hits, err = processAggregations(result, resultChan, &day.Truncated)
+    return day, err
+}
+
+// stationRequest builds the search request of a station report day-job. Everything in it
+// but the timestamps is what -checkpoint keys its saved days on
+func stationRequest(query map[string]interface{}, job Job) map[string]interface{} {
     currentQuery := map[string]interface{}{
         "query": query["query"],
         "start_timestamp": job.StartTimestamp,
         "end_timestamp": job.EndTimestamp,
         "max_hits": 0,
-        "aggs": map[string]interface{}{
+        "aggs": stationAggs(),
+    }
+
+    if opts.AllProviders {
+        currentQuery["aggs"] = map[string]interface{}{
+            "by_provider": map[string]interface{}{
+                "terms": map[string]interface{}{
+                    "field": "service_provider",
+                    "size":  1000,
+                },
+                "aggs": stationAggs(),
+            },
+        }
+    }
+    // นับ username แบบ cardinality คู่กัน เพื่อเทียบกับจำนวนที่ได้จาก terms bucket (ซึ่งถูกตัดด้วย size)
+    currentQuery["aggs"].(map[string]interface{})["unique_users"] = map[string]interface{}{
+        "cardinality": map[string]interface{}{"field": "username"},
+    }
+    return currentQuery
+}
+
+// stationAggs builds the station -> user -> realm/auth_times aggregation
+func stationAggs() map[string]interface{} {
+    perUserAggs := userAggs()
+    perUserAggs["by_realm"] = map[string]interface{}{
+        "terms": map[string]interface{}{
+            "field": "realm",
+            "size": opts.RealmSize,
+        },
+    }
+
+    return map[string]interface{}{
             "by_station": map[string]interface{}{
                 "terms": map[string]interface{}{
                     "field": "station_id",
-                    "size": 1000,  // ลดจาก 10000
+                    "size": opts.StationSize,  // -station-size (ค่าเริ่มต้น 1000)
                 },
                 "aggs": map[string]interface{}{
                     "by_user": map[string]interface{}{
                         "terms": map[string]interface{}{
                             "field": "username",
-                            "size": 100,   // ลดจาก 1000
-                        },
-                        "aggs": map[string]interface{}{
-                            "by_realm": map[string]interface{}{
-                                "terms": map[string]interface{}{
-                                    "field": "realm",
-                                    "size": 10,
-                                },
-                            },
-                            "auth_times": map[string]interface{}{
-                                "date_histogram": map[string]interface{}{
-                                    "field": "timestamp",
-                                    "fixed_interval": "1m",  // เปลี่ยนจาก 1s เป็น 1m
-                                },
-                            },
+                            "size": opts.UserSize,  // -user-size (ค่าเริ่มต้น 100)
                         },
+                        "aggs": perUserAggs,
                     },
                 },
             },
-        },
     }
+}
 
-    result, err := sendQuickwitRequest(currentQuery, props)
-    if err != nil {
-        return 0, err
+// userAggs builds the per-user auth_times aggregation, split by message_type with -include-challenges
+func userAggs() map[string]interface{} {
+    if !opts.IncludeChallenges {
+        return map[string]interface{}{
+            "auth_times": authTimesAgg(),
+        }
     }
 
-    return processAggregations(result, resultChan)
+    return map[string]interface{}{
+        "by_type": map[string]interface{}{
+            "terms": map[string]interface{}{
+                "field": "message_type",
+                "size":  2,
+            },
+            "aggs": map[string]interface{}{
+                "auth_times": authTimesAgg(),
+            },
+        },
+    }
 }
 
-// processAggregations processes the aggregation results
-func processAggregations(result map[string]interface{}, resultChan chan<- LogEntry) (int64, error) {
-    aggs, ok := result["aggregations"].(map[string]interface{})
-    if !ok {
-        return 0, fmt.Errorf("no aggregations in response")
+// authTimesAgg builds the auth timestamp date_histogram
+func authTimesAgg() map[string]interface{} {
+    return map[string]interface{}{
+        "date_histogram": map[string]interface{}{
+            "field": "timestamp",
+            "fixed_interval": opts.Interval,  // ค่าเริ่มต้น 1m
+        },
     }
+}
 
-    byStation, ok := aggs["by_station"].(map[string]interface{})
-    if !ok {
-        return 0, fmt.Errorf("no by_station aggregation")
-    }
+// collectStationResult runs the day-split worker pool for query over [startDate, endDate]
+// and returns the aggregated result with the total number of hits; progress is written to progress
+func collectStationResult(query map[string]interface{}, props Properties, startDate, endDate time.Time, days, numWorkers int, progress io.Writer) (*Result, int64, error) {
+    resultChan := make(chan LogEntry, opts.BufferSize)
+    var totalHits atomic.Int64
+    var mu sync.Mutex
 
-    buckets, ok := byStation["buckets"].([]interface{})
-    if !ok {
-        return 0, fmt.Errorf("no buckets in by_station aggregation")
+    var processedDays int32
+
+    result := newResult()
+    if opts.AllProviders {
+        result.Providers = make(map[string]*Result)
     }
 
-    var totalHits int64
-    for _, bucketInterface := range buckets {
-        bucket, ok := bucketInterface.(map[string]interface{})
-        if !ok {
-            continue
+    userCardinalityMu.Lock()
+    userCardinalityDays = nil
+    userCardinalityMu.Unlock()
+
+    processDone := make(chan struct{})
+    go func() {
+        processResults(resultChan, result, &mu)
+        close(processDone)
+    }()
+
+    err := runDayJobs(startDate, endDate, opts.Sample, numWorkers, func(job Job) error {
+        hits, err := checkpoint.Run(job, resultChan, query, props)
+        if err != nil {
+            return err
         }
+        totalHits.Add(hits)
+        current := atomic.AddInt32(&processedDays, 1)
+        fmt.Fprintf(progress, "\rProgress: %d/%d days processed, Progress hits: %d", 
+            current, days, totalHits.Load())
+        return nil
+    })
+    close(resultChan)
 
-        stationID := bucket["key"].(string)
-        docCount := int64(bucket["doc_count"].(float64))
-        totalHits += docCount
+    <-processDone
 
-        processStationBucket(bucket, stationID, resultChan)
+    if err != nil {
+        return nil, 0, err
     }
 
-    return totalHits, nil
+    return result, totalHits.Load(), nil
 }
 
-// analyzePotentialIssues วิเคราะห์ปัญหาที่อาจเกิดขึ้น
-func analyzePotentialIssues(patterns *UsagePattern) []PotentialIssue {
-    var issues []PotentialIssue
+// runDayJobs splits [startDate, endDate) into day-jobs, keeps every sample-th of them (1 = every
+// day, see sampledDay) and runs fn on each with numWorkers workers. This is the day-split worker
+// pool every mode is built on: fn runs concurrently, so it guards its own shared state. After the
+// first error the remaining day-jobs are skipped and that error is returned.
+func runDayJobs(startDate, endDate time.Time, sample, numWorkers int, fn func(job Job) error) error {
+    var wg sync.WaitGroup
+    var failed atomic.Bool
+    errChan := make(chan error, 1)
+    jobs := make(chan Job, numWorkers)
 
-    // ตรวจสอบ frequent reauths
-    for _, reauth := range patterns.ConnectionStability.FrequentReauths {
-        issues = append(issues, PotentialIssue{
-            Type:        "frequent_reauth",
-            Period:      reauth.Period,
-            Description: fmt.Sprintf("%d re-authentications within %s", reauth.Count, reauth.Interval),
-        })
+    for w := 1; w <= numWorkers; w++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for job := range jobs {
+                if failed.Load() {
+                    continue
+                }
+                if err := fn(job); err != nil {
+                    failed.Store(true)
+                    select {
+                    case errChan <- err:
+                    default:
+                    }
+                }
+            }
+        }()
     }
 
-    // ตรวจสอบ long gaps
-    if patterns.ConnectionStability.LongestGap.DurationMinutes > 60 {
-        issues = append(issues, PotentialIssue{
-            Type:        "long_gap",
-            Period:      fmt.Sprintf("%s to %s", 
-                        patterns.ConnectionStability.LongestGap.Start,
-                        patterns.ConnectionStability.LongestGap.End),
-            Description: fmt.Sprintf("No activity for %d minutes", 
-                        patterns.ConnectionStability.LongestGap.DurationMinutes),
-        })
+    currentDate := startDate
+    for currentDate.Before(endDate) {
+        nextDate := currentDate.Add(24 * time.Hour)
+        if nextDate.After(endDate) {
+            nextDate = endDate
+        }
+        if sampledDay(startDate, currentDate, sample) {
+            jobs <- Job{
+                StartTimestamp: currentDate.Unix(),
+                EndTimestamp:   nextDate.Unix(),
+            }
+        }
+        currentDate = nextDate
     }
+    close(jobs)
+    wg.Wait()
 
-    // ตรวจสอบ auth intervals ที่ผิดปกติ
-    if patterns.AuthIntervals.MinMinutes < 1 {
-        issues = append(issues, PotentialIssue{
-            Type:        "rapid_reauth",
-            Period:      "throughout session",
-            Description: fmt.Sprintf("Some re-authentications occurred less than 1 minute apart"),
-        })
+    select {
+    case err := <-errChan:
+        return err
+    default:
     }
+    return nil
+}
 
-    return issues
+// sampledDay reports whether the day starting at day is queried when sampling every
+// sample-th day counted from startDate (-sample N)
+func sampledDay(startDate, day time.Time, sample int) bool {
+    return int(day.Sub(startDate)/(24*time.Hour))%sample == 0
 }
 
-func main() {
-    if len(os.Args) < 2 || len(os.Args) > 3 {
-        fmt.Println("Usage: ./eduroam-sp <service_provider> [days|Ny|yxxxx|DD-MM-YYYY]")
-        fmt.Println("  service_provider: domain name (e.g., 'ku.ac.th', 'etlr1')")
-        fmt.Println("  days: number of days (1-3650)")
-        fmt.Println("  Ny: number of years (1y-10y)")
-        fmt.Println("  yxxxx: specific year (e.g., y2024)")
-        fmt.Println("  DD-MM-YYYY: specific date")
-        os.Exit(1)
+// sampleCoverage returns how many days of [startDate, endDate) -sample queries and the
+// factor that extrapolates their totals to the whole range (1 when not sampling)
+func sampleCoverage(startDate, endDate time.Time) (int, float64) {
+    total := int((endDate.Sub(startDate) + 24*time.Hour - 1) / (24 * time.Hour))
+    sampled := (total + opts.Sample - 1) / opts.Sample
+    if sampled == 0 {
+        return 0, 1
     }
+    return sampled, float64(total) / float64(sampled)
+}
 
-    var serviceProvider string
-    var startDate, endDate time.Time
-    var days int
+// SampleInfo marks the query_info of a report whose day-jobs were sampled with -sample
+type SampleInfo struct {
+    Sampled     bool `json:"sampled,omitempty"`
+    SampleRate  int  `json:"sample_rate,omitempty"`
+    SampledDays int  `json:"sampled_days,omitempty"`
+}
+
+// newSampleInfo returns the -sample marker for [startDate, endDate) (zero when not sampling)
+func newSampleInfo(startDate, endDate time.Time) SampleInfo {
+    if opts.Sample <= 1 {
+        return SampleInfo{}
+    }
+    sampledDays, _ := sampleCoverage(startDate, endDate)
+    return SampleInfo{Sampled: true, SampleRate: opts.Sample, SampledDays: sampledDays}
+}
+
+// runFollow re-runs the station query every -follow interval over the trailing -follow-window
+// and writes each report to stdout as one NDJSON line; a failed iteration is logged to stderr
+// and retried on the next tick. Returns on SIGINT/SIGTERM.
+func runFollow(query map[string]interface{}, props Properties, serviceProvider string) {
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+    defer signal.Stop(signals)
+
+    ticker := time.NewTicker(opts.Follow)
+    defer ticker.Stop()
+
+    encoder := json.NewEncoder(os.Stdout)
+    log.Printf("Following %s every %v over the last %v", serviceProvider, opts.Follow, opts.FollowWindow)
+    for {
+        endDate := time.Now()
+        startDate := endDate.Add(-opts.FollowWindow)
+        currentQuery := map[string]interface{}{
+            "query":           query["query"],
+            "start_timestamp": startDate.Unix(),
+            "end_timestamp":   endDate.Unix(),
+            "max_hits":        query["max_hits"],
+        }
+
+        result, totalHits, err := collectStationResult(currentQuery, props, startDate, endDate, 1, 10, io.Discard)
+        if err != nil {
+            log.Printf("Follow query failed: %v", err)
+        } else {
+            var outputData SimplifiedOutputData
+            if opts.AllProviders {
+                outputData = createNationalOutputData(result, startDate, endDate, 0)
+            } else {
+                outputData = createOutputData(result, serviceProvider, startDate, endDate, 0)
+            }
+            outputData.NoData = totalHits == 0
+            if err := encoder.Encode(outputData); err != nil {
+                log.Fatalf("Error writing follow output: %v", err)
+            }
+        }
+
+        select {
+        case <-signals:
+            return
+        case <-ticker.C:
+        }
+    }
+}
+
+// baselineStationSize is the station_id terms size of each baseline request
+const baselineStationSize = 10000
+
+// collectKnownStations queries the baseline period day by day and returns the set of station_ids seen.
+// The baseline is never sampled: a station missing from it would be flagged is_new.
+func collectKnownStations(query map[string]interface{}, props Properties, baselineStart, baselineEnd time.Time, numWorkers int) (map[string]bool, error) {
+    known := make(map[string]bool)
+    var mu sync.Mutex
+
+    err := runDayJobs(baselineStart, baselineEnd, 1, numWorkers, func(job Job) error {
+        dropped, err := addKnownStations(query, props, job, known, &mu)
+        truncatedBaseline.Add(dropped)
+        return err
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    return known, nil
+}
+
+// addKnownStations adds the station_ids of job to known. When the terms aggregation leaves
+// stations out (sum_other_doc_count > 0) a day-job is queried again hour by hour; returns the
+// events still left out of truncated hours, whose stations may be wrongly flagged is_new
+func addKnownStations(query map[string]interface{}, props Properties, job Job, known map[string]bool, mu *sync.Mutex) (int64, error) {
+    currentQuery := map[string]interface{}{
+        "query":           query["query"],
+        "start_timestamp": job.StartTimestamp,
+        "end_timestamp":   job.EndTimestamp,
+        "max_hits":        0,
+        "aggs": map[string]interface{}{
+            "by_station": map[string]interface{}{
+                "terms": map[string]interface{}{
+                    "field": "station_id",
+                    "size":  baselineStationSize,
+                },
+            },
+        },
+    }
+
+    result, err := sendQuickwitRequest(currentQuery, props)
+    if err != nil {
+        return 0, err
+    }
+
+    aggs, _ := result["aggregations"].(map[string]interface{})
+    byStation, _ := aggs["by_station"].(map[string]interface{})
+    buckets, _ := byStation["buckets"].([]interface{})
+    other, _ := byStation["sum_other_doc_count"].(float64)
+
+    mu.Lock()
+    for _, bucketInterface := range buckets {
+        if bucket, ok := bucketInterface.(map[string]interface{}); ok {
+            if stationID, ok := bucket["key"].(string); ok {
+                known[stationID] = true
+            }
+        }
+    }
+    mu.Unlock()
+
+    if other <= 0 {
+        return 0, nil
+    }
+    if job.EndTimestamp-job.StartTimestamp <= 3600 {
+        return int64(other), nil
+    }
+
+    // terms ถูกตัด: แบ่ง day-job เป็นรายชั่วโมงเพื่อให้ได้ station ครบ
+    var dropped int64
+    for start := job.StartTimestamp; start < job.EndTimestamp; start += 3600 {
+        end := start + 3600
+        if end > job.EndTimestamp {
+            end = job.EndTimestamp
+        }
+        hourDropped, err := addKnownStations(query, props, Job{StartTimestamp: start, EndTimestamp: end}, known, mu)
+        if err != nil {
+            return 0, err
+        }
+        dropped += hourDropped
+    }
+    return dropped, nil
+}
+
+// collectAcctSessions queries Accounting-Request records day by day, grouped by station_id and
+// acct_session_id, and merges the days so sessions crossing midnight stay whole.
+// Returns station_id -> sessions sorted by start time.
+func collectAcctSessions(queryString string, props Properties, startDate, endDate time.Time, numWorkers int) (map[string][]AcctSession, error) {
+    merged := make(map[string]map[string]*AcctSession)
+    var mu sync.Mutex
+
+    // session ที่ข้ามเที่ยงคืนต้องได้ทุกวัน จึงไม่ sample
+    err := runDayJobs(startDate, endDate, 1, numWorkers, func(job Job) error {
+        currentQuery := map[string]interface{}{
+            "query":           queryString,
+            "start_timestamp": job.StartTimestamp,
+            "end_timestamp":   job.EndTimestamp,
+            "max_hits":        0,
+            "aggs": map[string]interface{}{
+                "by_station": map[string]interface{}{
+                    "terms": map[string]interface{}{
+                        "field": "station_id",
+                        "size":  10000,
+                    },
+                    "aggs": map[string]interface{}{
+                        "by_session": map[string]interface{}{
+                            "terms": map[string]interface{}{
+                                "field": "acct_session_id",
+                                "size":  1000,
+                            },
+                            "aggs": map[string]interface{}{
+                                "session_time": map[string]interface{}{
+                                    "max": map[string]interface{}{"field": "acct_session_time"},
+                                },
+                                "record_times": map[string]interface{}{
+                                    "date_histogram": map[string]interface{}{
+                                        "field":          "timestamp",
+                                        "fixed_interval": opts.Interval,
+                                        "min_doc_count":  1,
+                                    },
+                                },
+                            },
+                        },
+                    },
+                },
+            },
+        }
+
+        result, err := sendQuickwitRequest(currentQuery, props)
+        if err != nil {
+            return err
+        }
+
+        aggs, _ := result["aggregations"].(map[string]interface{})
+        byStation, _ := aggs["by_station"].(map[string]interface{})
+        stationBuckets, _ := byStation["buckets"].([]interface{})
+
+        mu.Lock()
+        defer mu.Unlock()
+        for _, stationInterface := range stationBuckets {
+            stationBucket, ok := stationInterface.(map[string]interface{})
+            if !ok {
+                continue
+            }
+            stationID, _ := stationBucket["key"].(string)
+            bySession, _ := stationBucket["by_session"].(map[string]interface{})
+            sessionBuckets, _ := bySession["buckets"].([]interface{})
+            for _, sessionInterface := range sessionBuckets {
+                sessionBucket, ok := sessionInterface.(map[string]interface{})
+                if !ok {
+                    continue
+                }
+                mergeAcctSessionBucket(merged, stationID, sessionBucket)
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    stations := make(map[string][]AcctSession, len(merged))
+    for stationID, byID := range merged {
+        sessions := make([]AcctSession, 0, len(byID))
+        for _, session := range byID {
+            // ไม่มี Accounting-Start ในช่วงที่ query: ใช้ Stop - Acct-Session-Time เป็นเวลาเริ่ม
+            if sessionStart := session.End.Add(-time.Duration(session.SessionTime) * time.Second); sessionStart.Before(session.Start) {
+                session.Start = sessionStart
+            }
+            sessions = append(sessions, *session)
+        }
+        sort.Slice(sessions, func(i, j int) bool {
+            return sessions[i].Start.Before(sessions[j].Start)
+        })
+        stations[stationID] = sessions
+    }
+
+    return stations, nil
+}
+
+// mergeAcctSessionBucket folds one day's acct_session_id bucket into merged[stationID]
+func mergeAcctSessionBucket(merged map[string]map[string]*AcctSession, stationID string, bucket map[string]interface{}) {
+    sessionID, _ := bucket["key"].(string)
+    if stationID == "" || sessionID == "" {
+        return
+    }
+
+    recordTimes, _ := bucket["record_times"].(map[string]interface{})
+    timeBuckets, _ := recordTimes["buckets"].([]interface{})
+    var first, last time.Time
+    for _, timeInterface := range timeBuckets {
+        timeBucket, ok := timeInterface.(map[string]interface{})
+        if !ok {
+            continue
+        }
+        key, ok := timeBucket["key"].(float64)
+        if !ok {
+            continue
+        }
+        ts := time.Unix(int64(key/1000), 0)
+        if first.IsZero() || ts.Before(first) {
+            first = ts
+        }
+        if ts.After(last) {
+            last = ts
+        }
+    }
+    if first.IsZero() {
+        return
+    }
+
+    var sessionTime int64
+    if metric, ok := bucket["session_time"].(map[string]interface{}); ok {
+        if value, ok := metric["value"].(float64); ok {
+            sessionTime = int64(value)
+        }
+    }
+
+    if _, exists := merged[stationID]; !exists {
+        merged[stationID] = make(map[string]*AcctSession)
+    }
+    session, exists := merged[stationID][sessionID]
+    if !exists {
+        merged[stationID][sessionID] = &AcctSession{ID: sessionID, Start: first, End: last, SessionTime: sessionTime}
+        return
+    }
+    if first.Before(session.Start) {
+        session.Start = first
+    }
+    if last.After(session.End) {
+        session.End = last
+    }
+    if sessionTime > session.SessionTime {
+        session.SessionTime = sessionTime
+    }
+}
+
+// collectUserTimeline fetches the raw auth hits of the query day by day
+// returns the hits and whether any day had more hits than max_hits
+func collectUserTimeline(query map[string]interface{}, props Properties, startDate, endDate time.Time, numWorkers int) ([]TimelineEntry, bool, error) {
+    var timeline []TimelineEntry
+    var truncated bool
+    var mu sync.Mutex
+
+    err := runDayJobs(startDate, endDate, 1, numWorkers, func(job Job) error {
+        currentQuery := map[string]interface{}{
+            "query":           query["query"],
+            "start_timestamp": job.StartTimestamp,
+            "end_timestamp":   job.EndTimestamp,
+            "max_hits":        10000,
+        }
+
+        result, err := sendQuickwitRequest(currentQuery, props)
+        if err != nil {
+            return err
+        }
+
+        hits, _ := result["hits"].([]interface{})
+        numHits, _ := result["num_hits"].(float64)
+
+        mu.Lock()
+        defer mu.Unlock()
+        if int(numHits) > len(hits) {
+            truncated = true
+        }
+        for _, hitInterface := range hits {
+            hit, ok := hitInterface.(map[string]interface{})
+            if !ok {
+                continue
+            }
+            entry := TimelineEntry{}
+            timestamp, _ := hit["timestamp"].(string)
+            entry.Timestamp = TimeString(timestamp)
+            entry.MessageType, _ = hit["message_type"].(string)
+            entry.ServiceProvider, _ = hit["service_provider"].(string)
+            entry.StationID, _ = hit["station_id"].(string)
+            entry.Realm, _ = hit["realm"].(string)
+            timeline = append(timeline, entry)
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, false, err
+    }
+
+    return timeline, truncated, nil
+}
+
+// runUserTimeline queries a single username (-user) and writes its timeline with session analysis
+func runUserTimeline(query map[string]interface{}, props Properties, startDate, endDate time.Time, days int, specificDate bool, args []string) {
+    queryStart := time.Now()
+    timeline, truncated, err := collectUserTimeline(query, props, startDate, endDate, 10)
+    if err != nil {
+        log.Fatalf("Error occurred: %v", err)
+    }
+    queryDuration := time.Since(queryStart)
+
+    sort.Slice(timeline, func(i, j int) bool {
+        return timeline[i].Timestamp < timeline[j].Timestamp
+    })
+
+    output := UserTimelineOutput{NoData: len(timeline) == 0, Timeline: timeline}
+    output.QueryInfo.Username = opts.User
+    if !opts.AllProviders {
+        output.QueryInfo.ServiceProvider = getDomain(args[0])
+    }
+    output.QueryInfo.Days = days
+    output.QueryInfo.StartDate = startDate.Format("2006-01-02 15:04:05")
+    output.QueryInfo.EndDate = endDate.Format("2006-01-02 15:04:05")
+    output.QueryInfo.IncludeChallenges = opts.IncludeChallenges
+    output.Summary.Truncated = truncated
+
+    // session analysis ใช้เฉพาะ Access-Accept
+    providers := make(map[string]bool)
+    stations := make(map[string]bool)
+    var acceptTimes []time.Time
+    for _, entry := range timeline {
+        if entry.MessageType == messageChallenge {
+            output.Summary.TotalChallenges++
+            continue
+        }
+        output.Summary.TotalAuths++
+        providers[entry.ServiceProvider] = true
+        stations[entry.StationID] = true
+        if ts, err := time.Parse(time.RFC3339, string(entry.Timestamp)); err == nil {
+            acceptTimes = append(acceptTimes, ts)
+        }
+    }
+    output.SessionAnalysis = analyzeSessionPatterns(acceptTimes)
+
+    output.Summary.Providers = make([]string, 0, len(providers))
+    for provider := range providers {
+        output.Summary.Providers = append(output.Summary.Providers, provider)
+    }
+    sort.Strings(output.Summary.Providers)
+    output.Summary.Stations = make([]string, 0, len(stations))
+    for stationID := range stations {
+        output.Summary.Stations = append(output.Summary.Stations, stationID)
+    }
+    sort.Strings(output.Summary.Stations)
+
+    if output.NoData {
+        fmt.Printf("WARNING: the query matched no events for user %s\n", opts.User)
+        if opts.Strict {
+            os.Exit(2)
+        }
+    }
+    if truncated {
+        fmt.Println("WARNING: some days matched more than 10000 events; the timeline is incomplete")
+    }
+    fmt.Printf("Events for %s: %d auths, %d challenges at %d providers / %d stations\n", opts.User,
+        output.Summary.TotalAuths, output.Summary.TotalChallenges, len(providers), len(stations))
+
+    jsonData, err := json.MarshalIndent(output, "", "  ")
+    if err != nil {
+        log.Fatalf("Error marshaling JSON: %v", err)
+    }
+
+    outputDir := fmt.Sprintf("output/user-%s", strings.NewReplacer("@", "-", ".", "-").Replace(opts.User))
+    filename := outputFilename(outputDir, "timeline", specificDate, startDate, days, args)
+    if err := writeOutput(filename, jsonData); err != nil {
+        log.Fatalf("Error writing output: %v", err)
+    }
+
+    fmt.Printf("Results have been saved to %s\n", outputLocation(filename))
+    fmt.Printf("Time taken:\n")
+    fmt.Printf("  Quickwit query: %v\n", queryDuration)
+    fmt.Printf("  Overall: %v\n", time.Since(queryStart))
+}
+
+// collectTermCounts counts events per value of a keyword/ip field with a terms aggregation per day-job,
+// along with the total number of matched events (including those without the field)
+func collectTermCounts(query map[string]interface{}, props Properties, field string, startDate, endDate time.Time, numWorkers int) (map[string]int64, int64, error) {
+    daily, err := collectDailyTermCounts(query, props, field, startDate, endDate, numWorkers)
+    if err != nil {
+        return nil, 0, err
+    }
+    counts := make(map[string]int64)
+    var total int64
+    for _, day := range daily {
+        total += day.Total
+        for key, count := range day.Counts {
+            counts[key] += count
+        }
+    }
+    return counts, total, nil
+}
+
+// TermDay is the matched events and per-value counts of one day-job
+type TermDay struct {
+    Total  int64
+    Counts map[string]int64
+}
+
+// collectDailyTermCounts is collectTermCounts keyed by the date (YYYY-MM-DD) of each day-job
+func collectDailyTermCounts(query map[string]interface{}, props Properties, field string, startDate, endDate time.Time, numWorkers int) (map[string]*TermDay, error) {
+    daily := make(map[string]*TermDay)
+    var mu sync.Mutex
+
+    err := runDayJobs(startDate, endDate, opts.Sample, numWorkers, func(job Job) error {
+        currentQuery := map[string]interface{}{
+            "query":           query["query"],
+            "start_timestamp": job.StartTimestamp,
+            "end_timestamp":   job.EndTimestamp,
+            "max_hits":        0,
+            "aggs": map[string]interface{}{
+                "by_term": map[string]interface{}{
+                    "terms": map[string]interface{}{
+                        "field": field,
+                        "size":  1000,
+                    },
+                },
+            },
+        }
+
+        result, err := sendQuickwitRequest(currentQuery, props)
+        if err != nil {
+            return err
+        }
+
+        aggs, _ := result["aggregations"].(map[string]interface{})
+        byTerm, _ := aggs["by_term"].(map[string]interface{})
+        buckets, _ := byTerm["buckets"].([]interface{})
+        numHits, _ := result["num_hits"].(float64)
+
+        date := time.Unix(job.StartTimestamp, 0).Format("2006-01-02")
+        mu.Lock()
+        defer mu.Unlock()
+        day, exists := daily[date]
+        if !exists {
+            day = &TermDay{Counts: make(map[string]int64)}
+            daily[date] = day
+        }
+        day.Total += int64(numHits)
+        for _, bucketInterface := range buckets {
+            bucket, ok := bucketInterface.(map[string]interface{})
+            if !ok {
+                continue
+            }
+            key, _ := bucket["key"].(string)
+            docCount, _ := bucket["doc_count"].(float64)
+            day.Counts[key] += int64(docCount)
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    return daily, nil
+}
+
+// runMessageTypeReport writes the events per message_type over the window and per day (-message-types)
+func runMessageTypeReport(query map[string]interface{}, props Properties, serviceProvider string, startDate, endDate time.Time, days int, specificDate bool, args []string) {
+    queryStart := time.Now()
+    daily, err := collectDailyTermCounts(query, props, "message_type", startDate, endDate, 10)
+    if err != nil {
+        log.Fatalf("Error occurred: %v", err)
+    }
+    queryDuration := time.Since(queryStart)
+
+    var output MessageTypeOutput
+    output.QueryInfo.ServiceProvider = serviceProvider
+    output.QueryInfo.Query, _ = query["query"].(string)
+    output.QueryInfo.Days = days
+    output.QueryInfo.StartDate = startDate.Format("2006-01-02 15:04:05")
+    output.QueryInfo.EndDate = endDate.Format("2006-01-02 15:04:05")
+    output.QueryInfo.SampleInfo = newSampleInfo(startDate, endDate)
+
+    counts := make(map[string]int64)
+    for date, day := range daily {
+        output.Summary.TotalEvents += day.Total
+        for messageType, count := range day.Counts {
+            counts[messageType] += count
+        }
+        output.Daily = append(output.Daily, MessageTypeDay{Date: date, Total: day.Total, Counts: day.Counts})
+    }
+    sort.Slice(output.Daily, func(i, j int) bool {
+        return output.Daily[i].Date < output.Daily[j].Date
+    })
+    for messageType, count := range counts {
+        stat := TermStat{Value: messageType, Count: count}
+        if output.Summary.TotalEvents > 0 {
+            stat.Percentage = float64(count) / float64(output.Summary.TotalEvents) * 100
+        }
+        output.MessageTypes = append(output.MessageTypes, stat)
+    }
+    sort.Slice(output.MessageTypes, func(i, j int) bool {
+        if output.MessageTypes[i].Count != output.MessageTypes[j].Count {
+            return output.MessageTypes[i].Count > output.MessageTypes[j].Count
+        }
+        return output.MessageTypes[i].Value < output.MessageTypes[j].Value
+    })
+    output.Summary.Types = len(counts)
+    output.NoData = output.Summary.TotalEvents == 0
+
+    if output.NoData {
+        warnNoData(serviceProvider, startDate, endDate)
+        if opts.Strict {
+            os.Exit(2)
+        }
+    }
+    for _, stat := range output.MessageTypes {
+        fmt.Printf("%s: %d (%.1f%%)\n", stat.Value, stat.Count, stat.Percentage)
+    }
+
+    jsonData, err := json.MarshalIndent(output, "", "  ")
+    if err != nil {
+        log.Fatalf("Error marshaling JSON: %v", err)
+    }
+
+    outputDir := fmt.Sprintf("output/%s", strings.Replace(serviceProvider, ".", "-", -1))
+    filename := outputFilename(outputDir, "message-types", specificDate, startDate, days, args)
+    if err := writeOutput(filename, jsonData); err != nil {
+        log.Fatalf("Error writing output: %v", err)
+    }
+
+    fmt.Printf("Results have been saved to %s\n", outputLocation(filename))
+    fmt.Printf("Time taken:\n")
+    fmt.Printf("  Quickwit query: %v\n", queryDuration)
+    fmt.Printf("  Overall: %v\n", time.Since(queryStart))
+}
+
+// groupByDimensions are the fields -group-by can nest, in no particular order
+var groupByDimensions = []string{"station_id", "username", "realm", "service_provider"}
+
+// groupByFields is the parsed -group-by list, outermost dimension first (nil = not given)
+var groupByFields []string
+
+// parseGroupBy parses the -group-by comma list, refusing unknown and repeated dimensions
+func parseGroupBy(value string) ([]string, error) {
+    var fields []string
+    seen := make(map[string]bool)
+    for _, field := range strings.Split(value, ",") {
+        field = strings.TrimSpace(field)
+        if field == "" {
+            continue
+        }
+        known := false
+        for _, dimension := range groupByDimensions {
+            known = known || field == dimension
+        }
+        if !known {
+            return nil, fmt.Errorf("unknown dimension %q. Use %s", field, strings.Join(groupByDimensions, ", "))
+        }
+        if seen[field] {
+            return nil, fmt.Errorf("dimension %q given twice", field)
+        }
+        seen[field] = true
+        fields = append(fields, field)
+    }
+    if len(fields) == 0 {
+        return nil, fmt.Errorf("no dimension given")
+    }
+    return fields, nil
+}
+
+// groupBySize returns the terms size of a -group-by dimension and the counter of events its size dropped
+// (the -station-size/-user-size/-realm-size of the station report; nil for service_provider)
+func groupBySize(field string) (int, *atomic.Int64) {
+    switch field {
+    case "station_id":
+        return opts.StationSize, &truncatedStations
+    case "username":
+        return opts.UserSize, &truncatedUsers
+    case "realm":
+        return opts.RealmSize, &truncatedRealms
+    }
+    return 1000, nil
+}
+
+// groupByAggs builds the nested "group" terms aggregations for fields, outermost first
+func groupByAggs(fields []string) map[string]interface{} {
+    size, _ := groupBySize(fields[0])
+    agg := map[string]interface{}{
+        "terms": map[string]interface{}{
+            "field": fields[0],
+            "size":  size,
+        },
+    }
+    if len(fields) > 1 {
+        agg["aggs"] = groupByAggs(fields[1:])
+    }
+    return map[string]interface{}{"group": agg}
+}
+
+// GroupNode accumulates the auth counts of one group and its nested groups across day-jobs
+type GroupNode struct {
+    Auths      int64
+    OtherAuths int64 // sum_other_doc_count: auths in the buckets dropped by the terms size
+    Children   map[string]*GroupNode
+}
+
+// addGroupBuckets walks the nested "group" aggregation of one day-job into node, one level per field
+func addGroupBuckets(aggs map[string]interface{}, node *GroupNode, fields []string) {
+    group, ok := aggs["group"].(map[string]interface{})
+    if !ok {
+        malformedBuckets.Add(1)
+        return
+    }
+    buckets, ok := group["buckets"].([]interface{})
+    if !ok {
+        malformedBuckets.Add(1)
+        return
+    }
+    if _, counter := groupBySize(fields[0]); counter != nil {
+        countTruncated(group, counter)
+    }
+    if other, ok := group["sum_other_doc_count"].(float64); ok {
+        node.OtherAuths += int64(other)
+    }
+
+    for _, bucketInterface := range buckets {
+        bucket, ok := bucketInterface.(map[string]interface{})
+        if !ok {
+            malformedBuckets.Add(1)
+            continue
+        }
+        key, ok := bucket["key"].(string)
+        if !ok {
+            malformedBuckets.Add(1)
+            continue
+        }
+        docCount, ok := bucket["doc_count"].(float64)
+        if !ok {
+            malformedBuckets.Add(1)
+            continue
+        }
+
+        if node.Children == nil {
+            node.Children = make(map[string]*GroupNode)
+        }
+        child, exists := node.Children[key]
+        if !exists {
+            child = &GroupNode{}
+            node.Children[key] = child
+        }
+        child.Auths += int64(docCount)
+        if len(fields) > 1 {
+            addGroupBuckets(bucket, child, fields[1:])
+        }
+    }
+}
+
+// collectGroups runs the -group-by aggregation once per day between startDate and endDate
+// and merges the nested groups of all day-jobs; it returns the root node and the total num_hits
+func collectGroups(query map[string]interface{}, props Properties, fields []string, startDate, endDate time.Time, numWorkers int) (*GroupNode, int64, error) {
+    root := &GroupNode{}
+    var total int64
+    var mu sync.Mutex
+
+    err := runDayJobs(startDate, endDate, opts.Sample, numWorkers, func(job Job) error {
+        currentQuery := map[string]interface{}{
+            "query":           query["query"],
+            "start_timestamp": job.StartTimestamp,
+            "end_timestamp":   job.EndTimestamp,
+            "max_hits":        0,
+            "aggs":            groupByAggs(fields),
+        }
+
+        result, err := sendQuickwitRequest(currentQuery, props)
+        if err == nil && opts.DumpRaw != "" {
+            err = dumpRawResponse(job, result)
+        }
+        if err != nil {
+            return err
+        }
+
+        aggs, _ := result["aggregations"].(map[string]interface{})
+        numHits, _ := result["num_hits"].(float64)
+
+        mu.Lock()
+        defer mu.Unlock()
+        total += int64(numHits)
+        root.Auths += int64(numHits)
+        addGroupBuckets(aggs, root, fields)
+        return nil
+    })
+    if err != nil {
+        return nil, 0, err
+    }
+
+    return root, total, nil
+}
+
+// groupStats converts the children of node into output groups, ordered by auths (descending)
+// or by -sort name/auths
+func groupStats(node *GroupNode, fields []string) []GroupStat {
+    groups := make([]GroupStat, 0, len(node.Children))
+    for key, child := range node.Children {
+        group := GroupStat{
+            Key:        key,
+            Auths:      child.Auths,
+            OtherAuths: child.OtherAuths,
+        }
+        if len(fields) > 1 {
+            group.Field = fields[1]
+            group.Groups = groupStats(child, fields[1:])
+        }
+        groups = append(groups, group)
+    }
+    sort.Slice(groups, func(i, j int) bool {
+        a, b := groups[i], groups[j]
+        if sortOrder.Field != "" {
+            return sortOrder.less(sortItem{a.Key, int(a.Auths), 0}, sortItem{b.Key, int(b.Auths), 0})
+        }
+        if a.Auths != b.Auths {
+            return a.Auths > b.Auths
+        }
+        return a.Key < b.Key
+    })
+    return groups
+}
+
+// runGroupByReport writes the auth counts nested by the -group-by dimensions
+func runGroupByReport(query map[string]interface{}, props Properties, serviceProvider string, startDate, endDate time.Time, days int, specificDate bool, args []string) {
+    queryStart := time.Now()
+    root, total, err := collectGroups(query, props, groupByFields, startDate, endDate, 10)
+    if err != nil {
+        log.Fatalf("Error occurred: %v", err)
+    }
+    queryDuration := time.Since(queryStart)
+
+    var output GroupByOutput
+    output.QueryInfo.ServiceProvider = serviceProvider
+    output.QueryInfo.Query, _ = query["query"].(string)
+    output.QueryInfo.GroupBy = groupByFields
+    output.QueryInfo.Days = days
+    output.QueryInfo.StartDate = startDate.Format("2006-01-02 15:04:05")
+    output.QueryInfo.EndDate = endDate.Format("2006-01-02 15:04:05")
+    output.QueryInfo.SampleInfo = newSampleInfo(startDate, endDate)
+    output.Summary.TotalAuths = total
+    output.Summary.Groups = len(root.Children)
+    output.Summary.OtherAuths = root.OtherAuths
+    output.Field = groupByFields[0]
+    output.Groups = groupStats(root, groupByFields)
+    output.NoData = total == 0
+
+    if output.NoData {
+        warnNoData(serviceProvider, startDate, endDate)
+        if opts.Strict {
+            os.Exit(2)
+        }
+    }
+    fmt.Printf("Number of %s groups: %d\n", groupByFields[0], output.Summary.Groups)
+    if skipped := malformedBuckets.Load(); skipped > 0 {
+        fmt.Printf("Skipped %d malformed buckets\n", skipped)
+    }
+    warnTruncated()
+
+    jsonData, err := json.MarshalIndent(output, "", "  ")
+    if err != nil {
+        log.Fatalf("Error marshaling JSON: %v", err)
+    }
+
+    outputDir := fmt.Sprintf("output/%s", strings.Replace(serviceProvider, ".", "-", -1))
+    filename := outputFilename(outputDir, "groups", specificDate, startDate, days, args)
+    if err := writeOutput(filename, jsonData); err != nil {
+        log.Fatalf("Error writing output: %v", err)
+    }
+
+    fmt.Printf("Results have been saved to %s\n", outputLocation(filename))
+    fmt.Printf("Time taken:\n")
+    fmt.Printf("  Quickwit query: %v\n", queryDuration)
+    fmt.Printf("  Overall: %v\n", time.Since(queryStart))
+}
+
+// loadQueryTemplate reads a -query-file request body and checks it is a JSON object once
+// {start} and {end} are filled in
+func loadQueryTemplate(filePath string) (string, error) {
+    data, err := os.ReadFile(filePath)
+    if err != nil {
+        return "", err
+    }
+    template := string(data)
+    var query map[string]interface{}
+    if err := json.Unmarshal([]byte(fillQueryTemplate(template, Job{})), &query); err != nil {
+        return "", fmt.Errorf("%s is not a JSON object: %v", filePath, err)
+    }
+    if _, ok := query["query"]; !ok {
+        return "", fmt.Errorf("%s has no query", filePath)
+    }
+    return template, nil
+}
+
+// fillQueryTemplate replaces {start} and {end} with the unix timestamps of a day-job
+func fillQueryTemplate(template string, job Job) string {
+    return strings.NewReplacer(
+        "{start}", strconv.FormatInt(job.StartTimestamp, 10),
+        "{end}", strconv.FormatInt(job.EndTimestamp, 10),
+    ).Replace(template)
+}
+
+// collectQueryFile runs queryTemplate once per day between startDate and endDate and merges
+// the aggregations of all day-jobs; it returns them with the total num_hits and the number of day-jobs
+func collectQueryFile(props Properties, startDate, endDate time.Time, numWorkers int) (map[string]interface{}, int64, int, error) {
+    merged := make(map[string]interface{})
+    var total int64
+    var dayJobs int
+    var mu sync.Mutex
+
+    err := runDayJobs(startDate, endDate, opts.Sample, numWorkers, func(job Job) error {
+        var currentQuery map[string]interface{}
+        if err := json.Unmarshal([]byte(fillQueryTemplate(queryTemplate, job)), &currentQuery); err != nil {
+            return fmt.Errorf("error parsing query file: %v", err)
+        }
+        if _, ok := currentQuery["start_timestamp"]; !ok {
+            currentQuery["start_timestamp"] = job.StartTimestamp
+        }
+        if _, ok := currentQuery["end_timestamp"]; !ok {
+            currentQuery["end_timestamp"] = job.EndTimestamp
+        }
+        if _, ok := currentQuery["max_hits"]; !ok {
+            currentQuery["max_hits"] = 0
+        }
+
+        result, err := sendQuickwitRequest(currentQuery, props)
+        if err == nil && opts.DumpRaw != "" {
+            err = dumpRawResponse(job, result)
+        }
+        if err != nil {
+            return err
+        }
+
+        aggs, _ := result["aggregations"].(map[string]interface{})
+        numHits, _ := result["num_hits"].(float64)
+
+        mu.Lock()
+        defer mu.Unlock()
+        total += int64(numHits)
+        dayJobs++
+        mergeAggregations(merged, aggs)
+        return nil
+    })
+    if err != nil {
+        return nil, 0, 0, err
+    }
+
+    return merged, total, dayJobs, nil
+}
+
+// mergeAggregations merges the named aggregations of one day-job into merged
+func mergeAggregations(merged, aggs map[string]interface{}) {
+    for name, value := range aggs {
+        agg, ok := value.(map[string]interface{})
+        if !ok {
+            continue
+        }
+        if existing, ok := merged[name].(map[string]interface{}); ok {
+            mergeAggregation(existing, agg)
+        } else {
+            merged[name] = agg
+        }
+    }
+}
+
+// mergeAggregation adds one day's aggregation (or bucket) into merged: numbers such as doc_count,
+// sum_other_doc_count and metric values are summed, buckets are matched by key and sub-aggregations merged
+func mergeAggregation(merged, agg map[string]interface{}) {
+    for field, value := range agg {
+        if field == "key" || field == "key_as_string" {
+            continue
+        }
+        switch v := value.(type) {
+        case float64:
+            previous, _ := merged[field].(float64)
+            merged[field] = previous + v
+        case []interface{}:
+            if field == "buckets" {
+                merged[field] = mergeBuckets(merged[field], v)
+            }
+        case map[string]interface{}:
+            if existing, ok := merged[field].(map[string]interface{}); ok {
+                mergeAggregation(existing, v)
+            } else {
+                merged[field] = v
+            }
+        }
+    }
+}
+
+// mergeBuckets merges buckets into existing by key; histogram buckets (numeric keys) are kept in key order,
+// term buckets by doc_count (descending) then key
+func mergeBuckets(existing interface{}, buckets []interface{}) []interface{} {
+    merged, _ := existing.([]interface{})
+    index := make(map[string]map[string]interface{})
+    for _, bucketInterface := range merged {
+        if bucket, ok := bucketInterface.(map[string]interface{}); ok {
+            index[fmt.Sprint(bucket["key"])] = bucket
+        }
+    }
+    for _, bucketInterface := range buckets {
+        bucket, ok := bucketInterface.(map[string]interface{})
+        if !ok {
+            continue
+        }
+        key := fmt.Sprint(bucket["key"])
+        if previous, ok := index[key]; ok {
+            mergeAggregation(previous, bucket)
+            continue
+        }
+        index[key] = bucket
+        merged = append(merged, bucket)
+    }
+
+    sort.SliceStable(merged, func(i, j int) bool {
+        a, _ := merged[i].(map[string]interface{})
+        b, _ := merged[j].(map[string]interface{})
+        aKey, aNumeric := a["key"].(float64)
+        bKey, bNumeric := b["key"].(float64)
+        if aNumeric && bNumeric {
+            return aKey < bKey
+        }
+        aCount, _ := a["doc_count"].(float64)
+        bCount, _ := b["doc_count"].(float64)
+        if aCount != bCount {
+            return aCount > bCount
+        }
+        return fmt.Sprint(a["key"]) < fmt.Sprint(b["key"])
+    })
+    return merged
+}
+
+// runQueryFile runs -query-file over the range and writes the merged aggregations
+func runQueryFile(props Properties, serviceProvider string, startDate, endDate time.Time, days int, specificDate bool, args []string) {
+    queryStart := time.Now()
+    aggs, total, dayJobs, err := collectQueryFile(props, startDate, endDate, 10)
+    if err != nil {
+        log.Fatalf("Error occurred: %v", err)
+    }
+    queryDuration := time.Since(queryStart)
+
+    var output QueryFileOutput
+    output.QueryInfo.ServiceProvider = serviceProvider
+    output.QueryInfo.QueryFile = opts.QueryFile
+    output.QueryInfo.Days = days
+    output.QueryInfo.StartDate = startDate.Format("2006-01-02 15:04:05")
+    output.QueryInfo.EndDate = endDate.Format("2006-01-02 15:04:05")
+    output.QueryInfo.SampleInfo = newSampleInfo(startDate, endDate)
+    output.Summary.TotalHits = total
+    output.Summary.DayJobs = dayJobs
+    output.Aggregations = aggs
+    output.NoData = total == 0
+
+    if output.NoData {
+        warnNoData(serviceProvider, startDate, endDate)
+        if opts.Strict {
+            os.Exit(2)
+        }
+    }
+    fmt.Printf("Total hits: %d over %d day-jobs\n", total, dayJobs)
+
+    jsonData, err := json.MarshalIndent(output, "", "  ")
+    if err != nil {
+        log.Fatalf("Error marshaling JSON: %v", err)
+    }
+
+    outputDir := fmt.Sprintf("output/%s", strings.Replace(serviceProvider, ".", "-", -1))
+    filename := outputFilename(outputDir, "query", specificDate, startDate, days, args)
+    if err := writeOutput(filename, jsonData); err != nil {
+        log.Fatalf("Error writing output: %v", err)
+    }
+
+    fmt.Printf("Results have been saved to %s\n", outputLocation(filename))
+    fmt.Printf("Time taken:\n")
+    fmt.Printf("  Quickwit query: %v\n", queryDuration)
+    fmt.Printf("  Overall: %v\n", time.Since(queryStart))
+}
+
+// parseCIDR parses the -cidr value "V4[,V6]" into IPv4 and IPv6 prefix lengths (0 = per address)
+func parseCIDR(value string) (int, int, error) {
+    parts := strings.SplitN(value, ",", 2)
+    v4, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+    if err != nil || v4 < 1 || v4 > 32 {
+        return 0, 0, fmt.Errorf("invalid IPv4 prefix %q (1-32)", parts[0])
+    }
+    v6 := 0
+    if len(parts) == 2 {
+        v6, err = strconv.Atoi(strings.TrimSpace(parts[1]))
+        if err != nil || v6 < 1 || v6 > 128 {
+            return 0, 0, fmt.Errorf("invalid IPv6 prefix %q (1-128)", parts[1])
+        }
+    }
+    return v4, v6, nil
+}
+
+// classifyIP returns the grouping key (address or subnet) and the IP version of a destination_ip value
+func classifyIP(value string) (string, string) {
+    // Quickwit เก็บ IPv4 เป็น IPv4-mapped IPv6 (::ffff:a.b.c.d)
+    addr, err := netip.ParseAddr(value)
+    if err != nil {
+        return value, "unknown"
+    }
+    addr = addr.Unmap()
+
+    version, bits := "v6", opts.CIDR6
+    if addr.Is4() {
+        version, bits = "v4", opts.CIDR4
+    }
+    if bits > 0 {
+        if prefix, err := addr.Prefix(bits); err == nil {
+            return prefix.String(), version
+        }
+    }
+    return addr.String(), version
+}
+
+// runDestinationReport aggregates auths per destination_ip (-dest-ip) and writes the distribution
+func runDestinationReport(query map[string]interface{}, props Properties, serviceProvider string, startDate, endDate time.Time, days int, specificDate bool, args []string) {
+    queryStart := time.Now()
+    counts, _, err := collectTermCounts(query, props, "destination_ip", startDate, endDate, 10)
+    if err != nil {
+        log.Fatalf("Error occurred: %v", err)
+    }
+    queryDuration := time.Since(queryStart)
+
+    var output DestinationOutput
+    output.QueryInfo.ServiceProvider = serviceProvider
+    output.QueryInfo.Days = days
+    output.QueryInfo.StartDate = startDate.Format("2006-01-02 15:04:05")
+    output.QueryInfo.EndDate = endDate.Format("2006-01-02 15:04:05")
+    output.QueryInfo.CIDR = opts.CIDR
+    output.QueryInfo.SampleInfo = newSampleInfo(startDate, endDate)
+
+    grouped := make(map[string]*DestinationStat)
+    for ip, count := range counts {
+        key, version := classifyIP(ip)
+        stat, exists := grouped[key]
+        if !exists {
+            stat = &DestinationStat{Destination: key, IPVersion: version}
+            grouped[key] = stat
+        }
+        stat.Count += count
+        output.Summary.TotalAuths += count
+        switch version {
+        case "v4":
+            output.Summary.IPv4Auths += count
+        case "v6":
+            output.Summary.IPv6Auths += count
+        }
+    }
+
+    output.Destinations = make([]DestinationStat, 0, len(grouped))
+    for _, stat := range grouped {
+        if output.Summary.TotalAuths > 0 {
+            stat.Percentage = float64(stat.Count) / float64(output.Summary.TotalAuths) * 100
+        }
+        output.Destinations = append(output.Destinations, *stat)
+    }
+    sort.Slice(output.Destinations, func(i, j int) bool {
+        if output.Destinations[i].Count != output.Destinations[j].Count {
+            return output.Destinations[i].Count > output.Destinations[j].Count
+        }
+        return output.Destinations[i].Destination < output.Destinations[j].Destination
+    })
+    output.Summary.Destinations = len(output.Destinations)
+    output.NoData = output.Summary.TotalAuths == 0
+
+    if output.NoData {
+        warnNoData(serviceProvider, startDate, endDate)
+        if opts.Strict {
+            os.Exit(2)
+        }
+    }
+    fmt.Printf("Number of destinations: %d (IPv4 auths: %d, IPv6 auths: %d)\n",
+        output.Summary.Destinations, output.Summary.IPv4Auths, output.Summary.IPv6Auths)
+
+    jsonData, err := json.MarshalIndent(output, "", "  ")
+    if err != nil {
+        log.Fatalf("Error marshaling JSON: %v", err)
+    }
+
+    outputDir := fmt.Sprintf("output/%s", strings.Replace(serviceProvider, ".", "-", -1))
+    filename := outputFilename(outputDir, "destip", specificDate, startDate, days, args)
+    if err := writeOutput(filename, jsonData); err != nil {
+        log.Fatalf("Error writing output: %v", err)
+    }
+
+    fmt.Printf("Results have been saved to %s\n", outputLocation(filename))
+    fmt.Printf("Time taken:\n")
+    fmt.Printf("  Quickwit query: %v\n", queryDuration)
+    fmt.Printf("  Overall: %v\n", time.Since(queryStart))
+}
+
+// FlatAuthEvent is one auth event of the -flatten output
+type FlatAuthEvent struct {
+    StationID string     `json:"station_id"`
+    Username  string     `json:"username"`
+    Realm     string     `json:"realm"`
+    Timestamp TimeString `json:"timestamp"`
+    Provider  string     `json:"provider"`
+}
+
+// flattenResult turns the station -> user -> timestamps aggregation back into one row per
+// auth event, sorted by timestamp (then station and username)
+func flattenResult(result *Result, serviceProvider string) []FlatAuthEvent {
+    type event struct {
+        FlatAuthEvent
+        at time.Time
+    }
+    var events []event
+    providers := result.Providers
+    if providers == nil {
+        providers = map[string]*Result{serviceProvider: result}
+    }
+    for provider, sub := range providers {
+        for stationID, stats := range sub.Stations {
+            for username, activity := range stats.Users {
+                for _, ts := range activity.AuthTimestamps {
+                    events = append(events, event{
+                        FlatAuthEvent: FlatAuthEvent{
+                            StationID: stationID,
+                            Username:  username,
+                            Realm:     activity.Realm,
+                            Timestamp: TimeString(ts.Format(time.RFC3339)),
+                            Provider:  provider,
+                        },
+                        at: ts,
+                    })
+                }
+            }
+        }
+    }
+
+    sort.Slice(events, func(i, j int) bool {
+        if !events[i].at.Equal(events[j].at) {
+            return events[i].at.Before(events[j].at)
+        }
+        if events[i].StationID != events[j].StationID {
+            return events[i].StationID < events[j].StationID
+        }
+        return events[i].Username < events[j].Username
+    })
+
+    flat := make([]FlatAuthEvent, len(events))
+    for i, e := range events {
+        flat[i] = e.FlatAuthEvent
+    }
+    return flat
+}
+
+// heatmapCSV buckets the auth timestamps of every station into a date x hour matrix (local time)
+// and renders it as CSV: a "date,0,...,23" header and one row per date from startDate to endDate
+func heatmapCSV(result *Result, startDate, endDate time.Time) ([]byte, error) {
+    counts := make(map[string]*[24]int)
+    for _, leaf := range result.leafResults() {
+        for _, stats := range leaf.Stations {
+            for _, activity := range stats.Users {
+                for _, ts := range activity.AuthTimestamps {
+                    local := ts.Local()
+                    date := local.Format("2006-01-02")
+                    if counts[date] == nil {
+                        counts[date] = &[24]int{}
+                    }
+                    counts[date][local.Hour()]++
+                }
+            }
+        }
+    }
+
+    var buf bytes.Buffer
+    w := csv.NewWriter(&buf)
+    header := []string{"date"}
+    for hour := 0; hour < 24; hour++ {
+        header = append(header, strconv.Itoa(hour))
+    }
+    if err := w.Write(header); err != nil {
+        return nil, err
+    }
+    for day := startDate; !day.After(endDate); day = day.AddDate(0, 0, 1) {
+        date := day.Format("2006-01-02")
+        row := []string{date}
+        hours := counts[date]
+        for hour := 0; hour < 24; hour++ {
+            count := 0
+            if hours != nil {
+                count = hours[hour]
+            }
+            row = append(row, strconv.Itoa(count))
+        }
+        if err := w.Write(row); err != nil {
+            return nil, err
+        }
+    }
+    w.Flush()
+    return buf.Bytes(), w.Error()
+}
+
+// deviceTrend counts the distinct station_ids and usernames with an auth on each day of the
+// range (local time) across all stations (and providers with all), days without auths as zeros
+func deviceTrend(result *Result, startDate, endDate time.Time) []DeviceTrendPoint {
+    stations := make(map[string]map[string]bool) // key: date -> station_id
+    users := make(map[string]map[string]bool)    // key: date -> username
+    for _, leaf := range result.leafResults() {
+        for stationID, stats := range leaf.Stations {
+            for username, activity := range stats.Users {
+                for _, ts := range activity.AuthTimestamps {
+                    date := ts.Local().Format("2006-01-02")
+                    if stations[date] == nil {
+                        stations[date] = make(map[string]bool)
+                        users[date] = make(map[string]bool)
+                    }
+                    stations[date][stationID] = true
+                    users[date][username] = true
+                }
+            }
+        }
+    }
+
+    var series []DeviceTrendPoint
+    for day := startDate; !day.After(endDate); day = day.AddDate(0, 0, 1) {
+        date := day.Format("2006-01-02")
+        series = append(series, DeviceTrendPoint{
+            Date:           date,
+            UniqueStations: len(stations[date]),
+            UniqueUsers:    len(users[date]),
+        })
+    }
+    return series
+}
+
+// appendRollingData merges result into the rolling JSON file at path (-append).
+// Counts are summed and user/station sets unioned; session and pattern analysis
+// cannot be merged from earlier runs and are not kept. Dates already present are refused.
+func appendRollingData(path string, result *Result, serviceProvider string) (*RollingData, error) {
+    var rolling RollingData
+    data, err := os.ReadFile(path)
+    if err == nil {
+        if err := json.Unmarshal(data, &rolling); err != nil {
+            return nil, fmt.Errorf("error parsing %s: %v", path, err)
+        }
+        if rolling.ServiceProvider != serviceProvider {
+            return nil, fmt.Errorf("%s holds %s, not %s", path, rolling.ServiceProvider, serviceProvider)
+        }
+    } else if !os.IsNotExist(err) {
+        return nil, fmt.Errorf("error reading %s: %v", path, err)
+    }
+    rolling.ServiceProvider = serviceProvider
+
+    daily := make(map[string]*RollingDay)
+    for i := range rolling.Daily {
+        daily[rolling.Daily[i].Date] = &rolling.Daily[i]
+    }
+    stations := make(map[string]*RollingStation)
+    stationUsers := make(map[string]map[string]bool)
+    for i := range rolling.StationStats {
+        station := &rolling.StationStats[i]
+        stations[station.StationID] = station
+        stationUsers[station.StationID] = toSet(station.Users)
+    }
+    realms := make(map[string]*RollingRealm)
+    realmUsers := make(map[string]map[string]bool)
+    realmStations := make(map[string]map[string]bool)
+    for i := range rolling.RealmStats {
+        realm := &rolling.RealmStats[i]
+        realms[realm.Realm] = realm
+        realmUsers[realm.Realm] = toSet(realm.Users)
+        realmStations[realm.Realm] = toSet(realm.Stations)
+    }
+
+    // นับรายวันจาก timestamp ของ run นี้ก่อน เพื่อตรวจวันที่ซ้ำ
+    newDays := make(map[string]*RollingDay)
+    dayStations := make(map[string]map[string]bool)
+    dayUsers := make(map[string]map[string]bool)
+    for _, leaf := range result.leafResults() {
+        for stationID, stats := range leaf.Stations {
+            for username, activity := range stats.Users {
+                for _, ts := range activity.AuthTimestamps {
+                    date := ts.Local().Format("2006-01-02")
+                    if _, exists := newDays[date]; !exists {
+                        newDays[date] = &RollingDay{Date: date}
+                        dayStations[date] = make(map[string]bool)
+                        dayUsers[date] = make(map[string]bool)
+                    }
+                    newDays[date].TotalAuths++
+                    dayStations[date][stationID] = true
+                    dayUsers[date][username] = true
+                }
+            }
+        }
+    }
+    for date := range newDays {
+        if _, exists := daily[date]; exists {
+            return nil, fmt.Errorf("%s already contains %s; refusing to count it twice", path, date)
+        }
+    }
+    for date, day := range newDays {
+        day.Stations = len(dayStations[date])
+        day.Users = len(dayUsers[date])
+        rolling.Daily = append(rolling.Daily, *day)
+    }
+
+    for _, leaf := range result.leafResults() {
+        for stationID, stats := range leaf.Stations {
+            if stats.TotalAuths == 0 {
+                continue
+            }
+            station, exists := stations[stationID]
+            if !exists {
+                station = &RollingStation{StationID: stationID}
+                stations[stationID] = station
+                stationUsers[stationID] = make(map[string]bool)
+            }
+            station.TotalAuths += stats.TotalAuths
+            for username, activity := range stats.Users {
+                if len(activity.AuthTimestamps) == 0 {
+                    continue
+                }
+                stationUsers[stationID][username] = true
+                for _, ts := range activity.AuthTimestamps {
+                    date := ts.Local().Format("2006-01-02")
+                    if station.FirstSeen == "" || date < station.FirstSeen {
+                        station.FirstSeen = date
+                    }
+                    if date > station.LastSeen {
+                        station.LastSeen = date
+                    }
+                }
+            }
+        }
+        for realmName, stats := range leaf.Realms {
+            realm, exists := realms[realmName]
+            if !exists {
+                realm = &RollingRealm{Realm: realmName}
+                realms[realmName] = realm
+                realmUsers[realmName] = make(map[string]bool)
+                realmStations[realmName] = make(map[string]bool)
+            }
+            realm.TotalAuths += stats.TotalAuths
+            for username := range stats.Users {
+                realmUsers[realmName][username] = true
+            }
+            for stationID := range stats.Stations {
+                realmStations[realmName][stationID] = true
+            }
+        }
+    }
+
+    sort.Slice(rolling.Daily, func(i, j int) bool {
+        return rolling.Daily[i].Date < rolling.Daily[j].Date
+    })
+
+    uniqueUsers := make(map[string]bool)
+    rolling.StationStats = make([]RollingStation, 0, len(stations))
+    rolling.Summary.TotalAuths = 0
+    for stationID, station := range stations {
+        station.Users = sortedKeys(stationUsers[stationID])
+        for username := range stationUsers[stationID] {
+            uniqueUsers[username] = true
+        }
+        rolling.Summary.TotalAuths += station.TotalAuths
+        rolling.StationStats = append(rolling.StationStats, *station)
+    }
+    sort.Slice(rolling.StationStats, func(i, j int) bool {
+        if rolling.StationStats[i].TotalAuths != rolling.StationStats[j].TotalAuths {
+            return rolling.StationStats[i].TotalAuths > rolling.StationStats[j].TotalAuths
+        }
+        return rolling.StationStats[i].StationID < rolling.StationStats[j].StationID
+    })
+
+    rolling.RealmStats = make([]RollingRealm, 0, len(realms))
+    for realmName, realm := range realms {
+        realm.Users = sortedKeys(realmUsers[realmName])
+        realm.Stations = sortedKeys(realmStations[realmName])
+        rolling.RealmStats = append(rolling.RealmStats, *realm)
+    }
+    sort.Slice(rolling.RealmStats, func(i, j int) bool {
+        if rolling.RealmStats[i].TotalAuths != rolling.RealmStats[j].TotalAuths {
+            return rolling.RealmStats[i].TotalAuths > rolling.RealmStats[j].TotalAuths
+        }
+        return rolling.RealmStats[i].Realm < rolling.RealmStats[j].Realm
+    })
+
+    rolling.Summary.UniqueStations = len(rolling.StationStats)
+    rolling.Summary.UniqueUsers = len(uniqueUsers)
+    rolling.Summary.UniqueRealms = len(rolling.RealmStats)
+    rolling.UpdatedAt = time.Now().Format("2006-01-02 15:04:05")
+
+    jsonData, err := json.MarshalIndent(rolling, "", "  ")
+    if err != nil {
+        return nil, fmt.Errorf("error marshaling JSON: %v", err)
+    }
+    if dir := filepath.Dir(path); dir != "." {
+        if err := os.MkdirAll(dir, 0755); err != nil {
+            return nil, fmt.Errorf("error creating output directory: %v", err)
+        }
+    }
+    if err := writeFileAtomic(path, jsonData); err != nil {
+        return nil, err
+    }
+    return &rolling, nil
+}
+
+// mergeReports reads station reports from files and combines them into one all-providers report.
+// A report of a single provider becomes one entry of providers; an all-providers report contributes
+// each of its providers. Summary totals are summed, while stations, users and realms are counted
+// once across providers. complete is false when an input had no user_details to deduplicate users from.
+func mergeReports(files []string) (output SimplifiedOutputData, complete bool, err error) {
+    output.QueryInfo.ServiceProvider = allProviders
+    output.StationStats = []StationStatsOutput{}
+    output.RealmStats = []RealmStat{}
+    complete = true
+
+    result := newResult()
+    result.Providers = make(map[string]*Result)
+    source := make(map[string]string) // provider -> ไฟล์ที่อ่านมา
+    isNew := make(map[string]bool)     // station_id -> is_new ในทุก report ที่พบ
+    for _, name := range files {
+        data, err := os.ReadFile(name)
+        if err != nil {
+            return output, false, fmt.Errorf("error reading %s: %v", name, err)
+        }
+        var report SimplifiedOutputData
+        if err := json.Unmarshal(data, &report); err != nil {
+            return output, false, fmt.Errorf("error parsing %s: %v", name, err)
+        }
+
+        reports := report.Providers
+        if len(reports) == 0 {
+            reports = []SimplifiedOutputData{report}
+        }
+        for _, sub := range reports {
+            provider := sub.QueryInfo.ServiceProvider
+            if provider == "" || provider == allProviders {
+                return output, false, fmt.Errorf("%s is not a station report of a service provider", name)
+            }
+            if previous, exists := source[provider]; exists {
+                return output, false, fmt.Errorf("%s appears in both %s and %s", provider, previous, name)
+            }
+            source[provider] = name
+
+            leaf := result.providerResult(provider)
+            for _, station := range sub.StationStats {
+                stats := &StationStats{
+                    StationID:       station.StationID,
+                    TotalAuths:      station.TotalAuths,
+                    TotalChallenges: station.TotalChallenges,
+                    Users:           make(map[string]*UserActivity),
+                }
+                for _, detail := range station.UserDetails {
+                    stats.Users[detail.Username] = &UserActivity{Username: detail.Username, Realm: detail.Realm}
+                }
+                if station.TotalUsers > len(station.UserDetails) {
+                    complete = false
+                }
+                leaf.Stations[station.StationID] = stats
+                if station.IsNew != nil {
+                    known, seen := isNew[station.StationID]
+                    isNew[station.StationID] = *station.IsNew && (!seen || known)
+                }
+            }
+            if sub.QueryInfo.NoDetails {
+                complete = false
+            }
+            for _, realm := range sub.RealmStats {
+                leaf.Realms[realm.Realm] = &RealmStats{Realm: realm.Realm}
+            }
+
+            output.Providers = append(output.Providers, sub)
+            output.Summary.TotalAuths += sub.Summary.TotalAuths
+            output.Summary.TotalChallenges += sub.Summary.TotalChallenges
+            output.Summary.OvernightStations += sub.Summary.OvernightStations
+            output.Summary.ManyIdentityStations += sub.Summary.ManyIdentityStations
+            output.Summary.ManyRealmStations += sub.Summary.ManyRealmStations
+
+            // ช่วงเวลารวมของทุก report (รูปแบบ "2006-01-02 15:04:05" เรียงตามตัวอักษรได้)
+            if output.QueryInfo.StartDate == "" || sub.QueryInfo.StartDate < output.QueryInfo.StartDate {
+                output.QueryInfo.StartDate = sub.QueryInfo.StartDate
+            }
+            if sub.QueryInfo.EndDate > output.QueryInfo.EndDate {
+                output.QueryInfo.EndDate = sub.QueryInfo.EndDate
+            }
+            if sub.QueryInfo.Days > output.QueryInfo.Days {
+                output.QueryInfo.Days = sub.QueryInfo.Days
+            }
+            if output.QueryInfo.AuthInterval == "" {
+                output.QueryInfo.AuthInterval = sub.QueryInfo.AuthInterval
+            }
+            output.QueryInfo.IncludeChallenges = output.QueryInfo.IncludeChallenges || sub.QueryInfo.IncludeChallenges
+        }
+    }
+
+    uniqueUsers := make(map[string]bool)
+    for _, leaf := range result.leafResults() {
+        for _, stats := range leaf.Stations {
+            for username := range stats.Users {
+                uniqueUsers[username] = true
+            }
+        }
+    }
+    output.Summary.UniqueStations, output.Summary.UniqueRealms = result.countUnique()
+    output.Summary.UniqueUsers = len(uniqueUsers)
+    for _, stationIsNew := range isNew {
+        if stationIsNew {
+            output.Summary.NewStations++
+        }
+    }
+    output.setDensity(result.density())
+    output.NoData = output.Summary.TotalAuths == 0
+    sortProviders(output.Providers)
+
+    return output, complete, nil
+}
+
+// runMerge combines the report files given to the merge subcommand and writes the all-providers report
+func runMerge(files []string) {
+    if len(files) < 2 {
+        log.Fatalf("merge needs at least two report files")
+    }
+
+    output, complete, err := mergeReports(files)
+    if err != nil {
+        log.Fatalf("Error merging reports: %v", err)
+    }
+    if !complete {
+        fmt.Println("WARNING: some reports have no user_details (-no-details or -fields); unique users are a lower bound")
+    }
+    fmt.Printf("Merged %d providers from %d files\n", len(output.Providers), len(files))
+    fmt.Printf("Number of unique stations: %d\n", output.Summary.UniqueStations)
+    fmt.Printf("Number of unique users: %d\n", output.Summary.UniqueUsers)
+    fmt.Printf("Number of realms: %d\n", output.Summary.UniqueRealms)
+
+    jsonData, err := json.MarshalIndent(output, "", "  ")
+    if err != nil {
+        log.Fatalf("Error marshaling JSON: %v", err)
+    }
+
+    filename := fmt.Sprintf("output/%s/%s-merged.json", allProviders, time.Now().Format("20060102-150405"))
+    if err := writeOutput(filename, jsonData); err != nil {
+        log.Fatalf("Error writing output: %v", err)
+    }
+    fmt.Printf("Results have been saved to %s\n", outputLocation(filename))
+}
+
+// toSet converts a string slice into a set
+func toSet(values []string) map[string]bool {
+    set := make(map[string]bool, len(values))
+    for _, value := range values {
+        set[value] = true
+    }
+    return set
+}
+
+// sortedKeys returns the keys of a set in sorted order
+func sortedKeys(set map[string]bool) []string {
+    keys := make([]string, 0, len(set))
+    for key := range set {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+// runCountOnly prints the window totals (-count-only) from one max_hits:0 request
+func runCountOnly(query map[string]interface{}, props Properties, serviceProvider string) {
+    queryStart := time.Now()
+    countQuery := map[string]interface{}{
+        "query":           query["query"],
+        "start_timestamp": query["start_timestamp"],
+        "end_timestamp":   query["end_timestamp"],
+        "max_hits":        0,
+        "aggs": map[string]interface{}{
+            "unique_users": map[string]interface{}{
+                "cardinality": map[string]interface{}{"field": "username"},
+            },
+            "unique_stations": map[string]interface{}{
+                "cardinality": map[string]interface{}{"field": "station_id"},
+            },
+        },
+    }
+
+    result, err := sendQuickwitRequest(countQuery, props)
+    if err != nil {
+        log.Fatalf("Error occurred: %v", err)
+    }
+
+    totalAuths, _ := result["num_hits"].(float64)
+    aggs, _ := result["aggregations"].(map[string]interface{})
+    cardinality := func(name string) int64 {
+        agg, _ := aggs[name].(map[string]interface{})
+        value, _ := agg["value"].(float64)
+        return int64(value)
+    }
+
+    if totalAuths == 0 && opts.Strict {
+        fmt.Printf("WARNING: the query matched no events for %s\n", serviceProvider)
+        os.Exit(2)
+    }
+    fmt.Printf("Service provider: %s\n", serviceProvider)
+    fmt.Printf("Total authentications: %d\n", int64(totalAuths))
+    // cardinality ของ Quickwit เป็นค่าประมาณ (HyperLogLog)
+    fmt.Printf("Unique users (approx.): %d\n", cardinality("unique_users"))
+    fmt.Printf("Unique stations (approx.): %d\n", cardinality("unique_stations"))
+    fmt.Printf("Time taken: %v\n", time.Since(queryStart))
+}
+
+// runTermReport writes the auth distribution over the values of field; auths without
+// the field are counted as missing and listed under missingLabel
+func runTermReport(query map[string]interface{}, props Properties, field, missingLabel, suffix, serviceProvider string, startDate, endDate time.Time, days int, specificDate bool, args []string) {
+    queryStart := time.Now()
+    counts, total, err := collectTermCounts(query, props, field, startDate, endDate, 10)
+    if err != nil {
+        log.Fatalf("Error occurred: %v", err)
+    }
+    queryDuration := time.Since(queryStart)
+
+    var output TermReportOutput
+    output.QueryInfo.ServiceProvider = serviceProvider
+    output.QueryInfo.Query, _ = query["query"].(string)
+    output.QueryInfo.Field = field
+    output.QueryInfo.Days = days
+    output.QueryInfo.StartDate = startDate.Format("2006-01-02 15:04:05")
+    output.QueryInfo.EndDate = endDate.Format("2006-01-02 15:04:05")
+    output.QueryInfo.SampleInfo = newSampleInfo(startDate, endDate)
+    output.Summary.TotalAuths = total
+    output.NoData = total == 0
+
+    var counted int64
+    for value, count := range counts {
+        // ip fields (nas_ip) กลับจาก Quickwit เป็น IPv4-mapped IPv6
+        if addr, err := netip.ParseAddr(value); err == nil {
+            value = addr.Unmap().String()
+        }
+        output.Values = append(output.Values, TermStat{Value: value, Count: count})
+        counted += count
+    }
+    if missing := total - counted; missing > 0 {
+        output.Summary.Missing = missing
+        output.Values = append(output.Values, TermStat{Value: missingLabel, Count: missing})
+    }
+    for i := range output.Values {
+        if total > 0 {
+            output.Values[i].Percentage = float64(output.Values[i].Count) / float64(total) * 100
+        }
+    }
+    sort.Slice(output.Values, func(i, j int) bool {
+        if output.Values[i].Count != output.Values[j].Count {
+            return output.Values[i].Count > output.Values[j].Count
+        }
+        return output.Values[i].Value < output.Values[j].Value
+    })
+    output.Summary.Values = len(counts)
+
+    if output.NoData {
+        warnNoData(serviceProvider, startDate, endDate)
+        if opts.Strict {
+            os.Exit(2)
+        }
+    }
+    fmt.Printf("Number of %s values: %d (auths without %s: %d)\n", field, output.Summary.Values, field, output.Summary.Missing)
+
+    jsonData, err := json.MarshalIndent(output, "", "  ")
+    if err != nil {
+        log.Fatalf("Error marshaling JSON: %v", err)
+    }
+
+    outputDir := fmt.Sprintf("output/%s", strings.Replace(serviceProvider, ".", "-", -1))
+    filename := outputFilename(outputDir, suffix, specificDate, startDate, days, args)
+    if err := writeOutput(filename, jsonData); err != nil {
+        log.Fatalf("Error writing output: %v", err)
+    }
+
+    fmt.Printf("Results have been saved to %s\n", outputLocation(filename))
+    fmt.Printf("Time taken:\n")
+    fmt.Printf("  Quickwit query: %v\n", queryDuration)
+    fmt.Printf("  Overall: %v\n", time.Since(queryStart))
+}
+
+// userCardinality returns a day-job's unique_users estimate next to the distinct usernames
+// found in its by_station/by_user buckets (nil without the estimate)
+func userCardinality(job Job, result map[string]interface{}) *UserCardinalityDay {
+    aggs, ok := result["aggregations"].(map[string]interface{})
+    if !ok {
+        return nil
+    }
+    cardinality, ok := aggs["unique_users"].(map[string]interface{})
+    if !ok {
+        return nil
+    }
+    estimate, ok := cardinality["value"].(float64)
+    if !ok {
+        return nil
+    }
+    users := make(map[string]bool)
+    collectUsernames(aggs, users)
+
+    return &UserCardinalityDay{
+        Date:      time.Unix(job.StartTimestamp, 0).Format("2006-01-02"),
+        Estimated: int(estimate),
+        Counted:   len(users),
+    }
+}
+
+// collectUsernames adds the username keys of the by_user buckets under aggs (through
+// by_provider with all) to users
+func collectUsernames(aggs map[string]interface{}, users map[string]bool) {
+    bucketsOf := func(agg map[string]interface{}, name string) []interface{} {
+        sub, _ := agg[name].(map[string]interface{})
+        buckets, _ := sub["buckets"].([]interface{})
+        return buckets
+    }
+    if _, ok := aggs["by_provider"]; ok {
+        for _, providerBucket := range bucketsOf(aggs, "by_provider") {
+            if bucket, ok := providerBucket.(map[string]interface{}); ok {
+                collectUsernames(bucket, users)
+            }
+        }
+        return
+    }
+    for _, stationBucket := range bucketsOf(aggs, "by_station") {
+        bucket, ok := stationBucket.(map[string]interface{})
+        if !ok {
+            continue
+        }
+        for _, userBucket := range bucketsOf(bucket, "by_user") {
+            if user, ok := userBucket.(map[string]interface{}); ok {
+                if username, ok := user["key"].(string); ok {
+                    users[username] = true
+                }
+            }
+        }
+    }
+}
+
+// userCardinalityReport returns the per-day cardinality comparison sorted by date and the
+// number of days whose estimate exceeds the counted users by more than cardinalityTolerance
+func userCardinalityReport() ([]UserCardinalityDay, int) {
+    userCardinalityMu.Lock()
+    defer userCardinalityMu.Unlock()
+    report := append([]UserCardinalityDay(nil), userCardinalityDays...)
+    sort.Slice(report, func(i, j int) bool {
+        return report[i].Date < report[j].Date
+    })
+    undercounted := 0
+    for _, day := range report {
+        if float64(day.Estimated) > float64(day.Counted)*(1+cardinalityTolerance) {
+            undercounted++
+        }
+    }
+    return report, undercounted
+}
+
+// warnUndercounted prints a warning when the terms buckets missed users the cardinality saw
+func warnUndercounted() {
+    report, undercounted := userCardinalityReport()
+    if undercounted == 0 {
+        return
+    }
+    worst := report[0]
+    for _, day := range report {
+        if day.Estimated-day.Counted > worst.Estimated-worst.Counted {
+            worst = day
+        }
+    }
+    fmt.Printf("WARNING: unique users undercounted on %d days (worst %s: ~%d estimated, %d counted); raise -station-size/-user-size\n",
+        undercounted, worst.Date, worst.Estimated, worst.Counted)
+}
+
+// processAggregations processes the aggregation results
+func processAggregations(result map[string]interface{}, resultChan chan<- LogEntry, truncated *DayTruncation) (int64, error) {
+    aggs, ok := result["aggregations"].(map[string]interface{})
+    if !ok {
+        return 0, fmt.Errorf("no aggregations in response")
+    }
+
+    if byProvider, ok := aggs["by_provider"].(map[string]interface{}); ok {
+        return processProviderBuckets(byProvider, resultChan, truncated)
+    }
+
+    return processStationBuckets(aggs, "", resultChan, truncated)
+}
+
+// processProviderBuckets processes the top-level by_provider aggregation of all-providers mode
+func processProviderBuckets(byProvider map[string]interface{}, resultChan chan<- LogEntry, truncated *DayTruncation) (int64, error) {
+    buckets, ok := byProvider["buckets"].([]interface{})
+    if !ok {
+        return 0, fmt.Errorf("no buckets in by_provider aggregation")
+    }
+
+    var totalHits int64
+    for _, bucketInterface := range buckets {
+        bucket, ok := bucketInterface.(map[string]interface{})
+        if !ok {
+            malformedBuckets.Add(1)
+            continue
+        }
+
+        provider, ok := bucket["key"].(string)
+        if !ok {
+            malformedBuckets.Add(1)
+            continue
+        }
+        hits, err := processStationBuckets(bucket, provider, resultChan, truncated)
+        if err != nil {
+            return totalHits, err
+        }
+        totalHits += hits
+    }
+
+    return totalHits, nil
+}
+
+// processStationBuckets processes the by_station aggregation found in aggs
+func processStationBuckets(aggs map[string]interface{}, provider string, resultChan chan<- LogEntry, truncated *DayTruncation) (int64, error) {
+    byStation, ok := aggs["by_station"].(map[string]interface{})
+    if !ok {
+        return 0, fmt.Errorf("no by_station aggregation")
+    }
+
+    buckets, ok := byStation["buckets"].([]interface{})
+    if !ok {
+        return 0, fmt.Errorf("no buckets in by_station aggregation")
+    }
+    truncated.Stations += otherDocCount(byStation)
+
+    var totalHits int64
+    for _, bucketInterface := range buckets {
+        bucket, ok := bucketInterface.(map[string]interface{})
+        if !ok {
+            malformedBuckets.Add(1)
+            continue
+        }
+
+        stationID, ok := bucket["key"].(string)
+        if !ok {
+            malformedBuckets.Add(1)
+            continue
+        }
+        docCount, ok := bucket["doc_count"].(float64)
+        if !ok {
+            malformedBuckets.Add(1)
+            continue
+        }
+        totalHits += int64(docCount)
+
+        processStationBucket(bucket, stationID, provider, resultChan, truncated)
+    }
+
+    return totalHits, nil
+}
+
+// warnTruncated prints a warning for each terms aggregation that dropped documents beyond its size
+func warnTruncated() {
+    for _, agg := range []struct {
+        flag    string
+        size    int
+        dropped int64
+    }{
+        {"station-size", opts.StationSize, truncatedStations.Load()},
+        {"user-size", opts.UserSize, truncatedUsers.Load()},
+        {"realm-size", opts.RealmSize, truncatedRealms.Load()},
+    } {
+        if agg.dropped > 0 {
+            fmt.Printf("WARNING: -%s %d truncated the aggregation (%d events in the dropped buckets); raise -%s\n",
+                agg.flag, agg.size, agg.dropped, agg.flag)
+        }
+    }
+    if dropped := truncatedBaseline.Load(); dropped > 0 {
+        fmt.Printf("WARNING: the -baseline-days station_id aggregation was truncated even per hour (%d events in the dropped buckets); stations among them are flagged is_new\n",
+            dropped)
+    }
+}
+
+// warnNoData prints a prominent warning when the query matched no documents
+func warnNoData(serviceProvider string, startDate, endDate time.Time) {
+    fmt.Println("WARNING: the query matched no Access-Accept events.")
+    fmt.Printf("  service_provider: %s\n", serviceProvider)
+    fmt.Printf("  range: %s to %s\n", startDate.Format("2006-01-02"), endDate.Format("2006-01-02"))
+    fmt.Println("  Common causes:")
+    fmt.Println("    - wrong domain or missing 'eduroam.' prefix on the service provider")
+    fmt.Println("    - a date range in the future or before data was indexed")
+    fmt.Println("    - the nro-logs index name or QW_URL in qw-auth.properties")
+}
+
+// analyzePotentialIssues วิเคราะห์ปัญหาที่อาจเกิดขึ้น
+func analyzePotentialIssues(patterns *UsagePattern) []PotentialIssue {
+    var issues []PotentialIssue
+
+    // ตรวจสอบ frequent reauths
+    for _, reauth := range patterns.ConnectionStability.FrequentReauths {
+        issues = append(issues, PotentialIssue{
+            Type:        "frequent_reauth",
+            Period:      reauth.Period,
+            Description: fmt.Sprintf("%d re-authentications within %s", reauth.Count, reauth.Interval),
+        })
+    }
+
+    // ตรวจสอบ long gaps
+    if patterns.ConnectionStability.LongestGap.DurationMinutes > 60 {
+        issues = append(issues, PotentialIssue{
+            Type:        "long_gap",
+            Period:      fmt.Sprintf("%s to %s", 
+                        patterns.ConnectionStability.LongestGap.Start,
+                        patterns.ConnectionStability.LongestGap.End),
+            Description: fmt.Sprintf("No activity for %d minutes", 
+                        patterns.ConnectionStability.LongestGap.DurationMinutes),
+        })
+    }
+
+    // ตรวจสอบการใช้งานในช่วง quiet hours
+    if opts.QuietHours != "" && patterns.OvernightAuthCount > opts.QuietThreshold {
+        issues = append(issues, PotentialIssue{
+            Type:        "overnight_activity",
+            Period:      opts.QuietHours,
+            Description: fmt.Sprintf("%d authentications during quiet hours", patterns.OvernightAuthCount),
+        })
+    }
+
+    // ตรวจสอบ auth intervals ที่ผิดปกติ
+    if patterns.AuthIntervals.MinMinutes < 1 {
+        issues = append(issues, PotentialIssue{
+            Type:        "rapid_reauth",
+            Period:      "throughout session",
+            Description: fmt.Sprintf("Some re-authentications occurred less than 1 minute apart"),
+        })
+    }
+
+    return issues
+}
+
+// stationSpan returns the earliest and latest auth timestamps of a station across all its users;
+// ok is false when the station has no auth timestamps
+func stationSpan(stats *StationStats) (first, last time.Time, ok bool) {
+    for _, activity := range stats.Users {
+        for _, ts := range activity.AuthTimestamps {
+            if !ok || ts.Before(first) {
+                first = ts
+            }
+            if !ok || ts.After(last) {
+                last = ts
+            }
+            ok = true
+        }
+    }
+    return first, last, ok
+}
+
+// lifespanDays counts the calendar days from first to last inclusive (1 when both fall on the same day)
+func lifespanDays(first, last time.Time) int {
+    firstDay := time.Date(first.Year(), first.Month(), first.Day(), 0, 0, 0, 0, time.UTC)
+    lastDay := time.Date(last.Year(), last.Month(), last.Day(), 0, 0, 0, 0, time.UTC)
+    return int(lastDay.Sub(firstDay).Hours()/24) + 1
+}
+
+// manyRealmsIssue reports a station whose users came from more than -max-realms distinct realms
+func manyRealmsIssue(stats *StationStats, startDate, endDate time.Time) PotentialIssue {
+    realms := make([]string, 0, len(stats.Realms))
+    for realm := range stats.Realms {
+        realms = append(realms, realm)
+    }
+    sort.Strings(realms)
+    if len(realms) > 5 {
+        realms = realms[:5]
+    }
+
+    return PotentialIssue{
+        Type:        "many_realms",
+        Period:      fmt.Sprintf("%s to %s", startDate.Format("2006-01-02"), endDate.Format("2006-01-02")),
+        Description: fmt.Sprintf("%d distinct realms on one station (e.g., %s)", len(stats.Realms), strings.Join(realms, ", ")),
+    }
+}
+
+// manyIdentitiesIssue reports a station that authenticated as more than -max-identities
+// distinct usernames in the window, with up to 5 sample usernames
+func manyIdentitiesIssue(stats *StationStats, startDate, endDate time.Time) PotentialIssue {
+    usernames := make([]string, 0, len(stats.Users))
+    for username := range stats.Users {
+        usernames = append(usernames, username)
+    }
+    sort.Strings(usernames)
+    if len(usernames) > 5 {
+        usernames = usernames[:5]
+    }
+
+    return PotentialIssue{
+        Type:        "many_identities",
+        Period:      fmt.Sprintf("%s to %s", startDate.Format("2006-01-02"), endDate.Format("2006-01-02")),
+        Description: fmt.Sprintf("%d distinct usernames on one station (e.g., %s)", len(stats.Users), strings.Join(usernames, ", ")),
+    }
+}
+
+// writeManifest writes <output>.manifest.json next to the report with the query parameters
+// and the SHA-256 of the report bytes
+func writeManifest(filename string, data []byte, queryString string, startDate, endDate time.Time, workers int, totalHits int64) error {
+    // -stdout: ไม่มีไฟล์ report ให้วาง manifest ไว้ข้างๆ
+    if opts.Stdout {
+        return nil
+    }
+    manifest := Manifest{
+        Tool:        userAgent,
+        Query:       queryString,
+        StartTime:   startDate.Format(time.RFC3339),
+        EndTime:     endDate.Format(time.RFC3339),
+        Workers:     workers,
+        TotalHits:   totalHits,
+        Output:      outputLocation(filename),
+        SHA256:      sha256Hex(data),
+        GeneratedAt: time.Now().Format(time.RFC3339),
+    }
+
+    manifestData, err := json.MarshalIndent(manifest, "", "  ")
+    if err != nil {
+        return fmt.Errorf("error marshaling manifest: %v", err)
+    }
+    return writeOutput(strings.TrimSuffix(filename, ".json")+".manifest.json", manifestData)
+}
+
+// writeOutput writes a report to its local path under output/ (atomically), to stdout with -stdout,
+// or uploads it when -out-url is s3://
+func writeOutput(name string, data []byte) error {
+    if opts.Stdout {
+        _, err := reportOut.Write(append(data, '\n'))
+        return err
+    }
+    if opts.OutURL == "" {
+        if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+            return fmt.Errorf("error creating output directory: %v", err)
+        }
+        return writeFileAtomic(name, data)
+    }
+
+    u, _ := url.Parse(opts.OutURL)
+    return putS3Object(outputS3, u.Host, s3Key(name), data)
+}
+
+// outputLocation returns where writeOutput stores name
+func outputLocation(name string) string {
+    if opts.Stdout {
+        return "stdout"
+    }
+    if opts.OutURL == "" {
+        return name
+    }
+    u, _ := url.Parse(opts.OutURL)
+    return fmt.Sprintf("s3://%s/%s", u.Host, s3Key(name))
+}
+
+// s3Key maps a local output path (output/<dir>/<file>) to a key under the -out-url prefix
+func s3Key(name string) string {
+    u, _ := url.Parse(opts.OutURL)
+    return strings.TrimPrefix(path.Join(u.Path, strings.TrimPrefix(filepath.ToSlash(name), "output/")), "/")
+}
+
+// putS3Object uploads data with the AWS SDK; path-style addressing and S3_ENDPOINT make it work with
+// S3-compatible stores such as MinIO as well as AWS S3
+// (the SDK's own HTTP client is used: the proxy, client certificate and timeout of httpClient are Quickwit's)
+func putS3Object(cfg S3Config, bucket, key string, data []byte) error {
+    if cfg.Region == "" {
+        cfg.Region = "us-east-1"
+    }
+    if cfg.AccessKey == "" || cfg.SecretKey == "" {
+        return fmt.Errorf("S3_ACCESS_KEY and S3_SECRET_KEY must be set in qw-auth.properties")
+    }
+
+    client := s3.New(s3.Options{
+        Region:       cfg.Region,
+        Credentials:  credentials.NewStaticCredentialsProvider(cfg.AccessKey, cfg.SecretKey, ""),
+        UsePathStyle: true,
+    }, func(o *s3.Options) {
+        if cfg.Endpoint != "" {
+            o.BaseEndpoint = aws.String(cfg.Endpoint)
+        }
+    })
+
+    contentType := "application/json"
+    if strings.HasSuffix(key, ".csv") {
+        contentType = "text/csv"
+    }
+    _, err := client.PutObject(context.Background(), &s3.PutObjectInput{
+        Bucket:      aws.String(bucket),
+        Key:         aws.String(key),
+        Body:        bytes.NewReader(data),
+        ContentType: aws.String(contentType),
+    })
+    if err != nil {
+        return fmt.Errorf("error uploading to S3: %v", err)
+    }
+    return nil
+}
+
+func sha256Hex(data []byte) string {
+    sum := sha256.Sum256(data)
+    return hex.EncodeToString(sum[:])
+}
+
+// isRangeArg reports whether arg looks like a [days|Ny|yxxxx|DD-MM-YYYY] argument
+func isRangeArg(arg string) bool {
+    if _, err := strconv.Atoi(arg); err == nil {
+        return true
+    }
+    if _, err := strconv.Atoi(strings.TrimSuffix(arg, "y")); err == nil && strings.HasSuffix(arg, "y") {
+        return true
+    }
+    if _, err := strconv.Atoi(strings.TrimPrefix(arg, "y")); err == nil && strings.HasPrefix(arg, "y") && len(arg) == 5 {
+        return true
+    }
+    _, err := time.Parse("02-01-2006", arg)
+    return err == nil
+}
+
+// outputFilename builds the report path: <dir>/<now>-<date|year|Nd>-<suffix>.json
+func outputFilename(outputDir, suffix string, specificDate bool, startDate time.Time, days int, args []string) string {
+    currentTime := time.Now().Format("20060102-150405")
+    if specificDate {
+        return fmt.Sprintf("%s/%s-%s-%s.json", outputDir, currentTime, startDate.Format("20060102"), suffix)
+    } else if len(args) > 1 && strings.HasPrefix(args[1], "y") && len(args[1]) == 5 {
+        year := args[1][1:]
+        return fmt.Sprintf("%s/%s-%s-%s.json", outputDir, currentTime, year, suffix)
+    } else if opts.From != "" {
+        endDate := startDate.AddDate(0, 0, days-1)
+        return fmt.Sprintf("%s/%s-%s-%s-%s.json", outputDir, currentTime, startDate.Format("20060102"), endDate.Format("20060102"), suffix)
+    }
+    return fmt.Sprintf("%s/%s-%dd-%s.json", outputDir, currentTime, days, suffix)
+}
+
+// parseDateRange parses -from/-to (DD-MM-YYYY, both days included) into the local start
+// and end of the range and its number of days
+func parseDateRange(from, to string) (time.Time, time.Time, int, error) {
+    first, err := time.Parse("02-01-2006", from)
+    if err != nil {
+        return time.Time{}, time.Time{}, 0, fmt.Errorf("invalid -from %q: use DD-MM-YYYY", from)
+    }
+    last, err := time.Parse("02-01-2006", to)
+    if err != nil {
+        return time.Time{}, time.Time{}, 0, fmt.Errorf("invalid -to %q: use DD-MM-YYYY", to)
+    }
+    if last.Before(first) {
+        return time.Time{}, time.Time{}, 0, fmt.Errorf("-from %s is after -to %s", from, to)
+    }
+    days := int(last.Sub(first).Hours()/24) + 1
+    startDate := time.Date(first.Year(), first.Month(), first.Day(), 0, 0, 0, 0, time.Local)
+    endDate := time.Date(last.Year(), last.Month(), last.Day(), 23, 59, 59, 999999999, time.Local)
+    return startDate, endDate, days, nil
+}
+
+// usage prints the command-line help
+func usage() {
+    fmt.Println("Usage: ./eduroam-sp [flags] <service_provider> [days|Ny|yxxxx|DD-MM-YYYY]")
+    fmt.Println("  service_provider: domain name (e.g., 'ku.ac.th', 'etlr1'), or 'all' for every provider")
+    fmt.Println("  days: number of days (1-3650)")
+    fmt.Println("  Ny: number of years (1y-10y)")
+    fmt.Println("  yxxxx: specific year (e.g., y2024)")
+    fmt.Println("  DD-MM-YYYY: specific date")
+    fmt.Println("  or -from DD-MM-YYYY -to DD-MM-YYYY instead of the argument: explicit range, both days included")
+    fmt.Println("       ./eduroam-sp [flags] merge <report.json> <report.json>...")
+    fmt.Println("  combines per-provider station reports into one all-providers report (no Quickwit)")
+    fmt.Println("Flags:")
+    flag.PrintDefaults()
+}
+
+// parseFlags registers and parses the command-line flags into opts
+func parseFlags() []string {
+    flag.IntVar(&opts.BufferSize, "buffer", 10000, "size of the result channel buffer")
+    flag.IntVar(&opts.BaselineDays, "baseline-days", 0, "days before the start date used to detect new station_ids (0 = disabled)")
+    flag.StringVar(&opts.Interval, "interval", "1m", "auth timestamp histogram interval: 1m, 5m, 15m or 1h")
+    flag.BoolVar(&opts.Strict, "strict", false, "exit non-zero instead of writing a report when nothing matched")
+    flag.StringVar(&opts.From, "from", "", "first day (DD-MM-YYYY) of an explicit range, with -to")
+    flag.StringVar(&opts.To, "to", "", "last day (DD-MM-YYYY, included) of the -from range")
+    flag.StringVar(&opts.OUIFile, "oui-file", "", "OUI vendor list used to set a vendor per station")
+    flag.BoolVar(&opts.ExcludeRandomized, "exclude-randomized", false, "drop stations with a randomized (locally-administered) MAC from the report")
+    flag.StringVar(&opts.QuietHours, "quiet-hours", "", "quiet hours as HH-HH (e.g., 00-05) for overnight activity")
+    flag.IntVar(&opts.QuietThreshold, "quiet-threshold", 0, "overnight auths allowed before an overnight_activity issue")
+    flag.StringVar(&opts.BusinessHours, "business-hours", "", "business hours as HH-HH (e.g., 08-18) for business_hours_ratio per station")
+    flag.IntVar(&opts.MaxIdentities, "max-identities", 10, "flag stations with more distinct usernames than this (0 = disabled)")
+    flag.IntVar(&opts.MaxRealms, "max-realms", 3, "flag stations seen with more distinct realms than this over the window (0 = disabled)")
+    flag.BoolVar(&opts.NoDetails, "no-details", false, "emit counts and top stations only, skipping per-user analysis")
+    flag.IntVar(&opts.TopN, "top", 10, "number of stations kept with -no-details")
+    flag.IntVar(&opts.StationSize, "station-size", 1000, "maximum station_id buckets per day-job")
+    flag.IntVar(&opts.UserSize, "user-size", 100, "maximum username buckets per station and day-job")
+    flag.IntVar(&opts.RealmSize, "realm-size", 10, "maximum realm buckets per user")
+    flag.DurationVar(&opts.Timeout, "timeout", 30*time.Second, "HTTP timeout for each Quickwit request")
+    flag.IntVar(&opts.MaxIdleConns, "max-idle-conns", 10, "maximum idle keep-alive connections kept to Quickwit")
+    flag.IntVar(&opts.MaxInflight, "max-inflight", 0, "maximum search requests in flight to Quickwit at once (0 = no limit)")
+    flag.IntVar(&opts.MaxDays, "max-days", 400, "refuse ranges longer than this many days unless -force is given")
+    flag.BoolVar(&opts.Force, "force", false, "run ranges longer than -max-days")
+    flag.StringVar(&opts.OutURL, "out-url", "", "upload the report to s3://bucket/prefix instead of output/")
+    flag.BoolVar(&opts.Stdout, "stdout", false, "write the report to stdout (messages go to stderr) instead of output/")
+    flag.BoolVar(&opts.Summary, "summary", false, "print a top-10/totals/timing table to stderr at the end of the station report")
+    flag.StringVar(&opts.User, "user", "", "build the auth timeline of a single username instead of the station report")
+    flag.BoolVar(&opts.DestIP, "dest-ip", false, "report auths per destination_ip instead of the station report")
+    flag.StringVar(&opts.CIDR, "cidr", "", "with -dest-ip, group by subnet: IPv4 prefix[,IPv6 prefix] (e.g., 24 or 24,64)")
+    flag.StringVar(&opts.Append, "append", "", "merge this run into a rolling JSON file keyed by date instead of a new report")
+    flag.BoolVar(&opts.AcctSessions, "acct-sessions", false, "build session_analysis from accounting sessions (acct_session_id) where available")
+    flag.DurationVar(&opts.Follow, "follow", 0, "re-run every interval over the trailing window and stream NDJSON reports to stdout")
+    flag.DurationVar(&opts.FollowWindow, "follow-window", 0, "trailing window queried by -follow (default: the -follow interval)")
+    flag.BoolVar(&opts.Trend, "trend", false, "add a per-realm daily series to realm_stats")
+    flag.BoolVar(&opts.FillGaps, "fill-gaps", false, "with -trend, add zero points for days without activity")
+    flag.BoolVar(&opts.Flatten, "flatten", false, "write one flat JSON object per auth event instead of the station report")
+    flag.BoolVar(&opts.Heatmap, "heatmap", false, "write a date x hour CSV of auth counts across all stations instead of the station report")
+    flag.BoolVar(&opts.DeviceTrend, "device-trend", false, "write a daily series of unique stations and users instead of the station report")
+    flag.IntVar(&opts.Sample, "sample", 1, "query every Nth day and extrapolate totals (1 = every day)")
+    flag.BoolVar(&opts.CountOnly, "count-only", false, "print totals from a single aggregation request and exit")
+    flag.BoolVar(&opts.SSID, "ssid", false, "report auths per SSID instead of the station report")
+    flag.BoolVar(&opts.NASIP, "nas-ip", false, "report auths per nas_ip (access point) instead of the station report")
+    flag.BoolVar(&opts.TLS, "tls", false, "report TLS failures per realm (per provider with all) instead of the station report")
+    flag.StringVar(&opts.QueryFile, "query-file", "", "run the Quickwit request in this JSON file ({start}/{end} placeholders) per day-job and merge its aggregations")
+    flag.StringVar(&opts.GroupBy, "group-by", "", "report auths nested by these dimensions (station_id, username, realm, service_provider) instead of the station report")
+    flag.BoolVar(&opts.MessageTypes, "message-types", false, "report events per message_type with a daily series instead of the station report")
+    flag.StringVar(&opts.TSFormat, "ts-format", "rfc3339", "timestamp format in the JSON output: rfc3339, epoch_ms or epoch_s")
+    flag.StringVar(&opts.Sort, "sort", "", "order output arrays by field[:asc|desc]: name, auths or users")
+    flag.StringVar(&opts.Fields, "fields", strings.Join(allAnalysisFields, ","), "comma list of analyses to include: patterns, sessions, issues, details")
+    flag.StringVar(&opts.DumpRaw, "dump-raw", "", "write each day-job's raw Quickwit response to this directory")
+    flag.StringVar(&opts.Checkpoint, "checkpoint", "", "save finished day-jobs to this directory so the run can be resumed")
+    flag.BoolVar(&opts.Resume, "resume", false, "with -checkpoint, reuse the day-jobs already saved there")
+    flag.StringVar(&opts.CacheDir, "cache-dir", "", "answer repeated requests for days before today from responses saved in this directory")
+    flag.BoolVar(&opts.PreferFile, "prefer-file", false, "let qw-auth.properties win over QW_USER/QW_PASS/QW_URL environment variables")
+    flag.BoolVar(&opts.Check, "check", false, "verify Quickwit connectivity and the nro-logs index, then exit")
+    flag.BoolVar(&opts.IncludeChallenges, "include-challenges", false, "also query Access-Challenge events and count them separately")
+    flag.Usage = usage
+    flag.Parse()
+
+    if opts.OutURL != "" {
+        u, err := url.Parse(opts.OutURL)
+        if err != nil || u.Scheme != "s3" || u.Host == "" {
+            log.Fatalf("Invalid out-url %q. Use s3://bucket/prefix", opts.OutURL)
+        }
+    }
+
+    if (opts.From == "") != (opts.To == "") {
+        log.Fatalf("-from and -to must be given together")
+    }
+    if opts.From != "" && opts.Follow > 0 {
+        log.Fatalf("-from/-to cannot be combined with -follow")
+    }
+    if opts.Timeout <= 0 {
+        log.Fatalf("Invalid timeout. Must be greater than 0")
+    }
+    if opts.MaxIdleConns < 1 {
+        log.Fatalf("Invalid max idle connections. Must be 1 or greater")
+    }
+    if opts.MaxInflight < 0 {
+        log.Fatalf("Invalid max inflight. Must be 0 or greater")
+    }
+    if opts.MaxInflight > 0 {
+        inflight = make(chan struct{}, opts.MaxInflight)
+    }
+
+    if opts.MaxDays < 1 {
+        log.Fatalf("Invalid max days. Must be 1 or greater")
+    }
+    if opts.MaxIdentities < 0 {
+        log.Fatalf("Invalid max identities. Must be 0 or greater")
+    }
+    if opts.MaxRealms < 0 {
+        log.Fatalf("Invalid max realms. Must be 0 or greater")
+    }
+    if opts.TopN < 0 {
+        log.Fatalf("Invalid top. Must be 0 or greater")
+    }
+    if opts.StationSize < 1 || opts.UserSize < 1 || opts.RealmSize < 1 {
+        log.Fatalf("Invalid station, user or realm size. Must be 1 or greater")
+    }
+    if opts.BufferSize < 0 {
+        log.Fatalf("Invalid buffer size. Must be 0 or greater")
+    }
+    if opts.BaselineDays < 0 || opts.BaselineDays > 3650 {
+        log.Fatalf("Invalid baseline days. Must be between 0 and 3650")
+    }
+    if opts.TSFormat != "rfc3339" && opts.TSFormat != "epoch_ms" && opts.TSFormat != "epoch_s" {
+        log.Fatalf("Invalid ts-format %q. Use rfc3339, epoch_ms or epoch_s", opts.TSFormat)
+    }
+    if !validIntervals[opts.Interval] {
+        log.Fatalf("Invalid interval %q. Use 1m, 5m, 15m or 1h", opts.Interval)
+    }
+    analysisFields = make(map[string]bool)
+    for _, field := range strings.Split(opts.Fields, ",") {
+        field = strings.TrimSpace(field)
+        if field == "" {
+            continue
+        }
+        if !validAnalysisField(field) {
+            log.Fatalf("Invalid field %q. Use %s", field, strings.Join(allAnalysisFields, ", "))
+        }
+        analysisFields[field] = true
+    }
+    if opts.Sort != "" {
+        field, direction, _ := strings.Cut(opts.Sort, ":")
+        if !validSortField(field) {
+            log.Fatalf("Invalid sort field %q. Use %s", field, strings.Join(sortFields, ", "))
+        }
+        if direction != "" && direction != "asc" && direction != "desc" {
+            log.Fatalf("Invalid sort direction %q. Use asc or desc", direction)
+        }
+        sortOrder = SortOrder{Field: field, Desc: direction == "desc"}
+    }
+    modes := 0
+    for _, enabled := range []bool{opts.User != "", opts.DestIP, opts.CountOnly, opts.SSID, opts.TLS, opts.QueryFile != "", opts.GroupBy != "", opts.MessageTypes, opts.NASIP} {
+        if enabled {
+            modes++
+        }
+    }
+    if modes > 1 {
+        log.Fatalf("Only one of -user, -dest-ip, -count-only, -ssid, -tls, -query-file, -group-by, -message-types and -nas-ip can be given")
+    }
+    if opts.Append != "" && (modes > 0 || opts.OutURL != "") {
+        log.Fatalf("-append cannot be combined with -user, -dest-ip, -count-only, -ssid, -tls, -query-file, -group-by, -message-types, -nas-ip or -out-url")
+    }
+    if opts.FillGaps && !opts.Trend {
+        log.Fatalf("-fill-gaps requires -trend")
+    }
+    if opts.Flatten && (modes > 0 || opts.Append != "" || opts.Follow > 0) {
+        log.Fatalf("-flatten cannot be combined with -user, -dest-ip, -count-only, -ssid, -tls, -query-file, -group-by, -message-types, -nas-ip, -append or -follow")
+    }
+    if opts.Heatmap && (modes > 0 || opts.Append != "" || opts.Follow > 0 || opts.Flatten || opts.Sample > 1) {
+        log.Fatalf("-heatmap cannot be combined with -user, -dest-ip, -count-only, -ssid, -tls, -query-file, -group-by, -message-types, -nas-ip, -append, -follow, -flatten or -sample")
+    }
+    if opts.DeviceTrend && (modes > 0 || opts.Append != "" || opts.Follow > 0 || opts.Flatten || opts.Heatmap || opts.Sample > 1) {
+        log.Fatalf("-device-trend cannot be combined with -user, -dest-ip, -count-only, -ssid, -tls, -query-file, -group-by, -message-types, -nas-ip, -append, -follow, -flatten, -heatmap or -sample")
+    }
+    if opts.Sample < 1 {
+        log.Fatalf("Invalid sample. Must be 1 or greater")
+    }
+    // -user ต้องได้ timeline ครบทุกวัน, -count-only ไม่ได้แบ่ง day-job, -append/-follow ต่อข้อมูลรายวัน
+    if opts.Sample > 1 && (opts.User != "" || opts.CountOnly || opts.Append != "" || opts.Follow > 0) {
+        log.Fatalf("-sample cannot be combined with -user, -count-only, -append or -follow")
+    }
+    if opts.Follow < 0 || opts.FollowWindow < 0 {
+        log.Fatalf("Invalid follow. Must be 0 or greater")
+    }
+    if opts.FollowWindow > 0 && opts.Follow == 0 {
+        log.Fatalf("-follow-window requires -follow")
+    }
+    if opts.Follow > 0 {
+        if opts.FollowWindow == 0 {
+            opts.FollowWindow = opts.Follow
+        }
+        if opts.FollowWindow > 24*time.Hour {
+            log.Fatalf("Invalid follow window. Must be 24h or less")
+        }
+        if modes > 0 || opts.Append != "" || opts.BaselineDays > 0 || opts.AcctSessions {
+            log.Fatalf("-follow cannot be combined with -user, -dest-ip, -count-only, -ssid, -tls, -query-file, -group-by, -message-types, -nas-ip, -append, -baseline-days or -acct-sessions")
+        }
+    }
+    if opts.CIDR != "" {
+        if !opts.DestIP {
+            log.Fatalf("-cidr requires -dest-ip")
+        }
+        v4, v6, err := parseCIDR(opts.CIDR)
+        if err != nil {
+            log.Fatalf("Invalid cidr: %v", err)
+        }
+        opts.CIDR4, opts.CIDR6 = v4, v6
+    }
+    if opts.QuietHours != "" {
+        start, end, err := parseQuietHours(opts.QuietHours)
+        if err != nil {
+            log.Fatalf("Invalid quiet hours: %v", err)
+        }
+        opts.QuietStart, opts.QuietEnd = start, end
+    }
+    if opts.BusinessHours != "" {
+        start, end, err := parseQuietHours(opts.BusinessHours)
+        if err != nil {
+            log.Fatalf("Invalid business hours: %v", err)
+        }
+        opts.BusinessStart, opts.BusinessEnd = start, end
+    }
+    if opts.OUIFile != "" {
+        vendors, err := loadOUIFile(opts.OUIFile)
+        if err != nil {
+            log.Fatalf("Error reading OUI file: %v", err)
+        }
+        ouiVendors = vendors
+    }
+
+    if opts.GroupBy != "" {
+        fields, err := parseGroupBy(opts.GroupBy)
+        if err != nil {
+            log.Fatalf("Invalid group-by: %v", err)
+        }
+        groupByFields = fields
+    }
+    if opts.QueryFile != "" {
+        template, err := loadQueryTemplate(opts.QueryFile)
+        if err != nil {
+            log.Fatalf("Error reading query file: %v", err)
+        }
+        queryTemplate = template
+    }
+
+    if opts.DumpRaw != "" {
+        if err := os.MkdirAll(opts.DumpRaw, 0755); err != nil {
+            log.Fatalf("Error creating dump-raw directory: %v", err)
+        }
+    }
+    if opts.CacheDir != "" {
+        if err := os.MkdirAll(opts.CacheDir, 0755); err != nil {
+            log.Fatalf("Error creating cache directory: %v", err)
+        }
+    }
+    if opts.Resume && opts.Checkpoint == "" {
+        log.Fatalf("-resume requires -checkpoint")
+    }
+    if opts.Stdout {
+        if opts.OutURL != "" || opts.Append != "" || opts.Follow > 0 || opts.CountOnly {
+            log.Fatalf("-stdout cannot be combined with -out-url, -append, -follow or -count-only")
+        }
+        reportOut = os.Stdout
+        os.Stdout = os.Stderr
+    }
+    if opts.Checkpoint != "" {
+        if modes > 0 || opts.Follow > 0 {
+            log.Fatalf("-checkpoint cannot be combined with -user, -dest-ip, -count-only, -ssid, -tls, -query-file, -group-by, -message-types, -nas-ip or -follow")
+        }
+        if err := os.MkdirAll(opts.Checkpoint, 0755); err != nil {
+            log.Fatalf("Error creating checkpoint directory: %v", err)
+        }
+    }
+
+    return flag.Args()
+}
+
+func main() {
+    args := parseFlags()
+    if opts.Check {
+        runCheck()
+    }
+    if len(args) > 0 && args[0] == "merge" {
+        runMerge(args[1:])
+        return
+    }
+    if len(args) > 2 {
+        usage()
+        os.Exit(1)
+    }
+
+    var serviceProvider string
+    var startDate, endDate time.Time
+    var days int
     var specificDate bool
 
-    serviceProvider = getDomain(os.Args[1])
+    // argument เดียวที่เป็นช่วงเวลา (เช่น "7", "2y", "y2024") คือ all-providers ในช่วงนั้น ไม่ใช่ชื่อ provider
+    if len(args) == 1 && isRangeArg(args[0]) {
+        args = []string{allProviders, args[0]}
+    }
+
+    if len(args) == 0 || args[0] == allProviders {
+        opts.AllProviders = true
+        serviceProvider = allProviders
+    } else {
+        serviceProvider = getDomain(args[0])
+    }
+
+    if opts.Follow > 0 && len(args) == 2 {
+        log.Fatalf("-follow queries the trailing -follow-window; do not pass a range")
+    }
 
-    if len(os.Args) == 3 {
-        param := os.Args[2]
+    if opts.From != "" {
+        if len(args) == 2 {
+            log.Fatalf("-from/-to replace the [days|Ny|yxxxx|DD-MM-YYYY] argument; do not pass both")
+        }
+        var err error
+        startDate, endDate, days, err = parseDateRange(opts.From, opts.To)
+        if err != nil {
+            log.Fatalf("Invalid date range: %v", err)
+        }
+        if days > 3650 {
+            log.Fatalf("Invalid date range. Must be at most 3650 days")
+        }
+    } else if len(args) == 2 {
+        param := args[1]
         
         if strings.HasPrefix(param, "y") && len(param) == 5 {
             yearStr := param[1:]
@@ -925,134 +5582,376 @@ func main() {
     startDate = time.Date(startDate.Year(), startDate.Month(), startDate.Day(), 0, 0, 0, 0, startDate.Location())
     endDate = time.Date(endDate.Year(), endDate.Month(), endDate.Day(), 23, 59, 59, 999999999, endDate.Location())
 
+    // ป้องกันการรันช่วงเวลายาวเกินโดยไม่ตั้งใจ (แต่ละวันคือ 1 job, รวม baseline)
+    if days > opts.MaxDays && !opts.Force {
+        fmt.Printf("Refusing to query %d days (estimated %d day-jobs): exceeds -max-days %d\n", days, days+opts.BaselineDays, opts.MaxDays)
+        fmt.Println("Pass -force to run it anyway, or raise -max-days")
+        os.Exit(1)
+    }
+
     props, err := readProperties("qw-auth.properties")
     if err != nil {
         log.Fatalf("Error reading properties: %v", err)
     }
+    httpClient, err = newHTTPClient(opts.Timeout, opts.MaxIdleConns, props)
+    if err != nil {
+        log.Fatalf("Error creating HTTP client: %v", err)
+    }
+    defer httpClient.CloseIdleConnections()
+    outputS3 = props.S3
 
-    if specificDate {
-        fmt.Printf("Searching for date: %s\n", startDate.Format("2006-01-02"))
-    } else {
-        fmt.Printf("Searching from %s to %s\n", startDate.Format("2006-01-02"), endDate.Format("2006-01-02"))
+    // -follow: stdout เป็น NDJSON อย่างเดียว
+    if opts.Follow == 0 {
+        if specificDate {
+            fmt.Printf("Searching for date: %s\n", startDate.Format("2006-01-02"))
+        } else {
+            fmt.Printf("Searching from %s to %s\n", startDate.Format("2006-01-02"), endDate.Format("2006-01-02"))
+        }
+    }
+
+    jobDays := days
+    if opts.Sample > 1 {
+        jobDays, _ = sampleCoverage(startDate, endDate)
+        fmt.Printf("Sampling every %d days: %d of %d days queried\n", opts.Sample, jobDays, days)
+    }
+
+    messageQuery := `message_type:"Access-Accept"`
+    if opts.IncludeChallenges {
+        messageQuery = `(message_type:"Access-Accept" OR message_type:"Access-Challenge")`
+    }
+
+    queryString := fmt.Sprintf(`%s AND service_provider:"%s"`, messageQuery, escapeQueryValue(serviceProvider))
+    if opts.AllProviders {
+        queryString = messageQuery
     }
 
     query := map[string]interface{}{
-        "query":           fmt.Sprintf(`message_type:"Access-Accept" AND service_provider:"%s"`, serviceProvider),
+        "query":           queryString,
         "start_timestamp": startDate.Unix(),
         "end_timestamp":   endDate.Unix(),
         "max_hits":        10000,
     }
 
-    resultChan := make(chan LogEntry, 10000)
-    errChan := make(chan error, 1)
-    var totalHits atomic.Int64
-    var mu sync.Mutex
-    var wg sync.WaitGroup
+    if opts.User != "" {
+        query["query"] = fmt.Sprintf(`%s AND username:"%s"`, queryString, escapeQueryValue(opts.User))
+        runUserTimeline(query, props, startDate, endDate, days, specificDate, args)
+        return
+    }
+    if opts.CountOnly {
+        runCountOnly(query, props, serviceProvider)
+        return
+    }
+    if opts.SSID {
+        runTermReport(query, props, "ssid", "(none)", "ssid", serviceProvider, startDate, endDate, days, specificDate, args)
+        return
+    }
+    if opts.NASIP {
+        runTermReport(query, props, "nas_ip", "(none)", "nas-ip", serviceProvider, startDate, endDate, days, specificDate, args)
+        return
+    }
+    if opts.TLS {
+        // TLS failures อยู่นอก Access-Accept จึง query จาก tls_error แทน message_type
+        field := "realm"
+        query["query"] = fmt.Sprintf(`tls_error:true AND service_provider:"%s"`, escapeQueryValue(serviceProvider))
+        if opts.AllProviders {
+            field = "service_provider"
+            query["query"] = "tls_error:true"
+        }
+        runTermReport(query, props, field, "(none)", "tls", serviceProvider, startDate, endDate, days, specificDate, args)
+        return
+    }
+    if opts.MessageTypes {
+        // ทุก message_type ของ provider จึงไม่กรองด้วย messageQuery
+        query["query"] = fmt.Sprintf(`service_provider:"%s"`, escapeQueryValue(serviceProvider))
+        if opts.AllProviders {
+            query["query"] = "*"
+        }
+        runMessageTypeReport(query, props, serviceProvider, startDate, endDate, days, specificDate, args)
+        return
+    }
+    if groupByFields != nil {
+        runGroupByReport(query, props, serviceProvider, startDate, endDate, days, specificDate, args)
+        return
+    }
+    if opts.QueryFile != "" {
+        runQueryFile(props, serviceProvider, startDate, endDate, days, specificDate, args)
+        return
+    }
+    if opts.DestIP {
+        runDestinationReport(query, props, serviceProvider, startDate, endDate, days, specificDate, args)
+        return
+    }
+    if opts.Follow > 0 {
+        runFollow(query, props, serviceProvider)
+        return
+    }
 
-    jobs := make(chan Job, days)
     numWorkers := 10
-
-    var processedDays int32
+    if opts.Checkpoint != "" {
+        var err error
+        request, err := json.Marshal(stationRequest(query, Job{}))
+        if err != nil {
+            log.Fatalf("Error marshaling checkpoint request: %v", err)
+        }
+        checkpoint, err = openCheckpoint(opts.Checkpoint, queryString, sha256Hex(request), opts.Resume)
+        if err != nil {
+            log.Fatalf("Error opening checkpoint: %v", err)
+        }
+        if opts.Resume {
+            fmt.Printf("Resuming from %s: %d day-jobs already done\n", opts.Checkpoint, len(checkpoint.done))
+        }
+    }
     queryStart := time.Now()
+    result, totalHits, err := collectStationResult(query, props, startDate, endDate, jobDays, numWorkers, os.Stdout)
+    if err != nil {
+        log.Fatalf("Error occurred: %v", err)
+    }
 
-    result := &Result{
-        Stations: make(map[string]*StationStats),
-        Realms:   make(map[string]*RealmStats),
+    if opts.BaselineDays > 0 {
+        baselineStart := startDate.AddDate(0, 0, -opts.BaselineDays)
+        fmt.Printf("\nQuerying baseline from %s to %s\n", baselineStart.Format("2006-01-02"), startDate.AddDate(0, 0, -1).Format("2006-01-02"))
+        known, err := collectKnownStations(query, props, baselineStart, startDate, numWorkers)
+        if err != nil {
+            log.Fatalf("Error querying baseline: %v", err)
+        }
+        result.KnownStations = known
+        for _, sub := range result.Providers {
+            sub.KnownStations = known
+        }
     }
 
-    // Start worker pool
-    for w := 1; w <= numWorkers; w++ {
-        wg.Add(1)
-        go func() {
-            defer wg.Done()
-            for job := range jobs {
-                hits, err := worker(job, resultChan, query, props)
-                if err != nil {
-                    select {
-                    case errChan <- err:
-                    default:
-                    }
-                    return
-                }
-                totalHits.Add(hits)
-                current := atomic.AddInt32(&processedDays, 1)
-                fmt.Printf("\rProgress: %d/%d days processed, Progress hits: %d", 
-                    current, days, totalHits.Load())
-            }
-        }()
+    if opts.AcctSessions {
+        acctQuery := `message_type:"Accounting-Request"`
+        if !opts.AllProviders {
+            acctQuery += fmt.Sprintf(` AND service_provider:"%s"`, escapeQueryValue(serviceProvider))
+        }
+        sessions, err := collectAcctSessions(acctQuery, props, startDate, endDate, numWorkers)
+        if err != nil {
+            log.Fatalf("Error querying accounting sessions: %v", err)
+        }
+        result.AcctSessions = sessions
+        for _, sub := range result.Providers {
+            sub.AcctSessions = sessions
+        }
+        fmt.Printf("\nStations with accounting sessions: %d\n", len(sessions))
     }
 
-    processDone := make(chan struct{})
-    go func() {
-        processResults(resultChan, result, &mu)
-        close(processDone)
-    }()
+    queryDuration := time.Since(queryStart)
 
-    currentDate := startDate
-    for currentDate.Before(endDate) {
-        nextDate := currentDate.Add(24 * time.Hour)
-        if nextDate.After(endDate) {
-            nextDate = endDate
+    fmt.Printf("\n")
+    noData := totalHits == 0
+    if noData {
+        warnNoData(serviceProvider, startDate, endDate)
+        if opts.Strict {
+            os.Exit(2)
         }
-        jobs <- Job{
-            StartTimestamp: currentDate.Unix(),
-            EndTimestamp:   nextDate.Unix(),
+    }
+    stationCount, realmCount := result.countUnique()
+    if opts.AllProviders {
+        fmt.Printf("Number of providers: %d\n", len(result.Providers))
+    }
+    fmt.Printf("Number of unique stations: %d\n", stationCount)
+    fmt.Printf("Number of realms: %d\n", realmCount)
+    if result.KnownStations != nil {
+        newStations := 0
+        seen := make(map[string]bool)
+        for _, leaf := range result.leafResults() {
+            for stationID := range leaf.Stations {
+                if !result.KnownStations[stationID] && !seen[stationID] {
+                    newStations++
+                }
+                seen[stationID] = true
+            }
         }
-        currentDate = nextDate
+        fmt.Printf("Number of new stations (vs %d-day baseline): %d\n", opts.BaselineDays, newStations)
     }
-    close(jobs)
-
-    wg.Wait()
-    close(resultChan)
+    fmt.Printf("Backpressure: %d of %d result sends blocked (buffer %d)\n",
+        blockedSends.Load(), totalSends.Load(), opts.BufferSize)
+    if opts.CacheDir != "" {
+        fmt.Printf("Cache: %d requests answered from %s\n", cacheHits.Load(), opts.CacheDir)
+    }
+    if skipped := malformedBuckets.Load(); skipped > 0 {
+        fmt.Printf("Skipped %d malformed buckets\n", skipped)
+    }
+    warnTruncated()
+    warnUndercounted()
 
-    <-processDone
+    if opts.Append != "" {
+        processStart := time.Now()
+        rolling, err := appendRollingData(opts.Append, result, serviceProvider)
+        if err != nil {
+            log.Fatalf("Error appending to rolling file: %v", err)
+        }
+        fmt.Printf("Rolling file %s now covers %d days, %d stations, %d auths\n",
+            opts.Append, len(rolling.Daily), rolling.Summary.UniqueStations, rolling.Summary.TotalAuths)
+        fmt.Printf("Time taken:\n")
+        fmt.Printf("  Quickwit query: %v\n", queryDuration)
+        fmt.Printf("  Local processing: %v\n", time.Since(processStart))
+        fmt.Printf("  Overall: %v\n", time.Since(queryStart))
+        return
+    }
 
-    select {
-    case err := <-errChan:
+    if opts.Flatten {
+        processStart := time.Now()
+        events := flattenResult(result, serviceProvider)
+        outputDir := fmt.Sprintf("output/%s", strings.Replace(serviceProvider, ".", "-", -1))
+        filename := outputFilename(outputDir, "flat", specificDate, startDate, days, args)
+        jsonData, err := json.MarshalIndent(events, "", "  ")
         if err != nil {
-            log.Fatalf("Error occurred: %v", err)
+            log.Fatalf("Error marshaling JSON: %v", err)
         }
-    default:
+        if err := writeOutput(filename, jsonData); err != nil {
+            log.Fatalf("Error writing output: %v", err)
+        }
+        if err := writeManifest(filename, jsonData, queryString, startDate, endDate, numWorkers, totalHits); err != nil {
+            log.Fatalf("Error writing manifest: %v", err)
+        }
+        fmt.Printf("%d auth events have been saved to %s\n", len(events), outputLocation(filename))
+        fmt.Printf("Time taken:\n")
+        fmt.Printf("  Quickwit query: %v\n", queryDuration)
+        fmt.Printf("  Local processing: %v\n", time.Since(processStart))
+        fmt.Printf("  Overall: %v\n", time.Since(queryStart))
+        return
     }
 
-    queryDuration := time.Since(queryStart)
+    if opts.Heatmap {
+        processStart := time.Now()
+        csvData, err := heatmapCSV(result, startDate, endDate)
+        if err != nil {
+            log.Fatalf("Error writing CSV: %v", err)
+        }
+        outputDir := fmt.Sprintf("output/%s", strings.Replace(serviceProvider, ".", "-", -1))
+        filename := strings.TrimSuffix(outputFilename(outputDir, "heatmap", specificDate, startDate, days, args), ".json") + ".csv"
+        if err := writeOutput(filename, csvData); err != nil {
+            log.Fatalf("Error writing output: %v", err)
+        }
+        if err := writeManifest(filename, csvData, queryString, startDate, endDate, numWorkers, totalHits); err != nil {
+            log.Fatalf("Error writing manifest: %v", err)
+        }
+        fmt.Printf("Heatmap has been saved to %s\n", outputLocation(filename))
+        fmt.Printf("Time taken:\n")
+        fmt.Printf("  Quickwit query: %v\n", queryDuration)
+        fmt.Printf("  Local processing: %v\n", time.Since(processStart))
+        fmt.Printf("  Overall: %v\n", time.Since(queryStart))
+        return
+    }
 
-    fmt.Printf("\n")
-    fmt.Printf("Number of unique stations: %d\n", len(result.Stations))
-    fmt.Printf("Number of realms: %d\n", len(result.Realms))
+    if opts.DeviceTrend {
+        processStart := time.Now()
+        var output DeviceTrendOutput
+        output.NoData = noData
+        output.QueryInfo.ServiceProvider = serviceProvider
+        output.QueryInfo.Query = queryString
+        output.QueryInfo.Days = days
+        output.QueryInfo.StartDate = startDate.Format("2006-01-02 15:04:05")
+        output.QueryInfo.EndDate = endDate.Format("2006-01-02 15:04:05")
+        output.Series = deviceTrend(result, startDate, endDate)
+        outputDir := fmt.Sprintf("output/%s", strings.Replace(serviceProvider, ".", "-", -1))
+        filename := outputFilename(outputDir, "device-trend", specificDate, startDate, days, args)
+        jsonData, err := json.MarshalIndent(output, "", "  ")
+        if err != nil {
+            log.Fatalf("Error marshaling JSON: %v", err)
+        }
+        if err := writeOutput(filename, jsonData); err != nil {
+            log.Fatalf("Error writing output: %v", err)
+        }
+        if err := writeManifest(filename, jsonData, queryString, startDate, endDate, numWorkers, totalHits); err != nil {
+            log.Fatalf("Error writing manifest: %v", err)
+        }
+        fmt.Printf("Device trend (%d days) has been saved to %s\n", len(output.Series), outputLocation(filename))
+        fmt.Printf("Time taken:\n")
+        fmt.Printf("  Quickwit query: %v\n", queryDuration)
+        fmt.Printf("  Local processing: %v\n", time.Since(processStart))
+        fmt.Printf("  Overall: %v\n", time.Since(queryStart))
+        return
+    }
 
     processStart := time.Now()
-    outputData := createOutputData(result, serviceProvider, startDate, endDate, days)
+    var outputData SimplifiedOutputData
+    if opts.AllProviders {
+        outputData = createNationalOutputData(result, startDate, endDate, days)
+    } else {
+        outputData = createOutputData(result, serviceProvider, startDate, endDate, days)
+    }
+    outputData.NoData = noData
+    outputData.UserCardinality, outputData.Summary.UndercountedDays = userCardinalityReport()
     processDuration := time.Since(processStart)
 
     outputDir := fmt.Sprintf("output/%s", strings.Replace(serviceProvider, ".", "-", -1))
-    if err := os.MkdirAll(outputDir, 0755); err != nil {
-        log.Fatalf("Error creating output directory: %v", err)
-    }
 
-    currentTime := time.Now().Format("20060102-150405")
-    var filename string
-    if specificDate {
-        filename = fmt.Sprintf("%s/%s-%s-stationid.json", outputDir, currentTime, startDate.Format("20060102"))
-    } else if len(os.Args) > 2 && strings.HasPrefix(os.Args[2], "y") && len(os.Args[2]) == 5 {
-        year := os.Args[2][1:]
-        filename = fmt.Sprintf("%s/%s-%s-stationid.json", outputDir, currentTime, year)
-    } else {
-        filename = fmt.Sprintf("%s/%s-%dd-stationid.json", outputDir, currentTime, days)
-    }
+    filename := outputFilename(outputDir, "stationid", specificDate, startDate, days, args)
 
     jsonData, err := json.MarshalIndent(outputData, "", "  ")
     if err != nil {
         log.Fatalf("Error marshaling JSON: %v", err)
     }
 
-    if err := os.WriteFile(filename, jsonData, 0644); err != nil {
-        log.Fatalf("Error writing file: %v", err)
+    if err := writeOutput(filename, jsonData); err != nil {
+        log.Fatalf("Error writing output: %v", err)
+    }
+    if err := writeManifest(filename, jsonData, queryString, startDate, endDate, numWorkers, totalHits); err != nil {
+        log.Fatalf("Error writing manifest: %v", err)
     }
 
-    fmt.Printf("Results have been saved to %s\n", filename)
+    fmt.Printf("Results have been saved to %s\n", outputLocation(filename))
     fmt.Printf("Time taken:\n")
     fmt.Printf("  Quickwit query: %v\n", queryDuration)
     fmt.Printf("  Local processing: %v\n", processDuration)
     fmt.Printf("  Overall: %v\n", time.Since(queryStart))
+    if opts.Summary {
+        printSummary(outputData, queryDuration, processDuration, time.Since(queryStart))
+    }
+}
+
+// summaryTopN คือจำนวน station (หรือ provider เมื่อใช้ all) ที่แสดงในตาราง -summary
+const summaryTopN = 10
+
+// printSummary writes the -summary table to stderr: top stations (providers with "all") by auths,
+// the totals and the timings. It only reads the report, so the JSON stays as written.
+func printSummary(output SimplifiedOutputData, queryDuration, processDuration, overall time.Duration) {
+    w := tabwriter.NewWriter(os.Stderr, 0, 0, 2, ' ', 0)
+    fmt.Fprintf(w, "\nSummary: %s, %s to %s\n", output.QueryInfo.ServiceProvider,
+        output.QueryInfo.StartDate, output.QueryInfo.EndDate)
+
+    if len(output.Providers) > 0 {
+        providers := append([]SimplifiedOutputData(nil), output.Providers...)
+        sort.SliceStable(providers, func(i, j int) bool {
+            return providers[i].Summary.TotalAuths > providers[j].Summary.TotalAuths
+        })
+        fmt.Fprintln(w, "PROVIDER\tAUTHS\tUSERS\tSTATIONS")
+        for i, p := range providers {
+            if i == summaryTopN {
+                break
+            }
+            fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", p.QueryInfo.ServiceProvider, p.Summary.TotalAuths,
+                p.Summary.UniqueUsers, p.Summary.UniqueStations)
+        }
+    } else {
+        // StationStats อาจถูกเรียงด้วย -sort แบบอื่น จึงเรียงสำเนาตาม auth ใหม่
+        stations := append([]StationStatsOutput(nil), output.StationStats...)
+        sort.SliceStable(stations, func(i, j int) bool {
+            return stations[i].TotalAuths > stations[j].TotalAuths
+        })
+        fmt.Fprintln(w, "STATION\tAUTHS\tUSERS\tVENDOR")
+        for i, st := range stations {
+            if i == summaryTopN {
+                break
+            }
+            vendor := st.Vendor
+            if vendor == "" {
+                vendor = "-"
+            }
+            fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", st.StationID, st.TotalAuths, st.TotalUsers, vendor)
+        }
+    }
+
+    fmt.Fprintln(w)
+    fmt.Fprintf(w, "Total auths\t%d\n", output.Summary.TotalAuths)
+    fmt.Fprintf(w, "Unique stations\t%d\n", output.Summary.UniqueStations)
+    fmt.Fprintf(w, "Unique users\t%d\n", output.Summary.UniqueUsers)
+    fmt.Fprintf(w, "Unique realms\t%d\n", output.Summary.UniqueRealms)
+    fmt.Fprintf(w, "Quickwit query\t%v\n", queryDuration.Round(time.Millisecond))
+    fmt.Fprintf(w, "Local processing\t%v\n", processDuration.Round(time.Millisecond))
+    fmt.Fprintf(w, "Overall\t%v\n", overall.Round(time.Millisecond))
+    w.Flush()
 }
@@ -0,0 +1,403 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "strconv"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestRunDayJobs(t *testing.T) {
+    start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+    end := start.AddDate(0, 0, 7)
+    tests := []struct {
+        sample int
+        days   []int
+    }{
+        {1, []int{0, 1, 2, 3, 4, 5, 6}},
+        {3, []int{0, 3, 6}},
+        {10, []int{0}},
+    }
+    for _, tt := range tests {
+        var mu sync.Mutex
+        seen := make(map[int]int)
+        err := runDayJobs(start, end, tt.sample, 4, func(job Job) error {
+            if job.EndTimestamp-job.StartTimestamp != 24*3600 {
+                t.Errorf("sample %d: day-job %d-%d is not one day", tt.sample, job.StartTimestamp, job.EndTimestamp)
+            }
+            mu.Lock()
+            seen[int((job.StartTimestamp-start.Unix())/(24*3600))]++
+            mu.Unlock()
+            return nil
+        })
+        if err != nil {
+            t.Fatalf("sample %d: %v", tt.sample, err)
+        }
+        if len(seen) != len(tt.days) {
+            t.Errorf("sample %d: ran days %v, want %v", tt.sample, seen, tt.days)
+        }
+        for _, day := range tt.days {
+            if seen[day] != 1 {
+                t.Errorf("sample %d: day %d ran %d times, want once", tt.sample, day, seen[day])
+            }
+        }
+    }
+}
+
+func TestRunDayJobsPartialLastDay(t *testing.T) {
+    start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+    end := start.Add(36 * time.Hour)
+    var mu sync.Mutex
+    var jobs []Job
+    if err := runDayJobs(start, end, 1, 2, func(job Job) error {
+        mu.Lock()
+        jobs = append(jobs, job)
+        mu.Unlock()
+        return nil
+    }); err != nil {
+        t.Fatal(err)
+    }
+    var last int64
+    for _, job := range jobs {
+        if job.EndTimestamp > last {
+            last = job.EndTimestamp
+        }
+    }
+    if len(jobs) != 2 || last != end.Unix() {
+        t.Errorf("got %d day-jobs ending at %d, want 2 ending at %d", len(jobs), last, end.Unix())
+    }
+}
+
+func TestRunDayJobsError(t *testing.T) {
+    start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+    failure := errors.New("quickwit down")
+    err := runDayJobs(start, start.AddDate(0, 0, 30), 1, 3, func(job Job) error {
+        if job.StartTimestamp == start.AddDate(0, 0, 2).Unix() {
+            return failure
+        }
+        return nil
+    })
+    if !errors.Is(err, failure) {
+        t.Errorf("runDayJobs error = %v, want %v", err, failure)
+    }
+}
+
+// searchServer answers every search request with answer(query) as the aggregations, and
+// points httpClient at it; returns the QW_URL
+func searchServer(t *testing.T, answer func(query map[string]interface{}) map[string]interface{}) string {
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        var query map[string]interface{}
+        if err := json.NewDecoder(r.Body).Decode(&query); err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        json.NewEncoder(w).Encode(map[string]interface{}{
+            "num_hits":     0,
+            "hits":         []interface{}{},
+            "aggregations": answer(query),
+        })
+    }))
+    t.Cleanup(server.Close)
+    httpClient = server.Client()
+    return server.URL
+}
+
+func TestCollectKnownStationsSplitsTruncatedDays(t *testing.T) {
+    start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+    qwURL := searchServer(t, func(query map[string]interface{}) map[string]interface{} {
+        from := int64(query["start_timestamp"].(float64))
+        to := int64(query["end_timestamp"].(float64))
+        buckets := []interface{}{map[string]interface{}{"key": "day", "doc_count": 5}}
+        other := 0
+        switch {
+        case to-from > 3600:
+            other = 3 // ทั้งวันถูกตัด
+        case from == start.Unix()+3600:
+            buckets = append(buckets, map[string]interface{}{"key": "hour-1", "doc_count": 2})
+        case from == start.Unix()+2*3600:
+            other = 1 // ชั่วโมงนี้ยังถูกตัด
+        }
+        return map[string]interface{}{
+            "by_station": map[string]interface{}{"buckets": buckets, "sum_other_doc_count": other},
+        }
+    })
+    truncatedBaseline.Store(0)
+    defer truncatedBaseline.Store(0)
+
+    known, err := collectKnownStations(map[string]interface{}{"query": "*"}, Properties{QWURL: qwURL},
+        start, start.AddDate(0, 0, 1), 2)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !known["day"] || !known["hour-1"] || len(known) != 2 {
+        t.Errorf("known stations = %v, want day and hour-1", known)
+    }
+    if got := truncatedBaseline.Load(); got != 1 {
+        t.Errorf("truncatedBaseline = %d, want 1", got)
+    }
+}
+
+func TestEscapeQueryValue(t *testing.T) {
+    tests := []struct {
+        value string
+        want  string
+    }{
+        {"john@ku.ac.th", "john@ku.ac.th"},
+        {"john doe@ku.ac.th", "john doe@ku.ac.th"},
+        {`john"@ku.ac.th`, `john\"@ku.ac.th`},
+        {`DOMAIN\john`, `DOMAIN\\john`},
+        {`a\" OR username:*`, `a\\\" OR username:*`},
+        {"host:eduroam.ku.ac.th", "host:eduroam.ku.ac.th"},
+        {"", ""},
+    }
+    for _, tt := range tests {
+        if got := escapeQueryValue(tt.value); got != tt.want {
+            t.Errorf("escapeQueryValue(%q) = %q, want %q", tt.value, got, tt.want)
+        }
+        // ค่าที่ escape แล้วต้องไม่ปิด quote ก่อนจบ term
+        if closed := closingQuote(`"` + escapeQueryValue(tt.value) + `"`); closed != len(escapeQueryValue(tt.value))+1 {
+            t.Errorf("username:%q: quoted term closes at %d, want at its end", tt.value, closed)
+        }
+    }
+}
+
+// closingQuote returns the index of the quote that closes the term opened at term[0]
+func closingQuote(term string) int {
+    for i := 1; i < len(term); i++ {
+        switch term[i] {
+        case '\\':
+            i++
+        case '"':
+            return i
+        }
+    }
+    return -1
+}
+
+// userBucket builds a by_user bucket with one auth_times bucket; realms become its by_realm buckets
+func userBucket(username string, realms ...string) map[string]interface{} {
+    bucket := map[string]interface{}{
+        "key": username,
+        "auth_times": map[string]interface{}{
+            "buckets": []interface{}{map[string]interface{}{"key": float64(1709283600000), "doc_count": float64(1)}},
+        },
+    }
+    if realms != nil {
+        var realmBuckets []interface{}
+        for _, realm := range realms {
+            realmBuckets = append(realmBuckets, map[string]interface{}{"key": realm, "doc_count": float64(1)})
+        }
+        bucket["by_realm"] = map[string]interface{}{"buckets": realmBuckets}
+    }
+    return bucket
+}
+
+func TestProcessStationBucketRealmFallback(t *testing.T) {
+    tests := []struct {
+        name   string
+        bucket map[string]interface{}
+        realm  string // "" = bucket ถูกนับเป็น malformed
+    }{
+        {"indexed realm wins", userBucket("john@ku.ac.th", "cmu.ac.th"), "cmu.ac.th"},
+        {"no by_realm", userBucket("john@ku.ac.th"), "ku.ac.th"},
+        {"empty by_realm", userBucket("john@ku.ac.th", []string{}...), "ku.ac.th"},
+        {"last @ splits", userBucket("john@dept@ku.ac.th"), "ku.ac.th"},
+        {"no realm anywhere", userBucket("john"), ""},
+        {"trailing @", userBucket("john@"), ""},
+    }
+    for _, tt := range tests {
+        malformedBuckets.Store(0)
+        resultChan := make(chan LogEntry, 1)
+        station := map[string]interface{}{
+            "by_user": map[string]interface{}{"buckets": []interface{}{tt.bucket}},
+        }
+        processStationBucket(station, "AA-BB-CC-DD-EE-FF", "eduroam.ku.ac.th", resultChan, &DayTruncation{})
+        close(resultChan)
+
+        entry, sent := <-resultChan
+        if tt.realm == "" {
+            if sent || malformedBuckets.Load() != 1 {
+                t.Errorf("%s: sent %v (%+v), malformed %d; want the bucket dropped as malformed",
+                    tt.name, sent, entry, malformedBuckets.Load())
+            }
+            continue
+        }
+        if !sent || entry.Realm != tt.realm {
+            t.Errorf("%s: sent %v, realm %q; want %q", tt.name, sent, entry.Realm, tt.realm)
+        }
+    }
+    malformedBuckets.Store(0)
+}
+
+func TestSendQuickwitRequestRetriesTruncatedBody(t *testing.T) {
+    complete := `{"num_hits":1,"hits":[],"aggregations":{}}`
+    tests := []struct {
+        name     string
+        truncate func(w http.ResponseWriter)
+    }{
+        {"connection closed before Content-Length", func(w http.ResponseWriter) {
+            w.Header().Set("Content-Length", strconv.Itoa(len(complete)))
+            w.Write([]byte(complete[:10]))
+            // ตัดการเชื่อมต่อกลาง body
+            conn, _, _ := w.(http.Hijacker).Hijack()
+            conn.Close()
+        }},
+        {"body cut mid-JSON", func(w http.ResponseWriter) {
+            w.Write([]byte(complete[:len(complete)-5]))
+        }},
+    }
+    for _, tt := range tests {
+        var mu sync.Mutex
+        requests := 0
+        server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            mu.Lock()
+            requests++
+            first := requests == 1
+            mu.Unlock()
+            if first {
+                tt.truncate(w)
+                return
+            }
+            w.Write([]byte(complete))
+        }))
+        httpClient = server.Client()
+
+        query := map[string]interface{}{"query": "*", "max_hits": 0, "aggs": map[string]interface{}{}}
+        result, err := sendQuickwitRequest(query, Properties{QWURL: server.URL})
+        server.Close()
+        if err != nil {
+            t.Errorf("%s: sendQuickwitRequest: %v", tt.name, err)
+            continue
+        }
+        if requests != 2 {
+            t.Errorf("%s: %d requests, want the truncated one retried once", tt.name, requests)
+        }
+        if hits, _ := result["num_hits"].(float64); hits != 1 {
+            t.Errorf("%s: num_hits = %v, want the retried response", tt.name, result["num_hits"])
+        }
+    }
+}
+
+func TestSendQuickwitAttemptTruncatedBodyIsIncomplete(t *testing.T) {
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte(`{"num_hits":1,"hits":[`))
+    }))
+    defer server.Close()
+    httpClient = server.Client()
+
+    _, err := sendQuickwitAttempt(map[string]interface{}{"query": "*"}, Properties{QWURL: server.URL})
+    if !errors.Is(err, ErrIncompleteResponse) {
+        t.Errorf("sendQuickwitAttempt error = %v, want ErrIncompleteResponse", err)
+    }
+}
+
+func TestOpenCheckpointRefusesDifferentRequest(t *testing.T) {
+    dir := t.TempDir()
+    if _, err := openCheckpoint(dir, "*", "aaaa", false); err != nil {
+        t.Fatalf("openCheckpoint: %v", err)
+    }
+    if _, err := openCheckpoint(dir, "*", "aaaa", true); err != nil {
+        t.Errorf("resume with the same request: %v", err)
+    }
+    if _, err := openCheckpoint(dir, "*", "bbbb", true); err == nil {
+        t.Error("resume with a different request succeeded, want it refused")
+    }
+    if _, err := openCheckpoint(dir, "realm:x", "aaaa", true); err == nil {
+        t.Error("resume with a different query succeeded, want it refused")
+    }
+}
+
+func TestCheckpointResumeReplaysDayStats(t *testing.T) {
+    dir := t.TempDir()
+    c, err := openCheckpoint(dir, "*", "aaaa", false)
+    if err != nil {
+        t.Fatalf("openCheckpoint: %v", err)
+    }
+    job := Job{StartTimestamp: 1700000000, EndTimestamp: 1700086400}
+    saved := DayCheckpoint{
+        DayStats: DayStats{
+            Hits:            7,
+            UserCardinality: &UserCardinalityDay{Date: "2023-11-14", Estimated: 5, Counted: 4},
+            Truncated:       DayTruncation{Stations: 1, Users: 2, Realms: 3},
+        },
+        Entries: []LogEntry{{Username: "john@ku.ac.th", StationID: "AA-BB-CC-DD-EE-FF"}},
+    }
+    if err := c.save(jobKey(job), saved); err != nil {
+        t.Fatalf("save: %v", err)
+    }
+
+    c, err = openCheckpoint(dir, "*", "aaaa", true)
+    if err != nil {
+        t.Fatalf("resume: %v", err)
+    }
+    userCardinalityDays = nil
+    truncatedStations.Store(0)
+    truncatedUsers.Store(0)
+    truncatedRealms.Store(0)
+    resultChan := make(chan LogEntry, 1)
+    // worker ไม่ถูกเรียกสำหรับวันที่เสร็จแล้ว จึงไม่ต้องมี Quickwit
+    hits, err := c.Run(job, resultChan, nil, Properties{})
+    if err != nil {
+        t.Fatalf("Run: %v", err)
+    }
+    if hits != 7 || len(resultChan) != 1 {
+        t.Errorf("Run = %d hits, %d entries; want 7 hits, 1 entry", hits, len(resultChan))
+    }
+    if len(userCardinalityDays) != 1 || !reflect.DeepEqual(userCardinalityDays[0], *saved.UserCardinality) {
+        t.Errorf("user cardinality = %+v, want %+v", userCardinalityDays, *saved.UserCardinality)
+    }
+    if truncatedStations.Load() != 1 || truncatedUsers.Load() != 2 || truncatedRealms.Load() != 3 {
+        t.Errorf("truncated = %d/%d/%d, want 1/2/3",
+            truncatedStations.Load(), truncatedUsers.Load(), truncatedRealms.Load())
+    }
+    userCardinalityDays = nil
+    truncatedStations.Store(0)
+    truncatedUsers.Store(0)
+    truncatedRealms.Store(0)
+}
+
+func TestCachePathDayEndingAtMidnight(t *testing.T) {
+    saved := opts.CacheDir
+    opts.CacheDir = t.TempDir()
+    defer func() { opts.CacheDir = saved }()
+
+    now := time.Now()
+    today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location()).Unix()
+    tests := []struct {
+        name   string
+        end    int64
+        cached bool
+    }{
+        {"yesterday's job ends at midnight", today, true},
+        {"earlier day", today - 86400, true},
+        {"reaches into today", today + 1, false},
+    }
+    for _, tt := range tests {
+        query := map[string]interface{}{"query": "*", "start_timestamp": tt.end - 86400, "end_timestamp": tt.end}
+        if got := cachePath(query, Properties{}) != ""; got != tt.cached {
+            t.Errorf("%s: cached = %v, want %v", tt.name, got, tt.cached)
+        }
+    }
+}
+
+func TestCheckQuickwitSendsBasicAuthToLivez(t *testing.T) {
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        // proxy หน้า Quickwit บังคับ basic auth ทุก path รวมถึง /health/livez
+        if user, pass, ok := r.BasicAuth(); !ok || user != "qw" || pass != "secret" {
+            w.WriteHeader(http.StatusUnauthorized)
+            return
+        }
+        w.WriteHeader(http.StatusOK)
+    }))
+    defer server.Close()
+    httpClient = server.Client()
+
+    if err := checkQuickwit(Properties{QWURL: server.URL, QWUser: "qw", QWPass: "secret"}); err != nil {
+        t.Errorf("checkQuickwit: %v", err)
+    }
+}
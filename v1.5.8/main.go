@@ -28,22 +28,115 @@ Flags:
         Path to the configuration file (default "src2index.properties")
   -logfile string
         Path to the log file to process (overrides the value in config file)
+  -watch-dir string
+        Follow every *.log file under this directory tree instead of a single log file (e.g., logs/ holding
+        logs/<server>/radius.log; overrides watchDir in the config file). Existing files are read from the
+        start, and files and subdirectories created later are picked up automatically; entries of all files
+        go through the same sender
+  -listen string
+        Receive syslog messages on udp://host:port or tcp://host:port (e.g., udp://:514) instead of reading a
+        log file (overrides listen in the config file). Each UDP datagram is one message; a TCP stream carries
+        one message per line. Messages are parsed like log lines (a leading PRI is stripped); RFC 3339 timestamps
+        (rsyslog's RSYSLOG_ForwardFormat) and BSD "Oct 18 01:53:12" timestamps (RSYSLOG_TraditionalForwardFormat,
+        put in the current year) are built in. They are sent in batches of batchSize or every 5s. SIGINT/SIGTERM
+        sends the batch in progress before exiting. While Quickwit is slow, UDP datagrams the ingester cannot
+        take are dropped by the kernel; use TCP where that matters
   -quickwit-url string
         URL of the Quickwit server (overrides the value in config file)
+  -replay string
+        Re-parse the lines stored in a dead-letter file, send the ones that now parse,
+        and write the ones that still fail to a new dead-letter file
+  -check
+        Verify Quickwit is reachable, the credentials work and the index of quickwitURL exists, then exit
+  -once
+        Process the existing log data (backfill), print the run summary and exit instead of watching
+  -stream-addr string
+        Serve a live tail of the entries parsed while watching as Server-Sent Events on
+        http://<addr>/events (e.g., :8090); each event is one LogEntry as JSON. A client that falls
+        more than 256 entries behind is disconnected
+  -max-runtime duration
+        Give up after this long (e.g., 2h for a cron backfill): reading stops, the batch in progress is
+        sent, the last line read is logged so the rest can be ingested later, and the run exits with
+        code 3. A circuit left open by a Quickwit outage stops probing at the deadline (default 0 = no limit)
+
+Exit codes (-once, -replay, -max-runtime, or on SIGINT/SIGTERM):
+  0 : every batch was sent
+  1 : fatal error (configuration, log file)
+  2 : some batches still failed after maxRetries; the summary reports batches sent/failed and entries dropped
+  3 : -max-runtime was reached before the log data was fully processed
+  4 : stopped by SIGINT/SIGTERM; reading stopped and the batch in progress was sent first (a second
+      signal exits at once without sending it)
 
 Configuration file (src2index.properties) parameters:
-  logFilePath    : Path to the log file to process
+  logFilePath    : Path to the log file to process (not needed when watchDir is set)
+  watchDir       : Directory tree whose *.log files are followed instead of logFilePath (see -watch-dir)
+  listen         : udp://host:port or tcp://host:port to receive syslog on instead of logFilePath (see -listen)
   quickwitURL    : URL of the Quickwit server
   username       : Username for Quickwit authentication
   password       : Password for Quickwit authentication
   batchSize      : Number of log entries to send in each batch (default 30000)
   maxRetries     : Maximum number of retry attempts for failed requests (default 3)
+  storeFullMessage : Send the raw log line as full_message (default true)
+  fullMessageMaxLen : Longest full_message sent, in bytes: a longer raw line is cut (on a character boundary)
+                   and ends with "..." to keep a preview for debugging; 0 = keep the whole line, -1 = drop it
+                   like storeFullMessage=false (default 0). doc_id is still computed from the whole line
+  deadLetterPath : Append lines that fail to parse to this JSONL file (optional)
+  maxFutureSkew  : Maximum a timestamp may be ahead of now, Go duration (default 24h)
+  maxPastAge     : Maximum a timestamp may be behind now, Go duration (default 87600h, 0 = disabled)
+  skewAction     : What to do with skewed entries: log (count and warn, send unchanged), drop (to the
+                   dead-letter file) or clamp (default log, so existing deployments keep every line)
+  maxPayloadBytes : Split a batch into sub-requests before sending if its body would exceed this size
+                   (default 10485760, 0 = disabled)
+  timestampLayouts : Comma-separated Go time layouts (e.g., 2006-01-02T15:04:05.000Z07:00) tried in order
+                   before the built-in ones; each is validated at startup (optional)
+  multiline      : Join continuation lines (lines not starting with a timestamp) onto the previous
+                   record before parsing (default false). While following a file the last record stays
+                   pending across reads, since its continuation may still be written
+  multilineTimeout : Send a pending multiline record of a followed file once no line has continued it for
+                   this long, Go duration (default 5s); it is also sent when a new record starts, the file
+                   is removed or rotated, or the run stops
+  circuitFailures : Consecutive failed batches (after maxRetries) that open the circuit breaker: ingestion
+                   pauses and Quickwit is probed every circuitCooldown until a send succeeds (default 5, 0 = disabled)
+  circuitCooldown : Pause between probes while the circuit is open, Go duration (default 30s)
+  maxDocsPerSecond : Throttle sending to this many documents per second (token bucket on entry count,
+                   one second of burst) for polite backfills; a request larger than the rate is sent and
+                   then waited off, so keep batchSize at or below it (default 0 = unlimited)
+  defaultTimezone : IANA zone (e.g., Asia/Bangkok) for timestamps without an offset; they are indexed
+                   with that zone's offset (default UTC)
+  includeMessageTypes : Comma-separated message types to keep (e.g., Access-Accept,Access-Reject);
+                   other parsed entries are counted as filtered and not sent (default: keep all)
+  compressRequests : Gzip the NDJSON body of each ingest request (Content-Encoding: gzip); if Quickwit answers
+                   415 the batch is resent uncompressed and compression stays off for the rest of the run.
+                   maxPayloadBytes still applies to the uncompressed size (default false)
+  clientCertPath : PEM client certificate presented to Quickwit for mutual TLS; requires clientKeyPath
+  clientKeyPath  : PEM private key of clientCertPath (optional, both or neither)
+  proxyURL       : Proxy used for Quickwit requests instead of HTTP_PROXY/HTTPS_PROXY from the environment
+                   (which apply by default)
+  noProxy        : Comma list of hosts or domains reached without the proxy ("*" for all), overriding NO_PROXY
+  docIDs         : Send a deterministic doc_id (SHA-256 of timestamp, hostname, pid and the raw line) with
+                   each document (default false). It is only a correlation key: Quickwit does not deduplicate
+                   on it, but documents ingested twice share the same doc_id, so duplicates can be found
+                   (e.g., by grouping on doc_id) and a re-ingested line can be traced to the original
 
 Note: 
 - The program now supports multiple timestamp formats, including ISO8601 and traditional formats.
+- Accounting-Request lines carrying Acct-* attributes (status type, session id/time, input/output
+  octets and gigawords) are parsed into the acct_* fields.
+- The SSID suffix of Called-Station-Id (e.g., "AA-BB-CC-11-22-33:eduroam") is parsed into ssid;
+  a Called-Station-Id without a suffix leaves ssid empty.
+- TLS handshake and certificate errors (e.g., "TLS Alert read:fatal:certificate expired") set tls_error
+  and carry the error text in error_message.
+- NAS-IP-Address and NAS-Port, which identify the access point, are parsed into nas_ip and nas_port
+  (a NAS-IP-Address that is not an IP address is ignored).
+- Connect-Info (e.g., "CONNECT 54Mbps 802.11g") is kept in connect_info, with the link rate converted
+  to link_rate_mbps when one is given.
+- A leading syslog PRI (e.g., "<134>1 ") is stripped and recorded as facility/severity.
+- The run summary (and the periodic stats) report field coverage: the share of parsed entries with
+  username, station_id, realm, service_provider and destination_ip populated, to spot parsing gaps.
 - Log parsing has been optimized to handle various log entry formats more robustly.
 - Improved error handling provides more detailed information for troubleshooting.
-- The program will automatically reduce the batch size if it encounters "Payload Too Large" errors from Quickwit.
+- Batches larger than maxPayloadBytes are split before sending; the program still reduces the batch size
+  if it encounters "Payload Too Large" errors from Quickwit.
 
 For more information, please refer to the README.md file.
 */
@@ -53,65 +146,576 @@ package main
 import (
     "bufio"
     "bytes"
+    "compress/gzip"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/tls"
+    "encoding/hex"
     "encoding/json"
+    "errors"
+    "flag"
     "fmt"
     "io"
+    "io/fs"
     "log"
+    "net"
     "net/http"
+    "net/url"
     "os"
+    "os/signal"
+    "path/filepath"
+    "regexp"
     "strconv"
     "strings"
+    "sync"
+    "sync/atomic"
+    "syscall"
     "time"
+    "unicode/utf8"
 
     "github.com/fsnotify/fsnotify"
 )
 
 
 type Config struct {
-    LogFilePath  string
-    QuickwitURL  string
-    Username     string
-    Password     string
-    BatchSize    int
-    MaxRetries   int
+    LogFilePath         string
+    WatchDir            string
+    Listen              string
+    QuickwitURL         string
+    Username            string
+    Password            string
+    BatchSize           int
+    MaxRetries          int
+    StoreFullMessage    bool
+    FullMessageMaxLen   int // 0 = ไม่ตัด, -1 = ไม่ส่ง full_message
+    DeadLetterPath      string
+    MaxFutureSkew       time.Duration
+    MaxPastAge          time.Duration
+    SkewAction          string
+    MaxPayloadBytes     int
+    Multiline           bool
+    MultilineTimeout    time.Duration
+    TimestampLayouts    []string
+    DefaultTimezone     *time.Location
+    CircuitFailures     int
+    CircuitCooldown     time.Duration
+    IncludeMessageTypes map[string]bool // nil = ส่งทุก message_type
+    DocIDs              bool
+    CompressRequests    bool
+    MaxDocsPerSecond    int
+    ClientCertPath      string
+    ClientKeyPath       string
+    ProxyURL            string
+    NoProxy             string
 }
 
 type LogEntry struct {
-    Timestamp       string    `json:"timestamp"`
-    Hostname        string    `json:"hostname"`
-    Process         string    `json:"process"`
-    PID             int64     `json:"pid,omitempty"`
-    MessageType     string    `json:"message_type"`
-    DestinationIP   string    `json:"destination_ip,omitempty"`
-    Username        string    `json:"username,omitempty"`
-    StationID       string    `json:"station_id,omitempty"`
-    Realm           string    `json:"realm,omitempty"`
-    ServiceProvider string    `json:"service_provider,omitempty"`
-    FullMessage     string    `json:"full_message"`
+    Timestamp        string  `json:"timestamp"`
+    Hostname         string  `json:"hostname"`
+    Process          string  `json:"process"`
+    PID              int64   `json:"pid,omitempty"`
+    MessageType      string  `json:"message_type"`
+    DestinationIP    string  `json:"destination_ip,omitempty"`
+    Username         string  `json:"username,omitempty"`
+    StationID        string  `json:"station_id,omitempty"`
+    Realm            string  `json:"realm,omitempty"`
+    ServiceProvider  string  `json:"service_provider,omitempty"`
+    FullMessage      string  `json:"full_message,omitempty"`
+    AcctStatusType   string  `json:"acct_status_type,omitempty"`
+    AcctSessionID    string  `json:"acct_session_id,omitempty"`
+    AcctSessionTime  int64   `json:"acct_session_time,omitempty"`
+    AcctInputOctets  int64   `json:"acct_input_octets,omitempty"`
+    AcctOutputOctets int64   `json:"acct_output_octets,omitempty"`
+    SSID             string  `json:"ssid,omitempty"`
+    ConnectInfo      string  `json:"connect_info,omitempty"`
+    LinkRateMbps     float64 `json:"link_rate_mbps,omitempty"`
+    NASIP            string  `json:"nas_ip,omitempty"`
+    NASPort          int64   `json:"nas_port,omitempty"`
+    TLSError         bool    `json:"tls_error,omitempty"`
+    ErrorMessage     string  `json:"error_message,omitempty"`
+    Facility         string  `json:"facility,omitempty"`
+    Severity         string  `json:"severity,omitempty"`
+    DocID            string  `json:"doc_id,omitempty"`
+    IngestRunID      string  `json:"ingest_run_id,omitempty"`
+    IngestHost       string  `json:"ingest_host,omitempty"`
+}
+
+// ingestRunID and ingestHost are set once in main and stamped on every document sent
+var (
+    ingestRunID string
+    ingestHost  string
+)
+
+// newRunID returns a random (version 4) UUID
+func newRunID() (string, error) {
+    var b [16]byte
+    if _, err := rand.Read(b[:]); err != nil {
+        return "", err
+    }
+    b[6] = (b[6] & 0x0f) | 0x40
+    b[8] = (b[8] & 0x3f) | 0x80
+    return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// userAgent identifies the ingester in Quickwit access logs
+const userAgent = "log2quickwit/ingest/1.5.8"
+
+// setTraceHeaders sets the User-Agent and a per-request X-Request-ID so Quickwit-side
+// load can be traced back to this run (ingest_run_id is carried in the documents)
+func setTraceHeaders(req *http.Request) {
+    req.Header.Set("User-Agent", userAgent)
+    if requestID, err := newRunID(); err == nil {
+        req.Header.Set("X-Request-ID", requestID)
+    }
+}
+
+// IngestStats holds local ingest counters reported by showStats
+type IngestStats struct {
+    FullMessageBytesSaved atomic.Int64
+    SkewedEntries         atomic.Int64
+    PreSplitBatches       atomic.Int64
+    BatchesSent           atomic.Int64
+    BatchesFailed         atomic.Int64 // batches that still failed after maxRetries
+    EntriesDropped        atomic.Int64 // entries of the failed batches
+    FilteredEntries       atomic.Int64 // parsed entries skipped by includeMessageTypes
+    CircuitOpen           atomic.Bool  // Quickwit considered down; sends are paused and probed
+    CircuitOpens          atomic.Int64 // times the circuit has opened
+    DocsSent              atomic.Int64 // documents accepted by Quickwit
+    ParsedEntries         atomic.Int64 // lines parseLine accepted, the base of the field coverage
+    FieldsPopulated       [len(coverageFields)]atomic.Int64 // per coverageFields entry
+}
+
+// coverageFields are the parsed fields whose coverage is reported; a low share for one of
+// them points at a log variant the parser does not handle yet
+var coverageFields = [...]string{"username", "station_id", "realm", "service_provider", "destination_ip"}
+
+// recordCoverage counts a parsed entry and which coverageFields it has populated
+func recordCoverage(entry LogEntry) {
+    ingestStats.ParsedEntries.Add(1)
+    values := [len(coverageFields)]string{entry.Username, entry.StationID, entry.Realm, entry.ServiceProvider, entry.DestinationIP}
+    for i, value := range values {
+        if value != "" {
+            ingestStats.FieldsPopulated[i].Add(1)
+        }
+    }
+}
+
+// fieldCoverage formats the share of parsed entries with each coverageFields field populated
+func fieldCoverage() string {
+    parsed := ingestStats.ParsedEntries.Load()
+    parts := make([]string, 0, len(coverageFields))
+    for i, field := range coverageFields {
+        share := 0.0
+        if parsed > 0 {
+            share = float64(ingestStats.FieldsPopulated[i].Load()) / float64(parsed) * 100
+        }
+        parts = append(parts, fmt.Sprintf("%s %.1f%%", field, share))
+    }
+    return fmt.Sprintf("%s (%d parsed entries)", strings.Join(parts, ", "), parsed)
+}
+
+// ingestStart is when the run began, for the effective ingest rate
+var ingestStart = time.Now()
+
+// ingestRate returns the documents sent per second since the run began
+func ingestRate() float64 {
+    elapsed := time.Since(ingestStart).Seconds()
+    if elapsed <= 0 {
+        return 0
+    }
+    return float64(ingestStats.DocsSent.Load()) / elapsed
+}
+
+// RateLimiter is a token bucket on document count (maxDocsPerSecond); tokens may go
+// negative so a request larger than the bucket waits off its debt afterwards
+type RateLimiter struct {
+    mu     sync.Mutex
+    rate   float64
+    tokens float64
+    last   time.Time
+}
+
+// docLimiter is nil when maxDocsPerSecond is not set
+var docLimiter *RateLimiter
+
+func newRateLimiter(docsPerSecond int) *RateLimiter {
+    return &RateLimiter{rate: float64(docsPerSecond), tokens: float64(docsPerSecond), last: time.Now()}
+}
+
+// Wait takes n tokens and blocks until the bucket is out of debt
+func (l *RateLimiter) Wait(n int) {
+    if l == nil {
+        return
+    }
+    l.mu.Lock()
+    now := time.Now()
+    l.tokens += now.Sub(l.last).Seconds() * l.rate
+    if l.tokens > l.rate {
+        l.tokens = l.rate
+    }
+    l.last = now
+    l.tokens -= float64(n)
+    var delay time.Duration
+    if l.tokens < 0 {
+        delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+    }
+    l.mu.Unlock()
+    time.Sleep(delay)
+}
+
+var ingestStats IngestStats
+
+// exit codes: 0 = every batch was sent, 1 = fatal (config/file) error, 2 = some batches failed,
+// 3 = stopped by -max-runtime, 4 = stopped by SIGINT/SIGTERM
+const (
+    exitBatchesFailed = 2
+    exitIncomplete    = 3
+    exitInterrupted   = 4
+)
+
+// runStop is closed when -max-runtime elapses or on SIGINT/SIGTERM: reading stops, and the
+// loop that was reading sends the batch in progress and returns to main, which calls finish
+var (
+    runStop     = make(chan struct{})
+    runStopOnce sync.Once
+)
+
+// deadlineReached and interrupted record why runStop was closed (they pick the exit code)
+var deadlineReached, interrupted atomic.Bool
+
+// stopRun closes runStop (once)
+func stopRun() {
+    runStopOnce.Do(func() { close(runStop) })
+}
+
+// runStopped reports whether reading should stop
+func runStopped() bool {
+    select {
+    case <-runStop:
+        return true
+    default:
+        return false
+    }
+}
+
+// finish prints the run summary and exits 0 only if no batch failed after retries
+func finish() {
+    log.Printf("Run summary: batches sent: %d, batches failed: %d, entries dropped: %d, entries filtered: %d",
+        ingestStats.BatchesSent.Load(), ingestStats.BatchesFailed.Load(), ingestStats.EntriesDropped.Load(),
+        ingestStats.FilteredEntries.Load())
+    log.Printf("Documents sent: %d (%.1f docs/s)", ingestStats.DocsSent.Load(), ingestRate())
+    log.Printf("Field coverage: %s", fieldCoverage())
+    if deadLetters != nil {
+        deadLetters.Close()
+    }
+    if deadlineReached.Load() {
+        log.Printf("Run stopped by -max-runtime before the log data was fully processed")
+        os.Exit(exitIncomplete)
+    }
+    if interrupted.Load() {
+        log.Printf("Run stopped by SIGINT/SIGTERM after sending the batch in progress")
+        os.Exit(exitInterrupted)
+    }
+    if ingestStats.BatchesFailed.Load() > 0 {
+        os.Exit(exitBatchesFailed)
+    }
+    os.Exit(0)
+}
+
+// DeadLetter is a single line that failed to parse
+type DeadLetter struct {
+    Time  string `json:"time"`
+    Error string `json:"error"`
+    Line  string `json:"line"`
+}
+
+// DeadLetterWriter appends unparsable lines to a JSONL file
+type DeadLetterWriter struct {
+    mu   sync.Mutex
+    file *os.File
+}
+
+// deadLetters is nil when deadLetterPath is not configured
+var deadLetters *DeadLetterWriter
+
+func newDeadLetterWriter(path string) (*DeadLetterWriter, error) {
+    file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+    if err != nil {
+        return nil, err
+    }
+    return &DeadLetterWriter{file: file}, nil
+}
+
+func (w *DeadLetterWriter) Write(line string, parseErr error) {
+    if w == nil {
+        return
+    }
+    jsonData, err := json.Marshal(DeadLetter{
+        Time:  time.Now().Format(time.RFC3339),
+        Error: parseErr.Error(),
+        Line:  line,
+    })
+    if err != nil {
+        log.Printf("Error marshaling dead letter: %v", err)
+        return
+    }
+
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    if _, err := w.file.Write(append(jsonData, '\n')); err != nil {
+        log.Printf("Error writing dead letter: %v", err)
+    }
+}
+
+func (w *DeadLetterWriter) Close() error {
+    if w == nil {
+        return nil
+    }
+    return w.file.Close()
+}
+
+// streamClientBuffer is how many events a live-tail client may fall behind before it is dropped
+const streamClientBuffer = 256
+
+// StreamHub fans parsed entries out to the connected -stream-addr SSE clients
+type StreamHub struct {
+    mu      sync.Mutex
+    clients map[chan []byte]bool
+}
+
+// streamHub is nil when -stream-addr is not given
+var streamHub *StreamHub
+
+func newStreamHub() *StreamHub {
+    return &StreamHub{clients: make(map[chan []byte]bool)}
+}
+
+// Broadcast sends each entry to every client without blocking; a client whose buffer
+// is full is disconnected so a slow consumer never holds up ingestion
+func (h *StreamHub) Broadcast(entries []LogEntry) {
+    if h == nil {
+        return
+    }
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    if len(h.clients) == 0 {
+        return
+    }
+    for _, entry := range entries {
+        jsonData, err := json.Marshal(entry)
+        if err != nil {
+            log.Printf("Error marshaling stream event: %v", err)
+            continue
+        }
+        for client := range h.clients {
+            select {
+            case client <- jsonData:
+            default:
+                delete(h.clients, client)
+                close(client)
+                log.Printf("Dropped slow live-tail client (%d clients left)", len(h.clients))
+            }
+        }
+    }
+}
+
+// ServeHTTP streams entries to one client as text/event-stream until it disconnects or is dropped
+func (h *StreamHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    flusher, ok := w.(http.Flusher)
+    if !ok {
+        http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+        return
+    }
+
+    client := make(chan []byte, streamClientBuffer)
+    h.mu.Lock()
+    h.clients[client] = true
+    h.mu.Unlock()
+    defer func() {
+        h.mu.Lock()
+        if h.clients[client] {
+            delete(h.clients, client)
+            close(client)
+        }
+        h.mu.Unlock()
+    }()
+
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.Header().Set("Connection", "keep-alive")
+    w.WriteHeader(http.StatusOK)
+    flusher.Flush()
+
+    for {
+        select {
+        case <-r.Context().Done():
+            return
+        case data, ok := <-client:
+            if !ok {
+                return
+            }
+            if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+                return
+            }
+            flusher.Flush()
+        }
+    }
 }
 
 type QuickwitStats struct {
+    IndexID     string `json:"index_id"`
     ValidDocs   int `json:"valid_docs"`
     ErrorDocs   int `json:"error_docs"`
     ParseErrors int `json:"parse_errors"`
 }
 
 func main() {
-    log.Println("Starting log2quickwit v1.5.7")
+    configPath := flag.String("config", "src2index.properties", "Path to the configuration file")
+    logFile := flag.String("logfile", "", "Path to the log file to process (overrides the value in config file)")
+    watchDir := flag.String("watch-dir", "", "Follow every *.log file under this directory tree instead of a single log file")
+    listen := flag.String("listen", "", "Receive syslog on udp://host:port or tcp://host:port instead of reading a log file")
+    quickwitURL := flag.String("quickwit-url", "", "URL of the Quickwit server (overrides the value in config file)")
+    replayPath := flag.String("replay", "", "Re-parse and send the lines stored in a dead-letter file")
+    check := flag.Bool("check", false, "Verify Quickwit connectivity and the ingest index, then exit")
+    once := flag.Bool("once", false, "Process the existing log data, print the run summary and exit instead of watching")
+    streamAddr := flag.String("stream-addr", "", "Serve parsed entries as Server-Sent Events on http://<addr>/events (e.g., :8090)")
+    maxRuntime := flag.Duration("max-runtime", 0, "Stop after this long, send the batch in progress and exit 3 (0 = no limit)")
+    flag.Parse()
+
+    if *maxRuntime < 0 {
+        log.Fatalf("Invalid max-runtime. Must be 0 or greater")
+    }
+
+    log.Println("Starting log2quickwit v1.5.8")
+
+    runID, err := newRunID()
+    if err != nil {
+        log.Fatalf("Error generating ingest run ID: %v", err)
+    }
+    ingestRunID = runID
+    ingestHost, err = os.Hostname()
+    if err != nil {
+        log.Printf("Error getting hostname: %v", err)
+    }
+    log.Printf("Ingest run ID: %s (host %s)", ingestRunID, ingestHost)
     
-    config, err := loadConfig("src2index.properties")
+    config, err := loadConfig(*configPath)
     if err != nil {
         log.Fatalf("Error loading configuration: %v", err)
     }
+    if *logFile != "" {
+        config.LogFilePath = *logFile
+    }
+    if *watchDir != "" {
+        config.WatchDir = *watchDir
+    }
+    if *listen != "" {
+        config.Listen = *listen
+    }
+    if *quickwitURL != "" {
+        config.QuickwitURL = *quickwitURL
+    }
+    timestampLayouts = append(append([]string{}, config.TimestampLayouts...), defaultTimestampLayouts...)
+    timestampLocation = config.DefaultTimezone
+    if config.MaxDocsPerSecond > 0 {
+        docLimiter = newRateLimiter(config.MaxDocsPerSecond)
+    }
+    if config.ClientCertPath != "" || config.ProxyURL != "" || config.NoProxy != "" {
+        quickwitTransport = http.DefaultTransport.(*http.Transport).Clone()
+    }
+    if config.ClientCertPath != "" {
+        cert, err := tls.LoadX509KeyPair(config.ClientCertPath, config.ClientKeyPath)
+        if err != nil {
+            log.Fatalf("Error loading client certificate: %v", err)
+        }
+        quickwitTransport.TLSClientConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+    }
+    if config.ProxyURL != "" || config.NoProxy != "" {
+        proxy, err := proxyFunc(config.ProxyURL, config.NoProxy)
+        if err != nil {
+            log.Fatalf("Error configuring proxy: %v", err)
+        }
+        quickwitTransport.Proxy = proxy
+    }
+
+    if *check {
+        indexID, err := checkQuickwit(config)
+        if err != nil {
+            log.Fatalf("Check failed: %v", err)
+        }
+        log.Printf("Check OK: Quickwit is reachable and index %s exists", indexID)
+        return
+    }
+
+    if *replayPath != "" {
+        if err := replayDeadLetters(*replayPath, config); err != nil {
+            log.Fatalf("Error replaying dead letters: %v", err)
+        }
+        finish()
+    }
+
+    if config.DeadLetterPath != "" {
+        deadLetters, err = newDeadLetterWriter(config.DeadLetterPath)
+        if err != nil {
+            log.Fatalf("Error opening dead-letter file: %v", err)
+        }
+    }
+
+    if *streamAddr != "" {
+        streamHub = newStreamHub()
+        mux := http.NewServeMux()
+        mux.Handle("/events", streamHub)
+        go func() {
+            log.Printf("Live tail on http://%s/events", *streamAddr)
+            if err := http.ListenAndServe(*streamAddr, mux); err != nil {
+                log.Fatalf("Error serving live tail: %v", err)
+            }
+        }()
+    }
+
+    // Ctrl-C / SIGTERM: หยุดอ่าน ให้ loop ที่อ่านอยู่ส่ง batch ที่ค้างก่อน แล้ว main จึง finish;
+    // สัญญาณครั้งที่สองออกทันทีโดยไม่รอ
+    signals := make(chan os.Signal, 2)
+    signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+    go func() {
+        <-signals
+        log.Printf("Interrupted; sending the batch in progress before exiting (interrupt again to exit now)")
+        interrupted.Store(true)
+        stopRun()
+        <-signals
+        log.Printf("Interrupted again; exiting without sending the batch in progress")
+        finish()
+    }()
+
+    if *maxRuntime > 0 {
+        time.AfterFunc(*maxRuntime, func() {
+            log.Printf("Max runtime %v reached; stopping after the batch in progress", *maxRuntime)
+            deadlineReached.Store(true)
+            stopRun()
+        })
+    }
 
     go showStats(config)
 
-    if err := processLogFile(config); err != nil {
+    if config.Listen != "" {
+        if err := processListen(config); err != nil {
+            log.Fatalf("Error receiving syslog: %v", err)
+        }
+        finish()
+    }
+    if config.WatchDir != "" {
+        if err := processWatchDir(config, *once); err != nil {
+            log.Fatalf("Error processing watch directory: %v", err)
+        }
+        finish()
+    }
+    if err := processLogFile(config, *once); err != nil {
         log.Fatalf("Error processing log file: %v", err)
     }
+    finish()
 }
 
-func processLogFile(config Config) error {
+func processLogFile(config Config, once bool) error {
     watcher, err := fsnotify.NewWatcher()
     if err != nil {
         return fmt.Errorf("error creating watcher: %v", err)
@@ -125,9 +729,15 @@ func processLogFile(config Config) error {
     defer file.Close()
 
     var lastPosition int64
-    if err := processExistingData(file, &lastPosition, config); err != nil {
+    records := newRecordScanner(config.Multiline, !once)
+    if err := processExistingData(file, &lastPosition, records, config); err != nil {
         return fmt.Errorf("error processing existing data: %v", err)
     }
+    if once {
+        return nil
+    }
+    idle := time.NewTicker(time.Second)
+    defer idle.Stop()
 
     err = watcher.Add(config.LogFilePath)
     if err != nil {
@@ -137,12 +747,17 @@ func processLogFile(config Config) error {
     log.Println("Watching for file changes...")
     for {
         select {
+        case <-runStop:
+            flushRecord(records, 0, config)
+            return nil
+        case <-idle.C:
+            flushRecord(records, config.MultilineTimeout, config)
         case event, ok := <-watcher.Events:
             if !ok {
                 return nil
             }
             if event.Op&fsnotify.Write == fsnotify.Write {
-                if err := processNewData(file, &lastPosition, config); err != nil {
+                if err := processNewData(file, &lastPosition, records, config); err != nil {
                     log.Printf("Error processing new data: %v", err)
                 }
             }
@@ -155,22 +770,299 @@ func processLogFile(config Config) error {
     }
 }
 
-func processExistingData(file *os.File, lastPosition *int64, config Config) error {
+// listenFlushInterval is how long entries received by -listen wait for a full batch before they are sent
+const listenFlushInterval = 5 * time.Second
+
+// maxSyslogMessage is the longest TCP syslog line accepted by -listen
+const maxSyslogMessage = 1024 * 1024
+
+// processListen receives syslog messages on config.Listen instead of reading a file. Messages
+// from every UDP datagram or TCP connection are parsed and sent from this goroutine, in batches
+// of batchSize or after listenFlushInterval, so the sender sees one batch at a time
+func processListen(config Config) error {
+    u, err := url.Parse(config.Listen)
+    if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+        return fmt.Errorf("invalid listen address %q: use udp://host:port or tcp://host:port", config.Listen)
+    }
+
+    messages := make(chan string, config.BatchSize)
+    switch u.Scheme {
+    case "udp":
+        conn, err := net.ListenPacket("udp", u.Host)
+        if err != nil {
+            return fmt.Errorf("error listening on %s: %v", config.Listen, err)
+        }
+        defer conn.Close()
+        go receiveUDP(conn, messages)
+    case "tcp":
+        listener, err := net.Listen("tcp", u.Host)
+        if err != nil {
+            return fmt.Errorf("error listening on %s: %v", config.Listen, err)
+        }
+        defer listener.Close()
+        go acceptTCP(listener, messages)
+    }
+    log.Printf("Listening for syslog on %s", config.Listen)
+
+    ticker := time.NewTicker(listenFlushInterval)
+    defer ticker.Stop()
+    var entries []LogEntry
+    flush := func() {
+        if len(entries) == 0 {
+            return
+        }
+        streamHub.Broadcast(entries)
+        if err := sendToQuickwitWithRetry(entries, config); err != nil {
+            log.Printf("Error sending received entries to Quickwit: %v", err)
+        }
+        entries = nil
+    }
+
+    for {
+        select {
+        case <-runStop:
+            flush()
+            return nil
+        case <-ticker.C:
+            flush()
+        case message := <-messages:
+            entry, err := parseAndValidate(message, config)
+            if err != nil {
+                log.Printf("Error parsing message: %v\nMessage content: %s", err, message)
+                deadLetters.Write(message, err)
+                continue
+            }
+            if filteredOut(entry, config) {
+                continue
+            }
+            entries = append(entries, entry)
+            if len(entries) >= config.BatchSize {
+                flush()
+            }
+        }
+    }
+}
+
+// receiveUDP reads one syslog message per datagram until conn is closed
+func receiveUDP(conn net.PacketConn, messages chan<- string) {
+    buf := make([]byte, 65536)
+    for {
+        n, _, err := conn.ReadFrom(buf)
+        if err != nil {
+            if errors.Is(err, net.ErrClosed) {
+                return
+            }
+            log.Printf("Error reading UDP datagram: %v", err)
+            continue
+        }
+        if message := strings.TrimRight(string(buf[:n]), "\r\n\x00"); message != "" {
+            messages <- message
+        }
+    }
+}
+
+// acceptTCP hands each connection to receiveTCP until listener is closed
+func acceptTCP(listener net.Listener, messages chan<- string) {
+    for {
+        conn, err := listener.Accept()
+        if err != nil {
+            if errors.Is(err, net.ErrClosed) {
+                return
+            }
+            log.Printf("Error accepting TCP connection: %v", err)
+            time.Sleep(time.Second)
+            continue
+        }
+        go receiveTCP(conn, messages)
+    }
+}
+
+// receiveTCP reads newline-framed syslog messages from one connection until it closes
+func receiveTCP(conn net.Conn, messages chan<- string) {
+    defer conn.Close()
+    scanner := bufio.NewScanner(conn)
+    scanner.Buffer(make([]byte, 64*1024), maxSyslogMessage)
+    for scanner.Scan() {
+        if message := strings.TrimRight(scanner.Text(), "\r\x00"); message != "" {
+            messages <- message
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        log.Printf("Error reading from %s: %v", conn.RemoteAddr(), err)
+    }
+}
+
+// tailedFile is a *.log file followed by -watch-dir, the offset read so far and its records
+type tailedFile struct {
+    file         *os.File
+    lastPosition int64
+    records      *recordScanner
+}
+
+// processWatchDir follows every *.log file under config.WatchDir. fsnotify watches are not
+// recursive, so each directory of the tree gets its own watch, and a directory created later
+// is walked and watched when its Create event arrives. All files are read from this one
+// goroutine, so their batches reach the sender one at a time like a single log file's
+func processWatchDir(config Config, once bool) error {
+    var watcher *fsnotify.Watcher
+    if !once {
+        var err error
+        watcher, err = fsnotify.NewWatcher()
+        if err != nil {
+            return fmt.Errorf("error creating watcher: %v", err)
+        }
+        defer watcher.Close()
+    }
+
+    files := make(map[string]*tailedFile)
+    defer func() {
+        for _, tailed := range files {
+            tailed.file.Close()
+        }
+    }()
+
+    // watch ก่อนอ่านไฟล์ ไฟล์ที่สร้างระหว่าง backfill จึงไม่หลุด
+    if err := watchTree(watcher, config.WatchDir, files, config); err != nil {
+        return err
+    }
+    log.Printf("Following %d log files under %s", len(files), config.WatchDir)
+    if once {
+        return nil
+    }
+
+    idle := time.NewTicker(time.Second)
+    defer idle.Stop()
+
+    log.Println("Watching for file changes...")
+    for {
+        select {
+        case <-runStop:
+            for _, tailed := range files {
+                flushRecord(tailed.records, 0, config)
+            }
+            return nil
+        case <-idle.C:
+            for _, tailed := range files {
+                flushRecord(tailed.records, config.MultilineTimeout, config)
+            }
+        case event, ok := <-watcher.Events:
+            if !ok {
+                return nil
+            }
+            switch {
+            case event.Op&fsnotify.Create == fsnotify.Create:
+                info, err := os.Stat(event.Name)
+                if err != nil {
+                    continue
+                }
+                if info.IsDir() {
+                    if err := watchTree(watcher, event.Name, files, config); err != nil {
+                        log.Printf("Error watching new directory: %v", err)
+                    }
+                } else if isWatchedLog(event.Name) {
+                    if err := tailFile(event.Name, files, true, config); err != nil {
+                        log.Printf("Error following new log file: %v", err)
+                    }
+                }
+            case event.Op&fsnotify.Write == fsnotify.Write:
+                if tailed, ok := files[event.Name]; ok {
+                    if err := processNewData(tailed.file, &tailed.lastPosition, tailed.records, config); err != nil {
+                        log.Printf("Error processing new data of %s: %v", event.Name, err)
+                    }
+                }
+            case event.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+                // rotate: ไฟล์ใหม่ชื่อเดิมจะมาเป็น Create event
+                if tailed, ok := files[event.Name]; ok {
+                    flushRecord(tailed.records, 0, config)
+                    tailed.file.Close()
+                    delete(files, event.Name)
+                    log.Printf("Stopped following %s", event.Name)
+                }
+            }
+        case err, ok := <-watcher.Errors:
+            if !ok {
+                return nil
+            }
+            log.Printf("Error watching directory: %v", err)
+        }
+    }
+}
+
+// watchTree adds a watch for root and every directory below it (none when watcher is nil,
+// with -once) and reads each *.log file found that is not followed yet
+func watchTree(watcher *fsnotify.Watcher, root string, files map[string]*tailedFile, config Config) error {
+    return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+        if err != nil {
+            return fmt.Errorf("error walking %s: %v", path, err)
+        }
+        if runStopped() {
+            return filepath.SkipAll
+        }
+        if d.IsDir() {
+            if watcher == nil {
+                return nil
+            }
+            if err := watcher.Add(path); err != nil {
+                return fmt.Errorf("error adding directory %s to watcher: %v", path, err)
+            }
+            return nil
+        }
+        if !d.Type().IsRegular() || !isWatchedLog(path) {
+            return nil
+        }
+        if err := tailFile(path, files, watcher != nil, config); err != nil {
+            log.Printf("Error following %s: %v", path, err)
+        }
+        return nil
+    })
+}
+
+// tailFile opens a log file, sends its current content and records it in files
+// so later Write events continue from where it stopped (follow = not -once)
+func tailFile(path string, files map[string]*tailedFile, follow bool, config Config) error {
+    if _, ok := files[path]; ok {
+        return nil
+    }
+    file, err := os.Open(path)
+    if err != nil {
+        return fmt.Errorf("error opening file: %v", err)
+    }
+    tailed := &tailedFile{file: file, records: newRecordScanner(config.Multiline, follow)}
+    files[path] = tailed
+
+    fileConfig := config
+    fileConfig.LogFilePath = path
+    log.Printf("Following %s", path)
+    return processExistingData(file, &tailed.lastPosition, tailed.records, fileConfig)
+}
+
+// isWatchedLog reports whether -watch-dir follows the file at path
+func isWatchedLog(path string) bool {
+    return filepath.Ext(path) == ".log"
+}
+
+func processExistingData(file *os.File, lastPosition *int64, scanner *recordScanner, config Config) error {
     log.Println("Processing existing data...")
-    scanner := bufio.NewScanner(file)
+    scanner.Reset(file, 0)
     var entries []LogEntry
-    lineCount := 0
     errorCount := 0
 
     for scanner.Scan() {
-        lineCount++
+        if runStopped() {
+            log.Printf("Stopped before line %d of %s; ingest the remaining lines in a later run", scanner.Lines(), config.LogFilePath)
+            break
+        }
         line := scanner.Text()
-        entry, err := parseLine(line)
+        entry, err := parseAndValidate(line, config)
         if err != nil {
-            log.Printf("Error parsing line %d: %v\nLine content: %s", lineCount, err, line)
+            log.Printf("Error parsing line %d: %v\nLine content: %s", scanner.Lines(), err, line)
+            deadLetters.Write(line, err)
             errorCount++
             continue
         }
+        if filteredOut(entry, config) {
+            continue
+        }
 
         entries = append(entries, entry)
 
@@ -189,121 +1081,445 @@ func processExistingData(file *os.File, lastPosition *int64, config Config) erro
     }
 
     *lastPosition, _ = file.Seek(0, io.SeekCurrent)
-    log.Printf("Finished processing existing log data. Total lines: %d, Errors: %d", lineCount, errorCount)
+    log.Printf("Finished processing existing log data. Total lines: %d, Errors: %d", scanner.Lines(), errorCount)
     return nil
 }
 
-func processNewData(file *os.File, lastPosition *int64, config Config) error {
-    newEntries, err := readNewEntries(file, lastPosition)
+func processNewData(file *os.File, lastPosition *int64, records *recordScanner, config Config) error {
+    newEntries, err := readNewEntries(file, lastPosition, records, config)
     if err != nil {
         return fmt.Errorf("error reading new entries: %v", err)
     }
 
     if len(newEntries) > 0 {
+        // live tail ได้รับ entry ทันทีหลัง parse ไม่ต้องรอ Quickwit
+        streamHub.Broadcast(newEntries)
         if err := sendToQuickwitWithRetry(newEntries, config); err != nil {
             return fmt.Errorf("error sending new entries to Quickwit: %v", err)
         }
         log.Printf("Successfully sent %d new entries to Quickwit", len(newEntries))
     }
 
-    return nil
+    return nil
+}
+
+func readNewEntries(file *os.File, lastPosition *int64, scanner *recordScanner, config Config) ([]LogEntry, error) {
+    _, err := file.Seek(*lastPosition, io.SeekStart)
+    if err != nil {
+        return nil, fmt.Errorf("error seeking file: %v", err)
+    }
+
+    scanner.Reset(file, *lastPosition)
+    var newEntries []LogEntry
+
+    for scanner.Scan() {
+        line := scanner.Text()
+        entry, err := parseAndValidate(line, config)
+        if err != nil {
+            log.Printf("Error parsing line: %v\nLine content: %s", err, line)
+            deadLetters.Write(line, err)
+            continue
+        }
+        if filteredOut(entry, config) {
+            continue
+        }
+        newEntries = append(newEntries, entry)
+    }
+
+    if err := scanner.Err(); err != nil {
+        return nil, fmt.Errorf("error scanning file: %v", err)
+    }
+
+    *lastPosition, _ = file.Seek(0, io.SeekCurrent)
+    return newEntries, nil
+}
+
+// flushRecord sends the pending multiline record of a followed file once no line has continued it
+// for idle (0 = at once: the file was removed or rotated, or the run stops)
+func flushRecord(records *recordScanner, idle time.Duration, config Config) {
+    if !records.Flush(idle) {
+        return
+    }
+    line := records.Text()
+    entry, err := parseAndValidate(line, config)
+    if err != nil {
+        log.Printf("Error parsing record at offset %d: %v\nLine content: %s", records.PendingStart(), err, line)
+        deadLetters.Write(line, err)
+        return
+    }
+    if filteredOut(entry, config) {
+        return
+    }
+    entries := []LogEntry{entry}
+    streamHub.Broadcast(entries)
+    if err := sendToQuickwitWithRetry(entries, config); err != nil {
+        log.Printf("Error sending pending record to Quickwit: %v", err)
+    }
+}
+
+// replayDeadLetters re-parses the lines in a dead-letter file, sends the ones that
+// now parse and writes the ones that still fail to a new dead-letter file
+func replayDeadLetters(path string, config Config) error {
+    file, err := os.Open(path)
+    if err != nil {
+        return fmt.Errorf("error opening dead-letter file: %v", err)
+    }
+    defer file.Close()
+
+    failedPath := fmt.Sprintf("%s.%s", strings.TrimSuffix(path, ".jsonl"), time.Now().Format("20060102-150405")) + ".jsonl"
+    var failed *DeadLetterWriter
+
+    scanner := bufio.NewScanner(file)
+    scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+    var entries []LogEntry
+    replayed, stillFailing := 0, 0
+
+    for scanner.Scan() {
+        var record DeadLetter
+        if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+            // ไม่ใช่ JSON ถือว่าเป็นบรรทัด log ดิบ
+            record.Line = scanner.Text()
+        }
+
+        entry, parseErr := parseAndValidate(record.Line, config)
+        if parseErr != nil {
+            if failed == nil {
+                if failed, err = newDeadLetterWriter(failedPath); err != nil {
+                    return fmt.Errorf("error opening new dead-letter file: %v", err)
+                }
+                defer failed.Close()
+            }
+            failed.Write(record.Line, parseErr)
+            stillFailing++
+            continue
+        }
+        if filteredOut(entry, config) {
+            continue
+        }
+
+        entries = append(entries, entry)
+        replayed++
+
+        if len(entries) >= config.BatchSize {
+            if err := sendToQuickwitWithRetry(entries, config); err != nil {
+                return fmt.Errorf("error sending replayed batch to Quickwit: %v", err)
+            }
+            entries = []LogEntry{}
+        }
+    }
+
+    if err := scanner.Err(); err != nil {
+        return fmt.Errorf("error scanning dead-letter file: %v", err)
+    }
+
+    if len(entries) > 0 {
+        if err := sendToQuickwitWithRetry(entries, config); err != nil {
+            return fmt.Errorf("error sending final replayed batch to Quickwit: %v", err)
+        }
+    }
+
+    log.Printf("Replay finished. Re-ingested: %d, Still failing: %d", replayed, stillFailing)
+    if stillFailing > 0 {
+        log.Printf("Still-failing lines written to %s", failedPath)
+    }
+    return nil
+}
+
+func showStats(config Config) {
+    ticker := time.NewTicker(time.Minute)
+    defer ticker.Stop()
+
+    for range ticker.C {
+        stats, err := getQuickwitIndexingStats(config)
+        if err != nil {
+            log.Printf("Error getting Quickwit indexing stats: %v", err)
+            continue
+        }
+        log.Printf("Quickwit Indexing Stats for %s:", stats.IndexID)
+        log.Printf("  Valid documents: %d", stats.ValidDocs)
+        log.Printf("  Error documents: %d", stats.ErrorDocs)
+        log.Printf("  Parse errors: %d", stats.ParseErrors)
+        log.Printf("  Clock-skewed entries: %d (%s)", ingestStats.SkewedEntries.Load(), config.SkewAction)
+        log.Printf("  Pre-split batches: %d (maxPayloadBytes %d)", ingestStats.PreSplitBatches.Load(), config.MaxPayloadBytes)
+        log.Printf("  Field coverage: %s", fieldCoverage())
+        if config.MaxDocsPerSecond > 0 {
+            log.Printf("  Ingest rate: %.1f docs/s (maxDocsPerSecond %d)", ingestRate(), config.MaxDocsPerSecond)
+        } else {
+            log.Printf("  Ingest rate: %.1f docs/s", ingestRate())
+        }
+        if config.IncludeMessageTypes != nil {
+            log.Printf("  Filtered entries: %d (includeMessageTypes)", ingestStats.FilteredEntries.Load())
+        }
+        if config.CircuitFailures > 0 {
+            state := "closed"
+            if ingestStats.CircuitOpen.Load() {
+                state = "open"
+            }
+            log.Printf("  Circuit breaker: %s (opened %d times)", state, ingestStats.CircuitOpens.Load())
+        }
+        if !config.StoreFullMessage || config.FullMessageMaxLen != 0 {
+            log.Printf("  full_message bytes saved: %d", ingestStats.FullMessageBytesSaved.Load())
+        }
+    }
+}
+
+// defaultTimestampLayouts are the built-in layouts (ใช้โค้ดเดิมของ v1.5.7), plus RFC 3339 with an
+// offset (rsyslog RSYSLOG_ForwardFormat) and the BSD "Oct 18 01:53:12" (RSYSLOG_TraditionalForwardFormat)
+var defaultTimestampLayouts = []string{
+    "2006-01-02T15:04:05",
+    "2006-01-02 15:04:05",
+    "2006-01-02",
+    time.RFC3339Nano,
+    time.RFC3339,
+    "Jan _2 15:04:05",
+}
+
+// timestampLayouts is the config timestampLayouts followed by the defaults (set in main)
+var timestampLayouts = defaultTimestampLayouts
+
+// timestampLocation is the zone for timestamps without an offset (defaultTimezone, set in main)
+var timestampLocation = time.UTC
+
+// validateLayout checks that a Go time layout round-trips a known time
+func validateLayout(layout string) error {
+    known := time.Date(2024, 10, 18, 1, 53, 12, 0, time.UTC)
+    formatted := known.Format(layout)
+    if formatted == layout {
+        return fmt.Errorf("layout contains no date or time elements")
+    }
+    parsed, err := time.Parse(layout, formatted)
+    if err != nil {
+        return err
+    }
+    if parsed.Year() != known.Year() || parsed.Hour() != known.Hour() {
+        return fmt.Errorf("layout does not keep both the date and the time")
+    }
+    return nil
+}
+
+// parseTimestamp parses the timestamp at the start of fields and returns how many fields it took:
+// a layout with spaces (e.g., "Jan _2 15:04:05") spans as many fields as it has. A timestamp without
+// a year (BSD syslog) is put in the current year, or the previous one if that would be in the future.
+func parseTimestamp(fields []string) (time.Time, int, error) {
+    layouts := timestampLayouts
+
+    var timestamp time.Time
+    err := fmt.Errorf("no timestamp")
+    for _, layout := range layouts {
+        n := len(strings.Fields(layout))
+        if n == 0 || n > len(fields) {
+            continue
+        }
+        timestamp, err = time.ParseInLocation(layout, strings.Join(fields[:n], " "), timestampLocation)
+        if err != nil {
+            continue
+        }
+        if timestamp.Year() == 0 {
+            now := time.Now().In(timestampLocation)
+            timestamp = time.Date(now.Year(), timestamp.Month(), timestamp.Day(), timestamp.Hour(),
+                timestamp.Minute(), timestamp.Second(), timestamp.Nanosecond(), timestampLocation)
+            if timestamp.After(now.Add(24 * time.Hour)) {
+                timestamp = timestamp.AddDate(-1, 0, 0)
+            }
+        }
+        return timestamp, n, nil
+    }
+    return time.Time{}, 0, fmt.Errorf("unable to parse timestamp: %v", err)
+}
+
+
+// Syslog facility and severity names indexed by their numeric codes (RFC 5424)
+var syslogFacilities = []string{
+    "kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+    "uucp", "cron", "authpriv", "ftp", "ntp", "audit", "alert", "clock",
+    "local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+var syslogSeverities = []string{
+    "emerg", "alert", "crit", "err", "warning", "notice", "info", "debug",
+}
+
+// recordScanner returns one logical record per Scan. With multiline enabled, lines
+// that don't start with a timestamp are joined onto the previous record. The last record
+// is completed at the end of the input; a follow scanner keeps it pending across reads
+// instead, since the next chunk may continue it, until a new record starts or Flush.
+type recordScanner struct {
+    scanner      *bufio.Scanner
+    multiline    bool
+    follow       bool
+    record       string
+    pending      string
+    hasPending   bool
+    pendingStart int64     // file offset of the pending record's first line
+    pendingAt    time.Time // when a line last started or continued the pending record
+    offset       int64     // file offset after the last line read
+    lineStart    int64     // file offset of the last line read
+    lines        int
+}
+
+// newRecordScanner returns a scanner for complete input, or with follow for a followed file;
+// Reset it to each chunk read
+func newRecordScanner(multiline, follow bool) *recordScanner {
+    return &recordScanner{multiline: multiline, follow: follow}
+}
+
+// Reset continues scanning from r, which starts at file offset offset; a pending record is kept
+func (s *recordScanner) Reset(r io.Reader, offset int64) {
+    s.offset = offset
+    s.scanner = bufio.NewScanner(r)
+    s.scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+        advance, token, err := bufio.ScanLines(data, atEOF)
+        if token != nil {
+            s.lineStart = s.offset
+        }
+        s.offset += int64(advance)
+        return advance, token, err
+    })
 }
 
-func readNewEntries(file *os.File, lastPosition *int64) ([]LogEntry, error) {
-    _, err := file.Seek(*lastPosition, io.SeekStart)
-    if err != nil {
-        return nil, fmt.Errorf("error seeking file: %v", err)
+func (s *recordScanner) Scan() bool {
+    if !s.multiline {
+        if !s.scanner.Scan() {
+            return false
+        }
+        s.lines++
+        s.record = s.scanner.Text()
+        return true
     }
 
-    scanner := bufio.NewScanner(file)
-    var newEntries []LogEntry
-
-    for scanner.Scan() {
-        line := scanner.Text()
-        entry, err := parseLine(line)
-        if err != nil {
-            log.Printf("Error parsing line: %v\nLine content: %s", err, line)
+    for s.scanner.Scan() {
+        s.lines++
+        line := s.scanner.Text()
+        if s.hasPending && !startsWithTimestamp(line) {
+            if continuation := strings.TrimSpace(line); continuation != "" {
+                s.pending += " " + continuation
+            }
+            s.pendingAt = time.Now()
             continue
         }
-        newEntries = append(newEntries, entry)
+        if s.hasPending {
+            s.record = s.pending
+            s.setPending(line)
+            return true
+        }
+        s.setPending(line)
     }
 
-    if err := scanner.Err(); err != nil {
-        return nil, fmt.Errorf("error scanning file: %v", err)
+    if !s.follow {
+        return s.Flush(0)
     }
+    return false
+}
 
-    *lastPosition, _ = file.Seek(0, io.SeekCurrent)
-    return newEntries, nil
+func (s *recordScanner) setPending(line string) {
+    s.pending, s.hasPending = line, true
+    s.pendingStart, s.pendingAt = s.lineStart, time.Now()
 }
 
-func showStats(config Config) {
-    ticker := time.NewTicker(time.Minute)
-    defer ticker.Stop()
+// Flush completes the pending record if no line has continued it for idle (0 = at once, at the
+// end of the input); Text then returns it
+func (s *recordScanner) Flush(idle time.Duration) bool {
+    if !s.hasPending || time.Since(s.pendingAt) < idle {
+        return false
+    }
+    s.record, s.pending, s.hasPending = s.pending, "", false
+    return true
+}
 
-    for range ticker.C {
-        stats, err := getQuickwitIndexingStats(config)
-        if err != nil {
-            log.Printf("Error getting Quickwit indexing stats: %v", err)
-            continue
-        }
-        log.Printf("Quickwit Indexing Stats for nro-logs:")
-        log.Printf("  Valid documents: %d", stats.ValidDocs)
-        log.Printf("  Error documents: %d", stats.ErrorDocs)
-        log.Printf("  Parse errors: %d", stats.ParseErrors)
+// PendingStart returns the file offset where the pending record starts
+func (s *recordScanner) PendingStart() int64 {
+    return s.pendingStart
+}
+
+// Text returns the current record
+func (s *recordScanner) Text() string {
+    return s.record
+}
+
+// Lines returns the number of physical lines read so far
+func (s *recordScanner) Lines() int {
+    return s.lines
+}
+
+func (s *recordScanner) Err() error {
+    return s.scanner.Err()
+}
+
+// startsWithTimestamp reports whether a line begins a new record (optional PRI, then a timestamp)
+func startsWithTimestamp(line string) bool {
+    if line == "" || line[0] == ' ' || line[0] == '\t' {
+        return false
     }
+    rest, _, _ := stripPRI(line)
+    _, _, err := parseTimestamp(strings.Fields(rest))
+    return err == nil
 }
 
-func parseTimestamp(timestampStr string) (time.Time, error) {
-    layouts := []string{
-        "2006-01-02T15:04:05",
-        "2006-01-02 15:04:05",
-        "2006-01-02",
+// stripPRI removes a leading "<NNN>" PRI and an optional RFC 5424 version digit,
+// returning the rest of the line and the PRI value
+func stripPRI(line string) (string, int, bool) {
+    if !strings.HasPrefix(line, "<") {
+        return line, 0, false
+    }
+    end := strings.Index(line, ">")
+    if end < 2 || end > 4 {
+        return line, 0, false
+    }
+    pri, err := strconv.Atoi(line[1:end])
+    if err != nil || pri < 0 || pri > 191 {
+        return line, 0, false
     }
 
-    var timestamp time.Time
-    var err error
-    for _, layout := range layouts {
-        timestamp, err = time.Parse(layout, timestampStr)
-        if err == nil {
-            return timestamp, nil
-        }
+    rest := line[end+1:]
+    if len(rest) > 1 && rest[0] >= '1' && rest[0] <= '9' && rest[1] == ' ' {
+        rest = rest[2:]
     }
-    return time.Time{}, fmt.Errorf("unable to parse timestamp: %v", err)
+    return rest, pri, true
 }
 
-
 func parseLine(line string) (LogEntry, error) {
     entry := LogEntry{
         FullMessage: line,
     }
 
-    parts := strings.Fields(line)
+    // Strip an optional syslog PRI prefix (e.g., "<134>1 " or "<134>")
+    rest, pri, hasPRI := stripPRI(line)
+    if hasPRI {
+        entry.Facility = syslogFacilities[pri/8]
+        entry.Severity = syslogSeverities[pri%8]
+    }
+
+    parts := strings.Fields(rest)
     if len(parts) < 4 {
         return entry, fmt.Errorf("invalid log format: not enough parts")
     }
 
-    // Parse timestamp (ใช้โค้ดเดิมของ v1.5.7)
-    timestamp, err := parseTimestamp(parts[0])
+    // Parse timestamp (ใช้โค้ดเดิมของ v1.5.7); BSD timestamp กินหลาย field จึงเลื่อน parts ให้ parts[0] เป็น field สุดท้ายของเวลา
+    timestamp, n, err := parseTimestamp(parts)
     if err != nil {
         return entry, fmt.Errorf("invalid timestamp: %v", err)
     }
+    parts = parts[n-1:]
+    if len(parts) < 4 {
+        return entry, fmt.Errorf("invalid log format: not enough parts")
+    }
     entry.Timestamp = timestamp.Format(time.RFC3339)
 
     entry.Hostname = parts[1]
     processWithPID := parts[2]
 
-    // Extract process and PID
+    // Extract process and PID ("radiusd[123]:" หรือ "radiusd:" ได้ process เป็น "radiusd")
     pidStart := strings.Index(processWithPID, "[")
     pidEnd := strings.Index(processWithPID, "]")
     if pidStart != -1 && pidEnd != -1 && pidEnd > pidStart {
-        entry.Process = processWithPID[:pidStart]
+        entry.Process = trimProcessName(processWithPID[:pidStart])
         pidStr := processWithPID[pidStart+1 : pidEnd]
         pid, err := strconv.ParseInt(pidStr, 10, 64)
         if err == nil {
             entry.PID = pid
         }
     } else {
-        entry.Process = processWithPID
+        entry.Process = trimProcessName(processWithPID)
     }
 
     // Parse the rest of the message
@@ -311,11 +1527,73 @@ func parseLine(line string) (LogEntry, error) {
         messageContent := strings.Join(parts[3:], " ")
         entry.MessageType = extractMessageType(messageContent)
         parseAdditionalFields(&entry, messageContent)
+        if entry.MessageType == "Accounting-Request" {
+            parseAccountingFields(&entry, messageContent)
+        }
     }
 
+    recordCoverage(entry)
+    return entry, nil
+}
+
+// trimProcessName removes the syslog tag's trailing colon and whitespace
+func trimProcessName(process string) string {
+    return strings.TrimRight(process, ": \t")
+}
+
+// parseAndValidate parses a line and validates the resulting entry
+func parseAndValidate(line string, config Config) (LogEntry, error) {
+    entry, err := parseLine(line)
+    if err != nil {
+        return entry, err
+    }
+    if err := validateEntry(&entry, config); err != nil {
+        return entry, err
+    }
     return entry, nil
 }
 
+// filteredOut reports whether entry's message_type is not in includeMessageTypes
+// (counted in FilteredEntries); every entry is kept when includeMessageTypes is unset
+func filteredOut(entry LogEntry, config Config) bool {
+    if config.IncludeMessageTypes == nil || config.IncludeMessageTypes[entry.MessageType] {
+        return false
+    }
+    ingestStats.FilteredEntries.Add(1)
+    return true
+}
+
+// validateEntry checks the entry timestamp against maxFutureSkew/maxPastAge and, depending
+// on skewAction, only logs it, rejects the entry or clamps the timestamp to now
+func validateEntry(entry *LogEntry, config Config) error {
+    timestamp, err := time.Parse(time.RFC3339, entry.Timestamp)
+    if err != nil {
+        return fmt.Errorf("invalid timestamp: %v", err)
+    }
+
+    now := time.Now()
+    var skewErr error
+    if config.MaxFutureSkew > 0 && timestamp.After(now.Add(config.MaxFutureSkew)) {
+        skewErr = fmt.Errorf("timestamp %s is more than %v in the future", entry.Timestamp, config.MaxFutureSkew)
+    } else if config.MaxPastAge > 0 && timestamp.Before(now.Add(-config.MaxPastAge)) {
+        skewErr = fmt.Errorf("timestamp %s is more than %v in the past", entry.Timestamp, config.MaxPastAge)
+    }
+    if skewErr == nil {
+        return nil
+    }
+
+    ingestStats.SkewedEntries.Add(1)
+    switch config.SkewAction {
+    case "clamp":
+        entry.Timestamp = now.Format(time.RFC3339)
+        return nil
+    case "drop":
+        return skewErr
+    }
+    log.Printf("WARNING: %v (sent unchanged, skewAction=log)", skewErr)
+    return nil
+}
+
 // เพิ่มฟังก์ชันใหม่เพื่อแยก message_type
 func extractMessageType(message string) string {
     if strings.Contains(message, "Access-Accept") {
@@ -332,6 +1610,30 @@ func extractMessageType(message string) string {
     return "Unknown"
 }
 
+// tlsErrorPattern matches the TLS/EAP-TLS failure phrases radiusd logs
+var tlsErrorPattern = regexp.MustCompile(`(?i)TLS Alert|TLS_accept|TLS_connect|SSL_read|SSL_write|certificate (?:has )?expired|certificate revoked|certificate verify failed|unknown ca|handshake failure`)
+
+// extractTLSError returns the TLS error text of a message (from "ERROR: " or the matched phrase,
+// without the trailing route) and whether the message is a TLS failure
+func extractTLSError(message string) (string, bool) {
+    loc := tlsErrorPattern.FindStringIndex(message)
+    if loc == nil {
+        return "", false
+    }
+    start := loc[0]
+    if i := strings.LastIndex(message[:start], "ERROR: "); i != -1 {
+        start = i + len("ERROR: ")
+    }
+    errorMessage := message[start:]
+    if route := routePattern.FindStringIndex(errorMessage); route != nil {
+        errorMessage = errorMessage[:route[0]]
+    }
+    return strings.TrimSpace(errorMessage), true
+}
+
+// routePattern matches the "from <realm> to <provider> (<ip>)" part of a RADIUS log line
+var routePattern = regexp.MustCompile(`(?:^| )from (\S+) to ([^\s(]+)(?: \(([^)]*)\))?`)
+
 // เพิ่มฟังก์ชันใหม่เพื่อแยกข้อมูลเพิ่มเติม
 func parseAdditionalFields(entry *LogEntry, message string) {
     // แยก message_type (ถ้ายังไม่ได้กำหนดค่า)
@@ -339,6 +1641,12 @@ func parseAdditionalFields(entry *LogEntry, message string) {
         entry.MessageType = extractMessageType(message)
     }
 
+    // แยก TLS error (handshake / certificate) สำหรับวิเคราะห์ปัญหา EAP-TLS
+    if errorMessage, ok := extractTLSError(message); ok {
+        entry.TLSError = true
+        entry.ErrorMessage = errorMessage
+    }
+
     // แยก username
     if userIndex := strings.Index(message, "user "); userIndex != -1 {
         endIndex := strings.IndexAny(message[userIndex+5:], " \n")
@@ -359,24 +1667,35 @@ func parseAdditionalFields(entry *LogEntry, message string) {
         }
     }
 
-    // แยก realm (from)
-    if fromIndex := strings.Index(message, " from "); fromIndex != -1 {
-        endIndex := strings.IndexAny(message[fromIndex+6:], " \n")
-        if endIndex != -1 {
-            entry.Realm = message[fromIndex+6 : fromIndex+6+endIndex]
-        } else {
-            entry.Realm = message[fromIndex+6:]
-        }
+    // แยก ssid จาก Called-Station-Id ("AA-BB-CC-11-22-33:eduroam")
+    if calledStationID := attributeValue(message, "Called-Station-Id"); calledStationID != "" {
+        entry.SSID = extractSSID(calledStationID)
     }
 
-    // แยก service_provider (to)
-    if toIndex := strings.LastIndex(message, " to "); toIndex != -1 {
-        endIndex := strings.IndexAny(message[toIndex+4:], " (\n")
-        if endIndex != -1 {
-            entry.ServiceProvider = message[toIndex+4 : toIndex+4+endIndex]
-        } else {
-            entry.ServiceProvider = message[toIndex+4:]
+    // แยก NAS-IP-Address / NAS-Port ระบุ access point ที่ผู้ใช้เชื่อมต่อ
+    if nasIP := attributeValue(message, "NAS-IP-Address"); nasIP != "" && net.ParseIP(nasIP) != nil {
+        entry.NASIP = nasIP
+    }
+    if match := nasPortPattern.FindStringSubmatch(message); match != nil {
+        entry.NASPort, _ = strconv.ParseInt(match[1], 10, 64)
+    }
+
+    // แยก Connect-Info ("CONNECT 54Mbps 802.11g") และ link rate สำหรับเทียบกับความถี่ในการ reauth
+    if connectInfo := extractConnectInfo(message); connectInfo != "" {
+        entry.ConnectInfo = connectInfo
+        entry.LinkRateMbps = parseLinkRate(connectInfo)
+    }
+
+    // แยก realm (from) และ service_provider (to) เฉพาะเมื่อตรงรูปแบบ "from <realm> to <provider> (<ip>)"
+    // เพื่อไม่ให้ข้อความอย่าง "failed to contact home server" ถูกตีความเป็น provider
+    if matches := routePattern.FindAllStringSubmatch(message, -1); matches != nil {
+        match := matches[len(matches)-1]
+        entry.Realm = match[1]
+        entry.ServiceProvider = match[2]
+        if match[3] != "" {
+            entry.DestinationIP = strings.TrimSpace(match[3])
         }
+        return
     }
 
     // แยก destination_ip
@@ -388,6 +1707,126 @@ func parseAdditionalFields(entry *LogEntry, message string) {
     }
 }
 
+// attributeValue returns the value of a RADIUS attribute written as "Name = value",
+// "Name=value" or "Name value" (quotes removed), or "" if absent
+func attributeValue(message, name string) string {
+    index := strings.Index(message, name)
+    if index == -1 {
+        return ""
+    }
+    rest := strings.TrimLeft(message[index+len(name):], " ")
+    rest = strings.TrimLeft(strings.TrimPrefix(rest, "="), " ")
+    if end := strings.IndexAny(rest, " ,;\n"); end != -1 {
+        rest = rest[:end]
+    }
+    return strings.Trim(rest, "\"")
+}
+
+// nasPortPattern matches a numeric NAS-Port attribute (not NAS-Port-Type or NAS-Port-Id)
+var nasPortPattern = regexp.MustCompile(`\bNAS-Port(?:\s*=\s*|\s+)"?(\d+)`)
+
+// connectInfoPattern matches a Connect-Info attribute, quoted ("CONNECT 54Mbps 802.11g") or a single word
+var connectInfoPattern = regexp.MustCompile(`(?i)connect-info\s*=?\s*(?:"([^"]*)"|([^\s,;]+))`)
+
+// extractConnectInfo returns the Connect-Info value of a message, or "" if absent
+func extractConnectInfo(message string) string {
+    match := connectInfoPattern.FindStringSubmatch(message)
+    if match == nil {
+        return ""
+    }
+    if match[1] != "" {
+        return strings.TrimSpace(match[1])
+    }
+    return match[2]
+}
+
+// linkRatePattern matches a link rate such as "54Mbps", "866.7 Mb/s" or "1Gbps"
+var linkRatePattern = regexp.MustCompile(`(?i)(\d+(?:\.\d+)?)\s*([kmg])(?:bps|bit/s|b/s)`)
+
+// parseLinkRate returns the link rate in Connect-Info converted to Mbps, or 0 when none is given
+func parseLinkRate(connectInfo string) float64 {
+    match := linkRatePattern.FindStringSubmatch(connectInfo)
+    if match == nil {
+        return 0
+    }
+    rate, err := strconv.ParseFloat(match[1], 64)
+    if err != nil {
+        return 0
+    }
+    switch strings.ToLower(match[2]) {
+    case "k":
+        rate /= 1000
+    case "g":
+        rate *= 1000
+    }
+    return rate
+}
+
+// extractSSID returns the SSID suffix of a Called-Station-Id such as
+// "AA-BB-CC-11-22-33:eduroam", or "" when the value is only a MAC address
+func extractSSID(calledStationID string) string {
+    index := strings.LastIndex(calledStationID, ":")
+    if index == -1 {
+        return ""
+    }
+    hexDigits := 0
+    for _, r := range calledStationID[:index] {
+        switch {
+        case r >= '0' && r <= '9', r >= 'a' && r <= 'f', r >= 'A' && r <= 'F':
+            hexDigits++
+        case r == '-' || r == ':' || r == '.':
+        default:
+            return ""
+        }
+    }
+    if hexDigits != 12 {
+        return ""
+    }
+    return calledStationID[index+1:]
+}
+
+// parseAccountingFields แยก RADIUS accounting attributes ("Acct-Input-Octets=123" หรือ "Acct-Input-Octets 123")
+// Gigawords จะถูกรวมเข้ากับ octets (1 gigaword = 2^32 octets)
+func parseAccountingFields(entry *LogEntry, message string) {
+    var inputGigawords, outputGigawords int64
+    parts := strings.Fields(message)
+    for i := 0; i < len(parts); i++ {
+        name, value, found := strings.Cut(parts[i], "=")
+        if !found || value == "" {
+            // รูปแบบ "Attr value" หรือ "Attr = value"
+            next := i + 1
+            if next < len(parts) && parts[next] == "=" {
+                next++
+            }
+            if !strings.HasPrefix(name, "Acct-") || next >= len(parts) {
+                continue
+            }
+            value = parts[next]
+            i = next
+        }
+        value = strings.Trim(value, "\",;")
+
+        switch name {
+        case "Acct-Status-Type":
+            entry.AcctStatusType = value
+        case "Acct-Session-Id":
+            entry.AcctSessionID = value
+        case "Acct-Session-Time":
+            entry.AcctSessionTime, _ = strconv.ParseInt(value, 10, 64)
+        case "Acct-Input-Octets":
+            entry.AcctInputOctets, _ = strconv.ParseInt(value, 10, 64)
+        case "Acct-Output-Octets":
+            entry.AcctOutputOctets, _ = strconv.ParseInt(value, 10, 64)
+        case "Acct-Input-Gigawords":
+            inputGigawords, _ = strconv.ParseInt(value, 10, 64)
+        case "Acct-Output-Gigawords":
+            outputGigawords, _ = strconv.ParseInt(value, 10, 64)
+        }
+    }
+    entry.AcctInputOctets += inputGigawords << 32
+    entry.AcctOutputOctets += outputGigawords << 32
+}
+
 func parseAccessMessage(entry *LogEntry, message string) {
     parts := strings.Fields(message)
     for i, part := range parts {
@@ -420,81 +1859,418 @@ func parseMessage(entry *LogEntry, message string) {
     // ... (existing parseMessage function remains unchanged)
 }
 
+// consecutiveFailures counts batches in a row that failed after maxRetries
+// (batches are sent from one goroutine at a time)
+var consecutiveFailures int
+
+// sendToQuickwitWithRetry sends a batch through the circuit breaker: while the circuit is
+// open the batch waits and probes Quickwit every circuitCooldown; after circuitFailures
+// batches in a row fail, the circuit opens with a single warning
 func sendToQuickwitWithRetry(entries []LogEntry, config Config) error {
+    if config.CircuitFailures > 0 && ingestStats.CircuitOpen.Load() {
+        var sent bool
+        if entries, sent = probeQuickwit(entries, config); sent {
+            return nil
+        }
+    }
+
+    err := sendBatchWithRetry(entries, config)
+    if config.CircuitFailures <= 0 {
+        return err
+    }
+    if err == nil {
+        consecutiveFailures = 0
+        return nil
+    }
+
+    consecutiveFailures++
+    if consecutiveFailures >= config.CircuitFailures && !ingestStats.CircuitOpen.Load() {
+        ingestStats.CircuitOpen.Store(true)
+        ingestStats.CircuitOpens.Add(1)
+        log.Printf("WARNING: %d batches in a row failed; circuit open, pausing ingestion and probing Quickwit every %v",
+            consecutiveFailures, config.CircuitCooldown)
+    }
+    return err
+}
+
+// probeQuickwit waits circuitCooldown and sends entries as a single attempt until Quickwit
+// answers. Returns true when the batch went through (circuit closed); false when Quickwit
+// answered but rejected the batch (size, auth or mapping), or the run was stopped (-max-runtime, SIGINT/SIGTERM), so the normal retry path should handle it.
+// The entries returned are the ones not yet accepted, so sub-batches that went through are not sent again.
+func probeQuickwit(entries []LogEntry, config Config) ([]LogEntry, bool) {
+    for {
+        time.Sleep(config.CircuitCooldown)
+        if runStopped() {
+            // -max-runtime หรือ SIGINT/SIGTERM: เลิก probe แล้วให้ retry ปกติตัดสินผลของ batch นี้
+            return entries, false
+        }
+        sent, err := sendToQuickwit(entries, config)
+        entries = entries[sent:]
+        if errors.Is(err, ErrServerUnavailable) {
+            continue
+        }
+
+        ingestStats.CircuitOpen.Store(false)
+        consecutiveFailures = 0
+        log.Printf("Quickwit is reachable again; circuit closed, resuming ingestion")
+        if err != nil {
+            return entries, false
+        }
+        ingestStats.BatchesSent.Add(1)
+        return entries, true
+    }
+}
+
+// sendBatchWithRetry sends a batch with up to maxRetries attempts, halving it on 413
+// (ErrPayloadTooLarge); ErrQuickwitAuth and ErrQuickwitQuery fail at once since a retry
+// would get the same answer. Only the entries Quickwit has not accepted yet are retried.
+func sendBatchWithRetry(entries []LogEntry, config Config) error {
     batchSize := len(entries)
     for i := 0; i < config.MaxRetries; i++ {
-        err := sendToQuickwit(entries[:batchSize], config)
+        sent, err := sendToQuickwit(entries[:batchSize], config)
         if err == nil {
+            ingestStats.BatchesSent.Add(1)
+            // หลังลด batch size ต้องส่งส่วนที่เหลือด้วย ไม่เช่นนั้น entries จะหาย
+            if batchSize < len(entries) {
+                return sendBatchWithRetry(entries[batchSize:], config)
+            }
             return nil
         }
         
         log.Printf("Attempt %d failed: %v", i+1, err)
+        // sub-batch ที่ pre-split ส่งผ่านไปแล้วถูก index แล้ว ส่งซ้ำจะได้เอกสารซ้ำ
+        entries = entries[sent:]
+        batchSize -= sent
         
-        if strings.Contains(err.Error(), "413") || strings.Contains(err.Error(), "Payload Too Large") {
+        if errors.Is(err, ErrQuickwitAuth) || errors.Is(err, ErrQuickwitQuery) {
+            ingestStats.BatchesFailed.Add(1)
+            ingestStats.EntriesDropped.Add(int64(len(entries)))
+            return fmt.Errorf("not retrying: %w", err)
+        }
+        if errors.Is(err, ErrPayloadTooLarge) {
             batchSize = batchSize / 2
             if batchSize < 1 {
-                return fmt.Errorf("batch size reduced to zero: %v", err)
+                ingestStats.BatchesFailed.Add(1)
+                ingestStats.EntriesDropped.Add(int64(len(entries)))
+                return fmt.Errorf("batch size reduced to zero: %w", err)
             }
             log.Printf("Reducing batch size to %d and retrying", batchSize)
         } else {
             time.Sleep(time.Second * time.Duration(1<<uint(i))) // Exponential backoff
         }
     }
+    ingestStats.BatchesFailed.Add(1)
+    ingestStats.EntriesDropped.Add(int64(len(entries)))
     return fmt.Errorf("failed after %d attempts", config.MaxRetries)
 }
 
-func sendToQuickwit(entries []LogEntry, config Config) error {
+// Errors returned by the Quickwit requests; callers branch on them with errors.Is
+// instead of matching status codes in the message text
+var (
+    ErrQuickwitAuth      = errors.New("quickwit authentication failed")
+    ErrQuickwitQuery     = errors.New("quickwit rejected the request")
+    ErrPayloadTooLarge   = errors.New("quickwit payload too large")
+    ErrServerUnavailable = errors.New("quickwit unavailable")
+)
+
+// statusError wraps a non-200 Quickwit answer in the matching sentinel error:
+// 401/403 auth, 413 payload too large, 429/5xx unavailable, other 4xx query
+func statusError(status int, body []byte) error {
+    var kind error
+    switch {
+    case status == http.StatusUnauthorized || status == http.StatusForbidden:
+        kind = ErrQuickwitAuth
+    case status == http.StatusRequestEntityTooLarge:
+        kind = ErrPayloadTooLarge
+    case status == http.StatusTooManyRequests || status >= 500:
+        kind = ErrServerUnavailable
+    case status >= 400:
+        kind = ErrQuickwitQuery
+    default:
+        return fmt.Errorf("error response: Status %d, Body: %s", status, string(body))
+    }
+    return fmt.Errorf("%w: Status %d, Body: %s", kind, status, string(body))
+}
+
+// docID returns the correlation key of an entry: the hex SHA-256 of its timestamp, hostname,
+// pid and raw log line, so the same line always maps to the same ID across runs
+func docID(entry LogEntry) string {
+    hash := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%d\x00%s", entry.Timestamp, entry.Hostname, entry.PID, entry.FullMessage)))
+    return hex.EncodeToString(hash[:])
+}
+
+// truncateMessage cuts message to at most maxLen bytes, ending in "..." and without splitting
+// a UTF-8 character, for the fullMessageMaxLen preview
+func truncateMessage(message string, maxLen int) string {
+    const ellipsis = "..."
+    if maxLen <= len(ellipsis) {
+        return ellipsis[:maxLen]
+    }
+    cut := maxLen - len(ellipsis)
+    for cut > 0 && !utf8.RuneStart(message[cut]) {
+        cut--
+    }
+    return message[:cut] + ellipsis
+}
+
+// sendToQuickwit marshals entries into NDJSON and posts them, pre-split into requests of at
+// most maxPayloadBytes. Returns how many entries from the front of entries Quickwit accepted,
+// so on error the caller retries only entries[sent:]
+func sendToQuickwit(entries []LogEntry, config Config) (int, error) {
     var buffer bytes.Buffer
-    for _, entry := range entries {
+    var bytesSaved int64
+    count := 0
+    payloads := 0
+    sent := 0
+    for i, entry := range entries {
+        // doc_id คำนวณจากบรรทัดดิบก่อนตัด full_message ออก ให้ค่าเดิมเสมอเมื่อ ingest ซ้ำ
+        if config.DocIDs {
+            entry.DocID = docID(entry)
+        }
+        if !config.StoreFullMessage || config.FullMessageMaxLen < 0 {
+            bytesSaved += int64(len(entry.FullMessage))
+            entry.FullMessage = ""
+        } else if config.FullMessageMaxLen > 0 && len(entry.FullMessage) > config.FullMessageMaxLen {
+            preview := truncateMessage(entry.FullMessage, config.FullMessageMaxLen)
+            bytesSaved += int64(len(entry.FullMessage) - len(preview))
+            entry.FullMessage = preview
+        }
+        entry.IngestRunID = ingestRunID
+        entry.IngestHost = ingestHost
         jsonData, err := json.Marshal(entry)
         if err != nil {
             log.Printf("Error marshaling entry: %v", err)
             continue
         }
+
+        // Pre-split: send what we have before this entry pushes the body over maxPayloadBytes
+        if config.MaxPayloadBytes > 0 && count > 0 && buffer.Len()+len(jsonData)+1 > config.MaxPayloadBytes {
+            if err := postToQuickwit(&buffer, count, config); err != nil {
+                return sent, err
+            }
+            buffer.Reset()
+            count = 0
+            payloads++
+            sent = i
+        }
+
         buffer.Write(jsonData)
         buffer.WriteString("\n")
+        count++
+    }
+
+    if payloads > 0 {
+        ingestStats.PreSplitBatches.Add(1)
+        log.Printf("Batch of %d entries exceeded maxPayloadBytes (%d), split into %d requests", len(entries), config.MaxPayloadBytes, payloads+1)
+    }
+    if err := postToQuickwit(&buffer, count, config); err != nil {
+        return sent, err
+    }
+
+    ingestStats.FullMessageBytesSaved.Add(bytesSaved)
+    return len(entries), nil
+}
+
+// postToQuickwit sends one NDJSON body of count entries to the ingest endpoint
+// gzipRejected is set once Quickwit answers a compressed request with 415; later requests
+// are sent uncompressed
+var gzipRejected atomic.Bool
+
+func postToQuickwit(buffer *bytes.Buffer, count int, config Config) error {
+    docLimiter.Wait(count)
+    payload := buffer.Bytes()
+    compress := config.CompressRequests && !gzipRejected.Load()
+    status, body, err := postPayload(payload, compress, config)
+    if err != nil {
+        return err
+    }
+    if compress && status == http.StatusUnsupportedMediaType {
+        gzipRejected.Store(true)
+        log.Printf("Quickwit rejected a gzip request body (415); sending uncompressed from now on")
+        status, body, err = postPayload(payload, false, config)
+        if err != nil {
+            return err
+        }
+    }
+    if status != http.StatusOK {
+        return statusError(status, body)
+    }
+
+    ingestStats.DocsSent.Add(int64(count))
+    log.Printf("Successfully sent %d entries. Response: %s", count, string(body))
+    return nil
+}
+
+// postPayload POSTs one NDJSON payload, gzip-encoded when compress is set, and returns
+// the response status and body
+func postPayload(payload []byte, compress bool, config Config) (int, []byte, error) {
+    var reqBody io.Reader = bytes.NewReader(payload)
+    if compress {
+        var compressed bytes.Buffer
+        writer := gzip.NewWriter(&compressed)
+        if _, err := writer.Write(payload); err != nil {
+            return 0, nil, fmt.Errorf("error compressing request: %v", err)
+        }
+        if err := writer.Close(); err != nil {
+            return 0, nil, fmt.Errorf("error compressing request: %v", err)
+        }
+        reqBody = &compressed
     }
 
-    req, err := http.NewRequest("POST", config.QuickwitURL, &buffer)
+    req, err := http.NewRequest("POST", config.QuickwitURL, reqBody)
     if err != nil {
-        return fmt.Errorf("error creating request: %v", err)
+        return 0, nil, fmt.Errorf("error creating request: %v", err)
     }
 
     req.SetBasicAuth(config.Username, config.Password)
     req.Header.Set("Content-Type", "application/json")
+    if compress {
+        req.Header.Set("Content-Encoding", "gzip")
+    }
+    setTraceHeaders(req)
 
-    client := &http.Client{Timeout: 30 * time.Second}
+    client := newQuickwitClient(30 * time.Second)
     resp, err := client.Do(req)
     if err != nil {
-        return fmt.Errorf("error sending request: %v", err)
+        return 0, nil, fmt.Errorf("%w: error sending request: %v", ErrServerUnavailable, err)
     }
     defer resp.Body.Close()
 
     body, _ := io.ReadAll(resp.Body)
+    return resp.StatusCode, body, nil
+}
+
+// quickwitTransport carries the clientCertPath certificate and proxyURL/noProxy (nil = http.DefaultTransport)
+var quickwitTransport *http.Transport
+
+// proxyFunc returns the transport Proxy for proxyURL/noProxy: requests go through proxyURL
+// ("" = HTTP_PROXY/HTTPS_PROXY/NO_PROXY from the environment) unless the host matches an entry of
+// the comma list noProxy ("*", a host, or a domain with or without a leading dot)
+func proxyFunc(proxyURL, noProxy string) (func(*http.Request) (*url.URL, error), error) {
+    var proxy *url.URL
+    if proxyURL != "" {
+        u, err := url.Parse(proxyURL)
+        if err != nil || u.Host == "" {
+            return nil, fmt.Errorf("invalid proxy URL %q", proxyURL)
+        }
+        proxy = u
+    }
+    var bypass []string
+    for _, host := range strings.Split(noProxy, ",") {
+        if host = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(host), ".")); host != "" {
+            bypass = append(bypass, host)
+        }
+    }
+
+    return func(req *http.Request) (*url.URL, error) {
+        host := strings.ToLower(req.URL.Hostname())
+        for _, domain := range bypass {
+            if domain == "*" || host == domain || strings.HasSuffix(host, "."+domain) {
+                return nil, nil
+            }
+        }
+        if proxy != nil {
+            return proxy, nil
+        }
+        return http.ProxyFromEnvironment(req)
+    }, nil
+}
+
+// newQuickwitClient returns a client for Quickwit requests, using quickwitTransport when set
+func newQuickwitClient(timeout time.Duration) *http.Client {
+    client := &http.Client{Timeout: timeout}
+    if quickwitTransport != nil {
+        client.Transport = quickwitTransport
+    }
+    return client
+}
+
+// quickwitBase splits the ingest URL (e.g., http://host:7280/api/v1/nro-logs/ingest?commit=auto)
+// into the server base URL, which is everything before /api/v1/, and the index ID that follows it
+func quickwitBase(ingestURL string) (string, string, error) {
+    u, err := url.Parse(ingestURL)
+    if err != nil || u.Scheme == "" || u.Host == "" {
+        return "", "", fmt.Errorf("invalid quickwitURL %q", ingestURL)
+    }
+    prefix, rest, found := strings.Cut(u.Path, "/api/v1/")
+    indexID, _, _ := strings.Cut(rest, "/")
+    if !found || indexID == "" {
+        return "", "", fmt.Errorf("quickwitURL %q is not an /api/v1/<index>/ingest URL", ingestURL)
+    }
+    base := url.URL{Scheme: u.Scheme, User: u.User, Host: u.Host, Path: strings.TrimSuffix(prefix, "/")}
+    return base.String(), indexID, nil
+}
+
+// checkQuickwit verifies that Quickwit is alive and the index of quickwitURL exists,
+// and returns that index ID
+func checkQuickwit(config Config) (string, error) {
+    client := newQuickwitClient(10 * time.Second)
+    baseURL, indexID, err := quickwitBase(config.QuickwitURL)
+    if err != nil {
+        return "", err
+    }
+
+    // livez อยู่หลัง proxy เดียวกับ API ซึ่งอาจบังคับ basic auth ด้วย
+    req, err := http.NewRequest("GET", baseURL+"/health/livez", nil)
+    if err != nil {
+        return "", fmt.Errorf("error creating request: %v", err)
+    }
+    req.SetBasicAuth(config.Username, config.Password)
+    setTraceHeaders(req)
+
+    resp, err := client.Do(req)
+    if err != nil {
+        return "", fmt.Errorf("%w: error connecting to %s: %v", ErrServerUnavailable, baseURL, err)
+    }
+    resp.Body.Close()
     if resp.StatusCode != http.StatusOK {
-        return fmt.Errorf("error response: Status %d, Body: %s", resp.StatusCode, string(body))
+        return "", fmt.Errorf("%w: health check failed (status %d)", ErrServerUnavailable, resp.StatusCode)
     }
 
-    log.Printf("Successfully sent %d entries. Response: %s", len(entries), string(body))
-    return nil
+    req, err = http.NewRequest("GET", baseURL+"/api/v1/indexes/"+url.PathEscape(indexID), nil)
+    if err != nil {
+        return "", fmt.Errorf("error creating request: %v", err)
+    }
+    req.SetBasicAuth(config.Username, config.Password)
+    setTraceHeaders(req)
+
+    resp, err = client.Do(req)
+    if err != nil {
+        return "", fmt.Errorf("%w: error sending request: %v", ErrServerUnavailable, err)
+    }
+    defer resp.Body.Close()
+
+    switch resp.StatusCode {
+    case http.StatusOK:
+        return indexID, nil
+    case http.StatusUnauthorized, http.StatusForbidden:
+        return "", fmt.Errorf("%w (status %d): check username/password", ErrQuickwitAuth, resp.StatusCode)
+    case http.StatusNotFound:
+        return "", fmt.Errorf("%w: index %s not found", ErrQuickwitQuery, indexID)
+    default:
+        body, _ := io.ReadAll(resp.Body)
+        return "", fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(body))
+    }
 }
 
 func getQuickwitIndexingStats(config Config) (QuickwitStats, error) {
     var stats QuickwitStats
-    client := &http.Client{Timeout: 10 * time.Second}
+    client := newQuickwitClient(10 * time.Second)
     
     // Construct the metrics URL
-    metricsURL := strings.TrimSuffix(config.QuickwitURL, "/api/v1/nro-logs/ingest")
-    if !strings.HasSuffix(metricsURL, "/") {
-        metricsURL += "/"
+    baseURL, indexID, err := quickwitBase(config.QuickwitURL)
+    if err != nil {
+        return stats, err
     }
-    metricsURL += "metrics"
+    stats.IndexID = indexID
+    metricsURL := baseURL + "/metrics"
     
     req, err := http.NewRequest("GET", metricsURL, nil)
     if err != nil {
         return stats, fmt.Errorf("error creating request: %v", err)
     }
     req.SetBasicAuth(config.Username, config.Password)
+    setTraceHeaders(req)
     
     resp, err := client.Do(req)
     if err != nil {
@@ -515,7 +2291,7 @@ func getQuickwitIndexingStats(config Config) (QuickwitStats, error) {
     // Parse metrics
     lines := strings.Split(string(body), "\n")
     for _, line := range lines {
-        if strings.Contains(line, "quickwit_indexing_processed_docs_total") && strings.Contains(line, `index="nro-logs"`) {
+        if strings.Contains(line, "quickwit_indexing_processed_docs_total") && strings.Contains(line, `index="`+indexID+`"`) {
             parts := strings.Fields(line)
             if len(parts) == 2 {
                 value, err := strconv.ParseInt(parts[1], 10, 64)
@@ -537,8 +2313,17 @@ func getQuickwitIndexingStats(config Config) (QuickwitStats, error) {
 
 func loadConfig(filename string) (Config, error) {
     config := Config{
-        BatchSize:  30000, // Default value
-        MaxRetries: 3,     // Default value
+        BatchSize:        30000, // Default value
+        MaxRetries:       3,     // Default value
+        StoreFullMessage: true,
+        MaxFutureSkew:    24 * time.Hour,
+        MaxPastAge:       10 * 365 * 24 * time.Hour,
+        SkewAction:       "log",
+        MaxPayloadBytes:  10 * 1024 * 1024, // Quickwit default max ingest body
+        DefaultTimezone:  time.UTC,
+        CircuitFailures:  5,
+        CircuitCooldown:  30 * time.Second,
+        MultilineTimeout: 5 * time.Second,
     }
 
     file, err := os.Open(filename)
@@ -566,6 +2351,10 @@ func loadConfig(filename string) (Config, error) {
         switch key {
         case "logFilePath":
             config.LogFilePath = value
+        case "watchDir":
+            config.WatchDir = value
+        case "listen":
+            config.Listen = value
         case "quickwitURL":
             config.QuickwitURL = value
         case "username":
@@ -580,6 +2369,87 @@ func loadConfig(filename string) (Config, error) {
             if i, err := strconv.Atoi(value); err == nil {
                 config.MaxRetries = i
             }
+        case "circuitFailures":
+            if i, err := strconv.Atoi(value); err == nil {
+                config.CircuitFailures = i
+            }
+        case "circuitCooldown":
+            if d, err := time.ParseDuration(value); err == nil && d > 0 {
+                config.CircuitCooldown = d
+            }
+        case "storeFullMessage":
+            if b, err := strconv.ParseBool(value); err == nil {
+                config.StoreFullMessage = b
+            }
+        case "fullMessageMaxLen":
+            if i, err := strconv.Atoi(value); err == nil && i >= -1 {
+                config.FullMessageMaxLen = i
+            }
+        case "deadLetterPath":
+            config.DeadLetterPath = value
+        case "maxFutureSkew":
+            if d, err := time.ParseDuration(value); err == nil {
+                config.MaxFutureSkew = d
+            }
+        case "maxPastAge":
+            if d, err := time.ParseDuration(value); err == nil {
+                config.MaxPastAge = d
+            }
+        case "skewAction":
+            config.SkewAction = value
+        case "maxPayloadBytes":
+            if i, err := strconv.Atoi(value); err == nil {
+                config.MaxPayloadBytes = i
+            }
+        case "timestampLayouts":
+            for _, layout := range strings.Split(value, ",") {
+                if layout = strings.TrimSpace(layout); layout != "" {
+                    config.TimestampLayouts = append(config.TimestampLayouts, layout)
+                }
+            }
+        case "multiline":
+            if b, err := strconv.ParseBool(value); err == nil {
+                config.Multiline = b
+            }
+        case "multilineTimeout":
+            if d, err := time.ParseDuration(value); err == nil && d > 0 {
+                config.MultilineTimeout = d
+            }
+        case "defaultTimezone":
+            location, err := time.LoadLocation(value)
+            if err != nil {
+                return config, fmt.Errorf("invalid defaultTimezone %q: %v", value, err)
+            }
+            config.DefaultTimezone = location
+        case "maxDocsPerSecond":
+            if i, err := strconv.Atoi(value); err == nil && i >= 0 {
+                config.MaxDocsPerSecond = i
+            }
+        case "compressRequests":
+            if b, err := strconv.ParseBool(value); err == nil {
+                config.CompressRequests = b
+            }
+        case "clientCertPath":
+            config.ClientCertPath = value
+        case "clientKeyPath":
+            config.ClientKeyPath = value
+        case "proxyURL":
+            config.ProxyURL = value
+        case "noProxy":
+            config.NoProxy = value
+        case "docIDs":
+            if b, err := strconv.ParseBool(value); err == nil {
+                config.DocIDs = b
+            }
+        case "includeMessageTypes":
+            for _, messageType := range strings.Split(value, ",") {
+                if messageType = strings.TrimSpace(messageType); messageType != "" {
+                    if config.IncludeMessageTypes == nil {
+                        config.IncludeMessageTypes = make(map[string]bool)
+                    }
+                    config.IncludeMessageTypes[messageType] = true
+                }
+            }
         }
     }
 
@@ -588,9 +2458,20 @@ func loadConfig(filename string) (Config, error) {
     }
 
     // Validate required fields
-    if config.LogFilePath == "" || config.QuickwitURL == "" || config.Username == "" || config.Password == "" {
+    if (config.LogFilePath == "" && config.WatchDir == "" && config.Listen == "") || config.QuickwitURL == "" || config.Username == "" || config.Password == "" {
         return config, fmt.Errorf("missing required configuration")
     }
+    if config.SkewAction != "log" && config.SkewAction != "drop" && config.SkewAction != "clamp" {
+        return config, fmt.Errorf("invalid skewAction %q: use log, drop or clamp", config.SkewAction)
+    }
+    if (config.ClientCertPath == "") != (config.ClientKeyPath == "") {
+        return config, fmt.Errorf("clientCertPath and clientKeyPath must be set together")
+    }
+    for _, layout := range config.TimestampLayouts {
+        if err := validateLayout(layout); err != nil {
+            return config, fmt.Errorf("invalid timestampLayouts entry %q: %v", layout, err)
+        }
+    }
 
     return config, nil
 }
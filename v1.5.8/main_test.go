@@ -0,0 +1,468 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// ingestServer counts the documents of every request and answers 503 to the requests
+// listed in fail (1-based), once each
+func ingestServer(t *testing.T, fail ...int) (*httptest.Server, func() []string) {
+    var mu sync.Mutex
+    var docs []string
+    requests := 0
+    failed := map[int]bool{}
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        mu.Lock()
+        defer mu.Unlock()
+        requests++
+        for _, n := range fail {
+            if n == requests && !failed[n] {
+                failed[n] = true
+                http.Error(w, "unavailable", http.StatusServiceUnavailable)
+                return
+            }
+        }
+        scanner := bufio.NewScanner(r.Body)
+        for scanner.Scan() {
+            docs = append(docs, scanner.Text())
+        }
+        fmt.Fprint(w, `{"num_docs_for_processing":1}`)
+    }))
+    t.Cleanup(server.Close)
+    return server, func() []string {
+        mu.Lock()
+        defer mu.Unlock()
+        return append([]string(nil), docs...)
+    }
+}
+
+func TestSendBatchWithRetryDoesNotResendAcceptedSubBatches(t *testing.T) {
+    server, received := ingestServer(t, 2)
+    config := Config{QuickwitURL: server.URL, MaxRetries: 3, MaxPayloadBytes: 150}
+
+    var entries []LogEntry
+    for i := 0; i < 3; i++ {
+        entries = append(entries, LogEntry{
+            Timestamp:   "2024-10-18T01:53:12Z",
+            Hostname:    "radius1",
+            Process:     "radiusd",
+            PID:         int64(100 + i),
+            MessageType: "Access-Accept",
+            Username:    fmt.Sprintf("user%d@example.ac.th", i),
+        })
+    }
+
+    if err := sendBatchWithRetry(entries, config); err != nil {
+        t.Fatalf("sendBatchWithRetry: %v", err)
+    }
+    docs := received()
+    if len(docs) != len(entries) {
+        t.Fatalf("Quickwit received %d documents, want %d (accepted sub-batches resent?):\n%s",
+            len(docs), len(entries), strings.Join(docs, "\n"))
+    }
+    seen := map[string]bool{}
+    for _, doc := range docs {
+        if seen[doc] {
+            t.Errorf("document sent twice: %s", doc)
+        }
+        seen[doc] = true
+    }
+}
+
+func TestQuickwitBase(t *testing.T) {
+    tests := []struct {
+        url     string
+        base    string
+        indexID string
+        wantErr bool
+    }{
+        {"http://qw:7280/api/v1/nro-logs/ingest", "http://qw:7280", "nro-logs", false},
+        {"http://qw:7280/api/v1/nro-logs-new/ingest?commit=auto", "http://qw:7280", "nro-logs-new", false},
+        {"https://proxy.example/quickwit/api/v1/logs/ingest", "https://proxy.example/quickwit", "logs", false},
+        {"http://qw:7280/", "", "", true},
+        {"qw:7280/api/v1/nro-logs/ingest", "", "", true},
+    }
+    for _, tt := range tests {
+        base, indexID, err := quickwitBase(tt.url)
+        if (err != nil) != tt.wantErr {
+            t.Errorf("quickwitBase(%q) error = %v, wantErr %v", tt.url, err, tt.wantErr)
+            continue
+        }
+        if base != tt.base || indexID != tt.indexID {
+            t.Errorf("quickwitBase(%q) = %q, %q; want %q, %q", tt.url, base, indexID, tt.base, tt.indexID)
+        }
+    }
+}
+
+func TestStripPRI(t *testing.T) {
+    tests := []struct {
+        line   string
+        rest   string
+        pri    int
+        hasPRI bool
+    }{
+        {"<134>1 2024-10-18T01:53:12 radius1 radiusd[123]: x", "2024-10-18T01:53:12 radius1 radiusd[123]: x", 134, true},
+        {"<134>2024-10-18T01:53:12 radius1 radiusd[123]: x", "2024-10-18T01:53:12 radius1 radiusd[123]: x", 134, true},
+        {"<0>Oct 18 01:53:12 radius1 radiusd: x", "Oct 18 01:53:12 radius1 radiusd: x", 0, true},
+        {"<191>1 2024-10-18T01:53:12 radius1 radiusd: x", "2024-10-18T01:53:12 radius1 radiusd: x", 191, true},
+        {"2024-10-18T01:53:12 radius1 radiusd[123]: x", "2024-10-18T01:53:12 radius1 radiusd[123]: x", 0, false},
+        {"<192>2024-10-18T01:53:12 radius1 radiusd: x", "<192>2024-10-18T01:53:12 radius1 radiusd: x", 0, false},
+        {"<1a4>2024-10-18T01:53:12 radius1 radiusd: x", "<1a4>2024-10-18T01:53:12 radius1 radiusd: x", 0, false},
+        {"<1340>2024-10-18T01:53:12 radius1 radiusd: x", "<1340>2024-10-18T01:53:12 radius1 radiusd: x", 0, false},
+        {"<>2024-10-18T01:53:12 radius1 radiusd: x", "<>2024-10-18T01:53:12 radius1 radiusd: x", 0, false},
+        {"<134 2024-10-18T01:53:12 radius1 radiusd: x", "<134 2024-10-18T01:53:12 radius1 radiusd: x", 0, false},
+    }
+    for _, tt := range tests {
+        rest, pri, hasPRI := stripPRI(tt.line)
+        if rest != tt.rest || pri != tt.pri || hasPRI != tt.hasPRI {
+            t.Errorf("stripPRI(%q) = %q, %d, %v; want %q, %d, %v", tt.line, rest, pri, hasPRI, tt.rest, tt.pri, tt.hasPRI)
+        }
+    }
+}
+
+func TestParseLinePRI(t *testing.T) {
+    const message = " radius1 radiusd[123]: Access-Accept for user@example.ac.th"
+    tests := []struct {
+        line     string
+        facility string
+        severity string
+        wantErr  bool
+    }{
+        {"<134>1 2024-10-18T01:53:12" + message, "local0", "info", false},
+        {"<134>2024-10-18T01:53:12" + message, "local0", "info", false},
+        {"<0>2024-10-18T01:53:12" + message, "kern", "emerg", false},
+        {"<38>1 2024-10-18T01:53:12" + message, "auth", "info", false},
+        {"<191>2024-10-18T01:53:12" + message, "local7", "debug", false},
+        {"2024-10-18T01:53:12" + message, "", "", false},
+        {"<192>2024-10-18T01:53:12" + message, "", "", true},
+        {"<x>2024-10-18T01:53:12" + message, "", "", true},
+    }
+    for _, tt := range tests {
+        entry, err := parseLine(tt.line)
+        if (err != nil) != tt.wantErr {
+            t.Errorf("parseLine(%q) error = %v, wantErr %v", tt.line, err, tt.wantErr)
+            continue
+        }
+        if err != nil {
+            continue
+        }
+        if entry.Facility != tt.facility || entry.Severity != tt.severity {
+            t.Errorf("parseLine(%q) facility/severity = %q/%q, want %q/%q", tt.line, entry.Facility, entry.Severity, tt.facility, tt.severity)
+        }
+        if entry.Timestamp != "2024-10-18T01:53:12Z" || entry.Hostname != "radius1" || entry.Process != "radiusd" || entry.PID != 123 {
+            t.Errorf("parseLine(%q) = timestamp %q, hostname %q, process %q, pid %d", tt.line, entry.Timestamp, entry.Hostname, entry.Process, entry.PID)
+        }
+        if entry.FullMessage != tt.line {
+            t.Errorf("parseLine(%q) full_message = %q, want the raw line", tt.line, entry.FullMessage)
+        }
+    }
+}
+
+func TestParseAdditionalFieldsRoute(t *testing.T) {
+    tests := []struct {
+        name            string
+        message         string
+        realm           string
+        serviceProvider string
+        destinationIP   string
+    }{
+        {
+            "full route",
+            "Access-Accept for user john@ku.ac.th stationid AA-BB-CC-DD-EE-FF from ku.ac.th to eduroam.uni.net.th (203.0.113.5)",
+            "ku.ac.th", "eduroam.uni.net.th", "203.0.113.5",
+        },
+        {
+            "route without ip",
+            "Access-Accept for user john@ku.ac.th from ku.ac.th to eduroam.uni.net.th",
+            "ku.ac.th", "eduroam.uni.net.th", "",
+        },
+        {
+            "failed to contact home server",
+            "Access-Reject for user john@ku.ac.th stationid AA-BB-CC-DD-EE-FF failed to contact home server (203.0.113.9)",
+            "", "", "203.0.113.9",
+        },
+        {
+            "from without to",
+            "Access-Reject for user john@ku.ac.th from ku.ac.th: failed to contact home server",
+            "", "", "",
+        },
+        {
+            "to before the route",
+            "Access-Reject for user john@ku.ac.th failed to contact home server from ku.ac.th to eduroam.uni.net.th (203.0.113.5)",
+            "ku.ac.th", "eduroam.uni.net.th", "203.0.113.5",
+        },
+    }
+    for _, tt := range tests {
+        var entry LogEntry
+        parseAdditionalFields(&entry, tt.message)
+        if entry.Realm != tt.realm || entry.ServiceProvider != tt.serviceProvider || entry.DestinationIP != tt.destinationIP {
+            t.Errorf("%s: realm/service_provider/destination_ip = %q/%q/%q, want %q/%q/%q", tt.name,
+                entry.Realm, entry.ServiceProvider, entry.DestinationIP, tt.realm, tt.serviceProvider, tt.destinationIP)
+        }
+    }
+}
+
+func TestParseLineProcessName(t *testing.T) {
+    tests := []struct {
+        tag string
+        pid int64
+    }{
+        {"radiusd:", 0},
+        {"radiusd[123]:", 123},
+        {"radiusd", 0},
+        {"radiusd[123]", 123},
+    }
+    for _, tt := range tests {
+        line := "2024-10-18T01:53:12 radius1 " + tt.tag + " Access-Accept for user john@ku.ac.th"
+        entry, err := parseLine(line)
+        if err != nil {
+            t.Errorf("parseLine(%q): %v", line, err)
+            continue
+        }
+        if entry.Process != "radiusd" || entry.PID != tt.pid {
+            t.Errorf("tag %q: process %q, pid %d; want \"radiusd\", %d", tt.tag, entry.Process, entry.PID, tt.pid)
+        }
+    }
+}
+
+// startListen runs processListen on a free TCP port with a fresh runStop and returns a connection
+// to it; stopRun ends the listener, whose error arrives on done
+func startListen(t *testing.T, config *Config) (net.Conn, <-chan error) {
+    probe, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    addr := probe.Addr().String()
+    probe.Close()
+
+    config.Listen = "tcp://" + addr
+    runStop, runStopOnce = make(chan struct{}), sync.Once{}
+    t.Cleanup(func() { runStop, runStopOnce = make(chan struct{}), sync.Once{} })
+    done := make(chan error, 1)
+    go func() { done <- processListen(*config) }()
+
+    var conn net.Conn
+    for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+        if conn, err = net.Dial("tcp", addr); err == nil || time.Now().After(deadline) {
+            break
+        }
+    }
+    if err != nil {
+        t.Fatalf("dial %s: %v", addr, err)
+    }
+    return conn, done
+}
+
+func TestProcessListenSendsPendingBatchOnStop(t *testing.T) {
+    server, received := ingestServer(t)
+    config := Config{QuickwitURL: server.URL, BatchSize: 100, MaxRetries: 1}
+    conn, done := startListen(t, &config)
+    parsed := ingestStats.ParsedEntries.Load()
+    for i := 0; i < 3; i++ {
+        fmt.Fprintf(conn, "2024-10-18T01:53:12 radius1 radiusd[%d]: Access-Accept for user john@ku.ac.th\n", i)
+    }
+    conn.Close()
+
+    // รอให้ทั้งสามบรรทัดเข้า batch (ยังไม่เต็ม batchSize และยังไม่ถึง flush 5s) แล้วจึงหยุด
+    for deadline := time.Now().Add(2 * time.Second); ingestStats.ParsedEntries.Load() < parsed+3 && time.Now().Before(deadline); {
+        time.Sleep(10 * time.Millisecond)
+    }
+    stopRun()
+    if err := <-done; err != nil {
+        t.Fatalf("processListen: %v", err)
+    }
+    if docs := received(); len(docs) != 3 {
+        t.Errorf("Quickwit received %d documents after the stop, want the 3 pending ones", len(docs))
+    }
+}
+
+func TestProcessListenForwardedLines(t *testing.T) {
+    // BSD timestamp ไม่มีปี: ใช้เวลาเมื่อชั่วโมงก่อนเพื่อให้ได้ปีปัจจุบันแน่นอน
+    bsd := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+    tests := []struct {
+        name      string
+        line      string
+        timestamp string
+    }{
+        {"RSYSLOG_ForwardFormat", "<134>2024-10-18T01:53:12.123456+07:00 radius1 radiusd[123]: Access-Accept for user john@ku.ac.th",
+            "2024-10-18T01:53:12+07:00"},
+        {"RSYSLOG_ForwardFormat UTC", "<38>2024-10-18T01:53:12Z radius2 radiusd: Access-Reject for user john@ku.ac.th",
+            "2024-10-18T01:53:12Z"},
+        {"RSYSLOG_TraditionalForwardFormat", "<134>" + bsd.Format("Jan _2 15:04:05") + " radius3 radiusd[123]: Access-Accept for user john@ku.ac.th",
+            bsd.Format(time.RFC3339)},
+        {"space-padded day", "<134>Oct  8 01:53:12 radius4 radiusd[123]: Access-Accept for user john@ku.ac.th", ""},
+    }
+
+    server, received := ingestServer(t)
+    config := Config{QuickwitURL: server.URL, BatchSize: len(tests), MaxRetries: 1}
+    conn, done := startListen(t, &config)
+    for _, tt := range tests {
+        fmt.Fprintf(conn, "%s\n", tt.line)
+    }
+    conn.Close()
+
+    // batch เต็มเมื่อทุกบรรทัด parse ได้ จึงถูกส่งทันที
+    var docs []string
+    for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+        if docs = received(); len(docs) == len(tests) {
+            break
+        }
+    }
+    stopRun()
+    if err := <-done; err != nil {
+        t.Fatalf("processListen: %v", err)
+    }
+    if len(docs) != len(tests) {
+        t.Fatalf("Quickwit received %d documents, want %d (forwarded lines dead-lettered?):\n%s",
+            len(docs), len(tests), strings.Join(docs, "\n"))
+    }
+
+    byHost := map[string]LogEntry{}
+    for _, doc := range docs {
+        var entry LogEntry
+        if err := json.Unmarshal([]byte(doc), &entry); err != nil {
+            t.Fatalf("document %s: %v", doc, err)
+        }
+        byHost[entry.Hostname] = entry
+    }
+    for i, tt := range tests {
+        entry, ok := byHost[fmt.Sprintf("radius%d", i+1)]
+        if !ok {
+            t.Errorf("%s: no document for %q", tt.name, tt.line)
+            continue
+        }
+        if entry.Process != "radiusd" || entry.Username != "john@ku.ac.th" {
+            t.Errorf("%s: process %q, username %q", tt.name, entry.Process, entry.Username)
+        }
+        if tt.timestamp != "" && entry.Timestamp != tt.timestamp {
+            t.Errorf("%s: timestamp %q, want %q", tt.name, entry.Timestamp, tt.timestamp)
+        }
+    }
+}
+
+func TestParseTimestampFields(t *testing.T) {
+    tests := []struct {
+        line   string
+        fields int
+    }{
+        {"2024-10-18T01:53:12 radius1", 1},
+        {"2024-10-18 01:53:12 radius1", 2},
+        {"2024-10-18T01:53:12+07:00 radius1", 1},
+        {"2024-10-18T01:53:12.5Z radius1", 1},
+        {"Oct 18 01:53:12 radius1", 3},
+        {"Oct  8 01:53:12 radius1", 3},
+    }
+    for _, tt := range tests {
+        if _, n, err := parseTimestamp(strings.Fields(tt.line)); err != nil || n != tt.fields {
+            t.Errorf("parseTimestamp(%q) = %d fields, %v; want %d fields", tt.line, n, err, tt.fields)
+        }
+    }
+    if _, _, err := parseTimestamp(strings.Fields("radius1 radiusd: x")); err == nil {
+        t.Errorf("parseTimestamp accepted a line without a timestamp")
+    }
+}
+
+func TestRecordScannerFollowKeepsPendingAcrossReads(t *testing.T) {
+    const header = "2024-10-18T01:53:12 radius1 radiusd[123]: Login incorrect: [john@ku.ac.th]\n"
+    const continuation = "    (from client eduroam-ap port 0)\n"
+    const next = "2024-10-18T01:53:13 radius1 radiusd[123]: Access-Accept for user john@ku.ac.th\n"
+
+    records := newRecordScanner(true, true)
+    records.Reset(strings.NewReader(header), 0)
+    if records.Scan() {
+        t.Fatalf("first read completed %q before its continuation arrived", records.Text())
+    }
+
+    records.Reset(strings.NewReader(continuation+next), int64(len(header)))
+    if !records.Scan() {
+        t.Fatal("second read did not complete the record")
+    }
+    if want := strings.TrimSpace(header) + " (from client eduroam-ap port 0)"; records.Text() != want {
+        t.Errorf("record = %q, want %q", records.Text(), want)
+    }
+    if records.Scan() {
+        t.Fatalf("the next record %q was completed without a following header", records.Text())
+    }
+    if start := records.PendingStart(); start != int64(len(header)+len(continuation)) {
+        t.Errorf("pending record starts at %d, want %d", start, len(header)+len(continuation))
+    }
+
+    if records.Flush(time.Hour) {
+        t.Errorf("Flush completed the pending record before the idle timeout")
+    }
+    if !records.Flush(0) || records.Text() != strings.TrimSpace(next) {
+        t.Errorf("Flush(0) = %q, want %q", records.Text(), strings.TrimSpace(next))
+    }
+    if records.Flush(0) {
+        t.Errorf("Flush completed a record twice")
+    }
+}
+
+func TestRecordScannerCompleteInputFlushesAtEOF(t *testing.T) {
+    records := newRecordScanner(true, false)
+    records.Reset(strings.NewReader("2024-10-18T01:53:12 radius1 radiusd: a\n  b\n"), 0)
+    if !records.Scan() || records.Text() != "2024-10-18T01:53:12 radius1 radiusd: a b" {
+        t.Fatalf("record = %q, want the joined last record at EOF", records.Text())
+    }
+    if records.Scan() {
+        t.Errorf("extra record %q", records.Text())
+    }
+}
+
+func TestReadNewEntriesJoinsContinuationFromLaterWrite(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "radius.log")
+    file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer file.Close()
+    config := Config{Multiline: true}
+    records := newRecordScanner(true, true)
+    var lastPosition int64
+
+    fmt.Fprintln(file, "2024-10-18T01:53:12 radius1 radiusd[123]: Access-Reject for user john@ku.ac.th")
+    entries, err := readNewEntries(file, &lastPosition, records, config)
+    if err != nil || len(entries) != 0 {
+        t.Fatalf("first read = %d entries, %v; want the record kept pending", len(entries), err)
+    }
+
+    fmt.Fprintln(file, "  stationid AA-BB-CC-DD-EE-FF")
+    fmt.Fprintln(file, "2024-10-18T01:53:13 radius1 radiusd[123]: Access-Accept for user john@ku.ac.th")
+    entries, err = readNewEntries(file, &lastPosition, records, config)
+    if err != nil || len(entries) != 1 {
+        t.Fatalf("second read = %d entries, %v; want the joined record", len(entries), err)
+    }
+    if entries[0].MessageType != "Access-Reject" || !strings.Contains(entries[0].FullMessage, "stationid AA-BB-CC-DD-EE-FF") {
+        t.Errorf("entry = %s %q, want the Access-Reject with its continuation", entries[0].MessageType, entries[0].FullMessage)
+    }
+}
+
+func TestValidateLayout(t *testing.T) {
+    tests := []struct {
+        layout  string
+        wantErr bool
+    }{
+        {"2006-01-02T15:04:05.000Z07:00", false},
+        {"2006-01-02 15:04:05", false},
+        {"02/01/2006 15:04:05", false},
+        {"15:04:05", true},   // ไม่มีวันที่: ทุก entry จะตกไปปี 0
+        {"2006-01-02", true}, // ไม่มีเวลา: ทุก entry จะเป็นเที่ยงคืน
+        {"not a layout", true},
+    }
+    for _, tt := range tests {
+        if err := validateLayout(tt.layout); (err != nil) != tt.wantErr {
+            t.Errorf("validateLayout(%q) error = %v, wantErr %v", tt.layout, err, tt.wantErr)
+        }
+    }
+}